@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"hitenok/pkg/app"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/migrations"
+	"hitenok/pkg/services"
+	"log"
+	"os"
+)
+
+const usage = `usage: main <command> [flags] [arguments]
+
+commands:
+  serve                      run the HTTP server (the default without a command)
+  migrate up|down|status     apply, revert or list the schema migrations
+  config print               show the effective configuration
+  user create                create an active account, -superuser to bootstrap an admin
+  user show <email|id>       show an account
+  user deactivate <email|id> delete an account, purged after the grace period
+  user restore <id>          bring back a deleted account before it is purged
+  user logout-all <email|id> end every session of an account
+  keys list                  list the key ids of the keyrings
+  keys rotate <keyring>      generate a key for jwt, pepper, otp or audit
+  outbox retry               requeue the webhook deliveries that ran out of attempts
+
+Every command takes the configuration flags; all but serve and config print take -json.
+
+On SIGHUP the server reads its configuration again but applies only the keyrings
+(keys.*) and the TLS certificate files. Every other change, CORS origins and rate
+limits included, is logged and needs a restart.
+`
+
+// commandFlags starts the flag set of a command with -json and the configuration flags.
+func commandFlags(name string) (*flag.FlagSet, *config.Loader, *bool) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	asJson := flags.Bool("json", false, "print the result as JSON")
+	loader := config.RegisterFlags(flags)
+	return flags, loader, asJson
+}
+
+func loadConfig(loader *config.Loader) *config.AppConfig {
+	appConfig, err := loader.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return appConfig
+}
+
+// openServices connects to the database, refuses a schema that is behind and builds
+// the services the server runs on. Call Drain on the event bus before exiting, so the
+// asynchronous side effects of the command are not cut short.
+func openServices(appConfig *config.AppConfig) *app.Services {
+	db := openDatabase(appConfig)
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		log.Fatalf("main.openServices.%s: %v", err.Module, err.ErrorBase)
+	}
+	if err := migrator.Check(); err != nil {
+		log.Fatalf("main.openServices.%s: %v", err.Module, err.ErrorBase)
+	}
+	svc, err := app.NewServices(db, appConfig, services.NewSMTPMailer(appConfig))
+	if err != nil {
+		log.Fatalf("main.openServices.%s: %v", err.Module, err.ErrorBase)
+	}
+	return svc
+}
+
+// printResult writes value as indented JSON with -json, or calls text otherwise.
+func printResult(asJson bool, value interface{}, text func()) {
+	if !asJson {
+		text()
+		return
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		log.Fatalf("main.printResult.Error: %v", err)
+	}
+}
+
+// recordAdminAction writes an admin command to the audit log. There is no acting
+// account, so the operating system user is kept instead where it is known.
+func recordAdminAction(svc *app.Services, action string, subjectId uint, metadata map[string]string) {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	if osUser := os.Getenv("USER"); osUser != "" {
+		metadata["os_user"] = osUser
+	}
+	svc.Audit.Record(domain.AuditEvent{
+		SubjectId: subjectId,
+		Action:    action,
+		Outcome:   domain.AuditSuccess,
+		UserAgent: "cli",
+		Metadata:  metadata,
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"hitenok/pkg/config"
+	"hitenok/pkg/security"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// keyringSetting names a configured keyring with the setting and variable it is read
+// from.
+type keyringSetting struct {
+	name    string
+	setting string
+	env     string
+	ring    func(appConfig *config.AppConfig) (*security.Keyring, []string)
+}
+
+var keyrings = []keyringSetting{
+	{"jwt", "keys.jwt", "JWT_KEYS", func(appConfig *config.AppConfig) (*security.Keyring, []string) {
+		return appConfig.Keys.Jwt, appConfig.Keys.JwtKeys
+	}},
+	{"pepper", "keys.pepper", "PASSWORD_PEPPER_KEYS", func(appConfig *config.AppConfig) (*security.Keyring, []string) {
+		return appConfig.Keys.Pepper, appConfig.Keys.PepperKeys
+	}},
+	{"otp", "keys.otp", "OTP_KEYS", func(appConfig *config.AppConfig) (*security.Keyring, []string) {
+		return appConfig.Keys.Otp, appConfig.Keys.OtpKeys
+	}},
+	{"audit", "keys.audit", "AUDIT_KEYS", func(appConfig *config.AppConfig) (*security.Keyring, []string) {
+		return appConfig.Keys.Audit, appConfig.Keys.AuditKeys
+	}},
+}
+
+// runKeys implements `keys list` and `keys rotate`. The keys live in the configuration,
+// not the database, so rotating prints the new value of the setting; deploy it and send
+// the servers SIGHUP.
+func runKeys(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: keys list|rotate [flags]")
+	}
+	switch args[0] {
+	case "list":
+		listKeys(args[1:])
+	case "rotate":
+		rotateKeys(args[1:])
+	default:
+		log.Fatalf("usage: keys list|rotate [flags]")
+	}
+}
+
+type keyringOutput struct {
+	Name    string   `json:"name"`
+	Setting string   `json:"setting"`
+	Env     string   `json:"env"`
+	Current string   `json:"current"`
+	Ids     []string `json:"ids"`
+}
+
+// listKeys shows the key ids of every keyring, never the secrets.
+func listKeys(args []string) {
+	flags, loader, asJson := commandFlags("keys list")
+	flags.Parse(args)
+	appConfig := loadConfig(loader)
+	output := []keyringOutput{}
+	for _, keyring := range keyrings {
+		ring, _ := keyring.ring(appConfig)
+		ids := ring.Ids()
+		output = append(output, keyringOutput{
+			Name:    keyring.name,
+			Setting: keyring.setting,
+			Env:     keyring.env,
+			Current: ids[0],
+			Ids:     ids,
+		})
+	}
+	printResult(*asJson, output, func() {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "KEYRING\tCURRENT\tKEYS")
+		for _, keyring := range output {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", keyring.Name, keyring.Current, strings.Join(keyring.Ids, ","))
+		}
+		writer.Flush()
+	})
+}
+
+// rotateKeys generates a key for one keyring and puts it in front of the configured
+// ones. The old keys stay to verify what they signed; -keep drops all but the newest
+// few, which is only safe once nothing signed with the dropped ones is in use (for the
+// pepper, once every user has signed in since; for the audit keys, never while the
+// events they hashed are kept). Password history entries older than the current
+// password are never rehashed, so dropping a pepper forgets them.
+func rotateKeys(args []string) {
+	flags, loader, asJson := commandFlags("keys rotate")
+	keep := flags.Int("keep", -1, "keep only this many of the old keys (default all)")
+	flags.Parse(args)
+	index := slices.IndexFunc(keyrings, func(keyring keyringSetting) bool {
+		return keyring.name == flags.Arg(0)
+	})
+	if flags.NArg() != 1 || index < 0 {
+		log.Fatalf("usage: keys rotate [flags] jwt|pepper|otp|audit")
+	}
+	keyring := keyrings[index]
+	ring, entries := keyring.ring(loadConfig(loader))
+
+	id := keyring.name + "-" + time.Now().UTC().Format("20060102150405")
+	if _, found := ring.Key(id); found {
+		log.Fatalf("main.rotateKeys: key %q exists, try again in a second", id)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("main.rotateKeys.Error: %v", err)
+	}
+	if *keep >= 0 && *keep < len(entries) {
+		entries = entries[:*keep]
+	}
+	entries = append([]string{id + ":" + base64.RawURLEncoding.EncodeToString(secret)}, entries...)
+
+	output := struct {
+		Name    string `json:"name"`
+		Setting string `json:"setting"`
+		Env     string `json:"env"`
+		Current string `json:"current"`
+		Value   string `json:"value"`
+	}{keyring.name, keyring.setting, keyring.env, id, strings.Join(entries, ",")}
+	printResult(*asJson, output, func() {
+		fmt.Fprintf(os.Stderr, "New %s key %s. Set %s (%s) to the line below and send the servers SIGHUP.\n", output.Name, output.Current, output.Setting, output.Env)
+		fmt.Println(output.Value)
+	})
+}
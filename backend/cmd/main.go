@@ -1,74 +1,242 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"hitenok/pkg/app"
 	"hitenok/pkg/config"
-	"hitenok/pkg/domain"
-	"hitenok/pkg/handlers"
+	"hitenok/pkg/migrations"
 	"hitenok/pkg/repository"
+	"hitenok/pkg/security"
 	"hitenok/pkg/services"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	_ "time/tzdata"
 
-	"github.com/gin-gonic/gin"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
 
-func runServer(db *gorm.DB, appConfig *config.AppConfig) {
-	router := gin.Default()
-	router.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+func runServer(db *gorm.DB, appConfig *config.AppConfig, loader *config.Loader) {
+	application, appErr := app.New(db, appConfig, services.NewSMTPMailer(appConfig))
+	if appErr != nil {
+		log.Fatalf("runserver.%s: %v", appErr.Module, appErr.ErrorBase)
+	}
 
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(http.StatusOK)
-			return
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%s", appConfig.WebPort),
+		Handler:           application.Handler,
+		ReadHeaderTimeout: appConfig.Server.ReadHeaderTimeout,
+		ReadTimeout:       appConfig.Server.ReadTimeout,
+		WriteTimeout:      appConfig.Server.WriteTimeout,
+		IdleTimeout:       appConfig.Server.IdleTimeout,
+		MaxHeaderBytes:    appConfig.Server.MaxHeaderBytes,
+	}
+	var certificate *security.Certificate
+	if appConfig.Server.TlsCertFile != "" {
+		var err error
+		certificate, err = security.LoadCertificate(appConfig.Server.TlsCertFile, appConfig.Server.TlsKeyFile)
+		if err != nil {
+			log.Fatalf("runserver.LoadCertificate.Error: %v", err)
+		}
+		server.TLSConfig = &tls.Config{
+			GetCertificate: certificate.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+	go func() {
+		var err error
+		if certificate != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("runserver.ListenAndServe.Error: %v", err)
 		}
+	}()
 
-		c.Next()
-	})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for received := range signals {
+		if received == syscall.SIGHUP {
+			reloadConfig(loader, appConfig, certificate)
+			continue
+		}
+		log.Printf("runserver: %s received, shutting down", received)
+		break
+	}
 
-	err := db.AutoMigrate(&domain.User{})
-	if err != nil {
-		log.Fatalf("runserver.AutoMigrate.Error: %v", err)
+	// Stop taking requests and let the running ones finish, then stop the workers and
+	// wait for the background work, all within one deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), appConfig.Server.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("runserver.Shutdown.Error: %v", err)
 	}
-	api := router.Group("/api")
-	v1 := api.Group("/v1")
-	auth := v1.Group("/auth")
+	if appErr := application.Shutdown(ctx); appErr != nil {
+		log.Printf("runserver.%s: %v", appErr.Module, appErr.ErrorBase)
+	}
+}
 
-	userRepo := repository.NewUserRepository(db, appConfig)
+// reloadConfig reads the configuration again on SIGHUP, picking up a changed file and
+// rotated secret files. The keyrings and the TLS certificate are swapped in place;
+// other changes are reported and wait for a restart. An invalid configuration is
+// ignored and the running one kept.
+func reloadConfig(loader *config.Loader, appConfig *config.AppConfig, certificate *security.Certificate) {
+	next, err := loader.Load()
+	if err != nil {
+		log.Printf("runserver.reloadConfig: keeping the running configuration: %v", err)
+		return
+	}
+	for _, path := range config.Changed(appConfig, next) {
+		if !strings.HasPrefix(path, "keys.") {
+			log.Printf("runserver.reloadConfig: %s changed, restart to apply it", path)
+		}
+	}
+	appConfig.Keys.Jwt.Replace(next.Keys.Jwt)
+	appConfig.Keys.Pepper.Replace(next.Keys.Pepper)
+	appConfig.Keys.Otp.Replace(next.Keys.Otp)
+	appConfig.Keys.Audit.Replace(next.Keys.Audit)
+	appConfig.Keys.JwtKeys, appConfig.Keys.PepperKeys, appConfig.Keys.OtpKeys = next.Keys.JwtKeys, next.Keys.PepperKeys, next.Keys.OtpKeys
+	appConfig.Keys.AuditKeys = next.Keys.AuditKeys
+	if certificate != nil {
+		if err := certificate.Reload(); err != nil {
+			log.Printf("runserver.reloadConfig.Certificate.Error: %v", err)
+		}
+	}
+	log.Printf("runserver.reloadConfig: keys reloaded")
+}
 
-	mailAuthenticationService := services.NewMailAuthenticationService(userRepo, appConfig)
-	otpService := services.NewMailOTPService(userRepo, appConfig)
-	jwtService := services.NewJWTService(appConfig, userRepo)
-	hashService := services.NewHashService(userRepo)
-	userService := services.NewUserService(userRepo)
+// printConfig implements `config print [--redacted]`, showing the effective
+// configuration and where every value came from.
+func printConfig(args []string) {
+	flags := flag.NewFlagSet("config print", flag.ExitOnError)
+	redacted := flags.Bool("redacted", false, "hide secrets")
+	loader := config.RegisterFlags(flags)
+	flags.Parse(args)
+	appConfig, err := loader.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := config.Print(os.Stdout, appConfig, loader.Sources(), *redacted); err != nil {
+		log.Fatalf("main.printConfig.Error: %v", err)
+	}
+}
 
-	mailAuthenticationHandler := handlers.NewMailAuthHandler(mailAuthenticationService, otpService, jwtService, appConfig)
-	mailAuthenticationHandler.RegisterRoutes(auth)
-	activateServiceHandler := handlers.NewActivateHandler(otpService, hashService, jwtService, userService, appConfig)
-	activateServiceHandler.RegisterRoutes(auth)
-	userHandler := handlers.NewUserHandler(userService, jwtService)
-	userHandler.RegisterRoutes(v1)
+// runMigrate implements `migrate up`, `migrate down [steps]` and `migrate status`; the
+// configuration flags go before the steps.
+func runMigrate(args []string) {
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		log.Fatalf("usage: migrate up|down [steps]|status [flags]")
+	}
+	flags, loader, asJson := commandFlags("migrate " + args[0])
+	flags.Parse(args[1:])
+	appConfig := loadConfig(loader)
+	migrator, migrateErr := migrations.NewMigrator(openDatabase(appConfig))
+	if migrateErr != nil {
+		log.Fatalf("main.runMigrate.%s: %v", migrateErr.Module, migrateErr.ErrorBase)
+	}
+	// up and down report the migrations they ran, also when one of them failed.
+	report := func(key, verb string, ran []migrations.Migration) {
+		type migrationOutput struct {
+			Version int    `json:"version"`
+			Name    string `json:"name"`
+		}
+		output := map[string][]migrationOutput{key: {}}
+		for _, migration := range ran {
+			output[key] = append(output[key], migrationOutput{Version: migration.Version, Name: migration.Name})
+		}
+		printResult(*asJson, output, func() {
+			for _, migration := range ran {
+				fmt.Printf("%s %04d_%s\n", verb, migration.Version, migration.Name)
+			}
+		})
+	}
+	switch args[0] {
+	case "up":
+		applied, migrateErr := migrator.Up()
+		report("applied", "applied", applied)
+		if migrateErr != nil {
+			log.Fatalf("main.runMigrate.%s: %v", migrateErr.Module, migrateErr.ErrorBase)
+		}
+	case "down":
+		steps := 1
+		if flags.NArg() > 0 {
+			var err error
+			steps, err = strconv.Atoi(flags.Arg(0))
+			if err != nil || steps < 1 {
+				log.Fatalf("main.runMigrate: steps must be a positive number")
+			}
+		}
+		reverted, migrateErr := migrator.Down(steps)
+		report("reverted", "reverted", reverted)
+		if migrateErr != nil {
+			log.Fatalf("main.runMigrate.%s: %v", migrateErr.Module, migrateErr.ErrorBase)
+		}
+	case "status":
+		statuses, migrateErr := migrator.Status()
+		if migrateErr != nil {
+			log.Fatalf("main.runMigrate.%s: %v", migrateErr.Module, migrateErr.ErrorBase)
+		}
+		printResult(*asJson, statuses, func() {
+			for _, status := range statuses {
+				appliedAt := "pending"
+				if status.AppliedAt != nil {
+					appliedAt = "applied " + status.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, appliedAt)
+			}
+		})
+	}
+}
 
-	auth.GET("/refresh-token", func(c *gin.Context) { handlers.RefreshJWTHandler(c, jwtService) })
+func openDatabase(appConfig *config.AppConfig) *gorm.DB {
+	db, err := repository.OpenDatabase(appConfig.Db)
+	if err != nil {
+		log.Fatalf("main.connection_to_database.%s: %v", err.Module, err.ErrorBase)
+	}
+	return db
+}
 
-	router.Run(fmt.Sprintf(":%s", appConfig.WebPort))
+// serve runs the server; it is also what the binary does when given only flags.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	loader := config.RegisterFlags(flags)
+	flags.Parse(args)
+	appConfig := loadConfig(loader)
+	runServer(openDatabase(appConfig), appConfig, loader)
 }
 
 func main() {
-	appConfig, err := config.NewAppConfig()
-	if err != nil {
-		log.Fatalf("%v", err)
-		return
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
-	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=Asia/Shanghai", appConfig.DbUrl, appConfig.DbUser, appConfig.DbPass, appConfig.DbName, appConfig.DbPort)
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
-	if err != nil {
-		log.Fatalf("main.connection_to_database.Error: %v", err)
-		return
+	switch {
+	case command == "serve":
+		serve(args)
+	case command == "migrate":
+		runMigrate(args)
+	case command == "config" && len(args) > 0 && args[0] == "print":
+		printConfig(args[1:])
+	case command == "user":
+		runUser(args)
+	case command == "keys":
+		runKeys(args)
+	case command == "outbox":
+		runOutbox(args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
-	runServer(db, appConfig)
 }
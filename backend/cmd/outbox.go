@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hitenok/pkg/domain"
+	"log"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// runOutbox implements `outbox retry`, which puts the webhook deliveries that ran out of
+// attempts back in the outbox once the receiver works again. The running servers pick
+// them up on their next poll.
+func runOutbox(args []string) {
+	if len(args) == 0 || args[0] != "retry" {
+		log.Fatalf("usage: outbox retry [-subscription <id>] [flags]")
+	}
+	flags, loader, asJson := commandFlags("outbox retry")
+	subscriptionId := flags.Uint("subscription", 0, "only the deliveries of this webhook subscription")
+	flags.Parse(args[1:])
+	svc := openServices(loadConfig(loader))
+	requeued, err := svc.Webhook.RetryFailed(*subscriptionId)
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		log.Fatalf("subscription %d: no such webhook subscription", *subscriptionId)
+	}
+	if err != nil {
+		log.Fatalf("main.runOutbox.%s: %v", err.Module, err.ErrorBase)
+	}
+	recordAdminAction(svc, domain.AuditAdminOutboxRetry, 0, map[string]string{
+		"subscription_id": strconv.FormatUint(uint64(*subscriptionId), 10),
+		"requeued":        strconv.Itoa(requeued),
+	})
+	output := struct {
+		Requeued int `json:"requeued"`
+	}{requeued}
+	printResult(*asJson, output, func() {
+		fmt.Printf("requeued %d deliveries\n", output.Requeued)
+	})
+}
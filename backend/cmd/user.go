@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"hitenok/pkg/app"
+	"hitenok/pkg/domain"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type userOutput struct {
+	Id                uint      `json:"id"`
+	Email             string    `json:"email"`
+	Fullname          string    `json:"fullname"`
+	IsActive          bool      `json:"isActive"`
+	IsSuperuser       bool      `json:"isSuperuser"`
+	Roles             []string  `json:"roles"`
+	JWTVersion        uint      `json:"jwtVersion"`
+	CreatedAt         time.Time `json:"createdAt"`
+	PasswordChangedAt time.Time `json:"passwordChangedAt"`
+}
+
+func newUserOutput(svc *app.Services, user *domain.User) userOutput {
+	return userOutput{
+		Id:                user.ID,
+		Email:             user.Email,
+		Fullname:          user.Fullname,
+		IsActive:          user.IsActive,
+		IsSuperuser:       user.IsSuperuser,
+		Roles:             svc.User.Roles(user),
+		JWTVersion:        user.JWTVersion,
+		CreatedAt:         user.CreatedAt,
+		PasswordChangedAt: user.PasswordChangedAt,
+	}
+}
+
+func printUser(output userOutput) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "id\t%d\n", output.Id)
+	fmt.Fprintf(writer, "email\t%s\n", output.Email)
+	fmt.Fprintf(writer, "fullname\t%s\n", output.Fullname)
+	fmt.Fprintf(writer, "active\t%t\n", output.IsActive)
+	fmt.Fprintf(writer, "roles\t%s\n", strings.Join(output.Roles, ","))
+	fmt.Fprintf(writer, "jwt version\t%d\n", output.JWTVersion)
+	fmt.Fprintf(writer, "created\t%s\n", output.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(writer, "password changed\t%s\n", output.PasswordChangedAt.Format(time.RFC3339))
+	writer.Flush()
+}
+
+// runUser implements the `user` commands; the account is named by email or id after
+// the flags.
+func runUser(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: user create|show|deactivate|restore|logout-all [flags]")
+	}
+	switch args[0] {
+	case "create":
+		createUser(args[1:])
+	case "show":
+		showUser(args[1:])
+	case "deactivate":
+		deactivateUser(args[1:])
+	case "restore":
+		restoreUser(args[1:])
+	case "logout-all":
+		logoutAllUser(args[1:])
+	default:
+		log.Fatalf("usage: user create|show|deactivate|restore|logout-all [flags]")
+	}
+}
+
+// createUser creates an account that is active right away, as an invited one is, so
+// the first superuser needs no mail relay. The registration mode does not apply; the
+// password policy does. Without -password the password is read as a line from stdin,
+// which keeps it out of the process list.
+func createUser(args []string) {
+	flags, loader, asJson := commandFlags("user create")
+	email := flags.String("email", "", "email of the account")
+	fullname := flags.String("fullname", "", "full name of the account")
+	password := flags.String("password", "", "password (default a line read from stdin)")
+	superuser := flags.Bool("superuser", false, "grant the superuser role")
+	flags.Parse(args)
+	if *email == "" || *fullname == "" {
+		log.Fatalf("usage: user create -email <email> -fullname <name> [-password <password>] [-superuser] [flags]")
+	}
+	if *password == "" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Fatalf("main.createUser: no password given and none on stdin")
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+	svc := openServices(loadConfig(loader))
+	defer svc.EventBus.Drain()
+
+	user, err := svc.Authentication.RegisterInvited(*email, *fullname, *password)
+	var validationError *domain.ValidationError
+	if err != nil && errors.As(err.ErrorBase, &validationError) {
+		for _, violation := range validationError.Violations {
+			log.Printf("%s: %s", violation.Field, violation.Message)
+		}
+		log.Fatalf("main.createUser: password rejected")
+	}
+	if err != nil {
+		log.Fatalf("main.createUser.%s: %v", err.Module, err.ErrorBase)
+	}
+	if *superuser {
+		if err := svc.User.SetSuperuser(user, true); err != nil {
+			log.Fatalf("main.createUser.%s: %v", err.Module, err.ErrorBase)
+		}
+	}
+	recordAdminAction(svc, domain.AuditAdminUserCreate, user.ID, map[string]string{
+		"superuser": strconv.FormatBool(*superuser),
+	})
+	output := newUserOutput(svc, user)
+	printResult(*asJson, output, func() { printUser(output) })
+}
+
+func showUser(args []string) {
+	flags, loader, asJson := commandFlags("user show")
+	flags.Parse(args)
+	svc := openServices(loadConfig(loader))
+	user := findUser(svc, flags)
+	output := newUserOutput(svc, user)
+	printResult(*asJson, output, func() { printUser(output) })
+}
+
+// deactivateUser deletes the account the way its owner would: it is gone at once,
+// with its sessions, and purged after the grace period.
+func deactivateUser(args []string) {
+	flags, loader, asJson := commandFlags("user deactivate")
+	flags.Parse(args)
+	svc := openServices(loadConfig(loader))
+	defer svc.EventBus.Drain()
+	user := findUser(svc, flags)
+	purgeAfter, err := svc.Account.DeleteAccount(user)
+	if err != nil {
+		log.Fatalf("main.deactivateUser.%s: %v", err.Module, err.ErrorBase)
+	}
+	recordAdminAction(svc, domain.AuditAdminUserDeactivate, user.ID, nil)
+	output := struct {
+		Id         uint      `json:"id"`
+		Email      string    `json:"email"`
+		PurgeAfter time.Time `json:"purgeAfter"`
+	}{user.ID, user.Email, purgeAfter.UTC()}
+	printResult(*asJson, output, func() {
+		fmt.Printf("deactivated user %d, purged after %s\n", output.Id, output.PurgeAfter.Format(time.RFC3339))
+	})
+}
+
+// restoreUser brings back an account deleted within the grace period. It is named by
+// id only: a deleted account no longer owns its email, which a new account may hold.
+func restoreUser(args []string) {
+	flags, loader, asJson := commandFlags("user restore")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		log.Fatalf("usage: user restore [flags] <id>")
+	}
+	id, parseErr := strconv.ParseUint(flags.Arg(0), 10, 64)
+	if parseErr != nil {
+		log.Fatalf("usage: user restore [flags] <id>")
+	}
+	svc := openServices(loadConfig(loader))
+	defer svc.EventBus.Drain()
+	user, err := svc.Account.RestoreAccount(uint(id))
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		log.Fatalf("%s: no deleted user to restore, it may have been purged", flags.Arg(0))
+	}
+	if err != nil && err.ErrorBase.Error() == "user already exists" {
+		log.Fatalf("%s: another account uses the email %s now", flags.Arg(0), user.Email)
+	}
+	if err != nil {
+		log.Fatalf("main.restoreUser.%s: %v", err.Module, err.ErrorBase)
+	}
+	recordAdminAction(svc, domain.AuditAdminUserRestore, user.ID, nil)
+	output := newUserOutput(svc, user)
+	printResult(*asJson, output, func() { printUser(output) })
+}
+
+// logoutAllUser ends every session by bumping JWTVersion. Servers that cache token
+// introspection may accept a token for up to denylist_sync_interval more.
+func logoutAllUser(args []string) {
+	flags, loader, asJson := commandFlags("user logout-all")
+	flags.Parse(args)
+	svc := openServices(loadConfig(loader))
+	user := findUser(svc, flags)
+	if err := svc.User.EndSessions(user); err != nil {
+		log.Fatalf("main.logoutAllUser.%s: %v", err.Module, err.ErrorBase)
+	}
+	recordAdminAction(svc, domain.AuditAdminLogoutAll, user.ID, nil)
+	output := struct {
+		Id         uint `json:"id"`
+		JWTVersion uint `json:"jwtVersion"`
+	}{user.ID, user.JWTVersion}
+	printResult(*asJson, output, func() {
+		fmt.Printf("ended the sessions of user %d\n", output.Id)
+	})
+}
+
+// findUser looks up the account named by the only argument, an id or an email.
+func findUser(svc *app.Services, flags *flag.FlagSet) *domain.User {
+	if flags.NArg() != 1 {
+		log.Fatalf("usage: %s [flags] <email|id>", flags.Name())
+	}
+	var user *domain.User
+	var err *domain.MyError
+	if id, parseErr := strconv.ParseUint(flags.Arg(0), 10, 64); parseErr == nil {
+		user, err = svc.User.GetUser(uint(id))
+	} else {
+		user, err = svc.User.GetUserByEmail(flags.Arg(0))
+	}
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		log.Fatalf("%s: no such user", flags.Arg(0))
+	}
+	if err != nil {
+		log.Fatalf("main.findUser.%s: %v", err.Module, err.ErrorBase)
+	}
+	return user
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"context"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
+	"hitenok/pkg/handlers"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/migrations"
+	"hitenok/pkg/repository"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// App is the wired application: the router with every route, and the workers and
+// background work behind it. The server binary serves Handler; the end-to-end tests
+// drive it with httptest.
+type App struct {
+	Handler http.Handler
+
+	background  services.BackgroundI
+	eventBus    events.EventBusI
+	stopWorkers context.CancelFunc
+}
+
+// New checks the schema (migrating first if configured), builds the repositories,
+// services and handlers, and starts the periodic workers. Mails go through mailer, so
+// tests can capture them.
+func New(db *gorm.DB, appConfig *config.AppConfig, mailer services.MailerI) (*App, *domain.MyError) {
+	router := gin.Default()
+	// Without trusted proxies gin would believe any X-Forwarded-For, which lets every
+	// client pick the address the rate limit and the audit log see.
+	if err := router.SetTrustedProxies(appConfig.Server.TrustedProxies); err != nil {
+		return nil, domain.NewError(err, "app.New.SetTrustedProxies")
+	}
+	router.Use(middlewares.RequestId())
+	router.Use(middlewares.BodyLimit(int64(appConfig.Server.MaxBodyBytes)))
+	router.Use(func(c *gin.Context) {
+		if origin := allowedOrigin(appConfig.Cors.AllowedOrigins, c.GetHeader("Origin")); origin != "" {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			if origin != "*" {
+				c.Writer.Header().Add("Vary", "Origin")
+			}
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match, X-Request-Id")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag, X-Request-Id")
+
+		if c.Request.Method == "OPTIONS" {
+			c.AbortWithStatus(http.StatusOK)
+			return
+		}
+
+		c.Next()
+	})
+
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		err.Module = "app.New." + err.Module
+		return nil, err
+	}
+	if appConfig.Db.MigrateOnStart {
+		if _, err := migrator.Up(); err != nil {
+			err.Module = "app.New." + err.Module
+			return nil, err
+		}
+	}
+	if err := migrator.Check(); err != nil {
+		err.Module = "app.New." + err.Module
+		return nil, err
+	}
+	api := router.Group("/api")
+	v1 := api.Group("/v1")
+	auth := v1.Group("/auth")
+
+	svc, err := NewServices(db, appConfig, mailer)
+	if err != nil {
+		err.Module = "app.New." + err.Module
+		return nil, err
+	}
+	if err := svc.TokenDenylist.Sync(); err != nil {
+		err.Module = "app.New.tokenDenylistService.Sync." + err.Module
+		return nil, err
+	}
+
+	workers, stopWorkers := context.WithCancel(context.Background())
+	background := services.NewBackground()
+	heartbeats := services.NewHeartbeats()
+	// A pass of the webhook worker waits on the receivers, up to WebhookTimeout for each
+	// delivery of the batch; a slow receiver must not make the instance unready.
+	runEvery(workers, background, heartbeats, "webhookService.DeliverDue", appConfig.WebhookPollInterval, false, func() {
+		if _, err := svc.Webhook.DeliverDue(); err != nil {
+			log.Printf("app.webhookService.DeliverDue.%s: %v", err.Module, err.ErrorBase)
+		}
+	})
+	runEvery(workers, background, heartbeats, "tokenDenylistService.Sync", appConfig.DenylistSyncInterval, true, func() {
+		if err := svc.TokenDenylist.Sync(); err != nil {
+			log.Printf("app.tokenDenylistService.Sync.%s: %v", err.Module, err.ErrorBase)
+		}
+	})
+	runEvery(workers, background, heartbeats, "accountService.PurgeDeletedAccounts", appConfig.AccountPurgeInterval, true, func() {
+		purged, err := svc.Account.PurgeDeletedAccounts()
+		if err != nil {
+			log.Printf("app.accountService.PurgeDeletedAccounts.%s: %v", err.Module, err.ErrorBase)
+			return
+		}
+		if purged > 0 {
+			log.Printf("app.accountService.PurgeDeletedAccounts: purged %d accounts", purged)
+		}
+	})
+	healthService := services.NewHealthService(repository.NewHealthRepository(db), mailer, heartbeats, appConfig)
+
+	healthHandler := handlers.NewHealthHandler(healthService)
+	healthHandler.RegisterRoutes(&router.RouterGroup)
+	mailAuthenticationHandler := handlers.NewMailAuthHandler(svc.Authentication, svc.JWT, svc.Audit, appConfig)
+	mailAuthenticationHandler.RegisterRoutes(auth)
+	activateServiceHandler := handlers.NewActivateHandler(svc.OTP, svc.Hash, svc.JWT, svc.User, svc.Authentication, svc.Audit, background, appConfig)
+	activateServiceHandler.RegisterRoutes(auth)
+	userHandler := handlers.NewUserHandler(svc.User, svc.JWT, svc.Audit)
+	userHandler.RegisterRoutes(v1)
+	emailChangeHandler := handlers.NewEmailChangeHandler(svc.EmailChange, svc.Authentication, svc.JWT, svc.Audit, background)
+	emailChangeHandler.RegisterRoutes(v1)
+	passwordHandler := handlers.NewPasswordHandler(svc.Authentication, svc.JWT, svc.Audit, background)
+	passwordHandler.RegisterRoutes(v1)
+	accountHandler := handlers.NewAccountHandler(svc.Account, svc.Authentication, svc.JWT, svc.Audit)
+	accountHandler.RegisterRoutes(v1)
+	apiKeyHandler := handlers.NewApiKeyHandler(svc.ApiKey, svc.Introspection, svc.JWT, svc.Audit)
+	apiKeyHandler.RegisterRoutes(v1)
+	organizationHandler := handlers.NewOrganizationHandler(svc.Organization, svc.JWT, svc.Audit)
+	organizationHandler.RegisterRoutes(v1)
+	invitationHandler := handlers.NewInvitationHandler(svc.Invitation, svc.Organization, svc.JWT, svc.Audit, background)
+	invitationHandler.RegisterRoutes(v1)
+	auditHandler := handlers.NewAuditHandler(svc.Audit, svc.JWT)
+	auditHandler.RegisterRoutes(v1)
+	webhookHandler := handlers.NewWebhookHandler(svc.Webhook, svc.JWT, svc.Audit)
+	webhookHandler.RegisterRoutes(v1)
+	oauthHandler := handlers.NewOAuthHandler(svc.DeviceAuth, svc.JWT, svc.OAuthClient, svc.Introspection, svc.TokenDenylist, svc.Audit, appConfig)
+	oauthHandler.RegisterRoutes(v1)
+	forwardAuthHandler := handlers.NewForwardAuthHandler(svc.JWT, svc.User, appConfig)
+	forwardAuthHandler.RegisterRoutes(auth)
+	openAPIHandler := handlers.NewOpenAPIHandler(appConfig)
+	openAPIHandler.RegisterRoutes(api)
+
+	auth.GET("/refresh-token", func(c *gin.Context) { handlers.RefreshJWTHandler(c, svc.JWT) })
+	auth.POST("/logout", middlewares.CheckAuth(svc.JWT), func(c *gin.Context) {
+		handlers.LogoutHandler(c, svc.JWT, svc.Introspection, svc.Audit)
+	})
+
+	return &App{
+		Handler:     router,
+		background:  background,
+		eventBus:    svc.EventBus,
+		stopWorkers: stopWorkers,
+	}, nil
+}
+
+// Shutdown stops the workers and waits for the background work and the asynchronous
+// event handlers, giving up when ctx is done. Stop serving requests before calling it.
+func (app *App) Shutdown(ctx context.Context) *domain.MyError {
+	app.stopWorkers()
+	if err := app.background.Wait(ctx); err != nil {
+		return domain.NewError(err, "app.Shutdown.background.Wait")
+	}
+	drained := make(chan struct{})
+	go func() {
+		app.eventBus.Drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return domain.NewError(ctx.Err(), "app.Shutdown.eventBus.Drain")
+	}
+}
+
+// runEvery calls fn every interval until ctx is done, beating the worker's heartbeat
+// after each call; a stale critical worker makes the instance unready. It runs on the
+// background group, so a shutdown waits for a call in progress.
+func runEvery(ctx context.Context, background services.BackgroundI, heartbeats services.HeartbeatsI, name string, interval time.Duration, critical bool, fn func()) {
+	heartbeats.Register(name, interval, critical)
+	background.Go(name, func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn()
+				heartbeats.Beat(name)
+			}
+		}
+	})
+}
+
+// allowedOrigin picks the Access-Control-Allow-Origin value for a request origin, or
+// "" when the origin is not allowed.
+func allowedOrigin(allowedOrigins []string, origin string) string {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
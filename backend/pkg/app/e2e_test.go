@@ -0,0 +1,484 @@
+package app_test
+
+import (
+	"encoding/json"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/security"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSignUpActivateAndSignIn(t *testing.T) {
+	h := newHarness(t)
+	const email = "new@example.com"
+	credentials := gin.H{"email": email, "password": testPassword}
+
+	userId, otp := h.signUp(email)
+	mail := h.mailer.to(email)[0]
+	if !strings.Contains(mail.Body, otp) {
+		t.Errorf("mail %q does not carry the code", mail.Body)
+	}
+	h.call(http.MethodPost, "/api/v1/auth/mail/sign-in", "", credentials, http.StatusUnauthorized)
+	h.call(http.MethodPost, "/api/v1/auth/mail/sign-up", "", gin.H{
+		"email":    email,
+		"fullname": "Someone Else",
+		"password": testPassword,
+	}, http.StatusBadRequest)
+
+	activated := h.call(http.MethodPost, "/api/v1/auth/activate", "", gin.H{
+		"user_id":           userId,
+		"one_time_password": otp,
+	}, http.StatusOK)
+	bodyString(t, activated, "access_token")
+
+	signedIn := h.call(http.MethodPost, "/api/v1/auth/mail/sign-in", "", credentials, http.StatusOK)
+	accessToken := bodyString(t, signedIn, "access_token")
+	refreshToken := bodyString(t, signedIn, "refresh_token")
+	h.call(http.MethodPost, "/api/v1/auth/mail/sign-in", "", gin.H{"email": email, "password": "wrong-" + testPassword}, http.StatusUnauthorized)
+
+	me := h.call(http.MethodGet, "/api/v1/users/me", accessToken, nil, http.StatusOK)
+	profile, _ := me.Body["user"].(map[string]interface{})
+	if profile["email"] != email || profile["fullname"] != "Test User" || profile["isActive"] != true {
+		t.Errorf("profile = %v, want the active user", profile)
+	}
+	h.call(http.MethodGet, "/api/v1/users/me", "", nil, http.StatusUnauthorized)
+
+	refreshed := h.call(http.MethodGet, "/api/v1/auth/refresh-token", refreshToken, nil, http.StatusOK)
+	newAccessToken := bodyString(t, refreshed, "access_token")
+	if bodyString(t, refreshed, "refresh_token") == refreshToken {
+		t.Errorf("refresh token was not renewed")
+	}
+	h.call(http.MethodGet, "/api/v1/users/me", newAccessToken, nil, http.StatusOK)
+}
+
+func TestResendCooldown(t *testing.T) {
+	h := newHarness(t)
+	const email = "cooldown@example.com"
+	userId, _ := h.signUp(email)
+
+	for _, request := range []gin.H{{"user_id": userId}, {"email": email}} {
+		answer := h.call(http.MethodPost, "/api/v1/auth/resend", "", request, http.StatusBadRequest)
+		if answer.Error != "Wait 5 minutes" {
+			t.Errorf("resend by %v error = %q, want the cooldown", request, answer.Error)
+		}
+	}
+	h.call(http.MethodPost, "/api/v1/auth/resend", "", gin.H{"email": "nobody@example.com"}, http.StatusBadRequest)
+	if sent := len(h.mailer.to(email)); sent != 1 {
+		t.Errorf("sent %d mails, want only the sign-up one", sent)
+	}
+}
+
+func TestResendAfterCooldown(t *testing.T) {
+	h := newHarness(t, "-otp.resend_interval=1ms")
+	const email = "again@example.com"
+	userId, first := h.signUp(email)
+	// The code can be mailed within the interval of the resend that follows.
+	time.Sleep(5 * time.Millisecond)
+
+	h.call(http.MethodPost, "/api/v1/auth/resend", "", gin.H{"user_id": userId}, http.StatusOK)
+	second := h.otpFrom(h.mailer.waitFor(t, email, 2))
+	if second == first {
+		t.Skipf("the new code repeats the old one by chance")
+	}
+	h.call(http.MethodPost, "/api/v1/auth/activate", "", gin.H{"user_id": userId, "one_time_password": first}, http.StatusUnauthorized)
+	h.call(http.MethodPost, "/api/v1/auth/activate", "", gin.H{"user_id": userId, "one_time_password": second}, http.StatusOK)
+}
+
+func TestOTPAttemptsExhausted(t *testing.T) {
+	h := newHarness(t)
+	const email = "guesser@example.com"
+	userId, otp := h.signUp(email)
+	wrong := "0000"
+	if otp == wrong {
+		wrong = "1111"
+	}
+
+	for i := 0; i < 3; i++ {
+		h.call(http.MethodPost, "/api/v1/auth/activate", "", gin.H{"user_id": userId, "one_time_password": wrong}, http.StatusUnauthorized)
+	}
+	if attempts := h.user(userId).OTPAttempts; attempts != 0 {
+		t.Errorf("attempts left = %d, want 0", attempts)
+	}
+	h.call(http.MethodPost, "/api/v1/auth/activate", "", gin.H{"user_id": userId, "one_time_password": otp}, http.StatusUnauthorized)
+	h.call(http.MethodPost, "/api/v1/auth/mail/sign-in", "", gin.H{"email": email, "password": testPassword}, http.StatusUnauthorized)
+	if h.user(userId).IsActive {
+		t.Errorf("user activated after the attempts ran out")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	h := newHarness(t)
+	const email = "forgetful@example.com"
+	const newPassword = "Harbor-Violet-1987"
+	userId, accessToken, _ := h.activate(email)
+
+	h.call(http.MethodPost, "/api/v1/auth/resend", "", gin.H{"email": email}, http.StatusOK)
+	otp := h.otpFrom(h.mailer.waitFor(t, email, 2))
+	answer := h.call(http.MethodPost, "/api/v1/auth/activate", "", gin.H{
+		"user_id":           userId,
+		"one_time_password": otp,
+	}, http.StatusOK)
+	resetHash := bodyString(t, answer, "reset_hash")
+	// The code is spent on the reset hash.
+	h.call(http.MethodPost, "/api/v1/auth/activate", "", gin.H{"user_id": userId, "one_time_password": otp}, http.StatusUnauthorized)
+
+	h.call(http.MethodPost, "/api/v1/auth/reset-password", "", gin.H{
+		"user_id":      userId,
+		"reset_hash":   strings.ToLower(resetHash) + "x",
+		"new_password": newPassword,
+	}, http.StatusUnauthorized)
+	h.call(http.MethodPost, "/api/v1/auth/reset-password", "", gin.H{
+		"user_id":      userId,
+		"reset_hash":   resetHash,
+		"new_password": "short",
+	}, http.StatusBadRequest)
+	h.call(http.MethodPost, "/api/v1/auth/reset-password", "", gin.H{
+		"user_id":      userId,
+		"reset_hash":   resetHash,
+		"new_password": newPassword,
+	}, http.StatusOK)
+	h.call(http.MethodPost, "/api/v1/auth/reset-password", "", gin.H{
+		"user_id":      userId,
+		"reset_hash":   resetHash,
+		"new_password": "Another-" + newPassword,
+	}, http.StatusUnauthorized)
+
+	// The reset ends the sessions started with the old password.
+	h.call(http.MethodGet, "/api/v1/users/me", accessToken, nil, http.StatusUnauthorized)
+	h.call(http.MethodPost, "/api/v1/auth/mail/sign-in", "", gin.H{"email": email, "password": testPassword}, http.StatusUnauthorized)
+	signedIn := h.call(http.MethodPost, "/api/v1/auth/mail/sign-in", "", gin.H{"email": email, "password": newPassword}, http.StatusOK)
+	h.call(http.MethodGet, "/api/v1/users/me", bodyString(t, signedIn, "access_token"), nil, http.StatusOK)
+}
+
+func TestTokenTypesAreNotInterchangeable(t *testing.T) {
+	h := newHarness(t)
+	_, accessToken, refreshToken := h.activate("types@example.com")
+
+	h.call(http.MethodGet, "/api/v1/users/me", refreshToken, nil, http.StatusUnauthorized)
+	h.call(http.MethodGet, "/api/v1/auth/refresh-token", accessToken, nil, http.StatusUnauthorized)
+
+	refreshed := h.call(http.MethodGet, "/api/v1/auth/refresh-token", refreshToken, nil, http.StatusOK)
+	refreshedAgain := h.call(http.MethodGet, "/api/v1/auth/refresh-token", bodyString(t, refreshed, "refresh_token"), nil, http.StatusOK)
+	// Replaying a used refresh token ends the session it belongs to.
+	h.call(http.MethodGet, "/api/v1/auth/refresh-token", refreshToken, nil, http.StatusUnauthorized)
+	h.call(http.MethodGet, "/api/v1/auth/refresh-token", bodyString(t, refreshedAgain, "refresh_token"), nil, http.StatusUnauthorized)
+	h.call(http.MethodGet, "/api/v1/users/me", bodyString(t, refreshedAgain, "access_token"), nil, http.StatusUnauthorized)
+}
+
+func TestLogoutEndsTheSession(t *testing.T) {
+	h := newHarness(t)
+	_, accessToken, refreshToken := h.activate("logout@example.com")
+	signedIn := h.call(http.MethodPost, "/api/v1/auth/mail/sign-in", "", gin.H{"email": "logout@example.com", "password": testPassword}, http.StatusOK)
+	otherAccessToken := bodyString(t, signedIn, "access_token")
+
+	h.call(http.MethodPost, "/api/v1/auth/logout", accessToken, nil, http.StatusOK)
+	h.call(http.MethodGet, "/api/v1/users/me", accessToken, nil, http.StatusUnauthorized)
+	h.call(http.MethodGet, "/api/v1/auth/refresh-token", refreshToken, nil, http.StatusUnauthorized)
+	h.call(http.MethodGet, "/api/v1/users/me", otherAccessToken, nil, http.StatusOK)
+}
+
+func TestForwardAuthTakesAccessTokensOnly(t *testing.T) {
+	h := newHarness(t)
+	userId, accessToken, refreshToken := h.activate("proxy@example.com")
+
+	for _, test := range []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{name: "access token", token: accessToken, wantCode: http.StatusOK},
+		{name: "bearer access token", token: "Bearer " + accessToken, wantCode: http.StatusOK},
+		{name: "refresh token", token: refreshToken, wantCode: http.StatusUnauthorized},
+		{name: "bearer refresh token", token: "Bearer " + refreshToken, wantCode: http.StatusUnauthorized},
+	} {
+		recorder, _ := h.do(http.MethodGet, "/api/v1/auth/verify", test.token, nil)
+		if recorder.Code != test.wantCode {
+			t.Errorf("%s: HTTP %d, want %d", test.name, recorder.Code, test.wantCode)
+		}
+		if test.wantCode == http.StatusOK && recorder.Header().Get("X-Auth-User-Id") != strconv.Itoa(int(userId)) {
+			t.Errorf("%s: user id header %q, want %d", test.name, recorder.Header().Get("X-Auth-User-Id"), userId)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/auth/verify", nil)
+	request.AddCookie(&http.Cookie{Name: "access_token", Value: refreshToken})
+	recorder := httptest.NewRecorder()
+	h.handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token in the cookie: HTTP %d, want 401", recorder.Code)
+	}
+}
+
+func TestDeviceCodeIsRedeemedOnce(t *testing.T) {
+	h := newHarness(t)
+	_, accessToken, _ := h.activate("device@example.com")
+	recorder, _ := h.do(http.MethodPost, "/api/v1/oauth/device/code", "", gin.H{"client_id": "cli"})
+	var deviceCode struct {
+		DeviceCode string `json:"device_code"`
+		UserCode   string `json:"user_code"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &deviceCode); err != nil || deviceCode.DeviceCode == "" {
+		t.Fatalf("device code answer %q: %v", recorder.Body.String(), err)
+	}
+	h.call(http.MethodPost, "/api/v1/oauth/device/approve", accessToken, gin.H{"user_code": deviceCode.UserCode, "approve": true}, http.StatusOK)
+
+	const polls = 8
+	codes := make(chan int, polls)
+	var wg sync.WaitGroup
+	for i := 0; i < polls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder, _ := h.do(http.MethodPost, "/api/v1/oauth/token", "", gin.H{
+				"grant_type":  "urn:ietf:params:oauth:grant-type:device_code",
+				"device_code": deviceCode.DeviceCode,
+				"client_id":   "cli",
+			})
+			codes <- recorder.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	granted := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			granted++
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("poll answered HTTP %d", code)
+		}
+	}
+	if granted != 1 {
+		t.Errorf("%d polls got tokens, want exactly one", granted)
+	}
+}
+
+// TestEveryRouteAnswers sends every registered route a request without and with a
+// token: none may be missing or fail with a server error.
+func TestEveryRouteAnswers(t *testing.T) {
+	h := newHarness(t)
+	_, accessToken, _ := h.activate("routes@example.com")
+	engine, ok := h.app.Handler.(*gin.Engine)
+	if !ok {
+		t.Fatalf("handler is a %T, want the gin engine", h.app.Handler)
+	}
+	routes := engine.Routes()
+	if len(routes) == 0 {
+		t.Fatalf("no routes registered")
+	}
+	for _, route := range routes {
+		path := routeParameter.ReplaceAllString(route.Path, "1")
+		for _, token := range []string{"", accessToken} {
+			recorder, answer := h.do(route.Method, path, token, gin.H{})
+			if recorder.Code == http.StatusNotFound || recorder.Code == http.StatusMethodNotAllowed || recorder.Code >= http.StatusInternalServerError && recorder.Code != http.StatusServiceUnavailable {
+				t.Errorf("%s %s (token %v): HTTP %d", route.Method, route.Path, token != "", recorder.Code)
+			}
+			if answer.Status >= http.StatusInternalServerError {
+				t.Errorf("%s %s (token %v): status %d (%q)", route.Method, route.Path, token != "", answer.Status, answer.Error)
+			}
+		}
+	}
+}
+
+// TestEmailChangeCancelLink opens the mailed link the way a link scanner would before
+// the owner confirms the cancellation with the form.
+func TestEmailChangeCancelLink(t *testing.T) {
+	h := newHarness(t)
+	const email = "mover@example.com"
+	userId, accessToken, _ := h.activate(email)
+	h.call(http.MethodPost, "/api/v1/users/me/email", accessToken, gin.H{"new_email": "moved@example.com", "password": testPassword}, http.StatusOK)
+	link := cancelLinkPattern.FindString(h.mailer.waitFor(t, email, 2).Body)
+	if link == "" {
+		t.Fatalf("no cancel link in the mail to %s", email)
+	}
+	cancelToken := strings.TrimPrefix(link, "/api/v1/users/email/cancel?token=")
+
+	request := httptest.NewRequest(http.MethodGet, link, nil)
+	request.Header.Set("Accept", "text/html")
+	recorder := httptest.NewRecorder()
+	h.handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `method="post"`) {
+		t.Fatalf("GET %s: HTTP %d %q, want the confirmation page", link, recorder.Code, recorder.Body.String())
+	}
+	var pending int64
+	h.db.Table("email_changes").Where("user_id = ?", userId).Count(&pending)
+	if pending != 1 {
+		t.Fatalf("%d pending email changes after opening the link, want it kept", pending)
+	}
+
+	request = httptest.NewRequest(http.MethodPost, link, strings.NewReader("token="+cancelToken))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "text/html")
+	recorder = httptest.NewRecorder()
+	h.handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || strings.Contains(recorder.Body.String(), `method="post"`) {
+		t.Fatalf("POST %s: HTTP %d %q, want the result page", link, recorder.Code, recorder.Body.String())
+	}
+	h.db.Table("email_changes").Where("user_id = ?", userId).Count(&pending)
+	if pending != 0 {
+		t.Fatalf("%d pending email changes after the cancellation, want none", pending)
+	}
+	h.call(http.MethodPost, "/api/v1/users/email/cancel", "", gin.H{"token": cancelToken}, http.StatusBadRequest)
+}
+
+// TestClientAddressTrustsConfiguredProxiesOnly checks the address the audit log keeps
+// for a sign-in sent through a proxy, which the rate limit keys on as well.
+func TestClientAddressTrustsConfiguredProxiesOnly(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		args   []string
+		wantIp string
+	}{
+		{name: "no trusted proxies", wantIp: "192.0.2.1"},
+		{name: "trusted proxy", args: []string{"-server.trusted_proxies=192.0.2.0/24"}, wantIp: "203.0.113.9"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := newHarness(t, test.args...)
+			body := strings.NewReader(`{"email":"nobody@example.com","password":"` + testPassword + `"}`)
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/auth/mail/sign-in", body)
+			request.Header.Set("Content-Type", "application/json")
+			request.Header.Set("X-Forwarded-For", "203.0.113.9")
+			h.handler.ServeHTTP(httptest.NewRecorder(), request)
+
+			var event domain.AuditEvent
+			if err := h.db.Where("action = ?", domain.AuditSignIn).Last(&event).Error; err != nil {
+				t.Fatalf("reading the sign-in event: %v", err)
+			}
+			if event.Ip != test.wantIp {
+				t.Errorf("audit address %q, want %q", event.Ip, test.wantIp)
+			}
+		})
+	}
+}
+
+// TestAuditChainNeedsTheKey rewrites an event and rehashes it the way someone with only
+// database access could, under a key id of the ring but not its secret.
+func TestAuditChainNeedsTheKey(t *testing.T) {
+	h := newHarness(t)
+	userId, accessToken, _ := h.activate("auditor@example.com")
+	h.db.Model(&domain.User{}).Where("id = ?", userId).Update("is_superuser", true)
+	answer := h.call(http.MethodGet, "/api/v1/admin/audit/verify", accessToken, nil, http.StatusOK)
+	if answer.Body["valid"] != true {
+		t.Fatalf("verification %v, want the untouched chain valid", answer.Body)
+	}
+
+	var event domain.AuditEvent
+	if err := h.db.Order("id DESC").First(&event).Error; err != nil {
+		t.Fatalf("reading the last event: %v", err)
+	}
+	forger, err := security.NewKeyring([]string{security.LegacyKeyId + ":guessed-secret"})
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	event.Ip = "198.51.100.7"
+	event.Hash = forger.Sign(event.HashMessage())
+	h.db.Model(&event).Updates(map[string]interface{}{"ip": event.Ip, "hash": event.Hash})
+	h.db.Model(&domain.AuditChainHead{}).Where("id = ?", 1).Update("hash", event.Hash)
+
+	answer = h.call(http.MethodGet, "/api/v1/admin/audit/verify", accessToken, nil, http.StatusOK)
+	if answer.Body["valid"] != false || answer.Body["reason"] != "content does not match its hash" {
+		t.Errorf("verification %v, want the forged event caught", answer.Body)
+	}
+}
+
+func TestExportHasSessionsAndActivity(t *testing.T) {
+	h := newHarness(t)
+	const email = "exporter@example.com"
+	_, accessToken, _ := h.activate(email)
+	h.call(http.MethodPost, "/api/v1/auth/mail/sign-in", "", gin.H{"email": email, "password": testPassword}, http.StatusOK)
+	loggedOut := h.call(http.MethodPost, "/api/v1/auth/mail/sign-in", "", gin.H{"email": email, "password": testPassword}, http.StatusOK)
+	h.call(http.MethodPost, "/api/v1/auth/logout", bodyString(t, loggedOut, "access_token"), nil, http.StatusOK)
+
+	recorder, _ := h.do(http.MethodPost, "/api/v1/users/me/export", accessToken, nil)
+	var export domain.UserExport
+	if err := json.Unmarshal(recorder.Body.Bytes(), &export); err != nil {
+		t.Fatalf("export %q: %v", recorder.Body.String(), err)
+	}
+	if len(export.Sessions) != 2 {
+		t.Errorf("%d sessions, want the activation and the sign-in still signed in", len(export.Sessions))
+	}
+	signIns := 0
+	for _, event := range export.AuditEvents {
+		if event.Action == domain.AuditSignIn {
+			signIns++
+		}
+	}
+	if signIns != 2 {
+		t.Errorf("%d sign-ins among the audit events %+v, want both", signIns, export.AuditEvents)
+	}
+}
+
+// TestApiKeyIntrospection has a resource server introspect an API key before and after
+// its owner deletes it; the first answer is cached, so the delete has to drop it.
+func TestApiKeyIntrospection(t *testing.T) {
+	h := newHarness(t, "-oauth_clients=rs:rs-secret")
+	userId, accessToken, _ := h.activate("keyholder@example.com")
+	_, strangerToken, _ := h.activate("stranger@example.com")
+	created := h.call(http.MethodPost, "/api/v1/users/me/api-keys", accessToken, gin.H{"name": "ci", "scope": "read write"}, http.StatusOK)
+	key := bodyString(t, created, "key")
+	keyId := uint(created.Body["api_key"].(map[string]interface{})["ID"].(float64))
+
+	introspect := func() domain.Introspection {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/oauth/introspect", strings.NewReader(url.Values{"token": {key}}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth("rs", "rs-secret")
+		recorder := httptest.NewRecorder()
+		h.handler.ServeHTTP(recorder, request)
+		var introspection domain.Introspection
+		if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &introspection) != nil {
+			t.Fatalf("introspect: HTTP %d %q", recorder.Code, recorder.Body.String())
+		}
+		return introspection
+	}
+	introspection := introspect()
+	if !introspection.Active || introspection.TokenType != domain.ApiKeyTokenType || introspection.Sub != strconv.FormatUint(uint64(userId), 10) || introspection.Scope != "read write" {
+		t.Fatalf("introspection %+v, want the active key of user %d", introspection, userId)
+	}
+
+	keyPath := "/api/v1/users/me/api-keys/" + strconv.FormatUint(uint64(keyId), 10)
+	h.call(http.MethodDelete, keyPath, strangerToken, nil, http.StatusNotFound)
+	h.call(http.MethodDelete, keyPath, accessToken, nil, http.StatusOK)
+	if introspection := introspect(); introspection.Active {
+		t.Fatalf("introspection %+v after the delete, want inactive", introspection)
+	}
+}
+
+// TestIntrospectionAfterPasswordChange has a resource server introspect an access token
+// before and after its owner changes the password; the cached answer must not outlive
+// the session.
+func TestIntrospectionAfterPasswordChange(t *testing.T) {
+	h := newHarness(t, "-oauth_clients=rs:rs-secret")
+	_, accessToken, _ := h.activate("changer@example.com")
+
+	introspect := func() domain.Introspection {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/oauth/introspect", strings.NewReader(url.Values{"token": {accessToken}}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.SetBasicAuth("rs", "rs-secret")
+		recorder := httptest.NewRecorder()
+		h.handler.ServeHTTP(recorder, request)
+		var introspection domain.Introspection
+		if recorder.Code != http.StatusOK || json.Unmarshal(recorder.Body.Bytes(), &introspection) != nil {
+			t.Fatalf("introspect: HTTP %d %q", recorder.Code, recorder.Body.String())
+		}
+		return introspection
+	}
+	if introspection := introspect(); !introspection.Active {
+		t.Fatalf("introspection %+v, want the access token active", introspection)
+	}
+
+	h.call(http.MethodPost, "/api/v1/users/me/password", accessToken, gin.H{"current_password": testPassword, "new_password": "An0ther-passphrase"}, http.StatusOK)
+	if introspection := introspect(); introspection.Active {
+		t.Fatalf("introspection %+v after the password change, want inactive", introspection)
+	}
+}
@@ -0,0 +1,258 @@
+package app_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"hitenok/pkg/app"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const testPassword = "Lantern-Marble-42"
+
+// harness runs the whole application against a fresh SQLite file, with the mails
+// captured instead of sent.
+type harness struct {
+	t       *testing.T
+	app     *app.App
+	db      *gorm.DB
+	mailer  *capturingMailer
+	handler http.Handler
+}
+
+// newHarness boots the application; args are configuration flags on top of the test
+// defaults, a later flag winning.
+func newHarness(t *testing.T, args ...string) *harness {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	flags := flag.NewFlagSet("e2e", flag.ContinueOnError)
+	loader := config.RegisterFlags(flags)
+	defaults := []string{
+		"-web_port=0",
+		"-secret_key=e2e-secret",
+		"-db.driver=sqlite",
+		"-db.name=" + filepath.Join(t.TempDir(), "e2e.db"),
+		"-db.migrate_on_start=true",
+		"-smtp.user=noreply@example.com",
+		"-smtp.password=unused",
+		"-rate_limit.enabled=false",
+	}
+	if err := flags.Parse(append(defaults, args...)); err != nil {
+		t.Fatalf("flags: %v", err)
+	}
+	appConfig, err := loader.Load()
+	if err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	db, dbErr := repository.OpenDatabase(appConfig.Db)
+	if dbErr != nil {
+		t.Fatalf("OpenDatabase.%s: %v", dbErr.Module, dbErr.ErrorBase)
+	}
+	mailer := &capturingMailer{}
+	application, appErr := app.New(db, appConfig, mailer)
+	if appErr != nil {
+		t.Fatalf("app.New.%s: %v", appErr.Module, appErr.ErrorBase)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := application.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown.%s: %v", err.Module, err.ErrorBase)
+		}
+		if sqlDb, err := db.DB(); err == nil {
+			sqlDb.Close()
+		}
+	})
+	return &harness{
+		t:       t,
+		app:     application,
+		db:      db,
+		mailer:  mailer,
+		handler: application.Handler,
+	}
+}
+
+// envelope is the body every API answer is wrapped in.
+type envelope struct {
+	Status int                    `json:"status"`
+	Body   map[string]interface{} `json:"body"`
+	Error  string                 `json:"error"`
+}
+
+// do sends a request with a JSON body (nil for none) and the token as the
+// Authorization header (empty for none).
+func (h *harness) do(method, path, token string, body interface{}) (*httptest.ResponseRecorder, envelope) {
+	h.t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			h.t.Fatalf("encoding %s %s: %v", method, path, err)
+		}
+	}
+	request := httptest.NewRequest(method, path, &payload)
+	request.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		request.Header.Set("Authorization", token)
+	}
+	recorder := httptest.NewRecorder()
+	h.handler.ServeHTTP(recorder, request)
+
+	var answer envelope
+	if recorder.Header().Get("Content-Type") == "application/json; charset=utf-8" {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &answer); err != nil {
+			h.t.Fatalf("%s %s: decoding %q: %v", method, path, recorder.Body.String(), err)
+		}
+	}
+	return recorder, answer
+}
+
+// call is do for the envelope, failing the test unless it carries wantStatus.
+func (h *harness) call(method, path, token string, body interface{}, wantStatus int) envelope {
+	h.t.Helper()
+	_, answer := h.do(method, path, token, body)
+	if answer.Status != wantStatus {
+		h.t.Fatalf("%s %s: status %d (%q), want %d", method, path, answer.Status, answer.Error, wantStatus)
+	}
+	return answer
+}
+
+// signUp registers a user and returns its id with the OTP mailed to it.
+func (h *harness) signUp(email string) (uint, string) {
+	h.t.Helper()
+	answer := h.call(http.MethodPost, "/api/v1/auth/mail/sign-up", "", gin.H{
+		"email":    email,
+		"fullname": "Test User",
+		"password": testPassword,
+	}, http.StatusOK)
+	return bodyId(h.t, answer, "user_id"), h.otpFrom(h.mailer.waitFor(h.t, email, 1))
+}
+
+// activate signs up a user and activates it, returning its id and the token pair. It
+// waits for the activation side effects, which clear the OTP, so they do not race the
+// scenario that follows.
+func (h *harness) activate(email string) (uint, string, string) {
+	h.t.Helper()
+	userId, otp := h.signUp(email)
+	answer := h.call(http.MethodPost, "/api/v1/auth/activate", "", gin.H{
+		"user_id":           userId,
+		"one_time_password": otp,
+	}, http.StatusOK)
+	waitUntil(h.t, "the OTP is cleared after the activation", func() bool {
+		return h.user(userId).OTP == ""
+	})
+	return userId, bodyString(h.t, answer, "access_token"), bodyString(h.t, answer, "refresh_token")
+}
+
+// user reads the stored user, for the waits on asynchronous side effects.
+func (h *harness) user(userId uint) domain.User {
+	h.t.Helper()
+	var user domain.User
+	if err := h.db.First(&user, userId).Error; err != nil {
+		h.t.Fatalf("reading user %d: %v", userId, err)
+	}
+	return user
+}
+
+var otpPattern = regexp.MustCompile(`\d{4,12}`)
+
+func (h *harness) otpFrom(mail sentMail) string {
+	h.t.Helper()
+	otp := otpPattern.FindString(mail.Body)
+	if otp == "" {
+		h.t.Fatalf("no code in the mail %q", mail.Body)
+	}
+	return otp
+}
+
+type sentMail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// capturingMailer keeps the mails instead of sending them. Most mails are sent in the
+// background after the request has been answered, so tests wait for them.
+type capturingMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+func (mailer *capturingMailer) Send(to, subject, body string) error {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	mailer.sent = append(mailer.sent, sentMail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+func (mailer *capturingMailer) Ping(ctx context.Context) error {
+	return nil
+}
+
+// to lists the mails sent to the address so far, oldest first.
+func (mailer *capturingMailer) to(address string) []sentMail {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	var sent []sentMail
+	for _, mail := range mailer.sent {
+		if mail.To == address {
+			sent = append(sent, mail)
+		}
+	}
+	return sent
+}
+
+// waitFor waits for the count-th mail to the address and returns it.
+func (mailer *capturingMailer) waitFor(t *testing.T, address string, count int) sentMail {
+	t.Helper()
+	waitUntil(t, "mail "+strconv.Itoa(count)+" to "+address, func() bool {
+		return len(mailer.to(address)) >= count
+	})
+	return mailer.to(address)[count-1]
+}
+
+func waitUntil(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func bodyString(t *testing.T, answer envelope, key string) string {
+	t.Helper()
+	value, ok := answer.Body[key].(string)
+	if !ok || value == "" {
+		t.Fatalf("body %v has no %s", answer.Body, key)
+	}
+	return value
+}
+
+func bodyId(t *testing.T, answer envelope, key string) uint {
+	t.Helper()
+	value, ok := answer.Body[key].(float64)
+	if !ok || value <= 0 {
+		t.Fatalf("body %v has no %s", answer.Body, key)
+	}
+	return uint(value)
+}
+
+var routeParameter = regexp.MustCompile(`:[A-Za-z]+`)
+
+var cancelLinkPattern = regexp.MustCompile(`/api/v1/users/email/cancel\?token=[0-9a-f]+`)
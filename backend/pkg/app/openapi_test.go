@@ -0,0 +1,98 @@
+package app_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type openAPIDocument struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]json.RawMessage `json:"schemas"`
+	} `json:"components"`
+}
+
+func (h *harness) openAPIDocument() (openAPIDocument, []byte) {
+	h.t.Helper()
+	recorder := httptest.NewRecorder()
+	h.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if recorder.Code != http.StatusOK {
+		h.t.Fatalf("GET /api/openapi.json: HTTP %d", recorder.Code)
+	}
+	var document openAPIDocument
+	if err := json.Unmarshal(recorder.Body.Bytes(), &document); err != nil {
+		h.t.Fatalf("decoding the OpenAPI document: %v", err)
+	}
+	return document, recorder.Body.Bytes()
+}
+
+// TestOpenAPICoversEveryRoute fails when a route is registered without being described,
+// or described without being registered.
+func TestOpenAPICoversEveryRoute(t *testing.T) {
+	h := newHarness(t, "-openapi.swagger_ui=true")
+	document, _ := h.openAPIDocument()
+	if document.OpenAPI != "3.1.0" {
+		t.Errorf("openapi is %q, want 3.1.0", document.OpenAPI)
+	}
+	engine, ok := h.app.Handler.(*gin.Engine)
+	if !ok {
+		t.Fatalf("handler is a %T, want the gin engine", h.app.Handler)
+	}
+
+	registered := map[string]bool{}
+	for _, route := range engine.Routes() {
+		if route.Method == http.MethodConnect {
+			continue
+		}
+		path := routeParameter.ReplaceAllStringFunc(route.Path, func(parameter string) string {
+			return "{" + parameter[1:] + "}"
+		})
+		method := strings.ToLower(route.Method)
+		registered[method+" "+path] = true
+		if _, ok := document.Paths[path][method]; !ok {
+			t.Errorf("%s %s is registered but missing from the OpenAPI document", route.Method, route.Path)
+		}
+	}
+	for path, operations := range document.Paths {
+		for method := range operations {
+			if !registered[method+" "+path] {
+				t.Errorf("%s %s is in the OpenAPI document but not registered", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
+
+func TestOpenAPIReferencesResolve(t *testing.T) {
+	h := newHarness(t)
+	document, raw := h.openAPIDocument()
+	const prefix = `"$ref":"#/components/schemas/`
+	for rest := string(raw); strings.Contains(rest, prefix); {
+		rest = rest[strings.Index(rest, prefix)+len(prefix):]
+		name := rest[:strings.Index(rest, `"`)]
+		if _, ok := document.Components.Schemas[name]; !ok {
+			t.Errorf("reference to the undefined schema %q", name)
+		}
+	}
+}
+
+func TestSwaggerUI(t *testing.T) {
+	h := newHarness(t, "-openapi.swagger_ui=true")
+	recorder, _ := h.do(http.MethodGet, "/api/docs", "", nil)
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "SwaggerUIBundle") {
+		t.Fatalf("GET /api/docs: HTTP %d %q, want the Swagger UI page", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestSwaggerUIDisabledByDefault(t *testing.T) {
+	h := newHarness(t)
+	recorder, _ := h.do(http.MethodGet, "/api/docs", "", nil)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("GET /api/docs: HTTP %d, want 404 while the Swagger UI is disabled", recorder.Code)
+	}
+}
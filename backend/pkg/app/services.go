@@ -0,0 +1,93 @@
+package app
+
+import (
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
+	"hitenok/pkg/repository"
+	"hitenok/pkg/security"
+	"hitenok/pkg/services"
+
+	"gorm.io/gorm"
+)
+
+// Services holds the services over one database, with the domain event subscribers
+// registered. The server builds its handlers on them and the admin commands call them
+// directly, so both go through the same rules and emit the same events.
+type Services struct {
+	EventBus       events.EventBusI
+	Authentication services.PasswordAuthenticationServiceI
+	OTP            services.OTPServiceI
+	JWT            services.JWTServiceI
+	Hash           services.HashServiceI
+	User           services.UserServiceI
+	Account        services.AccountServiceI
+	Audit          services.AuditServiceI
+	Webhook        services.WebhookServiceI
+	ApiKey         services.ApiKeyServiceI
+	TokenDenylist  services.TokenDenylistServiceI
+	Introspection  services.IntrospectionServiceI
+	DeviceAuth     services.DeviceAuthorizationServiceI
+	OAuthClient    services.OAuthClientServiceI
+	EmailChange    services.EmailChangeServiceI
+	Organization   services.OrganizationServiceI
+	Invitation     services.InvitationServiceI
+}
+
+func NewServices(db *gorm.DB, appConfig *config.AppConfig, mailer services.MailerI) (*Services, *domain.MyError) {
+	userRepo := repository.NewUserRepository(db, appConfig)
+	deviceAuthorizationRepo := repository.NewDeviceAuthorizationRepository(db)
+	revokedTokenRepo := repository.NewRevokedTokenRepository(db)
+	emailChangeRepo := repository.NewEmailChangeRepository(db)
+	passwordHistoryRepo := repository.NewPasswordHistoryRepository(db)
+	organizationRepo := repository.NewOrganizationRepository(db)
+	sessionRepo := repository.NewSessionRepository(db)
+	invitationRepo := repository.NewInvitationRepository(db)
+	auditEventRepo := repository.NewAuditEventRepository(db, appConfig)
+	webhookRepo := repository.NewWebhookRepository(db)
+	apiKeyRepo := repository.NewApiKeyRepository(db)
+
+	passwordPolicy := &security.PasswordPolicy{
+		MinLength:      appConfig.PasswordMinLength,
+		MaxLength:      appConfig.PasswordMaxLength,
+		MinCharClasses: appConfig.PasswordMinCharClasses,
+		MinStrength:    appConfig.PasswordMinStrength,
+	}
+	if appConfig.PasswordBreachedCorpus != "" {
+		breachedCorpus, err := security.OpenBreachedCorpus(appConfig.PasswordBreachedCorpus)
+		if err != nil {
+			return nil, domain.NewError(err, "app.NewServices.OpenBreachedCorpus")
+		}
+		passwordPolicy.Breached = breachedCorpus
+	}
+
+	eventBus := events.NewEventBus()
+	if appConfig.EventsPgNotifyChannel != "" {
+		eventBus.AddPublisher(events.NewPgNotifyPublisher(db, appConfig.EventsPgNotifyChannel))
+	}
+	tokenDenylistService := services.NewTokenDenylistService(revokedTokenRepo)
+	authenticationService := services.NewMailAuthenticationService(userRepo, passwordHistoryRepo, mailer, passwordPolicy, eventBus, appConfig)
+	apiKeyService := services.NewApiKeyService(apiKeyRepo, userRepo)
+	jwtService := services.NewJWTService(appConfig, userRepo, organizationRepo, sessionRepo, tokenDenylistService, eventBus)
+	svc := &Services{
+		EventBus:       eventBus,
+		Authentication: authenticationService,
+		OTP:            services.NewMailOTPService(userRepo, mailer, appConfig),
+		JWT:            jwtService,
+		Hash:           services.NewHashService(userRepo, appConfig),
+		User:           services.NewUserService(userRepo),
+		Account:        services.NewAccountService(userRepo, emailChangeRepo, sessionRepo, auditEventRepo, eventBus, appConfig),
+		Audit:          services.NewAuditService(auditEventRepo, appConfig),
+		Webhook:        services.NewWebhookService(webhookRepo, appConfig),
+		ApiKey:         apiKeyService,
+		TokenDenylist:  tokenDenylistService,
+		Introspection:  services.NewIntrospectionService(jwtService, apiKeyService, appConfig),
+		DeviceAuth:     services.NewDeviceAuthorizationService(deviceAuthorizationRepo, userRepo),
+		OAuthClient:    services.NewOAuthClientService(appConfig),
+		EmailChange:    services.NewEmailChangeService(emailChangeRepo, userRepo, mailer, eventBus, appConfig),
+		Organization:   services.NewOrganizationService(organizationRepo, userRepo),
+		Invitation:     services.NewInvitationService(invitationRepo, organizationRepo, userRepo, authenticationService, mailer, appConfig),
+	}
+	registerSubscribers(eventBus, svc.User, svc.OTP, svc.Webhook, svc.Introspection)
+	return svc, nil
+}
@@ -0,0 +1,107 @@
+package app
+
+import (
+	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
+	"hitenok/pkg/services"
+)
+
+// registerSubscribers wires the side effects of the domain events. Webhook deliveries
+// are queued synchronously, so they are in the outbox before the publishing request
+// answers; emails and cleanups run asynchronously and write only the columns they own,
+// so they cannot undo what the request did meanwhile. Cached introspection answers are
+// dropped synchronously too, so that a resource server asking right after sees the
+// change.
+func registerSubscribers(eventBus events.EventBusI, userService services.UserServiceI, otpService services.OTPServiceI, webhookService services.WebhookServiceI, introspectionService services.IntrospectionServiceI) {
+	events.OnAsync(eventBus, func(event events.UserRegistered) *domain.MyError {
+		// Invited accounts start active, there is nothing to confirm.
+		if event.Invited {
+			return nil
+		}
+		user, err := userService.GetUser(event.UserId)
+		if err != nil {
+			return err
+		}
+		otp, err := otpService.GenerateOTP(user)
+		if err != nil {
+			return err
+		}
+		otpService.SendOTP(*user, otp)
+		return nil
+	})
+	events.OnAsync(eventBus, func(event events.UserActivated) *domain.MyError {
+		user, err := userService.GetUser(event.UserId)
+		if err != nil {
+			return err
+		}
+		return otpService.ClearOTP(user)
+	})
+
+	events.On(eventBus, func(event events.UserRegistered) *domain.MyError {
+		webhookService.Emit(domain.WebhookUserSignedUp, map[string]interface{}{
+			"user_id": event.UserId,
+			"email":   event.Email,
+			"invited": event.Invited,
+		})
+		return nil
+	})
+	events.On(eventBus, func(event events.UserActivated) *domain.MyError {
+		webhookService.Emit(domain.WebhookUserActivated, map[string]interface{}{
+			"user_id": event.UserId,
+			"email":   event.Email,
+		})
+		return nil
+	})
+	events.On(eventBus, func(event events.EmailChanged) *domain.MyError {
+		webhookService.Emit(domain.WebhookUserEmailChanged, map[string]interface{}{
+			"user_id":   event.UserId,
+			"email":     event.NewEmail,
+			"old_email": event.OldEmail,
+		})
+		return nil
+	})
+	events.On(eventBus, func(event events.UserDeactivated) *domain.MyError {
+		webhookService.Emit(domain.WebhookUserDeactivated, map[string]interface{}{
+			"user_id":     event.UserId,
+			"email":       event.Email,
+			"purge_after": event.PurgeAfter,
+		})
+		return nil
+	})
+	events.On(eventBus, func(event events.UserDeleted) *domain.MyError {
+		webhookService.Emit(domain.WebhookUserDeleted, map[string]interface{}{
+			"user_id": event.UserId,
+			"mode":    event.Mode,
+		})
+		return nil
+	})
+	events.On(eventBus, func(event events.UserRestored) *domain.MyError {
+		webhookService.Emit(domain.WebhookUserRestored, map[string]interface{}{
+			"user_id": event.UserId,
+			"email":   event.Email,
+		})
+		return nil
+	})
+
+	// Each of these ends every token of the user at once.
+	events.On(eventBus, func(event events.PasswordChanged) *domain.MyError {
+		introspectionService.ForgetUser(event.UserId)
+		return nil
+	})
+	events.On(eventBus, func(event events.PasswordReset) *domain.MyError {
+		introspectionService.ForgetUser(event.UserId)
+		return nil
+	})
+	events.On(eventBus, func(event events.EmailChanged) *domain.MyError {
+		introspectionService.ForgetUser(event.UserId)
+		return nil
+	})
+	events.On(eventBus, func(event events.UserDeactivated) *domain.MyError {
+		introspectionService.ForgetUser(event.UserId)
+		return nil
+	})
+	events.On(eventBus, func(event events.UserDeleted) *domain.MyError {
+		introspectionService.ForgetUser(event.UserId)
+		return nil
+	})
+}
@@ -1,79 +1,364 @@
 package config
 
 import (
+	"flag"
 	"fmt"
-	"os"
-
-	"github.com/joho/godotenv"
+	"hitenok/pkg/security"
+	"net"
+	"strings"
+	"time"
 )
 
 var moduleName string = "config"
 
+// AppConfig is filled by a Loader from, in increasing priority: the `default` tags, a
+// YAML or TOML file, the environment and command line flags. Every setting has a file
+// key (the dotted path of the `key` tags, also the flag name) and one or more
+// environment variables, the first set one winning; NAME_FILE may be given instead of
+// NAME to read the value from a file, as container secrets are mounted. Lists are
+// comma separated and maps are "key:value" pairs.
 type AppConfig struct {
-	WebPort    string
-	DbUrl      string
-	DbUser     string
-	DbPass     string
-	DbName     string
-	DbPort     string
-	SecretKey  string
-	Email      string
-	EmailToken string
+	WebPort   string `key:"web_port" env:"WEB_PORT" required:"true" help:"HTTP listen port"`
+	PublicUrl string `key:"public_url" env:"PUBLIC_URL" help:"externally visible base URL (default http://localhost:<web_port>)"`
+	// SecretKey is the single secret of older deployments. It stands in for any keyring
+	// that is not configured, as the key "legacy", and checks the password hashes made
+	// before the pepper keyring; keep it until those have been rehashed on sign-in.
+	SecretKey string `key:"secret_key" env:"SECRET_KEY" secret:"true" help:"legacy application secret"`
+
+	Server    ServerConfig    `key:"server"`
+	Db        DbConfig        `key:"db"`
+	Smtp      SmtpConfig      `key:"smtp"`
+	Jwt       JwtConfig       `key:"jwt"`
+	Otp       OtpConfig       `key:"otp"`
+	RateLimit RateLimitConfig `key:"rate_limit"`
+	Cors      CorsConfig      `key:"cors"`
+	OpenApi   OpenApiConfig   `key:"openapi"`
+	Keys      KeysConfig      `key:"keys"`
+	Health    HealthConfig    `key:"health"`
+
+	DeviceVerificationUrl string `key:"device_verification_url" env:"DEVICE_VERIFICATION_URL" help:"device flow verification page (default <public_url>/api/v1/oauth/device)"`
+	// OAuthClients maps confidential client ids to their secrets, e.g. resource servers
+	// calling the introspection endpoint.
+	OAuthClients          map[string]string `key:"oauth_clients" env:"OAUTH_CLIENTS" secret:"true" help:"confidential clients as id:secret,id:secret"`
+	IntrospectionCacheTtl time.Duration     `key:"introspection_cache_ttl" env:"INTROSPECTION_CACHE_TTL" default:"30s"`
+	DenylistSyncInterval  time.Duration     `key:"denylist_sync_interval" env:"DENYLIST_SYNC_INTERVAL" default:"10s"`
+
+	ForwardAuthUserIdHeader string `key:"forward_auth_user_id_header" env:"FORWARD_AUTH_USER_ID_HEADER" default:"X-Auth-User-Id"`
+	ForwardAuthEmailHeader  string `key:"forward_auth_email_header" env:"FORWARD_AUTH_EMAIL_HEADER" default:"X-Auth-Email"`
+	ForwardAuthRolesHeader  string `key:"forward_auth_roles_header" env:"FORWARD_AUTH_ROLES_HEADER" default:"X-Auth-Roles"`
+	ForwardAuthCookie       string `key:"forward_auth_cookie" env:"FORWARD_AUTH_COOKIE" default:"access_token"`
+	// ForwardAuthLoginUrl enables redirecting browsers to the login page instead of
+	// answering 401; left empty the verify endpoint never redirects.
+	ForwardAuthLoginUrl string `key:"forward_auth_login_url" env:"FORWARD_AUTH_LOGIN_URL"`
+
+	// Deleted accounts stay soft-deleted for the grace period; after it the purge job
+	// either anonymizes their PII or removes them for good, per AccountDeletionMode.
+	AccountDeletionGracePeriod time.Duration `key:"account_deletion_grace_period" env:"ACCOUNT_DELETION_GRACE_PERIOD" default:"720h"`
+	AccountDeletionMode        string        `key:"account_deletion_mode" env:"ACCOUNT_DELETION_MODE" default:"anonymize" help:"anonymize or delete"`
+	AccountPurgeInterval       time.Duration `key:"account_purge_interval" env:"ACCOUNT_PURGE_INTERVAL" default:"1h"`
+
+	PasswordMinLength      int `key:"password_min_length" env:"PASSWORD_MIN_LENGTH" default:"8"`
+	PasswordMaxLength      int `key:"password_max_length" env:"PASSWORD_MAX_LENGTH" default:"128"`
+	PasswordMinCharClasses int `key:"password_min_char_classes" env:"PASSWORD_MIN_CHAR_CLASSES" default:"1"`
+	PasswordMinStrength    int `key:"password_min_strength" env:"PASSWORD_MIN_STRENGTH" default:"2"`
+	// PasswordBreachedCorpus is the path of a sorted SHA-1 digest file, see
+	// security.BreachedCorpus; empty disables the breached-password check.
+	PasswordBreachedCorpus string `key:"password_breached_corpus" env:"PASSWORD_BREACHED_CORPUS"`
+	// PasswordHistorySize is how many previous passwords may not be reused; 0 only
+	// forbids the current one.
+	PasswordHistorySize int `key:"password_history_size" env:"PASSWORD_HISTORY_SIZE" default:"5"`
+	// PasswordMaxAge forces a password change on sign-in once the password is older;
+	// 0 disables expiry.
+	PasswordMaxAge time.Duration `key:"password_max_age" env:"PASSWORD_MAX_AGE" default:"0s"`
+
+	// RegistrationMode is open, invite-only or domain-allowlist; the last admits only
+	// emails under RegistrationAllowedDomains. Accepting an invitation always works.
+	RegistrationMode           string        `key:"registration_mode" env:"REGISTRATION_MODE" default:"open" help:"open, invite-only or domain-allowlist"`
+	RegistrationAllowedDomains []string      `key:"registration_allowed_domains" env:"REGISTRATION_ALLOWED_DOMAINS"`
+	InvitationTtl              time.Duration `key:"invitation_ttl" env:"INVITATION_TTL" default:"168h"`
+	// InvitationUrl is the page the invite email links to, with ?token= appended.
+	InvitationUrl string `key:"invitation_url" env:"INVITATION_URL" help:"invite page (default <public_url>/invite)"`
+
+	// The webhook worker polls the delivery outbox every WebhookPollInterval and gives
+	// a delivery up after WebhookMaxAttempts failed attempts.
+	WebhookPollInterval time.Duration `key:"webhook_poll_interval" env:"WEBHOOK_POLL_INTERVAL" default:"5s"`
+	WebhookTimeout      time.Duration `key:"webhook_timeout" env:"WEBHOOK_TIMEOUT" default:"10s"`
+	WebhookMaxAttempts  int           `key:"webhook_max_attempts" env:"WEBHOOK_MAX_ATTEMPTS" default:"8"`
+	// WebhookAllowPrivate lets deliveries reach loopback, private and link-local
+	// addresses, for receivers on an internal network. Off, an admin cannot point a
+	// webhook at the services next to this one.
+	WebhookAllowPrivate bool `key:"webhook_allow_private" env:"WEBHOOK_ALLOW_PRIVATE" default:"false"`
+
+	// EventsPgNotifyChannel forwards every domain event with Postgres NOTIFY on this
+	// channel; empty disables the publisher.
+	EventsPgNotifyChannel string `key:"events_pg_notify_channel" env:"EVENTS_PG_NOTIFY_CHANNEL"`
+}
+
+// ServerConfig tunes the HTTP server. TLS is served when both files are set; they are
+// read again on SIGHUP, as are the keyrings.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `key:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT" default:"5s"`
+	ReadTimeout       time.Duration `key:"read_timeout" env:"SERVER_READ_TIMEOUT" default:"15s"`
+	WriteTimeout      time.Duration `key:"write_timeout" env:"SERVER_WRITE_TIMEOUT" default:"30s"`
+	IdleTimeout       time.Duration `key:"idle_timeout" env:"SERVER_IDLE_TIMEOUT" default:"2m"`
+	MaxHeaderBytes    int           `key:"max_header_bytes" env:"SERVER_MAX_HEADER_BYTES" default:"65536"`
+	MaxBodyBytes      int           `key:"max_body_bytes" env:"SERVER_MAX_BODY_BYTES" default:"1048576"`
+	// ShutdownTimeout bounds the drain on SIGTERM: in-flight requests first, then the
+	// background work such as emails and event handlers.
+	ShutdownTimeout time.Duration `key:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT" default:"30s"`
+	TlsCertFile     string        `key:"tls_cert_file" env:"TLS_CERT_FILE"`
+	TlsKeyFile      string        `key:"tls_key_file" env:"TLS_KEY_FILE"`
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For names the client, for
+	// the audit log and the rate limit. Empty trusts none and takes the peer address.
+	TrustedProxies []string `key:"trusted_proxies" env:"SERVER_TRUSTED_PROXIES" help:"proxy addresses or CIDRs trusted with X-Forwarded-For"`
+}
+
+// DbConfig selects the database. Postgres and MySQL are reached with the host settings
+// or a complete Dsn in the driver's own syntax, which then replaces all of them; a MySQL
+// Dsn needs parseTime=true. SQLite opens the file named by Name. SQLite stores times as
+// text in the server's time zone and compares them as text, so run it with a fixed TZ
+// such as UTC.
+type DbConfig struct {
+	Driver string `key:"driver" env:"DB_DRIVER" default:"postgres" help:"postgres, mysql or sqlite"`
+	Dsn    string `key:"dsn" env:"DB_DSN,DATABASE_URL" secret:"true" help:"driver DSN, replaces the host settings"`
+	// DB_URL is the historical name of the host variable.
+	Host     string `key:"host" env:"DB_HOST,DB_URL"`
+	Port     string `key:"port" env:"DB_PORT" help:"default 5432 for postgres, 3306 for mysql"`
+	User     string `key:"user" env:"DB_USER"`
+	Password string `key:"password" env:"DB_PASS,DB_PASSWORD" secret:"true"`
+	Name     string `key:"name" env:"DB_NAME" help:"database name, or the file for sqlite"`
+	// SslMode takes the Postgres sslmode values, MySQL maps them: disable, prefer,
+	// require (encrypted, unverified) and verify-ca or verify-full (verified).
+	SslMode     string `key:"sslmode" env:"DB_SSLMODE" default:"disable"`
+	TlsCaFile   string `key:"tls_ca_file" env:"DB_TLS_CA_FILE" help:"CA bundle verifying the server"`
+	TlsCertFile string `key:"tls_cert_file" env:"DB_TLS_CERT_FILE" help:"client certificate"`
+	TlsKeyFile  string `key:"tls_key_file" env:"DB_TLS_KEY_FILE" help:"client certificate key"`
+	TimeZone    string `key:"timezone" env:"DB_TIMEZONE" default:"Asia/Shanghai"`
+	// MigrateOnStart applies pending migrations before serving. Without it the server
+	// refuses to start until `migrate up` has been run.
+	MigrateOnStart bool `key:"migrate_on_start" env:"DB_MIGRATE_ON_START" default:"false"`
+}
+
+type SmtpConfig struct {
+	Host string `key:"host" env:"SMTP_HOST" default:"smtp.mail.ru"`
+	// Port is dialled with implicit TLS.
+	Port string `key:"port" env:"SMTP_PORT" default:"465"`
+	// EMAIL and EMAIL_TOKEN are the historical names of the credentials.
+	User     string `key:"user" env:"SMTP_USER,EMAIL" required:"true"`
+	Password string `key:"password" env:"SMTP_PASSWORD,EMAIL_TOKEN" required:"true" secret:"true"`
+	From     string `key:"from" env:"SMTP_FROM" help:"sender address (default smtp.user)"`
+	// InsecureSkipVerify accepts any server certificate; only for test relays.
+	InsecureSkipVerify bool `key:"insecure_skip_verify" env:"SMTP_INSECURE_SKIP_VERIFY" default:"false"`
+}
+
+type JwtConfig struct {
+	AccessTtl  time.Duration `key:"access_ttl" env:"JWT_ACCESS_TTL" default:"1h"`
+	RefreshTtl time.Duration `key:"refresh_ttl" env:"JWT_REFRESH_TTL" default:"720h"`
+}
+
+// OtpConfig covers the emailed activation code and the password reset hash it is
+// traded for.
+type OtpConfig struct {
+	Length int           `key:"length" env:"OTP_LENGTH" default:"4"`
+	Ttl    time.Duration `key:"ttl" env:"OTP_TTL" default:"5m"`
+	// ResendInterval is how long a new code cannot be requested after the last one.
+	ResendInterval time.Duration `key:"resend_interval" env:"OTP_RESEND_INTERVAL" default:"5m"`
+	Attempts       int           `key:"attempts" env:"OTP_ATTEMPTS" default:"3"`
+	ResetTtl       time.Duration `key:"reset_ttl" env:"OTP_RESET_TTL" default:"5m"`
+	ResetAttempts  int           `key:"reset_attempts" env:"OTP_RESET_ATTEMPTS" default:"3"`
+}
+
+// RateLimitConfig limits the unauthenticated auth endpoints (sign-in, sign-up,
+// activation, resend and reset) to Requests per Window for each client address.
+type RateLimitConfig struct {
+	Enabled  bool          `key:"enabled" env:"RATE_LIMIT_ENABLED" default:"true"`
+	Requests int           `key:"requests" env:"RATE_LIMIT_REQUESTS" default:"30"`
+	Window   time.Duration `key:"window" env:"RATE_LIMIT_WINDOW" default:"1m"`
+}
+
+// KeysConfig holds the keyrings as "kid:secret" lists, current key first; see
+// security.Keyring. Each is rotated on its own: JWT keys sign access, refresh and
+// invitation tokens, the pepper keys the password hashes, OTP keys the activation
+// codes and reset hashes at rest and audit keys the hash chain of the audit log, whose
+// retired keys must be kept for as long as the events they hashed. The parsed rings are
+// set by Load.
+type KeysConfig struct {
+	JwtKeys    []string `key:"jwt" env:"JWT_KEYS" secret:"true" help:"token signing keys as kid:secret, current first (default legacy:<secret_key>)"`
+	PepperKeys []string `key:"pepper" env:"PASSWORD_PEPPER_KEYS" secret:"true" help:"password pepper keys as kid:secret, current first (default legacy:<secret_key>)"`
+	OtpKeys    []string `key:"otp" env:"OTP_KEYS" secret:"true" help:"OTP and reset hash keys as kid:secret, current first (default legacy:<secret_key>)"`
+	AuditKeys  []string `key:"audit" env:"AUDIT_KEYS" secret:"true" help:"audit log chain keys as kid:secret, current first (default legacy:<secret_key>)"`
+
+	Jwt    *security.Keyring
+	Pepper *security.Keyring
+	Otp    *security.Keyring
+	Audit  *security.Keyring
+}
+
+// HealthConfig tunes /readyz. Results are reused for CacheTtl so frequent probes do
+// not reach the database and the mail relay every time.
+type HealthConfig struct {
+	CacheTtl     time.Duration `key:"cache_ttl" env:"HEALTH_CACHE_TTL" default:"5s"`
+	CheckTimeout time.Duration `key:"check_timeout" env:"HEALTH_CHECK_TIMEOUT" default:"2s"`
+	// CheckMailer adds the mail relay to the checks; it only warns, as sign-in works
+	// without mail.
+	CheckMailer bool `key:"check_mailer" env:"HEALTH_CHECK_MAILER" default:"true"`
+}
+
+type CorsConfig struct {
+	// AllowedOrigins of "*" allows any origin.
+	AllowedOrigins []string `key:"allowed_origins" env:"CORS_ALLOWED_ORIGINS" default:"*"`
+}
+
+// OpenApiConfig covers the API documentation. The OpenAPI document at /api/openapi.json
+// is always served; SwaggerUi adds a page at /api/docs that browses it with the Swagger
+// UI files found under SwaggerUiAssets, a CDN by default or a copy of swagger-ui-dist
+// served elsewhere.
+type OpenApiConfig struct {
+	SwaggerUi       bool   `key:"swagger_ui" env:"OPENAPI_SWAGGER_UI" default:"false"`
+	SwaggerUiAssets string `key:"swagger_ui_assets" env:"OPENAPI_SWAGGER_UI_ASSETS" default:"https://unpkg.com/swagger-ui-dist@5" help:"base URL of the swagger-ui-dist files"`
 }
 
+// NewAppConfig loads the configuration from the defaults, the configuration file named
+// by CONFIG_FILE and the environment, without command line flags.
 func NewAppConfig() (*AppConfig, error) {
-	var functionName string = "NewAppConfig"
+	loader := RegisterFlags(flag.NewFlagSet("config", flag.ContinueOnError))
+	return loader.Load()
+}
 
-	err := godotenv.Load()
-	if err != nil {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %v", moduleName, functionName, err)
+// finalize fills the defaults that depend on other settings and normalizes values.
+func (appConfig *AppConfig) finalize(sources map[string]string) {
+	derived := func(path string, target *string, value string) {
+		if *target == "" {
+			*target = value
+			sources[path] = "derived"
+		}
 	}
-
-	webPort := os.Getenv("WEB_PORT")
-	dbPort := os.Getenv("DB_PORT")
-	dbUrl := os.Getenv("DB_URL")
-	dbUser := os.Getenv("DB_USER")
-	dbPass := os.Getenv("DB_PASS")
-	dbName := os.Getenv("DB_NAME")
-	secretKey := os.Getenv("SECRET_KEY")
-	email := os.Getenv("EMAIL")
-	emailToken := os.Getenv("EMAIL_TOKEN")
-	if webPort == "" {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %s not exists", moduleName, functionName, "WEB_PORT")
+	derived("public_url", &appConfig.PublicUrl, fmt.Sprintf("http://localhost:%s", appConfig.WebPort))
+	derived("invitation_url", &appConfig.InvitationUrl, appConfig.PublicUrl+"/invite")
+	derived("device_verification_url", &appConfig.DeviceVerificationUrl, appConfig.PublicUrl+"/api/v1/oauth/device")
+	derived("smtp.from", &appConfig.Smtp.From, appConfig.Smtp.User)
+	switch appConfig.Db.Driver {
+	case "postgres":
+		derived("db.port", &appConfig.Db.Port, "5432")
+	case "mysql":
+		derived("db.port", &appConfig.Db.Port, "3306")
 	}
-	if dbPort == "" {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %s not exists", moduleName, functionName, "DB_PORT")
+	derivedKeys := func(path string, target *[]string) {
+		if len(*target) == 0 && appConfig.SecretKey != "" {
+			*target = []string{security.LegacyKeyId + ":" + appConfig.SecretKey}
+			sources[path] = "derived"
+		}
 	}
-	if dbUrl == "" {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %s not exists", moduleName, functionName, "DB_URL")
+	derivedKeys("keys.jwt", &appConfig.Keys.JwtKeys)
+	derivedKeys("keys.pepper", &appConfig.Keys.PepperKeys)
+	derivedKeys("keys.otp", &appConfig.Keys.OtpKeys)
+	derivedKeys("keys.audit", &appConfig.Keys.AuditKeys)
+
+	allowedDomains := []string{}
+	for _, allowedDomain := range appConfig.RegistrationAllowedDomains {
+		allowedDomain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(allowedDomain), "@"))
+		if allowedDomain != "" {
+			allowedDomains = append(allowedDomains, allowedDomain)
+		}
+	}
+	appConfig.RegistrationAllowedDomains = allowedDomains
+}
+
+// validate checks the settings against each other, parses the keyrings and returns
+// every problem found.
+func (appConfig *AppConfig) validate() []error {
+	var errs []error
+	check := func(ok bool, path, message string) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", path, message))
+		}
 	}
-	if dbUser == "" {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %s not exists", moduleName, functionName, "DB_USER")
+	check(appConfig.AccountDeletionMode == "anonymize" || appConfig.AccountDeletionMode == "delete",
+		"account_deletion_mode", "must be anonymize or delete")
+	check(appConfig.RegistrationMode == "open" || appConfig.RegistrationMode == "invite-only" || appConfig.RegistrationMode == "domain-allowlist",
+		"registration_mode", "must be open, invite-only or domain-allowlist")
+	check(appConfig.RegistrationMode != "domain-allowlist" || len(appConfig.RegistrationAllowedDomains) > 0,
+		"registration_allowed_domains", "is required for domain-allowlist registration")
+	check(appConfig.PasswordMinLength >= 1, "password_min_length", "must be at least 1")
+	check(appConfig.PasswordMaxLength >= appConfig.PasswordMinLength, "password_max_length", "must not be below password_min_length")
+	check(appConfig.PasswordHistorySize >= 0, "password_history_size", "must not be negative")
+	check(appConfig.PasswordMaxAge >= 0, "password_max_age", "must not be negative")
+	check(appConfig.WebhookMaxAttempts >= 1, "webhook_max_attempts", "must be at least 1")
+	check(appConfig.Otp.Length >= 4 && appConfig.Otp.Length <= 12, "otp.length", "must be between 4 and 12")
+	check(appConfig.Otp.Attempts >= 1, "otp.attempts", "must be at least 1")
+	check(appConfig.Otp.ResetAttempts >= 1, "otp.reset_attempts", "must be at least 1")
+	check(!appConfig.RateLimit.Enabled || appConfig.RateLimit.Requests >= 1, "rate_limit.requests", "must be at least 1")
+	check((appConfig.Server.TlsCertFile == "") == (appConfig.Server.TlsKeyFile == ""), "server.tls_key_file", "must be set together with server.tls_cert_file")
+	check(appConfig.Db.Driver == "postgres" || appConfig.Db.Driver == "mysql" || appConfig.Db.Driver == "sqlite",
+		"db.driver", "must be postgres, mysql or sqlite")
+	if appConfig.Db.Driver == "sqlite" {
+		check(appConfig.Db.Name != "" || appConfig.Db.Dsn != "", "db.name", "is required, the database file")
+	} else if appConfig.Db.Dsn == "" {
+		check(appConfig.Db.Host != "", "db.host", "is required unless db.dsn is set")
+		check(appConfig.Db.User != "", "db.user", "is required unless db.dsn is set")
+		check(appConfig.Db.Name != "", "db.name", "is required unless db.dsn is set")
 	}
-	if dbPass == "" {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %s not exists", moduleName, functionName, "DB_PASS")
+	check(appConfig.Db.Driver != "mysql" || appConfig.Db.SslMode == "disable" || appConfig.Db.SslMode == "prefer" ||
+		appConfig.Db.SslMode == "require" || appConfig.Db.SslMode == "verify-ca" || appConfig.Db.SslMode == "verify-full",
+		"db.sslmode", "must be disable, prefer, require, verify-ca or verify-full for mysql")
+	check((appConfig.Db.TlsCertFile == "") == (appConfig.Db.TlsKeyFile == ""), "db.tls_key_file", "must be set together with db.tls_cert_file")
+	check(appConfig.EventsPgNotifyChannel == "" || appConfig.Db.Driver == "postgres", "events_pg_notify_channel", "needs the postgres driver")
+	check(appConfig.Health.CacheTtl >= 0, "health.cache_ttl", "must not be negative")
+	check(appConfig.Server.MaxHeaderBytes >= 1024, "server.max_header_bytes", "must be at least 1024")
+	check(appConfig.Server.MaxBodyBytes >= 1024, "server.max_body_bytes", "must be at least 1024")
+	check(!appConfig.OpenApi.SwaggerUi || appConfig.OpenApi.SwaggerUiAssets != "", "openapi.swagger_ui_assets", "is required for the Swagger UI")
+	for _, proxy := range appConfig.Server.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		check(cidrErr == nil || net.ParseIP(proxy) != nil, "server.trusted_proxies", fmt.Sprintf("%q is no address or CIDR", proxy))
 	}
-	if dbName == "" {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %s not exists", moduleName, functionName, "DB_NAME")
+	keyrings := []struct {
+		path    string
+		entries []string
+		target  **security.Keyring
+	}{
+		{"keys.jwt", appConfig.Keys.JwtKeys, &appConfig.Keys.Jwt},
+		{"keys.pepper", appConfig.Keys.PepperKeys, &appConfig.Keys.Pepper},
+		{"keys.otp", appConfig.Keys.OtpKeys, &appConfig.Keys.Otp},
+		{"keys.audit", appConfig.Keys.AuditKeys, &appConfig.Keys.Audit},
 	}
-	if secretKey == "" {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %s not exists", moduleName, functionName, "SECRET_KEY")
+	for _, keyring := range keyrings {
+		if len(keyring.entries) == 0 {
+			errs = append(errs, fmt.Errorf("%s: required, set it or secret_key", keyring.path))
+			continue
+		}
+		parsed, err := security.NewKeyring(keyring.entries)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", keyring.path, err))
+			continue
+		}
+		*keyring.target = parsed
 	}
-	if email == "" {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %s not exists", moduleName, functionName, "EMAIL")
+	positive := []struct {
+		path     string
+		duration time.Duration
+	}{
+		{"introspection_cache_ttl", appConfig.IntrospectionCacheTtl},
+		{"denylist_sync_interval", appConfig.DenylistSyncInterval},
+		{"account_deletion_grace_period", appConfig.AccountDeletionGracePeriod},
+		{"account_purge_interval", appConfig.AccountPurgeInterval},
+		{"invitation_ttl", appConfig.InvitationTtl},
+		{"webhook_poll_interval", appConfig.WebhookPollInterval},
+		{"webhook_timeout", appConfig.WebhookTimeout},
+		{"jwt.access_ttl", appConfig.Jwt.AccessTtl},
+		{"jwt.refresh_ttl", appConfig.Jwt.RefreshTtl},
+		{"otp.ttl", appConfig.Otp.Ttl},
+		{"otp.resend_interval", appConfig.Otp.ResendInterval},
+		{"otp.reset_ttl", appConfig.Otp.ResetTtl},
+		{"rate_limit.window", appConfig.RateLimit.Window},
+		{"server.read_header_timeout", appConfig.Server.ReadHeaderTimeout},
+		{"server.read_timeout", appConfig.Server.ReadTimeout},
+		{"server.write_timeout", appConfig.Server.WriteTimeout},
+		{"server.idle_timeout", appConfig.Server.IdleTimeout},
+		{"server.shutdown_timeout", appConfig.Server.ShutdownTimeout},
+		{"health.check_timeout", appConfig.Health.CheckTimeout},
 	}
-	if emailToken == "" {
-		return &AppConfig{}, fmt.Errorf("%s.%s:ERROR: %s not exists", moduleName, functionName, "EMAIL_TOKEN")
+	for _, setting := range positive {
+		check(setting.duration > 0, setting.path, "must be positive")
 	}
-	return &AppConfig{
-		WebPort:    webPort,
-		DbUrl:      dbUrl,
-		DbUser:     dbUser,
-		DbPass:     dbPass,
-		DbName:     dbName,
-		DbPort:     dbPort,
-		SecretKey:  secretKey,
-		EmailToken: emailToken,
-		Email:      email,
-	}, nil
+	return errs
 }
@@ -0,0 +1,353 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setting is one leaf of AppConfig, described by its struct tags.
+type setting struct {
+	path     string
+	env      []string
+	def      string
+	secret   bool
+	required bool
+	help     string
+	value    reflect.Value
+}
+
+// settings lists the leaves of the struct in declaration order; a struct field with a
+// key tag is a section whose leaves are prefixed with that key.
+func settings(value reflect.Value, prefix string) []setting {
+	var result []setting
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		key := field.Tag.Get("key")
+		if key == "" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			result = append(result, settings(value.Field(i), prefix+key+".")...)
+			continue
+		}
+		var env []string
+		if tag := field.Tag.Get("env"); tag != "" {
+			env = strings.Split(tag, ",")
+		}
+		result = append(result, setting{
+			path:     prefix + key,
+			env:      env,
+			def:      field.Tag.Get("default"),
+			secret:   field.Tag.Get("secret") == "true",
+			required: field.Tag.Get("required") == "true",
+			help:     field.Tag.Get("help"),
+			value:    value.Field(i),
+		})
+	}
+	return result
+}
+
+// Loader reads an AppConfig. Its flags are registered on a caller owned FlagSet, so
+// that commands can add their own flags next to them; Load is called after the set
+// has been parsed.
+type Loader struct {
+	flags      *flag.FlagSet
+	configFile *string
+	flagValues map[string]*string
+	sources    map[string]string
+}
+
+// RegisterFlags adds --config and one --<path> flag per setting, e.g. --db.host.
+func RegisterFlags(flags *flag.FlagSet) *Loader {
+	loader := &Loader{
+		flags:      flags,
+		flagValues: map[string]*string{},
+		sources:    map[string]string{},
+	}
+	loader.configFile = flags.String("config", "", "YAML or TOML configuration file (or CONFIG_FILE)")
+	for _, setting := range settings(reflect.ValueOf(&AppConfig{}).Elem(), "") {
+		usage := setting.help
+		if len(setting.env) > 0 {
+			usage = strings.TrimSpace(usage + " [" + strings.Join(setting.env, ", ") + "]")
+		}
+		loader.flagValues[setting.path] = flags.String(setting.path, "", usage)
+	}
+	return loader
+}
+
+// Sources tells, for every setting, which layer its value came from; it is filled by
+// Load.
+func (loader *Loader) Sources() map[string]string {
+	return loader.sources
+}
+
+// Load layers the configuration and validates it. All problems are reported together
+// rather than one per run.
+func (loader *Loader) Load() (*AppConfig, error) {
+	var functionName string = "Load"
+	var errs []error
+
+	// A .env file is a convenience for local runs; containers pass real variables.
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, fmt.Errorf(".env: %v", err))
+	}
+
+	setFlags := map[string]bool{}
+	loader.flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	path := *loader.configFile
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	var file map[string]interface{}
+	if path != "" {
+		var err error
+		file, err = readConfigFile(path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	appConfig := &AppConfig{}
+	all := settings(reflect.ValueOf(appConfig).Elem(), "")
+	for _, setting := range all {
+		raw, source, err := loader.lookup(setting, file, path, setFlags)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", setting.path, err))
+			continue
+		}
+		loader.sources[setting.path] = source
+		if raw == "" {
+			if setting.required {
+				errs = append(errs, fmt.Errorf("%s: required, set %s", setting.path, describe(setting)))
+			}
+			continue
+		}
+		if err := parseValue(setting.value, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): %v", setting.path, source, err))
+		}
+	}
+	errs = append(errs, unknownKeys(file, "", all)...)
+
+	if len(errs) == 0 {
+		appConfig.finalize(loader.sources)
+		errs = appConfig.validate()
+	}
+	if len(errs) > 0 {
+		return appConfig, fmt.Errorf("%s.%s:ERROR: invalid configuration:\n%w", moduleName, functionName, errors.Join(errs...))
+	}
+	return appConfig, nil
+}
+
+// lookup finds the raw value of a setting in the highest layer that has one.
+func (loader *Loader) lookup(setting setting, file map[string]interface{}, path string, setFlags map[string]bool) (string, string, error) {
+	if setFlags[setting.path] {
+		return *loader.flagValues[setting.path], "flag --" + setting.path, nil
+	}
+	for _, name := range setting.env {
+		value, fromFile := os.Getenv(name), os.Getenv(name+"_FILE")
+		if value != "" && fromFile != "" {
+			return "", "", fmt.Errorf("both %s and %s_FILE are set", name, name)
+		}
+		if value != "" {
+			return value, "env " + name, nil
+		}
+		if fromFile != "" {
+			content, err := os.ReadFile(fromFile)
+			if err != nil {
+				return "", "", fmt.Errorf("%s_FILE: %v", name, err)
+			}
+			return strings.TrimRight(string(content), "\r\n"), "env " + name + "_FILE", nil
+		}
+	}
+	if value, found := lookupFile(file, setting.path); found {
+		raw, err := rawValue(value)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: %v", path, err)
+		}
+		return raw, "file " + path, nil
+	}
+	return setting.def, "default", nil
+}
+
+// Changed lists the settings whose values differ between two configurations, e.g. to
+// tell which parts of a reloaded configuration only apply after a restart.
+func Changed(previous, next *AppConfig) []string {
+	previousSettings := settings(reflect.ValueOf(previous).Elem(), "")
+	nextSettings := settings(reflect.ValueOf(next).Elem(), "")
+	var changed []string
+	for i, setting := range previousSettings {
+		if !reflect.DeepEqual(setting.value.Interface(), nextSettings[i].value.Interface()) {
+			changed = append(changed, setting.path)
+		}
+	}
+	return changed
+}
+
+func describe(setting setting) string {
+	if len(setting.env) == 0 {
+		return "--" + setting.path
+	}
+	return setting.env[0] + " or --" + setting.path
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(content, &file)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &file)
+	default:
+		return nil, fmt.Errorf("%s: unknown format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return file, nil
+}
+
+func lookupFile(file map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = file
+	for _, key := range strings.Split(path, ".") {
+		section, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = section[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// rawValue turns a decoded file value into the string form the environment uses.
+func rawValue(value interface{}) (string, error) {
+	switch typed := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return typed, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(typed), nil
+	case []interface{}:
+		items := make([]string, 0, len(typed))
+		for _, item := range typed {
+			raw, err := rawValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, raw)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			raw, err := rawValue(typed[key])
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, key+":"+raw)
+		}
+		return strings.Join(pairs, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+// unknownKeys reports file keys that match no setting, which are most likely typos.
+func unknownKeys(file map[string]interface{}, prefix string, all []setting) []error {
+	var errs []error
+	for key, value := range file {
+		path := prefix + key
+		known, section := false, false
+		for _, setting := range all {
+			known = known || setting.path == path
+			section = section || strings.HasPrefix(setting.path, path+".")
+		}
+		nested, isMap := value.(map[string]interface{})
+		switch {
+		case known:
+		case section && isMap:
+			errs = append(errs, unknownKeys(nested, path+".", all)...)
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown setting", path))
+		}
+	}
+	return errs
+}
+
+func parseValue(value reflect.Value, raw string) error {
+	switch {
+	case value.Type() == durationType:
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(duration))
+	case value.Kind() == reflect.String:
+		value.SetString(raw)
+	case value.Kind() == reflect.Int:
+		number, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(number))
+	case value.Kind() == reflect.Bool:
+		flag, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(flag)
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String:
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	case value.Kind() == reflect.Map && value.Type().Elem().Kind() == reflect.String:
+		pairs := map[string]string{}
+		for _, pair := range strings.Split(raw, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			key, item, found := strings.Cut(strings.TrimSpace(pair), ":")
+			if !found || key == "" || item == "" {
+				return fmt.Errorf("malformed, expected key:value pairs")
+			}
+			pairs[key] = item
+		}
+		value.Set(reflect.ValueOf(pairs))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
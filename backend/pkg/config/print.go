@@ -0,0 +1,80 @@
+package config
+
+import (
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redactedValue = "<redacted>"
+
+// Print writes the effective configuration as YAML, usable as a configuration file,
+// with the layer every value came from as a comment. With redacted set, secrets are
+// replaced by a placeholder; map secrets keep their keys.
+func Print(w io.Writer, appConfig *AppConfig, sources map[string]string, redacted bool) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	sections := map[string]*yaml.Node{"": root}
+	for _, setting := range settings(reflect.ValueOf(appConfig).Elem(), "") {
+		parent := ""
+		key := setting.path
+		if dot := strings.LastIndex(setting.path, "."); dot >= 0 {
+			parent, key = setting.path[:dot], setting.path[dot+1:]
+		}
+		section, found := sections[parent]
+		if !found {
+			section = &yaml.Node{Kind: yaml.MappingNode}
+			sections[parent] = section
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: parent}, section)
+		}
+		node := valueNode(setting.value, setting.secret && redacted)
+		node.LineComment = sources[setting.path]
+		section.Content = append(section.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, node)
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func valueNode(value reflect.Value, redact bool) *yaml.Node {
+	scalar := func(text, tag string) *yaml.Node {
+		if redact && text != "" {
+			text, tag = redactedValue, "!!str"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: text, Tag: tag}
+	}
+	switch {
+	case value.Type() == durationType:
+		return scalar(time.Duration(value.Int()).String(), "!!str")
+	case value.Kind() == reflect.Int:
+		return scalar(strconv.FormatInt(value.Int(), 10), "!!int")
+	case value.Kind() == reflect.Bool:
+		return scalar(strconv.FormatBool(value.Bool()), "!!bool")
+	case value.Kind() == reflect.Slice:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for i := 0; i < value.Len(); i++ {
+			node.Content = append(node.Content, scalar(value.Index(i).String(), "!!str"))
+		}
+		return node
+	case value.Kind() == reflect.Map:
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		keys := make([]string, 0, value.Len())
+		for _, key := range value.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			item := value.MapIndex(reflect.ValueOf(key)).String()
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, scalar(item, "!!str"))
+		}
+		return node
+	}
+	return scalar(value.String(), "!!str")
+}
@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// ApiKeyPrefix starts every API key, which tells keys apart from JWTs at a glance.
+	ApiKeyPrefix = "hk_"
+	// ApiKeyTokenType is the token_type introspection reports for API keys.
+	ApiKeyTokenType = "api_key"
+)
+
+// ApiKey is a long-lived credential a user hands to a script or a service. Only the
+// SHA-256 of the key is stored; the key itself is shown once, when it is created, and
+// Prefix keeps enough of it for the user to recognise it in a list.
+type ApiKey struct {
+	gorm.Model
+	UserId     uint       `json:"-" gorm:"not null;index"`
+	Name       string     `json:"name" gorm:"not null"`
+	Prefix     string     `json:"prefix" gorm:"not null"`
+	Hash       string     `json:"-" gorm:"not null;uniqueIndex"`
+	Scope      string     `json:"scope"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// Expired tells whether the key has an expiry and it has passed.
+func (apiKey *ApiKey) Expired(now time.Time) bool {
+	return apiKey.ExpiresAt != nil && !apiKey.ExpiresAt.After(now)
+}
+
+// SessionId names the key the way a session id names a token pair, so cached
+// introspection responses can be dropped when the key is deleted.
+func (apiKey *ApiKey) SessionId() string {
+	return "api_key:" + strconv.FormatUint(uint64(apiKey.ID), 10)
+}
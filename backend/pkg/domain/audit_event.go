@@ -0,0 +1,129 @@
+package domain
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+const (
+	AuditSignIn              = "auth.sign_in"
+	AuditSignUp              = "auth.sign_up"
+	AuditActivate            = "auth.activate"
+	AuditPasswordResetCode   = "auth.password_reset_code"
+	AuditPasswordReset       = "auth.password_reset"
+	AuditLogout              = "auth.logout"
+	AuditProfileUpdate       = "user.profile_update"
+	AuditPasswordChange      = "user.password_change"
+	AuditEmailChangeRequest  = "user.email_change_request"
+	AuditEmailChangeConfirm  = "user.email_change_confirm"
+	AuditEmailChangeCancel   = "user.email_change_cancel"
+	AuditAccountExport       = "user.export"
+	AuditAccountDelete       = "user.delete"
+	AuditApiKeyCreate        = "user.api_key_create"
+	AuditApiKeyDelete        = "user.api_key_delete"
+	AuditOrgCreate           = "org.create"
+	AuditOrgMemberAdd        = "org.member_add"
+	AuditOrgMemberRoleChange = "org.member_role_change"
+	AuditOrgMemberRemove     = "org.member_remove"
+	AuditOrgInvite           = "org.invite"
+	AuditOrgInviteRevoke     = "org.invite_revoke"
+	AuditOrgInviteAccept     = "org.invite_accept"
+	AuditDeviceApprove       = "oauth.device_approve"
+	AuditDeviceDeny          = "oauth.device_deny"
+	AuditTokenRevoke         = "oauth.token_revoke"
+	AuditWebhookCreate       = "webhook.create"
+	AuditWebhookUpdate       = "webhook.update"
+	AuditWebhookDelete       = "webhook.delete"
+	AuditWebhookReplay       = "webhook.replay"
+	// The admin commands act with ActorId 0 and "cli" as the user agent.
+	AuditAdminUserCreate     = "admin.user_create"
+	AuditAdminUserDeactivate = "admin.user_deactivate"
+	AuditAdminUserRestore    = "admin.user_restore"
+	AuditAdminLogoutAll      = "admin.logout_all"
+	AuditAdminOutboxRetry    = "admin.outbox_retry"
+)
+
+// AuditEvent is one entry of the append-only security log. ActorId is who acted and
+// SubjectId the account acted upon, 0 where unknown (e.g. a sign-in for an unknown
+// email). Every event carries the hash of its predecessor, so editing or deleting a row
+// breaks the chain from that row on.
+type AuditEvent struct {
+	ID        uint              `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time         `json:"createdAt" gorm:"not null;index"`
+	ActorId   uint              `json:"actorId" gorm:"index"`
+	SubjectId uint              `json:"subjectId" gorm:"index"`
+	Action    string            `json:"action" gorm:"not null;index"`
+	Outcome   string            `json:"outcome" gorm:"not null"`
+	Ip        string            `json:"ip"`
+	UserAgent string            `json:"userAgent"`
+	RequestId string            `json:"requestId"`
+	Metadata  map[string]string `json:"metadata,omitempty" gorm:"serializer:json"`
+	PrevHash  string            `json:"prevHash" gorm:"not null"`
+	Hash      string            `json:"hash" gorm:"not null;uniqueIndex"`
+}
+
+// HashMessage is the event content together with PrevHash, as it is hashed into the
+// chain with an HMAC under the audit keyring: without the key, whoever can write the
+// table cannot compute a hash that passes verification. CreatedAt has to be in UTC and
+// cut to microseconds, the precision the database keeps, to hash the same before and
+// after a round trip.
+func (event *AuditEvent) HashMessage() string {
+	metadata, _ := json.Marshal(event.Metadata)
+	fields := []string{
+		event.PrevHash,
+		strconv.FormatUint(uint64(event.ID), 10),
+		event.CreatedAt.UTC().Format(time.RFC3339Nano),
+		strconv.FormatUint(uint64(event.ActorId), 10),
+		strconv.FormatUint(uint64(event.SubjectId), 10),
+		event.Action,
+		event.Outcome,
+		event.Ip,
+		event.UserAgent,
+		event.RequestId,
+		string(metadata),
+	}
+	var message strings.Builder
+	for _, field := range fields {
+		// Length prefixes keep ("ab", "c") and ("a", "bc") apart.
+		message.WriteString(strconv.Itoa(len(field)) + ":" + field + ";")
+	}
+	return message.String()
+}
+
+// AuditChainHead points at the newest event. Appending locks this single row, which
+// keeps concurrent writers, in this or another process, from forking the chain.
+type AuditChainHead struct {
+	ID          uint `gorm:"primarykey"`
+	LastEventId uint
+	Hash        string
+}
+
+// AuditFilter selects audit events. Zero fields do not filter; UserId matches events
+// with the user as either actor or subject. Results are newest first, continuing below
+// BeforeId when it is set.
+type AuditFilter struct {
+	ActorId   uint
+	SubjectId uint
+	UserId    uint
+	Action    string
+	Outcome   string
+	Since     time.Time
+	Until     time.Time
+	BeforeId  uint
+	Limit     int
+}
+
+// AuditVerification is the result of walking the chain.
+type AuditVerification struct {
+	Valid    bool   `json:"valid"`
+	Checked  int    `json:"checked"`
+	BrokenAt uint   `json:"brokenAt,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
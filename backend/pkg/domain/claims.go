@@ -2,8 +2,38 @@ package domain
 
 import "github.com/golang-jwt/jwt/v5"
 
+const (
+	AccessTokenType  = "access_token"
+	RefreshTokenType = "refresh_token"
+	// AnyTokenType is expected by the endpoints that take either kind, introspection
+	// and revocation.
+	AnyTokenType = ""
+
+	// PasswordChangeScope marks the restricted access token handed out on sign-in when
+	// the password has expired; it is only accepted by the change-password endpoint.
+	PasswordChangeScope = "password_change"
+)
+
 type Claims struct {
-	UserId  uint `json:"user_id"`
-	Version uint `json:"version"`
+	UserId    uint   `json:"user_id"`
+	Version   uint   `json:"version"`
+	TokenType string `json:"token_type,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	// OrgId is the active organization the token acts in, 0 when none is selected.
+	OrgId uint `json:"org_id,omitempty"`
+	// SessionId is shared by the tokens of one sign-in, refreshed ones included, so the
+	// session can be revoked as a whole.
+	SessionId string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
+
+// TokenOptions carries the optional claims a token is issued with, e.g. the OAuth client
+// that requested it.
+type TokenOptions struct {
+	ClientId string
+	Scope    string
+	OrgId    uint
+	// SessionId continues a session; empty starts a new one.
+	SessionId string
+}
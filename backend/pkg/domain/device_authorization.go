@@ -0,0 +1,26 @@
+package domain
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
+)
+
+type DeviceAuthorization struct {
+	gorm.Model
+	DeviceCode   string    `json:"-" gorm:"not null;uniqueIndex"`
+	UserCode     string    `json:"userCode" gorm:"not null;index"`
+	ClientId     string    `json:"clientId" gorm:"not null"`
+	Scope        string    `json:"scope"`
+	Status       string    `json:"status" gorm:"not null;default:pending"`
+	UserId       uint      `json:"-"`
+	Interval     int       `json:"-"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	LastPolledAt time.Time `json:"-"`
+}
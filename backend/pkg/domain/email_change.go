@@ -0,0 +1,19 @@
+package domain
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// EmailChange is a pending change of User.Email. It is kept apart from the user so the
+// current address stays in effect until the new one is confirmed.
+type EmailChange struct {
+	gorm.Model
+	UserId       uint      `json:"-" gorm:"not null;index"`
+	NewEmail     string    `json:"newEmail" gorm:"not null"`
+	Code         string    `json:"-" gorm:"not null"`
+	CodeAttempts int       `json:"-" gorm:"default:0"`
+	CancelToken  string    `json:"-" gorm:"not null;uniqueIndex"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
@@ -0,0 +1,24 @@
+package domain
+
+import "time"
+
+const (
+	HealthOk = "ok"
+	// HealthWarn is a failed check that does not make the instance unready.
+	HealthWarn = "warn"
+	HealthFail = "fail"
+)
+
+type HealthCheck struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// HealthReport is the outcome of the readiness checks; Status is fail if any check
+// failed.
+type HealthReport struct {
+	Status    string                 `json:"status"`
+	CheckedAt time.Time              `json:"checkedAt"`
+	Checks    map[string]HealthCheck `json:"checks"`
+}
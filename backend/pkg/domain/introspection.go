@@ -0,0 +1,15 @@
+package domain
+
+// Introspection is the RFC 7662 introspection response. Everything but Active is omitted
+// for inactive tokens so nothing leaks about them.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Sub       string `json:"sub,omitempty"`
+	Username  string `json:"username,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	OrgId     uint   `json:"org_id,omitempty"`
+}
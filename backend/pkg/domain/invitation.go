@@ -0,0 +1,32 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+const InvitationTokenType = "invitation"
+
+// Invitation offers an organization role to an email address. The row backs the signed
+// invite token so that it can be used once and withdrawn before it expires.
+type Invitation struct {
+	gorm.Model
+	OrganizationId uint         `json:"organizationId" gorm:"not null;index"`
+	Email          string       `json:"email" gorm:"not null;index"`
+	Role           string       `json:"role" gorm:"not null"`
+	InvitedBy      uint         `json:"invitedBy" gorm:"index"`
+	ExpiresAt      time.Time    `json:"expiresAt"`
+	AcceptedAt     *time.Time   `json:"acceptedAt"`
+	AcceptedBy     *uint        `json:"acceptedBy" gorm:"index"`
+	Organization   Organization `json:"-"`
+}
+
+// InvitationClaims is the payload of an invite token.
+type InvitationClaims struct {
+	InvitationId uint   `json:"invitation_id"`
+	Email        string `json:"email"`
+	TokenType    string `json:"token_type"`
+	jwt.RegisteredClaims
+}
@@ -0,0 +1,38 @@
+package domain
+
+import "gorm.io/gorm"
+
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+var orgRoleRanks = map[string]int{
+	OrgRoleMember: 1,
+	OrgRoleAdmin:  2,
+	OrgRoleOwner:  3,
+}
+
+// OrgRoleRank orders organization roles, owner being the highest. Unknown roles rank 0,
+// below every real one.
+func OrgRoleRank(role string) int {
+	return orgRoleRanks[role]
+}
+
+// Organization is a customer tenant. Users stay global (one account per email) and are
+// tied to organizations through memberships.
+type Organization struct {
+	gorm.Model
+	Name string `json:"name" gorm:"not null"`
+}
+
+// Membership gives a user a role inside one organization.
+type Membership struct {
+	gorm.Model
+	OrganizationId uint         `json:"organizationId" gorm:"not null;uniqueIndex:idx_membership_org_user"`
+	UserId         uint         `json:"userId" gorm:"not null;uniqueIndex:idx_membership_org_user;index"`
+	Role           string       `json:"role" gorm:"not null"`
+	Organization   Organization `json:"-"`
+	User           User         `json:"-"`
+}
@@ -0,0 +1,12 @@
+package domain
+
+import "time"
+
+// PasswordHistory keeps a hash of every password a user has set, so old ones cannot be
+// reused. Only the newest PASSWORD_HISTORY_SIZE rows of a user are kept.
+type PasswordHistory struct {
+	ID        uint      `gorm:"primarykey"`
+	UserId    uint      `gorm:"not null;index"`
+	Password  string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,12 @@
+package domain
+
+import "time"
+
+// RevokedToken is a denylist entry. Jti is the id of a token, or the session id of a
+// whole session. It only has to outlive the tokens it revokes, so rows past ExpiresAt
+// are purged.
+type RevokedToken struct {
+	Jti       string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time `gorm:"index"`
+}
@@ -0,0 +1,18 @@
+package domain
+
+import "time"
+
+// Session is a sign-in: the token pairs issued under one session id, from the first
+// pair to the last refresh. It lets a user see where they are signed in; whether a token
+// is usable is still decided by the token, its JWTVersion and the denylist, so a
+// session only counts as active while its JWTVersion is the user's and it has not
+// expired.
+type Session struct {
+	Id          string    `json:"id" gorm:"primaryKey"`
+	UserId      uint      `json:"-" gorm:"not null;index"`
+	ClientId    string    `json:"clientId,omitempty"`
+	JWTVersion  uint      `json:"-"`
+	CreatedAt   time.Time `json:"createdAt"`
+	RefreshedAt time.Time `json:"refreshedAt"`
+	ExpiresAt   time.Time `json:"expiresAt" gorm:"not null;index"`
+}
@@ -6,11 +6,21 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	RoleUser      = "user"
+	RoleSuperuser = "superuser"
+
+	// AnonymizedEmailDomain is the reserved domain purged accounts get their email moved to.
+	AnonymizedEmailDomain = "anonymized.invalid"
+)
+
 type User struct {
 	gorm.Model
 	Email              string    `json:"email" gorm:"not null"`
 	Password           string    `json:"-" gorm:"not null"`
 	Fullname           string    `json:"fullname" gorm:"not null"`
+	Locale             string    `json:"locale"`
+	Timezone           string    `json:"timezone"`
 	IsSuperuser        bool      `json:"isSuperuser" gorm:"default:false"`
 	OTP                string    `json:"-"`
 	OTPAttempts        int       `json:"-" gorm:"default:0"`
@@ -18,6 +28,7 @@ type User struct {
 	ResetHash          string    `json:"-"`
 	HashAttempts       int       `json:"-" gorm:"default:0"`
 	ResetHashSpawnedAt time.Time `json:"-"`
+	PasswordChangedAt  time.Time `json:"-"`
 	IsActive           bool      `json:"isActive" gorm:"default:false"`
 	JWTVersion         uint      `json:"jwtVersion" gorm:"default:0"`
 }
@@ -0,0 +1,16 @@
+package domain
+
+import "time"
+
+// UserExport is the archive handed out for a data subject access request: everything
+// the service stores about the user.
+type UserExport struct {
+	ExportedAt         time.Time    `json:"exportedAt"`
+	Profile            UserProfile  `json:"profile"`
+	IsSuperuser        bool         `json:"isSuperuser"`
+	PendingEmailChange *EmailChange `json:"pendingEmailChange"`
+	Sessions           []Session    `json:"sessions"`
+	// AuditEvents are the events with the user as actor or subject, which include the
+	// sign-in history.
+	AuditEvents []AuditEvent `json:"auditEvents"`
+}
@@ -0,0 +1,42 @@
+package domain
+
+import "time"
+
+// UserProfile is the public view of a User returned by the API; internal fields such as
+// JWTVersion or IsSuperuser never leave the service through it.
+type UserProfile struct {
+	Id        uint      `json:"id"`
+	Email     string    `json:"email"`
+	Fullname  string    `json:"fullname"`
+	Locale    string    `json:"locale"`
+	Timezone  string    `json:"timezone"`
+	IsActive  bool      `json:"isActive"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func NewUserProfile(user *User) UserProfile {
+	return UserProfile{
+		Id:        user.ID,
+		Email:     user.Email,
+		Fullname:  user.Fullname,
+		Locale:    user.Locale,
+		Timezone:  user.Timezone,
+		IsActive:  user.IsActive,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}
+}
+
+// ProfileUpdate holds the user editable fields; nil means "leave unchanged".
+type ProfileUpdate struct {
+	Fullname *string `json:"fullname"`
+	Locale   *string `json:"locale"`
+	Timezone *string `json:"timezone"`
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
@@ -0,0 +1,41 @@
+package domain
+
+import "strings"
+
+// FieldViolation is one broken rule on one input field. Code is stable for clients to
+// branch on; Message is for humans.
+type FieldViolation struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError reports every violation found in a request, keyed by JSON field name.
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func NewValidationError(violations ...FieldViolation) *ValidationError {
+	return &ValidationError{
+		Violations: violations,
+	}
+}
+
+func (validationError *ValidationError) Error() string {
+	messages := make([]string, 0, len(validationError.Violations))
+	for _, violation := range validationError.Violations {
+		messages = append(messages, violation.Field+": "+violation.Message)
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// Fields keeps the first message per field, for clients that show one error per input.
+func (validationError *ValidationError) Fields() map[string]string {
+	fields := map[string]string{}
+	for _, violation := range validationError.Violations {
+		if _, exists := fields[violation.Field]; !exists {
+			fields[violation.Field] = violation.Message
+		}
+	}
+	return fields
+}
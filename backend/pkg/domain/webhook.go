@@ -0,0 +1,77 @@
+package domain
+
+import (
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Lifecycle events sent to webhook subscribers. WebhookPing is only ever sent on demand
+// to a single subscription.
+const (
+	WebhookUserSignedUp     = "user.signed_up"
+	WebhookUserActivated    = "user.activated"
+	WebhookUserEmailChanged = "user.email_changed"
+	WebhookUserDeactivated  = "user.deactivated"
+	WebhookUserDeleted      = "user.deleted"
+	WebhookUserRestored     = "user.restored"
+	WebhookPing             = "ping"
+)
+
+var WebhookEventTypes = []string{
+	WebhookUserSignedUp,
+	WebhookUserActivated,
+	WebhookUserEmailChanged,
+	WebhookUserDeactivated,
+	WebhookUserDeleted,
+	WebhookUserRestored,
+}
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookSubscription is an endpoint that receives the events listed in Events, or
+// every event when Events is empty. Secret signs the deliveries and is shown only once,
+// when the subscription is created.
+type WebhookSubscription struct {
+	gorm.Model
+	Url         string   `json:"url" gorm:"not null"`
+	Secret      string   `json:"-" gorm:"not null"`
+	Events      []string `json:"events" gorm:"serializer:json"`
+	Description string   `json:"description"`
+	IsActive    bool     `json:"isActive"`
+}
+
+func (subscription *WebhookSubscription) Wants(eventType string) bool {
+	return len(subscription.Events) == 0 || slices.Contains(subscription.Events, eventType)
+}
+
+// WebhookDelivery is one event queued for one subscription; the table doubles as the
+// outbox the delivery worker drains and as the delivery log. Payload is the exact body
+// that is signed and sent, so a replay sends the same bytes again.
+type WebhookDelivery struct {
+	gorm.Model
+	SubscriptionId uint       `json:"subscriptionId" gorm:"not null;index"`
+	EventId        string     `json:"eventId" gorm:"not null;index"`
+	EventType      string     `json:"eventType" gorm:"not null"`
+	Payload        string     `json:"payload" gorm:"type:text"`
+	Status         string     `json:"status" gorm:"not null;index"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  time.Time  `json:"nextAttemptAt" gorm:"index"`
+	LastAttemptAt  *time.Time `json:"lastAttemptAt"`
+	LastStatusCode int        `json:"lastStatusCode"`
+	LastError      string     `json:"lastError"`
+	DeliveredAt    *time.Time `json:"deliveredAt"`
+}
+
+// WebhookEvent is the JSON body of a delivery.
+type WebhookEvent struct {
+	Id        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CreatedAt time.Time              `json:"created_at"`
+	Data      map[string]interface{} `json:"data"`
+}
@@ -0,0 +1,182 @@
+package events
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hitenok/pkg/domain"
+	"log"
+	"sync"
+	"time"
+)
+
+// Handler reacts to one event. A returned error is logged by the bus and, for a
+// synchronous handler, also returned from Publish.
+type Handler func(event Event) *domain.MyError
+
+// Envelope is what publishers forward: the event with an id and the time it happened.
+type Envelope struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       Event     `json:"data"`
+}
+
+// PublisherI forwards events outside the process, e.g. to a message broker. Publishers
+// receive every event, asynchronously, after the synchronous handlers have run.
+type PublisherI interface {
+	Publish(envelope Envelope) *domain.MyError
+}
+
+type EventBusI interface {
+	// Subscribe runs the handler inside Publish, before it returns, so the work is
+	// done by the time the publishing service carries on.
+	Subscribe(name string, handler Handler)
+	// SubscribeAsync runs the handler on its own goroutine, for side effects the
+	// publisher should not wait for, such as emails.
+	SubscribeAsync(name string, handler Handler)
+	AddPublisher(publisher PublisherI)
+	Publish(event Event) *domain.MyError
+	// Drain waits for the asynchronous handlers and publishers still running.
+	Drain()
+}
+
+type subscription struct {
+	handler Handler
+	async   bool
+}
+
+type eventBus struct {
+	mu            sync.RWMutex
+	subscriptions map[string][]subscription
+	publishers    []PublisherI
+	running       sync.WaitGroup
+}
+
+func NewEventBus() EventBusI {
+	return &eventBus{
+		subscriptions: map[string][]subscription{},
+	}
+}
+
+func (bus *eventBus) Subscribe(name string, handler Handler) {
+	bus.subscribe(name, handler, false)
+}
+
+func (bus *eventBus) SubscribeAsync(name string, handler Handler) {
+	bus.subscribe(name, handler, true)
+}
+
+func (bus *eventBus) subscribe(name string, handler Handler, async bool) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.subscriptions[name] = append(bus.subscriptions[name], subscription{
+		handler: handler,
+		async:   async,
+	})
+}
+
+func (bus *eventBus) AddPublisher(publisher PublisherI) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.publishers = append(bus.publishers, publisher)
+}
+
+// Publish hands the event to its subscribers in the order they subscribed. The
+// synchronous ones run first and their errors are joined into the result; a failing
+// handler does not stop the others. Callers for whom the event is only a notification
+// may ignore the result, the bus has already logged it.
+func (bus *eventBus) Publish(event Event) *domain.MyError {
+	name := event.EventName()
+	bus.mu.RLock()
+	subscriptions := bus.subscriptions[name]
+	publishers := bus.publishers
+	bus.mu.RUnlock()
+
+	var errs []error
+	for _, subscription := range subscriptions {
+		if subscription.async {
+			bus.goRun(name, func() *domain.MyError { return subscription.handler(event) })
+			continue
+		}
+		if err := bus.run(name, func() *domain.MyError { return subscription.handler(event) }); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", err.Module, err.ErrorBase))
+		}
+	}
+	if len(publishers) > 0 {
+		envelope, err := newEnvelope(event)
+		if err != nil {
+			log.Printf("eventBus.Publish.%s.%s: %v", name, err.Module, err.ErrorBase)
+		} else {
+			for _, publisher := range publishers {
+				bus.goRun(name, func() *domain.MyError { return publisher.Publish(envelope) })
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return domain.NewError(errors.Join(errs...), "eventBus.Publish."+name)
+	}
+	return nil
+}
+
+func (bus *eventBus) Drain() {
+	bus.running.Wait()
+}
+
+func (bus *eventBus) goRun(name string, fn func() *domain.MyError) {
+	bus.running.Add(1)
+	go func() {
+		defer bus.running.Done()
+		bus.run(name, fn)
+	}()
+}
+
+// run calls a handler, turning a panic into an error so that one broken subscriber
+// cannot take the publishing request, or the process, down with it.
+func (bus *eventBus) run(name string, fn func() *domain.MyError) (err *domain.MyError) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = domain.NewError(fmt.Errorf("panic: %v", recovered), "eventBus.run")
+		}
+		if err != nil {
+			log.Printf("eventBus.%s.%s: %v", name, err.Module, err.ErrorBase)
+		}
+	}()
+	return fn()
+}
+
+func newEnvelope(event Event) (Envelope, *domain.MyError) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Envelope{}, domain.NewError(err, "newEnvelope")
+	}
+	return Envelope{
+		Id:         hex.EncodeToString(id),
+		Name:       event.EventName(),
+		OccurredAt: time.Now().UTC(),
+		Data:       event,
+	}, nil
+}
+
+// On subscribes a handler typed to one event; the name is taken from the type.
+func On[T Event](bus EventBusI, handler func(event T) *domain.MyError) {
+	var zero T
+	bus.Subscribe(zero.EventName(), typed(handler))
+}
+
+// OnAsync is the asynchronous counterpart of On.
+func OnAsync[T Event](bus EventBusI, handler func(event T) *domain.MyError) {
+	var zero T
+	bus.SubscribeAsync(zero.EventName(), typed(handler))
+}
+
+func typed[T Event](handler func(event T) *domain.MyError) Handler {
+	return func(event Event) *domain.MyError {
+		typedEvent, ok := event.(T)
+		if !ok {
+			return domain.NewError(fmt.Errorf("unexpected event type %T", event), "events.typed")
+		}
+		return handler(typedEvent)
+	}
+}
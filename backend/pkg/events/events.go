@@ -0,0 +1,98 @@
+package events
+
+import "time"
+
+// Event is a fact about the domain published on the EventBus. Events carry ids and
+// the few fields subscribers need rather than whole models: they are handed to other
+// goroutines and, through publishers, to other processes.
+type Event interface {
+	EventName() string
+}
+
+type UserRegistered struct {
+	UserId uint   `json:"user_id"`
+	Email  string `json:"email"`
+	// Invited accounts are created already active and get no activation OTP.
+	Invited bool `json:"invited"`
+}
+
+func (UserRegistered) EventName() string { return "user.registered" }
+
+type UserActivated struct {
+	UserId uint   `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+func (UserActivated) EventName() string { return "user.activated" }
+
+type SignInSucceeded struct {
+	UserId uint   `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+func (SignInSucceeded) EventName() string { return "auth.sign_in_succeeded" }
+
+// SignInFailed has UserId 0 when the email matches no account.
+type SignInFailed struct {
+	UserId uint   `json:"user_id,omitempty"`
+	Email  string `json:"email"`
+	Reason string `json:"reason"`
+}
+
+func (SignInFailed) EventName() string { return "auth.sign_in_failed" }
+
+type PasswordReset struct {
+	UserId uint   `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+func (PasswordReset) EventName() string { return "user.password_reset" }
+
+// PasswordChanged is published when a signed-in user changes their password, which ends
+// their other sessions.
+type PasswordChanged struct {
+	UserId uint `json:"user_id"`
+}
+
+func (PasswordChanged) EventName() string { return "user.password_changed" }
+
+type TokenRefreshed struct {
+	UserId   uint   `json:"user_id"`
+	ClientId string `json:"client_id,omitempty"`
+	OrgId    uint   `json:"org_id,omitempty"`
+}
+
+func (TokenRefreshed) EventName() string { return "auth.token_refreshed" }
+
+type EmailChanged struct {
+	UserId   uint   `json:"user_id"`
+	OldEmail string `json:"old_email"`
+	NewEmail string `json:"new_email"`
+}
+
+func (EmailChanged) EventName() string { return "user.email_changed" }
+
+// UserDeactivated is published when an account is deleted by its owner and enters the
+// grace period; UserDeleted follows once the purge job has removed the personal data,
+// unless an admin restores the account first and UserRestored is published instead.
+type UserDeactivated struct {
+	UserId     uint      `json:"user_id"`
+	Email      string    `json:"email"`
+	PurgeAfter time.Time `json:"purge_after"`
+}
+
+func (UserDeactivated) EventName() string { return "user.deactivated" }
+
+type UserDeleted struct {
+	UserId uint   `json:"user_id"`
+	Mode   string `json:"mode"`
+}
+
+func (UserDeleted) EventName() string { return "user.deleted" }
+
+type UserRestored struct {
+	UserId uint   `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+func (UserRestored) EventName() string { return "user.restored" }
@@ -0,0 +1,42 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"hitenok/pkg/domain"
+
+	"gorm.io/gorm"
+)
+
+// pgNotifyPayloadLimit is the largest payload NOTIFY accepts by default.
+const pgNotifyPayloadLimit = 8000
+
+type pgNotifyPublisher struct {
+	DB      *gorm.DB
+	channel string
+}
+
+// NewPgNotifyPublisher forwards events as JSON envelopes with Postgres NOTIFY on the
+// given channel, so other services can follow them with LISTEN and no broker. NOTIFY
+// is fire-and-forget: listeners that are not connected at the time miss the event.
+func NewPgNotifyPublisher(db *gorm.DB, channel string) PublisherI {
+	return &pgNotifyPublisher{
+		DB:      db,
+		channel: channel,
+	}
+}
+
+func (publisher *pgNotifyPublisher) Publish(envelope Envelope) *domain.MyError {
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return domain.NewError(err, "pgNotifyPublisher.Publish")
+	}
+	if len(payload) >= pgNotifyPayloadLimit {
+		return domain.NewError(fmt.Errorf("payload of %s is %d bytes, over the NOTIFY limit", envelope.Name, len(payload)), "pgNotifyPublisher.Publish")
+	}
+	err = publisher.DB.Exec("SELECT pg_notify(?, ?)", publisher.channel, string(payload)).Error
+	if err != nil {
+		return domain.NewError(err, "pgNotifyPublisher.Publish")
+	}
+	return nil
+}
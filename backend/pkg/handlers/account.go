@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"fmt"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type DeleteAccountResponse struct {
+	PurgeAfter time.Time `json:"purge_after"`
+}
+
+type AccountHandlerI interface {
+	Export(c *gin.Context)
+	DeleteAccount(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type AccountHandler struct {
+	accountService        services.AccountServiceI
+	authenticationService services.PasswordAuthenticationServiceI
+	jwtService            services.JWTServiceI
+	auditService          services.AuditServiceI
+}
+
+func NewAccountHandler(accountService services.AccountServiceI, authenticationService services.PasswordAuthenticationServiceI, jwtService services.JWTServiceI, auditService services.AuditServiceI) AccountHandlerI {
+	return &AccountHandler{
+		accountService:        accountService,
+		authenticationService: authenticationService,
+		jwtService:            jwtService,
+		auditService:          auditService,
+	}
+}
+
+// Export answers with the archive itself rather than the usual envelope, as a file
+// download.
+func (accountHandler *AccountHandler) Export(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	export, err := accountHandler.accountService.Export(user)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("accountHandler.Export.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	accountHandler.auditService.Record(auditEvent(c, domain.AuditAccountExport, domain.AuditSuccess, user.ID, user.ID, nil))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="account-%d.json"`, user.ID))
+	c.Header("Cache-Control", "no-store")
+	c.IndentedJSON(http.StatusOK, export)
+}
+
+func (accountHandler *AccountHandler) DeleteAccount(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	var deleteAccountRequest DeleteAccountRequest
+	if err := c.ShouldBindJSON(&deleteAccountRequest); err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	if !accountHandler.authenticationService.CheckPassword(user, deleteAccountRequest.Password) {
+		accountHandler.auditService.Record(auditEvent(c, domain.AuditAccountDelete, domain.AuditFailure, user.ID, user.ID, map[string]string{
+			"reason": "wrong credentials",
+		}))
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	purgeAfter, err := accountHandler.accountService.DeleteAccount(user)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("accountHandler.DeleteAccount.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	accountHandler.auditService.Record(auditEvent(c, domain.AuditAccountDelete, domain.AuditSuccess, user.ID, user.ID, map[string]string{
+		"purge_after": purgeAfter.Format(time.RFC3339),
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": DeleteAccountResponse{
+			PurgeAfter: purgeAfter,
+		},
+		"error": nil,
+	})
+}
+
+func (accountHandler *AccountHandler) RegisterRoutes(router *gin.RouterGroup) {
+	me := router.Group("/users/me")
+	me.Use(middlewares.CheckAuth(accountHandler.jwtService))
+	me.POST("/export", accountHandler.Export)
+	me.DELETE("", accountHandler.DeleteAccount)
+}
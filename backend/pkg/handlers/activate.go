@@ -4,7 +4,7 @@ import (
 	"errors"
 	"hitenok/pkg/config"
 	"hitenok/pkg/domain"
-	"hitenok/pkg/security"
+	"hitenok/pkg/middlewares"
 	"hitenok/pkg/services"
 	"log"
 	"net/http"
@@ -14,13 +14,30 @@ import (
 )
 
 type ActivateRequest struct {
+	UserId uint   `json:"user_id"`
+	OTP    string `json:"one_time_password"`
+}
+
+// ResendRequest names the user by email or, failing that, by id.
+type ResendRequest struct {
+	UserId uint   `json:"user_id,omitempty"`
+	Email  string `json:"email,omitempty"`
+}
+
+type ResetPasswordRequest struct {
 	UserId      uint   `json:"user_id"`
-	Email       string `json:"email"`
-	OTP         string `json:"one_time_password"`
 	ResetHash   string `json:"reset_hash"`
 	NewPassword string `json:"new_password"`
 }
 
+// ActivateResponse carries the tokens of a freshly activated user, or the reset hash
+// when an active user verified a password reset code.
+type ActivateResponse struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ResetHash    string `json:"reset_hash,omitempty"`
+}
+
 type ActivateHandlerI interface {
 	Activate(c *gin.Context)
 	Resend(c *gin.Context)
@@ -29,20 +46,26 @@ type ActivateHandlerI interface {
 }
 
 type ActivateHandler struct {
-	otpService  services.OTPServiceI
-	userService services.UserServiceI
-	hashService services.HashServiceI
-	jwtService  services.JWTServiceI
-	appConfig   *config.AppConfig
+	otpService            services.OTPServiceI
+	userService           services.UserServiceI
+	hashService           services.HashServiceI
+	jwtService            services.JWTServiceI
+	authenticationService services.PasswordAuthenticationServiceI
+	auditService          services.AuditServiceI
+	background            services.BackgroundI
+	appConfig             *config.AppConfig
 }
 
-func NewActivateHandler(otpService services.OTPServiceI, hashService services.HashServiceI, jwtService services.JWTServiceI, userService services.UserServiceI, appConfig *config.AppConfig) ActivateHandlerI {
+func NewActivateHandler(otpService services.OTPServiceI, hashService services.HashServiceI, jwtService services.JWTServiceI, userService services.UserServiceI, authenticationService services.PasswordAuthenticationServiceI, auditService services.AuditServiceI, background services.BackgroundI, appConfig *config.AppConfig) ActivateHandlerI {
 	return &ActivateHandler{
-		otpService:  otpService,
-		hashService: hashService,
-		userService: userService,
-		jwtService:  jwtService,
-		appConfig:   appConfig,
+		otpService:            otpService,
+		hashService:           hashService,
+		userService:           userService,
+		jwtService:            jwtService,
+		authenticationService: authenticationService,
+		auditService:          auditService,
+		background:            background,
+		appConfig:             appConfig,
 	}
 }
 
@@ -82,6 +105,11 @@ func (activateHandler *ActivateHandler) Activate(c *gin.Context) {
 		log.Printf("activateHandler.Activate.%s: %v", err.Module, err.ErrorBase)
 		return
 	}
+	// An active user verifies an OTP only to get a password reset hash.
+	action := domain.AuditActivate
+	if user.IsActive {
+		action = domain.AuditPasswordResetCode
+	}
 	valid, err := activateHandler.otpService.VerifyOTP(user, activateRequest.OTP)
 	if err != nil {
 		if user.OTPAttempts <= 0 {
@@ -101,6 +129,9 @@ func (activateHandler *ActivateHandler) Activate(c *gin.Context) {
 		return
 	}
 	if !valid {
+		activateHandler.auditService.Record(auditEvent(c, action, domain.AuditFailure, 0, user.ID, map[string]string{
+			"reason": "wrong otp",
+		}))
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusUnauthorized,
 			"body":   gin.H{},
@@ -109,18 +140,7 @@ func (activateHandler *ActivateHandler) Activate(c *gin.Context) {
 		return
 	}
 	if !user.IsActive {
-		user.IsActive = true
-		err := activateHandler.userService.UpdateUser(user)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusOK, gin.H{
-				"status": http.StatusInternalServerError,
-				"body":   gin.H{},
-				"error":  "Internal server error",
-			})
-			log.Printf("activateHandler.Activate.%s: %v", err.Module, err.ErrorBase)
-			return
-		}
-		accessToken, err := activateHandler.jwtService.GenerateToken(user, true)
+		err := activateHandler.authenticationService.Activate(user)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusOK, gin.H{
 				"status": http.StatusInternalServerError,
@@ -130,7 +150,7 @@ func (activateHandler *ActivateHandler) Activate(c *gin.Context) {
 			log.Printf("activateHandler.Activate.%s: %v", err.Module, err.ErrorBase)
 			return
 		}
-		refreshToken, err := activateHandler.jwtService.GenerateToken(user, false)
+		accessToken, refreshToken, err := activateHandler.jwtService.GenerateTokenPair(user, domain.TokenOptions{})
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusOK, gin.H{
 				"status": http.StatusInternalServerError,
@@ -140,23 +160,18 @@ func (activateHandler *ActivateHandler) Activate(c *gin.Context) {
 			log.Printf("activateHandler.Activate.%s: %v", err.Module, err.ErrorBase)
 			return
 		}
+		activateHandler.auditService.Record(auditEvent(c, action, domain.AuditSuccess, user.ID, user.ID, nil))
 		c.JSON(http.StatusOK, gin.H{
 			"status": http.StatusOK,
-			"body": gin.H{
-				"access_token":  accessToken,
-				"refresh_token": refreshToken,
+			"body": ActivateResponse{
+				AccessToken:  accessToken,
+				RefreshToken: refreshToken,
 			},
 			"error": nil,
 		})
-		go func() {
-			err := activateHandler.otpService.ClearOTP(user)
-			if err != nil {
-				log.Printf("activateHandler.Activate.%s: %v", err.Module, err.ErrorBase)
-			}
-		}()
 		return
 	}
-	err = activateHandler.hashService.GenerateHash(user)
+	resetHash, err := activateHandler.hashService.GenerateHash(user)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusInternalServerError,
@@ -166,25 +181,25 @@ func (activateHandler *ActivateHandler) Activate(c *gin.Context) {
 		log.Printf("activateHandler.Activate.%s: %v", err.Module, err.ErrorBase)
 		return
 	}
+	// The code is spent once it has been traded for the reset hash.
+	err = activateHandler.otpService.ClearOTP(user)
+	if err != nil {
+		log.Printf("activateHandler.Activate.%s: %v", err.Module, err.ErrorBase)
+	}
 
+	activateHandler.auditService.Record(auditEvent(c, action, domain.AuditSuccess, user.ID, user.ID, nil))
 	c.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
-		"body": gin.H{
-			"reset_hash": user.ResetHash,
+		"body": ActivateResponse{
+			ResetHash: resetHash,
 		},
 		"error": nil,
 	})
-	go func() {
-		err := activateHandler.otpService.ClearOTP(user)
-		if err != nil {
-			log.Printf("activateHandler.Activate.%s: %v", err.Module, err.ErrorBase)
-		}
-	}()
 }
 
 func (activateHandler *ActivateHandler) Resend(c *gin.Context) {
-	var activateRequest ActivateRequest
-	if err := c.ShouldBindJSON(&activateRequest); err != nil {
+	var resendRequest ResendRequest
+	if err := c.ShouldBindJSON(&resendRequest); err != nil {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusBadRequest,
 			"body":   gin.H{},
@@ -194,10 +209,10 @@ func (activateHandler *ActivateHandler) Resend(c *gin.Context) {
 	}
 	var user *domain.User
 	var err *domain.MyError
-	if activateRequest.Email != "" {
-		user, err = activateHandler.userService.GetUserByEmail(activateRequest.Email)
+	if resendRequest.Email != "" {
+		user, err = activateHandler.userService.GetUserByEmail(resendRequest.Email)
 	} else {
-		user, err = activateHandler.userService.GetUser(activateRequest.UserId)
+		user, err = activateHandler.userService.GetUser(resendRequest.UserId)
 	}
 	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
@@ -217,7 +232,7 @@ func (activateHandler *ActivateHandler) Resend(c *gin.Context) {
 		return
 	}
 
-	err = activateHandler.otpService.GenerateOTP(user)
+	otp, err := activateHandler.otpService.GenerateOTP(user)
 	if err != nil && err.ErrorBase.Error() == "not now" {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusBadRequest,
@@ -235,20 +250,23 @@ func (activateHandler *ActivateHandler) Resend(c *gin.Context) {
 		log.Printf("activateHandler.Resend.%s: %v", err.Module, err.ErrorBase)
 		return
 	}
-	go activateHandler.otpService.SendOTP(*user)
+	notifiedUser := *user
+	activateHandler.background.Go("otpService.SendOTP", func() {
+		activateHandler.otpService.SendOTP(notifiedUser, otp)
+	})
 
 	c.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
-		"body": gin.H{
-			"user_id": user.ID,
+		"body": UserIdResponse{
+			UserId: user.ID,
 		},
 		"error": nil,
 	})
 }
 
 func (activateHandler *ActivateHandler) ResetPassword(c *gin.Context) {
-	var activateRequest ActivateRequest
-	if err := c.ShouldBindJSON(&activateRequest); err != nil {
+	var resetPasswordRequest ResetPasswordRequest
+	if err := c.ShouldBindJSON(&resetPasswordRequest); err != nil {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusBadRequest,
 			"body":   gin.H{},
@@ -257,8 +275,8 @@ func (activateHandler *ActivateHandler) ResetPassword(c *gin.Context) {
 		return
 	}
 
-	user, err := activateHandler.userService.GetUser(activateRequest.UserId)
-	if (err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound)) || activateRequest.ResetHash == "" || activateRequest.NewPassword == "" {
+	user, err := activateHandler.userService.GetUser(resetPasswordRequest.UserId)
+	if (err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound)) || resetPasswordRequest.ResetHash == "" || resetPasswordRequest.NewPassword == "" {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusBadRequest,
 			"body":   gin.H{},
@@ -275,9 +293,40 @@ func (activateHandler *ActivateHandler) ResetPassword(c *gin.Context) {
 		log.Printf("activateHandler.ResetPassword.%s: %v", err.Module, err.ErrorBase)
 		return
 	}
-	user.Password = security.HashPassword(activateRequest.NewPassword, activateHandler.appConfig.SecretKey)
-	user.JWTVersion += 1
-	err = activateHandler.userService.UpdateUser(user)
+	valid, err := activateHandler.hashService.ValidateHash(user, resetPasswordRequest.ResetHash)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("activateHandler.ResetPassword.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	if !valid {
+		activateHandler.auditService.Record(auditEvent(c, domain.AuditPasswordReset, domain.AuditFailure, 0, user.ID, map[string]string{
+			"reason": "wrong reset hash",
+		}))
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	err = activateHandler.authenticationService.ResetPassword(user, resetPasswordRequest.NewPassword)
+	var validationError *domain.ValidationError
+	if err != nil && errors.As(err.ErrorBase, &validationError) {
+		activateHandler.auditService.Record(auditEvent(c, domain.AuditPasswordReset, domain.AuditFailure, 0, user.ID, map[string]string{
+			"reason": "password policy",
+		}))
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   newValidationErrorResponse(validationError),
+			"error":  "Validation failed",
+		})
+		return
+	}
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusInternalServerError,
@@ -287,21 +336,17 @@ func (activateHandler *ActivateHandler) ResetPassword(c *gin.Context) {
 		log.Printf("activateHandler.ResetPassword.%s: %v", err.Module, err.ErrorBase)
 		return
 	}
+	activateHandler.auditService.Record(auditEvent(c, domain.AuditPasswordReset, domain.AuditSuccess, user.ID, user.ID, nil))
 	c.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
-		"body":   gin.H{},
+		"body":   EmptyResponse{},
 		"error":  nil,
 	})
-	go func() {
-		err := activateHandler.hashService.ClearHash(user)
-		if err != nil {
-			log.Printf("activateHandler.ResetPassword.%s: %v", err.Module, err.ErrorBase)
-		}
-	}()
 }
 
 func (activateHandler *ActivateHandler) RegisterRoutes(router *gin.RouterGroup) {
-	router.POST("/activate", activateHandler.Activate)
-	router.POST("/resend", activateHandler.Resend)
-	router.POST("/reset-password", activateHandler.ResetPassword)
+	rateLimit := middlewares.RateLimit(activateHandler.appConfig.RateLimit)
+	router.POST("/activate", rateLimit, activateHandler.Activate)
+	router.POST("/resend", rateLimit, activateHandler.Resend)
+	router.POST("/reset-password", rateLimit, activateHandler.ResetPassword)
 }
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"errors"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CreateApiKeyRequest names the key; ExpiresIn is in seconds, the key lasting until it
+// is deleted when it is left out.
+type CreateApiKeyRequest struct {
+	Name      string `json:"name"`
+	Scope     string `json:"scope,omitempty"`
+	ExpiresIn int64  `json:"expires_in,omitempty"`
+}
+
+// ApiKeyCreatedResponse is the only answer that shows the key itself.
+type ApiKeyCreatedResponse struct {
+	ApiKey *domain.ApiKey `json:"api_key"`
+	Key    string         `json:"key"`
+}
+
+type ApiKeysResponse struct {
+	ApiKeys []domain.ApiKey `json:"api_keys"`
+}
+
+type ApiKeyHandlerI interface {
+	Create(c *gin.Context)
+	List(c *gin.Context)
+	Delete(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type ApiKeyHandler struct {
+	apiKeyService        services.ApiKeyServiceI
+	introspectionService services.IntrospectionServiceI
+	jwtService           services.JWTServiceI
+	auditService         services.AuditServiceI
+}
+
+func NewApiKeyHandler(apiKeyService services.ApiKeyServiceI, introspectionService services.IntrospectionServiceI, jwtService services.JWTServiceI, auditService services.AuditServiceI) ApiKeyHandlerI {
+	return &ApiKeyHandler{
+		apiKeyService:        apiKeyService,
+		introspectionService: introspectionService,
+		jwtService:           jwtService,
+		auditService:         auditService,
+	}
+}
+
+func (apiKeyHandler *ApiKeyHandler) Create(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	var createRequest CreateApiKeyRequest
+	if err := c.ShouldBindJSON(&createRequest); err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	expiresIn := time.Duration(createRequest.ExpiresIn) * time.Second
+	apiKey, key, err := apiKeyHandler.apiKeyService.Create(user, createRequest.Name, createRequest.Scope, expiresIn)
+	var validationError *domain.ValidationError
+	if err != nil && errors.As(err.ErrorBase, &validationError) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   newValidationErrorResponse(validationError),
+			"error":  "Validation failed",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("apiKeyHandler.Create.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	apiKeyHandler.auditService.Record(auditEvent(c, domain.AuditApiKeyCreate, domain.AuditSuccess, user.ID, user.ID, map[string]string{
+		"api_key_id": strconv.FormatUint(uint64(apiKey.ID), 10),
+		"name":       apiKey.Name,
+		"scope":      apiKey.Scope,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": ApiKeyCreatedResponse{
+			ApiKey: apiKey,
+			Key:    key,
+		},
+		"error": nil,
+	})
+}
+
+func (apiKeyHandler *ApiKeyHandler) List(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	apiKeys, err := apiKeyHandler.apiKeyService.List(user)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("apiKeyHandler.List.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": ApiKeysResponse{
+			ApiKeys: apiKeys,
+		},
+		"error": nil,
+	})
+}
+
+// Delete revokes the key at once: introspection stops reporting it active without
+// waiting for the cached response to expire.
+func (apiKeyHandler *ApiKeyHandler) Delete(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	keyId, parseErr := strconv.ParseUint(c.Param("keyId"), 10, 64)
+	if parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "API key not found",
+		})
+		return
+	}
+	apiKey, err := apiKeyHandler.apiKeyService.Delete(user, uint(keyId))
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "API key not found",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("apiKeyHandler.Delete.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	apiKeyHandler.introspectionService.ForgetSession(apiKey.SessionId())
+	apiKeyHandler.auditService.Record(auditEvent(c, domain.AuditApiKeyDelete, domain.AuditSuccess, user.ID, user.ID, map[string]string{
+		"api_key_id": strconv.FormatUint(uint64(apiKey.ID), 10),
+		"name":       apiKey.Name,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   EmptyResponse{},
+		"error":  nil,
+	})
+}
+
+func (apiKeyHandler *ApiKeyHandler) RegisterRoutes(router *gin.RouterGroup) {
+	apiKeys := router.Group("/users/me/api-keys")
+	apiKeys.Use(middlewares.CheckAuth(apiKeyHandler.jwtService))
+	apiKeys.POST("", apiKeyHandler.Create)
+	apiKeys.GET("", apiKeyHandler.List)
+	apiKeys.DELETE("/:keyId", apiKeyHandler.Delete)
+}
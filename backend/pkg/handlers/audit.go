@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"fmt"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditEventsResponse struct {
+	Events []domain.AuditEvent `json:"events"`
+}
+
+// ActivityEntry is an audit event as its user sees it; BySelf tells their own actions
+// from those taken on their account by others.
+type ActivityEntry struct {
+	Id        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Action    string    `json:"action"`
+	Outcome   string    `json:"outcome"`
+	Ip        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	BySelf    bool      `json:"by_self"`
+}
+
+type ActivityResponse struct {
+	Activity []ActivityEntry `json:"activity"`
+}
+
+type AuditHandlerI interface {
+	Query(c *gin.Context)
+	Export(c *gin.Context)
+	Verify(c *gin.Context)
+	Activity(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type AuditHandler struct {
+	auditService services.AuditServiceI
+	jwtService   services.JWTServiceI
+}
+
+func NewAuditHandler(auditService services.AuditServiceI, jwtService services.JWTServiceI) AuditHandlerI {
+	return &AuditHandler{
+		auditService: auditService,
+		jwtService:   jwtService,
+	}
+}
+
+// auditEvent fills in the request side of an audit event: client address, user agent
+// and the id set by middlewares.RequestId.
+func auditEvent(c *gin.Context, action, outcome string, actorId, subjectId uint, metadata map[string]string) domain.AuditEvent {
+	return domain.AuditEvent{
+		ActorId:   actorId,
+		SubjectId: subjectId,
+		Action:    action,
+		Outcome:   outcome,
+		Ip:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		RequestId: c.GetString("request_id"),
+		Metadata:  metadata,
+	}
+}
+
+// auditFilter reads the filter query parameters shared by the audit endpoints.
+func auditFilter(c *gin.Context) (domain.AuditFilter, error) {
+	filter := domain.AuditFilter{
+		Action:  c.Query("action"),
+		Outcome: c.Query("outcome"),
+	}
+	ids := map[string]*uint{
+		"actor_id":   &filter.ActorId,
+		"subject_id": &filter.SubjectId,
+		"user_id":    &filter.UserId,
+		"before_id":  &filter.BeforeId,
+	}
+	for key, id := range ids {
+		if value := c.Query(key); value != "" {
+			parsed, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("%s: %v", key, err)
+			}
+			*id = uint(parsed)
+		}
+	}
+	times := map[string]*time.Time{
+		"since": &filter.Since,
+		"until": &filter.Until,
+	}
+	for key, moment := range times {
+		if value := c.Query(key); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s: %v", key, err)
+			}
+			*moment = parsed
+		}
+	}
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("limit: %v", err)
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+func (auditHandler *AuditHandler) Query(c *gin.Context) {
+	filter, parseErr := auditFilter(c)
+	if parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	events, err := auditHandler.auditService.Query(filter)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("auditHandler.Query.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": AuditEventsResponse{
+			Events: events,
+		},
+		"error": nil,
+	})
+}
+
+// Export streams the matching events as a JSON Lines download instead of the usual
+// envelope. Once streaming has started a failure can only cut the file short.
+func (auditHandler *AuditHandler) Export(c *gin.Context) {
+	filter, parseErr := auditFilter(c)
+	if parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	c.Status(http.StatusOK)
+	err := auditHandler.auditService.Export(filter, c.Writer)
+	if err != nil {
+		log.Printf("auditHandler.Export.%s: %v", err.Module, err.ErrorBase)
+	}
+}
+
+func (auditHandler *AuditHandler) Verify(c *gin.Context) {
+	verification, err := auditHandler.auditService.Verify()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("auditHandler.Verify.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   verification,
+		"error":  nil,
+	})
+}
+
+// Activity lists the events the user took part in, as actor or as subject.
+func (auditHandler *AuditHandler) Activity(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	filter, parseErr := auditFilter(c)
+	if parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	filter.ActorId, filter.SubjectId = 0, 0
+	filter.UserId = user.ID
+	events, err := auditHandler.auditService.Query(filter)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("auditHandler.Activity.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	activity := []ActivityEntry{}
+	for _, event := range events {
+		activity = append(activity, ActivityEntry{
+			Id:        event.ID,
+			CreatedAt: event.CreatedAt,
+			Action:    event.Action,
+			Outcome:   event.Outcome,
+			Ip:        event.Ip,
+			UserAgent: event.UserAgent,
+			BySelf:    event.ActorId == user.ID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": ActivityResponse{
+			Activity: activity,
+		},
+		"error": nil,
+	})
+}
+
+func (auditHandler *AuditHandler) RegisterRoutes(router *gin.RouterGroup) {
+	admin := router.Group("/admin/audit")
+	admin.Use(middlewares.CheckAuth(auditHandler.jwtService), middlewares.RequireSuperuser())
+	admin.GET("", auditHandler.Query)
+	admin.GET("/export", auditHandler.Export)
+	admin.GET("/verify", auditHandler.Verify)
+
+	me := router.Group("/users/me")
+	me.Use(middlewares.CheckAuth(auditHandler.jwtService))
+	me.GET("/activity", auditHandler.Activity)
+}
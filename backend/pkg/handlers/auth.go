@@ -3,6 +3,8 @@ package handlers
 import (
 	"errors"
 	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
 	"hitenok/pkg/services"
 	"log"
 	"net/http"
@@ -11,11 +13,25 @@ import (
 	"gorm.io/gorm"
 )
 
-type UserRequest struct {
+type SignInRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type SignUpRequest struct {
 	Email    string `json:"email"`
 	Fullname string `json:"fullname"`
 	Password string `json:"password"`
 }
+
+// SignInResponse has State "password_change_required" and no refresh token when the
+// password has expired; the access token is then only good for changing it.
+type SignInResponse struct {
+	State        string `json:"state,omitempty"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
 type AuthHandlerI interface {
 	SignIn(c *gin.Context)
 	SignUp(c *gin.Context)
@@ -24,24 +40,24 @@ type AuthHandlerI interface {
 
 type MailAuthHandler struct {
 	authenticationService services.PasswordAuthenticationServiceI
-	otpService            services.OTPServiceI
 	jwtService            services.JWTServiceI
+	auditService          services.AuditServiceI
 	appConfig             *config.AppConfig
 }
 
-func NewMailAuthHandler(authenticationService services.PasswordAuthenticationServiceI, otpService services.OTPServiceI, jwtService services.JWTServiceI, appConfig *config.AppConfig) AuthHandlerI {
+func NewMailAuthHandler(authenticationService services.PasswordAuthenticationServiceI, jwtService services.JWTServiceI, auditService services.AuditServiceI, appConfig *config.AppConfig) AuthHandlerI {
 	return &MailAuthHandler{
 		authenticationService: authenticationService,
-		otpService:            otpService,
 		appConfig:             appConfig,
 		jwtService:            jwtService,
+		auditService:          auditService,
 	}
 }
 
 func (mailAuthHandler *MailAuthHandler) SignIn(c *gin.Context) {
-	var userRequest UserRequest
+	var signInRequest SignInRequest
 
-	if err := c.ShouldBindJSON(&userRequest); err != nil {
+	if err := c.ShouldBindJSON(&signInRequest); err != nil {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusBadRequest,
 			"body":   gin.H{},
@@ -50,8 +66,12 @@ func (mailAuthHandler *MailAuthHandler) SignIn(c *gin.Context) {
 		return
 	}
 
-	user, err := mailAuthHandler.authenticationService.Authenticate(userRequest.Email, userRequest.Password)
+	user, err := mailAuthHandler.authenticationService.Authenticate(signInRequest.Email, signInRequest.Password)
 	if err != nil && (errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) || err.ErrorBase.Error() == "wrong credentials" || err.ErrorBase.Error() == "user is not active") {
+		mailAuthHandler.auditService.Record(auditEvent(c, domain.AuditSignIn, domain.AuditFailure, 0, user.ID, map[string]string{
+			"email":  signInRequest.Email,
+			"reason": err.ErrorBase.Error(),
+		}))
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusUnauthorized,
 			"body":   gin.H{},
@@ -68,17 +88,33 @@ func (mailAuthHandler *MailAuthHandler) SignIn(c *gin.Context) {
 		log.Printf("mailAuthHandler.SignIn.%s: %v", err.Module, err.ErrorBase)
 		return
 	}
-	accessToken, err := mailAuthHandler.jwtService.GenerateToken(user, true)
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusOK, gin.H{
-			"status": http.StatusInternalServerError,
-			"body":   gin.H{},
-			"error":  "Internal server error",
+	if mailAuthHandler.authenticationService.PasswordExpired(user) {
+		// No refresh token: the restricted token is only good for changing the password,
+		// which hands out a regular pair.
+		accessToken, err := mailAuthHandler.jwtService.GenerateTokenWithOptions(user, true, domain.TokenOptions{Scope: domain.PasswordChangeScope})
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusInternalServerError,
+				"body":   gin.H{},
+				"error":  "Internal server error",
+			})
+			log.Printf("mailAuthHandler.SignIn.%s: %v", err.Module, err.ErrorBase)
+			return
+		}
+		mailAuthHandler.auditService.Record(auditEvent(c, domain.AuditSignIn, domain.AuditSuccess, user.ID, user.ID, map[string]string{
+			"state": "password_change_required",
+		}))
+		c.JSON(http.StatusOK, gin.H{
+			"status": http.StatusOK,
+			"body": SignInResponse{
+				State:       "password_change_required",
+				AccessToken: accessToken,
+			},
+			"error": nil,
 		})
-		log.Printf("mailAuthHandler.SignIn.%s: %v", err.Module, err.ErrorBase)
 		return
 	}
-	refreshToken, err := mailAuthHandler.jwtService.GenerateToken(user, false)
+	accessToken, refreshToken, err := mailAuthHandler.jwtService.GenerateTokenPair(user, domain.TokenOptions{})
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusInternalServerError,
@@ -89,20 +125,21 @@ func (mailAuthHandler *MailAuthHandler) SignIn(c *gin.Context) {
 		return
 	}
 
+	mailAuthHandler.auditService.Record(auditEvent(c, domain.AuditSignIn, domain.AuditSuccess, user.ID, user.ID, nil))
 	c.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
-		"body": gin.H{
-			"access_token":  accessToken,
-			"refresh_token": refreshToken,
+		"body": SignInResponse{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
 		},
 		"error": nil,
 	})
 }
 
 func (mailAuthHandler *MailAuthHandler) SignUp(c *gin.Context) {
-	var userRequest UserRequest
+	var signUpRequest SignUpRequest
 
-	if err := c.ShouldBindJSON(&userRequest); err != nil {
+	if err := c.ShouldBindJSON(&signUpRequest); err != nil {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusBadRequest,
 			"body":   gin.H{},
@@ -111,7 +148,7 @@ func (mailAuthHandler *MailAuthHandler) SignUp(c *gin.Context) {
 		return
 	}
 
-	user, err := mailAuthHandler.authenticationService.Register(userRequest.Email, userRequest.Fullname, userRequest.Password)
+	user, err := mailAuthHandler.authenticationService.Register(signUpRequest.Email, signUpRequest.Fullname, signUpRequest.Password)
 	if err != nil && err.ErrorBase.Error() == "user already exists" {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusBadRequest,
@@ -120,24 +157,31 @@ func (mailAuthHandler *MailAuthHandler) SignUp(c *gin.Context) {
 		})
 		return
 	}
-	if err != nil && err.ErrorBase.Error() == "invalid credentials" {
+	var validationError *domain.ValidationError
+	if err != nil && errors.As(err.ErrorBase, &validationError) {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusBadRequest,
+			"body":   newValidationErrorResponse(validationError),
+			"error":  "Validation failed",
+		})
+		return
+	}
+	if err != nil && err.ErrorBase.Error() == "registration closed" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusForbidden,
 			"body":   gin.H{},
-			"error":  "Invalid credentials",
+			"error":  "Registration closed",
 		})
 		return
 	}
-	if err != nil {
+	if err != nil && err.ErrorBase.Error() == "invalid credentials" {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
-			"status": http.StatusInternalServerError,
+			"status": http.StatusBadRequest,
 			"body":   gin.H{},
-			"error":  "Internal server error",
+			"error":  "Invalid credentials",
 		})
-		log.Printf("mailAuthHandler.SignUp.%s: %v", err.Module, err.ErrorBase)
 		return
 	}
-	err = mailAuthHandler.otpService.GenerateOTP(user)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"status": http.StatusInternalServerError,
@@ -147,11 +191,11 @@ func (mailAuthHandler *MailAuthHandler) SignUp(c *gin.Context) {
 		log.Printf("mailAuthHandler.SignUp.%s: %v", err.Module, err.ErrorBase)
 		return
 	}
-	go mailAuthHandler.otpService.SendOTP(*user)
+	mailAuthHandler.auditService.Record(auditEvent(c, domain.AuditSignUp, domain.AuditSuccess, user.ID, user.ID, nil))
 	c.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
-		"body": gin.H{
-			"user_id": user.ID,
+		"body": UserIdResponse{
+			UserId: user.ID,
 		},
 		"error": nil,
 	})
@@ -160,6 +204,7 @@ func (mailAuthHandler *MailAuthHandler) SignUp(c *gin.Context) {
 
 func (mailAuthHandler *MailAuthHandler) RegisterRoutes(router *gin.RouterGroup) {
 	mail := router.Group("/mail")
+	mail.Use(middlewares.RateLimit(mailAuthHandler.appConfig.RateLimit))
 	mail.POST("/sign-in", mailAuthHandler.SignIn)
 	mail.POST("/sign-up", mailAuthHandler.SignUp)
 }
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	_ "embed"
+	"errors"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/services"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+//go:embed email_cancel.html
+var emailCancelPage string
+
+var emailCancelTemplate = template.Must(template.New("email_cancel").Parse(emailCancelPage))
+
+type EmailChangeRequest struct {
+	NewEmail string `json:"new_email"`
+	Password string `json:"password"`
+}
+
+type ConfirmEmailChangeRequest struct {
+	Code string `json:"code"`
+}
+
+type CancelEmailChangeRequest struct {
+	Token string `form:"token" json:"token"`
+}
+
+type EmailChangeResponse struct {
+	NewEmail  string    `json:"new_email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// EmailChangedResponse hands out new tokens, as the change ended every session.
+type EmailChangedResponse struct {
+	Email        string `json:"email"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type EmailChangeHandlerI interface {
+	RequestChange(c *gin.Context)
+	Confirm(c *gin.Context)
+	CancelPage(c *gin.Context)
+	Cancel(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type EmailChangeHandler struct {
+	emailChangeService    services.EmailChangeServiceI
+	authenticationService services.PasswordAuthenticationServiceI
+	jwtService            services.JWTServiceI
+	auditService          services.AuditServiceI
+	background            services.BackgroundI
+}
+
+func NewEmailChangeHandler(emailChangeService services.EmailChangeServiceI, authenticationService services.PasswordAuthenticationServiceI, jwtService services.JWTServiceI, auditService services.AuditServiceI, background services.BackgroundI) EmailChangeHandlerI {
+	return &EmailChangeHandler{
+		emailChangeService:    emailChangeService,
+		authenticationService: authenticationService,
+		jwtService:            jwtService,
+		auditService:          auditService,
+		background:            background,
+	}
+}
+
+func (emailChangeHandler *EmailChangeHandler) RequestChange(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	var emailChangeRequest EmailChangeRequest
+	if err := c.ShouldBindJSON(&emailChangeRequest); err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	if !emailChangeHandler.authenticationService.CheckPassword(user, emailChangeRequest.Password) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	emailChange, err := emailChangeHandler.emailChangeService.RequestChange(user, emailChangeRequest.NewEmail)
+	if err != nil && err.ErrorBase.Error() == "invalid email" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Invalid email",
+		})
+		return
+	}
+	if err != nil && err.ErrorBase.Error() == "email already taken" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "User already exists",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("emailChangeHandler.RequestChange.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	notifiedUser, notifiedChange := *user, *emailChange
+	emailChangeHandler.background.Go("emailChangeService.SendNotifications", func() {
+		emailChangeHandler.emailChangeService.SendNotifications(notifiedUser, notifiedChange)
+	})
+	emailChangeHandler.auditService.Record(auditEvent(c, domain.AuditEmailChangeRequest, domain.AuditSuccess, user.ID, user.ID, map[string]string{
+		"new_email": emailChange.NewEmail,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": EmailChangeResponse{
+			NewEmail:  emailChange.NewEmail,
+			ExpiresAt: emailChange.ExpiresAt,
+		},
+		"error": nil,
+	})
+}
+
+func (emailChangeHandler *EmailChangeHandler) Confirm(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	var confirmRequest ConfirmEmailChangeRequest
+	if err := c.ShouldBindJSON(&confirmRequest); err != nil || confirmRequest.Code == "" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	err := emailChangeHandler.emailChangeService.Confirm(user, confirmRequest.Code)
+	if err != nil && (errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) || err.ErrorBase.Error() == "code expired") {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "No pending email change",
+		})
+		return
+	}
+	if err != nil && err.ErrorBase.Error() == "wrong code" {
+		emailChangeHandler.auditService.Record(auditEvent(c, domain.AuditEmailChangeConfirm, domain.AuditFailure, user.ID, user.ID, map[string]string{
+			"reason": "wrong code",
+		}))
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	if err != nil && err.ErrorBase.Error() == "email already taken" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "User already exists",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("emailChangeHandler.Confirm.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	emailChangeHandler.auditService.Record(auditEvent(c, domain.AuditEmailChangeConfirm, domain.AuditSuccess, user.ID, user.ID, map[string]string{
+		"email": user.Email,
+	}))
+	// The JWTVersion bump logged every session out, this one included, so hand it a
+	// fresh pair of tokens.
+	options := domain.TokenOptions{}
+	claimsInterface, _ := c.Get("claims")
+	if claims, ok := claimsInterface.(*domain.Claims); ok {
+		options.OrgId = claims.OrgId
+		options.SessionId = claims.SessionId
+	}
+	accessToken, refreshToken, err := emailChangeHandler.jwtService.GenerateTokenPair(user, options)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("emailChangeHandler.Confirm.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": EmailChangedResponse{
+			Email:        user.Email,
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+		},
+		"error": nil,
+	})
+}
+
+// CancelPage is the target of the link mailed to the old address. It only asks for a
+// confirmation that posts to Cancel, so link scanners and prefetchers fetching it
+// change nothing.
+func (emailChangeHandler *EmailChangeHandler) CancelPage(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	emailChangeHandler.renderCancelPage(c, c.Query("token"), "")
+}
+
+// Cancel works without a session: the cancel token itself is the credential. The form
+// of CancelPage gets a page back, other clients the envelope.
+func (emailChangeHandler *EmailChangeHandler) Cancel(c *gin.Context) {
+	var cancelRequest CancelEmailChangeRequest
+	if err := c.ShouldBind(&cancelRequest); err != nil {
+		cancelRequest.Token = ""
+	}
+	if cancelRequest.Token == "" {
+		cancelRequest.Token = c.Query("token")
+	}
+	if cancelRequest.Token == "" {
+		emailChangeHandler.cancelAnswer(c, http.StatusBadRequest, "Wrong credentials", "Ссылка неполна, откройте её из письма целиком.")
+		return
+	}
+	emailChange, err := emailChangeHandler.emailChangeService.Cancel(cancelRequest.Token)
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		emailChangeHandler.cancelAnswer(c, http.StatusBadRequest, "No pending email change", "Смена адреса уже завершена, отменена или истекла.")
+		return
+	}
+	if err != nil {
+		emailChangeHandler.cancelAnswer(c, http.StatusInternalServerError, "Internal server error", "Не удалось отменить смену адреса, попробуйте позже.")
+		log.Printf("emailChangeHandler.Cancel.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	// Whoever holds the link to the old address acts for the account owner.
+	emailChangeHandler.auditService.Record(auditEvent(c, domain.AuditEmailChangeCancel, domain.AuditSuccess, emailChange.UserId, emailChange.UserId, map[string]string{
+		"new_email": emailChange.NewEmail,
+	}))
+	emailChangeHandler.cancelAnswer(c, http.StatusOK, "", "Смена адреса отменена.")
+}
+
+func (emailChangeHandler *EmailChangeHandler) cancelAnswer(c *gin.Context, status int, message, pageMessage string) {
+	if strings.Contains(c.Request.Header.Get("Accept"), "text/html") {
+		emailChangeHandler.renderCancelPage(c, "", pageMessage)
+		return
+	}
+	if status != http.StatusOK {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": status,
+			"body":   gin.H{},
+			"error":  message,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   EmptyResponse{},
+		"error":  nil,
+	})
+}
+
+func (emailChangeHandler *EmailChangeHandler) renderCancelPage(c *gin.Context, cancelToken, message string) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	err := emailCancelTemplate.Execute(c.Writer, map[string]string{
+		"Token":   cancelToken,
+		"Message": message,
+	})
+	if err != nil {
+		log.Printf("emailChangeHandler.renderCancelPage: %v", err)
+	}
+}
+
+func (emailChangeHandler *EmailChangeHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/users/email/cancel", emailChangeHandler.CancelPage)
+	router.POST("/users/email/cancel", emailChangeHandler.Cancel)
+
+	me := router.Group("/users/me")
+	me.Use(middlewares.CheckAuth(emailChangeHandler.jwtService))
+	me.POST("/email", emailChangeHandler.RequestChange)
+	me.POST("/email/confirm", emailChangeHandler.Confirm)
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"hitenok/pkg/config"
+	"hitenok/pkg/services"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ForwardAuthHandler serves reverse proxies (nginx auth_request, Traefik and Caddy
+// forward_auth) rather than API clients, so it answers with bare status codes and passes
+// the identity on in response headers.
+type ForwardAuthHandlerI interface {
+	Verify(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type ForwardAuthHandler struct {
+	jwtService  services.JWTServiceI
+	userService services.UserServiceI
+	appConfig   *config.AppConfig
+}
+
+func NewForwardAuthHandler(jwtService services.JWTServiceI, userService services.UserServiceI, appConfig *config.AppConfig) ForwardAuthHandlerI {
+	return &ForwardAuthHandler{
+		jwtService:  jwtService,
+		userService: userService,
+		appConfig:   appConfig,
+	}
+}
+
+// Verify accepts the access token from the Authorization header (with or without the
+// Bearer prefix) or from the session cookie; refresh tokens are refused by
+// ValidateToken like any other invalid token. Required roles come from the "roles" query
+// parameter or the X-Auth-Required-Roles header as a comma separated list; holding any
+// one of them is enough. With ?redirect=1 and a configured login URL, browsers get a
+// redirect to the login page instead of a 401.
+func (forwardAuthHandler *ForwardAuthHandler) Verify(c *gin.Context) {
+	token := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token, _ = c.Cookie(forwardAuthHandler.appConfig.ForwardAuthCookie)
+	}
+	if token == "" {
+		forwardAuthHandler.unauthorized(c)
+		return
+	}
+	user, err := forwardAuthHandler.jwtService.ValidateToken(token)
+	if err != nil && !services.IsTokenError(err) {
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil || !user.IsActive {
+		forwardAuthHandler.unauthorized(c)
+		return
+	}
+
+	roles := forwardAuthHandler.userService.Roles(user)
+	requiredRoles := c.Query("roles")
+	if requiredRoles == "" {
+		requiredRoles = c.Request.Header.Get("X-Auth-Required-Roles")
+	}
+	if requiredRoles != "" && !hasAnyRole(roles, strings.Split(requiredRoles, ",")) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	c.Header(forwardAuthHandler.appConfig.ForwardAuthUserIdHeader, strconv.FormatUint(uint64(user.ID), 10))
+	c.Header(forwardAuthHandler.appConfig.ForwardAuthEmailHeader, user.Email)
+	c.Header(forwardAuthHandler.appConfig.ForwardAuthRolesHeader, strings.Join(roles, ","))
+	c.Status(http.StatusOK)
+}
+
+func (forwardAuthHandler *ForwardAuthHandler) unauthorized(c *gin.Context) {
+	loginUrl := forwardAuthHandler.appConfig.ForwardAuthLoginUrl
+	redirect, _ := strconv.ParseBool(c.Query("redirect"))
+	isBrowser := strings.Contains(c.Request.Header.Get("Accept"), "text/html")
+	if !redirect || !isBrowser || loginUrl == "" {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	location, err := url.Parse(loginUrl)
+	if err != nil {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	if originalUrl := originalRequestUrl(c.Request); originalUrl != "" {
+		query := location.Query()
+		query.Set("rd", originalUrl)
+		location.RawQuery = query.Encode()
+	}
+	c.Redirect(http.StatusFound, location.String())
+	c.Abort()
+}
+
+// originalRequestUrl rebuilds the URL the proxied client asked for from the headers nginx
+// (X-Original-URL) or Traefik and Caddy (X-Forwarded-*) attach to the auth request.
+func originalRequestUrl(request *http.Request) string {
+	if originalUrl := request.Header.Get("X-Original-URL"); originalUrl != "" {
+		return originalUrl
+	}
+	host := request.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return ""
+	}
+	proto := request.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	return proto + "://" + host + request.Header.Get("X-Forwarded-Uri")
+}
+
+func hasAnyRole(roles []string, requiredRoles []string) bool {
+	for _, requiredRole := range requiredRoles {
+		if slices.Contains(roles, strings.TrimSpace(requiredRole)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (forwardAuthHandler *ForwardAuthHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.Any("/verify", forwardAuthHandler.Verify)
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"hitenok/pkg/domain"
+	"hitenok/pkg/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LiveResponse struct {
+	Status string `json:"status"`
+}
+
+type HealthHandlerI interface {
+	Live(c *gin.Context)
+	Ready(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+// HealthHandler serves the orchestrator probes. Unlike the API they answer with the
+// real HTTP status, which is what probes look at.
+type HealthHandler struct {
+	healthService services.HealthServiceI
+}
+
+func NewHealthHandler(healthService services.HealthServiceI) HealthHandlerI {
+	return &HealthHandler{
+		healthService: healthService,
+	}
+}
+
+// Live only tells that the process serves requests; it checks no dependency, so that a
+// database outage does not get every instance restarted.
+func (healthHandler *HealthHandler) Live(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": LiveResponse{
+			Status: domain.HealthOk,
+		},
+		"error": nil,
+	})
+}
+
+func (healthHandler *HealthHandler) Ready(c *gin.Context) {
+	report := healthHandler.healthService.Ready()
+	if report.Status == domain.HealthFail {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status": http.StatusServiceUnavailable,
+			"body":   report,
+			"error":  "Not ready",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   report,
+		"error":  nil,
+	})
+}
+
+func (healthHandler *HealthHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/healthz", healthHandler.Live)
+	router.GET("/readyz", healthHandler.Ready)
+}
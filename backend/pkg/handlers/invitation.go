@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"errors"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// InviteRequest invites with Role, by default member.
+type InviteRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role,omitempty"`
+}
+
+// AcceptInvitationRequest needs Fullname and Password only to create the account of an
+// invited email that has none.
+type AcceptInvitationRequest struct {
+	Token    string `json:"token"`
+	Fullname string `json:"fullname,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type InvitationsResponse struct {
+	Invitations []domain.Invitation `json:"invitations"`
+}
+
+type InvitationInfoResponse struct {
+	Email         string    `json:"email"`
+	Role          string    `json:"role"`
+	Organization  string    `json:"organization"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	AccountExists bool      `json:"account_exists"`
+}
+
+type InvitationHandlerI interface {
+	Invite(c *gin.Context)
+	ListInvitations(c *gin.Context)
+	RevokeInvitation(c *gin.Context)
+	Inspect(c *gin.Context)
+	Accept(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type InvitationHandler struct {
+	invitationService   services.InvitationServiceI
+	organizationService services.OrganizationServiceI
+	jwtService          services.JWTServiceI
+	auditService        services.AuditServiceI
+	background          services.BackgroundI
+}
+
+func NewInvitationHandler(invitationService services.InvitationServiceI, organizationService services.OrganizationServiceI, jwtService services.JWTServiceI, auditService services.AuditServiceI, background services.BackgroundI) InvitationHandlerI {
+	return &InvitationHandler{
+		invitationService:   invitationService,
+		organizationService: organizationService,
+		jwtService:          jwtService,
+		auditService:        auditService,
+		background:          background,
+	}
+}
+
+func (invitationHandler *InvitationHandler) Invite(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	membershipInterface, _ := c.Get("membership")
+	actor, membershipOk := membershipInterface.(*domain.Membership)
+	if !ok || !membershipOk {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	var inviteRequest InviteRequest
+	if err := c.ShouldBindJSON(&inviteRequest); err != nil || inviteRequest.Email == "" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	if inviteRequest.Role == "" {
+		inviteRequest.Role = domain.OrgRoleMember
+	}
+	invitation, token, err := invitationHandler.invitationService.Invite(actor, user, inviteRequest.Email, inviteRequest.Role)
+	if err != nil && err.ErrorBase.Error() == "invalid email" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Invalid email",
+		})
+		return
+	}
+	if err != nil && organizationErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("invitationHandler.Invite.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	invited, organizationName := *invitation, actor.Organization.Name
+	invitationHandler.background.Go("invitationService.SendInvitation", func() {
+		invitationHandler.invitationService.SendInvitation(invited, organizationName, token)
+	})
+	invitationHandler.auditService.Record(auditEvent(c, domain.AuditOrgInvite, domain.AuditSuccess, user.ID, 0, map[string]string{
+		"org_id":        strconv.FormatUint(uint64(invitation.OrganizationId), 10),
+		"invitation_id": strconv.FormatUint(uint64(invitation.ID), 10),
+		"email":         invitation.Email,
+		"role":          invitation.Role,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   invitation,
+		"error":  nil,
+	})
+}
+
+func (invitationHandler *InvitationHandler) ListInvitations(c *gin.Context) {
+	membershipInterface, _ := c.Get("membership")
+	actor, ok := membershipInterface.(*domain.Membership)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	invitations, err := invitationHandler.invitationService.ListInvitations(actor.OrganizationId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("invitationHandler.ListInvitations.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": InvitationsResponse{
+			Invitations: invitations,
+		},
+		"error": nil,
+	})
+}
+
+func (invitationHandler *InvitationHandler) RevokeInvitation(c *gin.Context) {
+	membershipInterface, _ := c.Get("membership")
+	actor, ok := membershipInterface.(*domain.Membership)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	invitationId, parseErr := strconv.ParseUint(c.Param("invitationId"), 10, 64)
+	if parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	err := invitationHandler.invitationService.RevokeInvitation(actor, uint(invitationId))
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "Invitation not found",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("invitationHandler.RevokeInvitation.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	invitationHandler.auditService.Record(auditEvent(c, domain.AuditOrgInviteRevoke, domain.AuditSuccess, actor.UserId, 0, map[string]string{
+		"org_id":        strconv.FormatUint(uint64(actor.OrganizationId), 10),
+		"invitation_id": strconv.FormatUint(invitationId, 10),
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   EmptyResponse{},
+		"error":  nil,
+	})
+}
+
+// Inspect shows the accept page what it is about to accept without consuming the token.
+func (invitationHandler *InvitationHandler) Inspect(c *gin.Context) {
+	invitation, accountExists, err := invitationHandler.invitationService.Inspect(c.Query("token"))
+	if err != nil && invitationErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("invitationHandler.Inspect.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": InvitationInfoResponse{
+			Email:         invitation.Email,
+			Role:          invitation.Role,
+			Organization:  invitation.Organization.Name,
+			ExpiresAt:     invitation.ExpiresAt,
+			AccountExists: accountExists,
+		},
+		"error": nil,
+	})
+}
+
+// Accept takes the invitation for a signed in user when an Authorization header is sent,
+// and otherwise for the invited email as described at InvitationServiceI.Accept. The
+// answer carries tokens already switched to the new organization.
+func (invitationHandler *InvitationHandler) Accept(c *gin.Context) {
+	var acceptRequest AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&acceptRequest); err != nil || acceptRequest.Token == "" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	var user *domain.User
+	if token := c.Request.Header.Get("Authorization"); token != "" {
+		var err *domain.MyError
+		user, err = invitationHandler.jwtService.ValidateToken(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusUnauthorized,
+				"body":   gin.H{},
+				"error":  "Unauthorized",
+			})
+			return
+		}
+	}
+	user, membership, err := invitationHandler.invitationService.Accept(acceptRequest.Token, user, acceptRequest.Fullname, acceptRequest.Password)
+	var validationError *domain.ValidationError
+	if err != nil && errors.As(err.ErrorBase, &validationError) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   newValidationErrorResponse(validationError),
+			"error":  "Validation failed",
+		})
+		return
+	}
+	if err != nil && invitationErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("invitationHandler.Accept.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	invitationHandler.auditService.Record(auditEvent(c, domain.AuditOrgInviteAccept, domain.AuditSuccess, user.ID, user.ID, map[string]string{
+		"org_id": strconv.FormatUint(uint64(membership.OrganizationId), 10),
+		"role":   membership.Role,
+	}))
+	options := domain.TokenOptions{OrgId: membership.OrganizationId}
+	accessToken, refreshToken, err := invitationHandler.jwtService.GenerateTokenPair(user, options)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("invitationHandler.Accept.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": OrganizationTokensResponse{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+			Organization: organizationView(membership),
+		},
+		"error": nil,
+	})
+}
+
+func (invitationHandler *InvitationHandler) RegisterRoutes(router *gin.RouterGroup) {
+	orgs := router.Group("/orgs")
+	orgs.Use(middlewares.CheckAuth(invitationHandler.jwtService))
+	admin := middlewares.RequireOrgRole(invitationHandler.organizationService, domain.OrgRoleAdmin)
+	orgs.POST("/:orgId/invitations", admin, invitationHandler.Invite)
+	orgs.GET("/:orgId/invitations", admin, invitationHandler.ListInvitations)
+	orgs.DELETE("/:orgId/invitations/:invitationId", admin, invitationHandler.RevokeInvitation)
+
+	router.GET("/invitations", invitationHandler.Inspect)
+	router.POST("/invitations/accept", invitationHandler.Accept)
+}
+
+// invitationErrorResponse answers the errors of a bad invite token or acceptance and
+// reports whether it did.
+func invitationErrorResponse(c *gin.Context, err *domain.MyError) bool {
+	switch err.ErrorBase.Error() {
+	case "invalid invitation":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Invalid invitation",
+		})
+	case "invitation expired":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusGone,
+			"body":   gin.H{},
+			"error":  "Invitation expired",
+		})
+	case "invitation already used":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusConflict,
+			"body":   gin.H{},
+			"error":  "Invitation already used",
+		})
+	case "invitation email mismatch":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusForbidden,
+			"body":   gin.H{},
+			"error":  "Invitation is for another email",
+		})
+	case "wrong credentials":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+	case "invalid credentials":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Invalid credentials",
+		})
+	case "already a member":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusConflict,
+			"body":   gin.H{},
+			"error":  "Already a member",
+		})
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"hitenok/pkg/domain"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LogoutHandler ends the session of the access token the request was made with, which
+// revokes the refresh token issued with it too. It has to run behind
+// middlewares.CheckAuth.
+func LogoutHandler(c *gin.Context, jwtService services.JWTServiceI, introspectionService services.IntrospectionServiceI, auditService services.AuditServiceI) {
+	userInterface, userExists := c.Get("user")
+	claimsInterface, claimsExist := c.Get("claims")
+	user, userOk := userInterface.(*domain.User)
+	claims, claimsOk := claimsInterface.(*domain.Claims)
+	if !userExists || !claimsExist || !userOk || !claimsOk {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	err := jwtService.EndSession(claims)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("LogoutHandler.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	introspectionService.Forget(c.Request.Header.Get("Authorization"))
+	introspectionService.ForgetSession(claims.SessionId)
+	auditService.Record(auditEvent(c, domain.AuditLogout, domain.AuditSuccess, user.ID, user.ID, nil))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   EmptyResponse{},
+		"error":  nil,
+	})
+}
@@ -0,0 +1,372 @@
+package handlers
+
+import (
+	"errors"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// OAuth endpoints are consumed by standard OAuth client libraries, so unlike the rest of
+// the API they answer with the RFC response bodies and real HTTP status codes.
+
+type DeviceCodeRequest struct {
+	ClientId string `form:"client_id" json:"client_id"`
+	Scope    string `form:"scope" json:"scope,omitempty"`
+}
+
+type TokenRequest struct {
+	GrantType  string `form:"grant_type" json:"grant_type"`
+	DeviceCode string `form:"device_code" json:"device_code"`
+	ClientId   string `form:"client_id" json:"client_id"`
+}
+
+type IntrospectRequest struct {
+	Token         string `form:"token" json:"token"`
+	TokenTypeHint string `form:"token_type_hint" json:"token_type_hint,omitempty"`
+}
+
+type RevokeRequest struct {
+	Token         string `form:"token" json:"token"`
+	TokenTypeHint string `form:"token_type_hint" json:"token_type_hint,omitempty"`
+}
+
+type DeviceApproveRequest struct {
+	UserCode string `json:"user_code"`
+	Approve  bool   `json:"approve"`
+}
+
+// DeviceCodeResponse is the device authorization response of RFC 8628 section 3.2.
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// TokenResponse is the access token response of RFC 6749 section 5.1.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+// OAuthErrorResponse is the error response of RFC 6749 section 5.2, e.g.
+// authorization_pending while the device flow waits for the user.
+type OAuthErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// DeviceInfoResponse is the pending request the verification page asks the user about.
+type DeviceInfoResponse struct {
+	UserCode  string    `json:"user_code"`
+	ClientId  string    `json:"client_id"`
+	Scope     string    `json:"scope"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type OAuthHandlerI interface {
+	DeviceCode(c *gin.Context)
+	Token(c *gin.Context)
+	DeviceInfo(c *gin.Context)
+	DeviceApprove(c *gin.Context)
+	Introspect(c *gin.Context)
+	Revoke(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type OAuthHandler struct {
+	deviceService        services.DeviceAuthorizationServiceI
+	jwtService           services.JWTServiceI
+	clientService        services.OAuthClientServiceI
+	introspectionService services.IntrospectionServiceI
+	denylistService      services.TokenDenylistServiceI
+	auditService         services.AuditServiceI
+	appConfig            *config.AppConfig
+}
+
+func NewOAuthHandler(deviceService services.DeviceAuthorizationServiceI, jwtService services.JWTServiceI, clientService services.OAuthClientServiceI, introspectionService services.IntrospectionServiceI, denylistService services.TokenDenylistServiceI, auditService services.AuditServiceI, appConfig *config.AppConfig) OAuthHandlerI {
+	return &OAuthHandler{
+		deviceService:        deviceService,
+		jwtService:           jwtService,
+		clientService:        clientService,
+		introspectionService: introspectionService,
+		denylistService:      denylistService,
+		auditService:         auditService,
+		appConfig:            appConfig,
+	}
+}
+
+func oauthError(c *gin.Context, status int, code string) {
+	c.AbortWithStatusJSON(status, OAuthErrorResponse{
+		Error: code,
+	})
+}
+
+// authenticateClient checks client credentials sent either with HTTP Basic auth or as
+// client_id/client_secret form parameters (RFC 6749 section 2.3.1).
+func (oauthHandler *OAuthHandler) authenticateClient(c *gin.Context) (string, bool) {
+	clientId, clientSecret, ok := c.Request.BasicAuth()
+	if !ok {
+		clientId = c.PostForm("client_id")
+		clientSecret = c.PostForm("client_secret")
+	}
+	err := oauthHandler.clientService.AuthenticateClient(clientId, clientSecret)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		oauthError(c, http.StatusUnauthorized, "invalid_client")
+		return "", false
+	}
+	return clientId, true
+}
+
+func (oauthHandler *OAuthHandler) DeviceCode(c *gin.Context) {
+	var deviceCodeRequest DeviceCodeRequest
+	if err := c.ShouldBind(&deviceCodeRequest); err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	deviceAuthorization, err := oauthHandler.deviceService.CreateAuthorization(deviceCodeRequest.ClientId, deviceCodeRequest.Scope)
+	if err != nil && err.ErrorBase.Error() == "invalid_client" {
+		oauthError(c, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error")
+		log.Printf("oauthHandler.DeviceCode.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	userCode := services.FormatUserCode(deviceAuthorization.UserCode)
+	c.JSON(http.StatusOK, DeviceCodeResponse{
+		DeviceCode:              deviceAuthorization.DeviceCode,
+		UserCode:                userCode,
+		VerificationUri:         oauthHandler.appConfig.DeviceVerificationUrl,
+		VerificationUriComplete: oauthHandler.appConfig.DeviceVerificationUrl + "?user_code=" + userCode,
+		ExpiresIn:               int(time.Until(deviceAuthorization.ExpiresAt).Seconds()),
+		Interval:                deviceAuthorization.Interval,
+	})
+}
+
+func (oauthHandler *OAuthHandler) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	var tokenRequest TokenRequest
+	if err := c.ShouldBind(&tokenRequest); err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	if tokenRequest.GrantType != deviceCodeGrantType {
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	if tokenRequest.DeviceCode == "" || tokenRequest.ClientId == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	user, scope, err := oauthHandler.deviceService.Poll(tokenRequest.DeviceCode, tokenRequest.ClientId)
+	if err != nil {
+		switch err.ErrorBase.Error() {
+		case "authorization_pending", "slow_down", "access_denied", "expired_token", "invalid_grant":
+			oauthError(c, http.StatusBadRequest, err.ErrorBase.Error())
+			return
+		}
+		oauthError(c, http.StatusInternalServerError, "server_error")
+		log.Printf("oauthHandler.Token.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	tokenOptions := domain.TokenOptions{
+		ClientId: tokenRequest.ClientId,
+		Scope:    scope,
+	}
+	accessToken, refreshToken, err := oauthHandler.jwtService.GenerateTokenPair(user, tokenOptions)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error")
+		log.Printf("oauthHandler.Token.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oauthHandler.appConfig.Jwt.AccessTtl.Seconds()),
+		Scope:        scope,
+	})
+}
+
+func (oauthHandler *OAuthHandler) Introspect(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	if _, ok := oauthHandler.authenticateClient(c); !ok {
+		return
+	}
+	var introspectRequest IntrospectRequest
+	if err := c.ShouldBind(&introspectRequest); err != nil || introspectRequest.Token == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	introspection, err := oauthHandler.introspectionService.Introspect(introspectRequest.Token)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error")
+		log.Printf("oauthHandler.Introspect.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, introspection)
+}
+
+// Revoke implements RFC 7009. Tokens that are already invalid count as revoked, so the
+// endpoint answers 200 for them as the RFC requires.
+func (oauthHandler *OAuthHandler) Revoke(c *gin.Context) {
+	clientId, ok := oauthHandler.authenticateClient(c)
+	if !ok {
+		return
+	}
+	var revokeRequest RevokeRequest
+	if err := c.ShouldBind(&revokeRequest); err != nil || revokeRequest.Token == "" {
+		oauthError(c, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	_, claims, err := oauthHandler.jwtService.ValidateTokenClaims(revokeRequest.Token, domain.AnyTokenType)
+	if err != nil {
+		c.Status(http.StatusOK)
+		return
+	}
+	if claims.ClientId != "" && claims.ClientId != clientId {
+		oauthError(c, http.StatusBadRequest, "unauthorized_client")
+		return
+	}
+	// Revoking a refresh token ends its session, taking the access tokens of the same
+	// grant with it as RFC 7009 recommends.
+	if claims.TokenType == domain.RefreshTokenType {
+		err = oauthHandler.jwtService.EndSession(claims)
+	} else {
+		err = oauthHandler.denylistService.Revoke(claims)
+	}
+	if err != nil {
+		oauthError(c, http.StatusServiceUnavailable, "temporarily_unavailable")
+		log.Printf("oauthHandler.Revoke.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	oauthHandler.introspectionService.Forget(revokeRequest.Token)
+	if claims.TokenType == domain.RefreshTokenType {
+		oauthHandler.introspectionService.ForgetSession(claims.SessionId)
+	}
+	oauthHandler.auditService.Record(auditEvent(c, domain.AuditTokenRevoke, domain.AuditSuccess, 0, claims.UserId, map[string]string{
+		"client_id": clientId,
+		"jti":       claims.ID,
+	}))
+	c.Status(http.StatusOK)
+}
+
+// DeviceInfo lets the verification page show the user which client is asking for access
+// before they approve it.
+func (oauthHandler *OAuthHandler) DeviceInfo(c *gin.Context) {
+	deviceAuthorization, err := oauthHandler.deviceService.GetPendingAuthorization(c.Query("user_code"))
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "Unknown or expired code",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("oauthHandler.DeviceInfo.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": DeviceInfoResponse{
+			UserCode:  services.FormatUserCode(deviceAuthorization.UserCode),
+			ClientId:  deviceAuthorization.ClientId,
+			Scope:     deviceAuthorization.Scope,
+			ExpiresAt: deviceAuthorization.ExpiresAt,
+		},
+		"error": nil,
+	})
+}
+
+func (oauthHandler *OAuthHandler) DeviceApprove(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	var approveRequest DeviceApproveRequest
+	if err := c.ShouldBindJSON(&approveRequest); err != nil || approveRequest.UserCode == "" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	var err *domain.MyError
+	if approveRequest.Approve {
+		err = oauthHandler.deviceService.Approve(approveRequest.UserCode, user)
+	} else {
+		err = oauthHandler.deviceService.Deny(approveRequest.UserCode, user)
+	}
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "Unknown or expired code",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("oauthHandler.DeviceApprove.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	action := domain.AuditDeviceDeny
+	if approveRequest.Approve {
+		action = domain.AuditDeviceApprove
+	}
+	oauthHandler.auditService.Record(auditEvent(c, action, domain.AuditSuccess, user.ID, user.ID, map[string]string{
+		"user_code": services.NormalizeUserCode(approveRequest.UserCode),
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   EmptyResponse{},
+		"error":  nil,
+	})
+}
+
+func (oauthHandler *OAuthHandler) RegisterRoutes(router *gin.RouterGroup) {
+	oauth := router.Group("/oauth")
+	oauth.POST("/device/code", oauthHandler.DeviceCode)
+	oauth.POST("/token", oauthHandler.Token)
+	oauth.POST("/introspect", oauthHandler.Introspect)
+	oauth.POST("/revoke", oauthHandler.Revoke)
+
+	device := oauth.Group("/device")
+	device.Use(middlewares.CheckAuth(oauthHandler.jwtService))
+	device.GET("", oauthHandler.DeviceInfo)
+	device.POST("/approve", oauthHandler.DeviceApprove)
+}
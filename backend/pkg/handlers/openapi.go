@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"bytes"
+	_ "embed"
+	"hitenok/pkg/config"
+	"hitenok/pkg/openapi"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+//go:embed swagger_ui.html
+var swaggerUiPage string
+
+var swaggerUiTemplate = template.Must(template.New("swagger_ui").Parse(swaggerUiPage))
+
+type OpenAPIHandlerI interface {
+	Document(c *gin.Context)
+	SwaggerUI(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+// OpenAPIHandler serves the OpenAPI document built from apiOperations and, when
+// enabled, a Swagger UI page browsing it. Both are built once.
+type OpenAPIHandler struct {
+	document  *openapi.Document
+	swaggerUi []byte
+	appConfig *config.AppConfig
+}
+
+func NewOpenAPIHandler(appConfig *config.AppConfig) OpenAPIHandlerI {
+	document := NewOpenAPIDocument(appConfig)
+	var swaggerUi bytes.Buffer
+	err := swaggerUiTemplate.Execute(&swaggerUi, map[string]string{
+		"Title":       document.Info.Title,
+		"Assets":      strings.TrimSuffix(appConfig.OpenApi.SwaggerUiAssets, "/"),
+		"DocumentUrl": "openapi.json",
+	})
+	if err != nil {
+		log.Printf("NewOpenAPIHandler.swaggerUiTemplate.Execute: %v", err)
+	}
+	return &OpenAPIHandler{
+		document:  document,
+		swaggerUi: swaggerUi.Bytes(),
+		appConfig: appConfig,
+	}
+}
+
+func (openAPIHandler *OpenAPIHandler) Document(c *gin.Context) {
+	c.JSON(http.StatusOK, openAPIHandler.document)
+}
+
+func (openAPIHandler *OpenAPIHandler) SwaggerUI(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", openAPIHandler.swaggerUi)
+}
+
+// RegisterRoutes expects the /api group; the page finds the document next to itself.
+func (openAPIHandler *OpenAPIHandler) RegisterRoutes(router *gin.RouterGroup) {
+	router.GET("/openapi.json", openAPIHandler.Document)
+	if openAPIHandler.appConfig.OpenApi.SwaggerUi {
+		router.GET("/docs", openAPIHandler.SwaggerUI)
+	}
+}
+
+const (
+	securityAccessToken  = "accessToken"
+	securityRefreshToken = "refreshToken"
+	securityBearerToken  = "bearerToken"
+	securityCookie       = "sessionCookie"
+	securityClient       = "clientCredentials"
+)
+
+// NewOpenAPIDocument describes every route of apiOperations. Enveloped answers are
+// documented as HTTP 200 with either the success envelope of the operation or the
+// shared ErrorEnvelope.
+func NewOpenAPIDocument(appConfig *config.AppConfig) *openapi.Document {
+	document := openapi.NewDocument(openapi.Info{
+		Title:   "go-gin-auth API",
+		Version: "v1",
+		Description: "Unless an operation says otherwise, every answer is HTTP 200 with the envelope " +
+			`{"status": <HTTP status of the outcome>, "body": <object>, "error": <message or null>}.`,
+	}, openapi.Server{Url: appConfig.PublicUrl})
+	document.Define(gorm.DeletedAt{}, &openapi.Schema{Type: []string{"string", "null"}, Format: "date-time"})
+
+	document.Components.SecuritySchemes = map[string]openapi.SecurityScheme{
+		securityAccessToken: {
+			Type:        "apiKey",
+			In:          "header",
+			Name:        "Authorization",
+			Description: `An access token as the raw header value, without "Bearer ".`,
+		},
+		securityRefreshToken: {
+			Type:        "apiKey",
+			In:          "header",
+			Name:        "Authorization",
+			Description: `A refresh token as the raw header value, without "Bearer ".`,
+		},
+		securityBearerToken: {
+			Type:   "http",
+			Scheme: "bearer",
+		},
+		securityCookie: {
+			Type: "apiKey",
+			In:   "cookie",
+			Name: appConfig.ForwardAuthCookie,
+		},
+		securityClient: {
+			Type:        "http",
+			Scheme:      "basic",
+			Description: "Confidential OAuth client credentials; the client_id and client_secret form parameters work too.",
+		},
+	}
+	maxProperties := 0
+	document.Components.Schemas["ErrorEnvelope"] = &openapi.Schema{
+		Type:     "object",
+		Required: []string{"status", "body", "error"},
+		Properties: map[string]*openapi.Schema{
+			"status": {Type: "integer", Description: "The HTTP status of the outcome, 400 or above."},
+			"body": {OneOf: []*openapi.Schema{
+				{Type: "object", MaxProperties: &maxProperties},
+				document.Schema(ValidationErrorResponse{}),
+			}},
+			"error": {Type: "string"},
+		},
+	}
+
+	for _, operation := range apiOperations {
+		if operation.onlyIf != nil && !operation.onlyIf(appConfig) {
+			continue
+		}
+		methods := []string{operation.method}
+		if operation.method == "ANY" {
+			methods = anyMethods
+		}
+		for _, method := range methods {
+			id := operation.id
+			if len(methods) > 1 {
+				id += strings.ToUpper(method[:1]) + strings.ToLower(method[1:])
+			}
+			document.Add(method, operation.path, operation.build(document, id))
+		}
+	}
+	return document
+}
+
+// anyMethods are the methods of gin's Any that OpenAPI can describe; it has no CONNECT.
+var anyMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+	http.MethodHead, http.MethodOptions, http.MethodTrace,
+}
+
+// apiOperation describes a route. body is the success body inside the envelope; routes
+// outside the envelope set response instead, or neither when they answer with a bare
+// status. statuses lists the other HTTP statuses such routes answer with.
+type apiOperation struct {
+	method      string
+	path        string
+	id          string
+	tag         string
+	summary     string
+	description string
+	// security lists alternatives; "" allows anonymous calls.
+	security        []string
+	parameters      []openapi.Parameter
+	request         interface{}
+	form            bool
+	optionalRequest bool
+	body            interface{}
+	response        interface{}
+	mediaType       string
+	statuses        map[int]string
+	errorResponse   interface{}
+	// onlyIf leaves out routes registered only under some configuration.
+	onlyIf func(appConfig *config.AppConfig) bool
+}
+
+func (operation apiOperation) build(document *openapi.Document, id string) *openapi.Operation {
+	built := &openapi.Operation{
+		OperationId: id,
+		Tags:        []string{operation.tag},
+		Summary:     operation.summary,
+		Description: operation.description,
+		Parameters:  operation.parameters,
+		Responses:   map[string]*openapi.Response{},
+	}
+	for _, scheme := range operation.security {
+		requirement := map[string][]string{}
+		if scheme != "" {
+			requirement[scheme] = []string{}
+		}
+		built.Security = append(built.Security, requirement)
+	}
+	if operation.request != nil {
+		content := map[string]openapi.MediaType{
+			"application/json": {Schema: document.Schema(operation.request)},
+		}
+		if operation.form {
+			content["application/x-www-form-urlencoded"] = content["application/json"]
+		}
+		built.RequestBody = &openapi.RequestBody{Required: !operation.optionalRequest, Content: content}
+	}
+
+	switch {
+	case operation.body != nil:
+		built.Responses["200"] = &openapi.Response{
+			Description: "The envelope; its status tells the outcome.",
+			Content: map[string]openapi.MediaType{
+				"application/json": {Schema: &openapi.Schema{OneOf: []*openapi.Schema{
+					{
+						Type:     "object",
+						Required: []string{"status", "body", "error"},
+						Properties: map[string]*openapi.Schema{
+							"status": {Type: "integer", Description: "The HTTP status of the outcome, below 300."},
+							"body":   document.Schema(operation.body),
+							"error":  {Type: "null"},
+						},
+					},
+					{Ref: "#/components/schemas/ErrorEnvelope"},
+				}}},
+			},
+		}
+	case operation.response != nil:
+		mediaType := operation.mediaType
+		if mediaType == "" {
+			mediaType = "application/json"
+		}
+		built.Responses["200"] = &openapi.Response{
+			Description: "OK",
+			Content: map[string]openapi.MediaType{
+				mediaType: {Schema: document.Schema(operation.response)},
+			},
+		}
+	default:
+		built.Responses["200"] = &openapi.Response{Description: "OK"}
+	}
+	for status, description := range operation.statuses {
+		response := &openapi.Response{Description: description}
+		if operation.errorResponse != nil {
+			response.Content = map[string]openapi.MediaType{
+				"application/json": {Schema: document.Schema(operation.errorResponse)},
+			}
+		}
+		built.Responses[strconv.Itoa(status)] = response
+	}
+	return built
+}
+
+func queryParameter(name, description string) openapi.Parameter {
+	return openapi.Parameter{Name: name, In: "query", Description: description, Schema: &openapi.Schema{Type: "string"}}
+}
+
+func headerParameter(name, description string) openapi.Parameter {
+	return openapi.Parameter{Name: name, In: "header", Description: description, Schema: &openapi.Schema{Type: "string"}}
+}
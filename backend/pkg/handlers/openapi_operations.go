@@ -0,0 +1,625 @@
+package handlers
+
+import (
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/openapi"
+	"net/http"
+)
+
+var auditFilterParameters = []openapi.Parameter{
+	queryParameter("action", "only this action, e.g. auth.sign_in"),
+	queryParameter("outcome", "only success or failure"),
+	queryParameter("since", "RFC 3339 time, inclusive"),
+	queryParameter("until", "RFC 3339 time, exclusive"),
+	queryParameter("before_id", "page backwards from this event id"),
+	queryParameter("limit", "page size"),
+}
+
+var adminAuditParameters = append([]openapi.Parameter{
+	queryParameter("actor_id", "only events by this user"),
+	queryParameter("subject_id", "only events on this user"),
+	queryParameter("user_id", "only events by or on this user"),
+}, auditFilterParameters...)
+
+// apiOperations lists every route of the handlers for the OpenAPI document. A route
+// registered in a RegisterRoutes but missing here fails the app tests.
+var apiOperations = []apiOperation{
+	// HealthHandler
+	{
+		method:  http.MethodGet,
+		path:    "/healthz",
+		id:      "live",
+		tag:     "health",
+		summary: "Liveness probe",
+		body:    LiveResponse{},
+	},
+	{
+		method:      http.MethodGet,
+		path:        "/readyz",
+		id:          "ready",
+		tag:         "health",
+		summary:     "Readiness probe",
+		description: "Checks the database, the keyrings and the workers, and the mail relay when configured. Answers with the real HTTP status.",
+		body:        domain.HealthReport{},
+		statuses: map[int]string{
+			http.StatusServiceUnavailable: `Not ready: the envelope with the error "Not ready" and the report as body.`,
+		},
+	},
+
+	// OpenAPIHandler
+	{
+		method:   http.MethodGet,
+		path:     "/api/openapi.json",
+		id:       "openApiDocument",
+		tag:      "docs",
+		summary:  "This document",
+		response: &openapi.Schema{Type: "object", Description: "An OpenAPI 3.1 document."},
+	},
+	{
+		method:    http.MethodGet,
+		path:      "/api/docs",
+		id:        "swaggerUi",
+		tag:       "docs",
+		summary:   "Swagger UI browsing this document",
+		response:  &openapi.Schema{Type: "string"},
+		mediaType: "text/html",
+		onlyIf:    func(appConfig *config.AppConfig) bool { return appConfig.OpenApi.SwaggerUi },
+	},
+
+	// MailAuthHandler
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/auth/mail/sign-in",
+		id:          "signIn",
+		tag:         "auth",
+		summary:     "Sign in with email and password",
+		description: `With an expired password the body has state "password_change_required" and an access token good only for changing it.`,
+		request:     SignInRequest{},
+		body:        SignInResponse{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/auth/mail/sign-up",
+		id:          "signUp",
+		tag:         "auth",
+		summary:     "Register an account",
+		description: "The account is inactive until activated with the code mailed to it.",
+		request:     SignUpRequest{},
+		body:        UserIdResponse{},
+	},
+
+	// ActivateHandler
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/auth/activate",
+		id:          "activate",
+		tag:         "auth",
+		summary:     "Verify a mailed code",
+		description: "Activates an inactive account and signs it in, or trades the code of an active one for a password reset hash.",
+		request:     ActivateRequest{},
+		body:        ActivateResponse{},
+	},
+	{
+		method:  http.MethodPost,
+		path:    "/api/v1/auth/resend",
+		id:      "resendCode",
+		tag:     "auth",
+		summary: "Mail a new code, for activation or a password reset",
+		request: ResendRequest{},
+		body:    UserIdResponse{},
+	},
+	{
+		method:  http.MethodPost,
+		path:    "/api/v1/auth/reset-password",
+		id:      "resetPassword",
+		tag:     "auth",
+		summary: "Set a new password with a reset hash",
+		request: ResetPasswordRequest{},
+		body:    EmptyResponse{},
+	},
+
+	// RefreshJWTHandler and LogoutHandler
+	{
+		method:      http.MethodGet,
+		path:        "/api/v1/auth/refresh-token",
+		id:          "refreshTokens",
+		tag:         "auth",
+		summary:     "Trade a refresh token for a new token pair",
+		description: "The refresh token is revoked; keep the new one.",
+		security:    []string{securityRefreshToken},
+		body:        TokenPairResponse{},
+	},
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/auth/logout",
+		id:       "logout",
+		tag:      "auth",
+		summary:  "End the session: revoke the access token and the refresh token issued with it",
+		security: []string{securityAccessToken},
+		body:     EmptyResponse{},
+	},
+
+	// ForwardAuthHandler
+	{
+		method:  "ANY",
+		path:    "/api/v1/auth/verify",
+		id:      "verify",
+		tag:     "auth",
+		summary: "Forward authentication for reverse proxies",
+		description: "Answers with bare statuses and passes the user id, email and roles on in response headers. " +
+			"The roles query parameter or X-Auth-Required-Roles header lists roles of which one is required.",
+		security: []string{securityAccessToken, securityBearerToken, securityCookie},
+		parameters: []openapi.Parameter{
+			queryParameter("roles", "comma separated roles, any one suffices"),
+			queryParameter("redirect", "1 to redirect browsers to the login page instead of answering 401"),
+			headerParameter("X-Auth-Required-Roles", "comma separated roles, when the query has none"),
+		},
+		statuses: map[int]string{
+			http.StatusFound:              "Redirect to the login page",
+			http.StatusUnauthorized:       "No valid token",
+			http.StatusForbidden:          "None of the required roles",
+			http.StatusServiceUnavailable: "The token could not be checked",
+		},
+	},
+
+	// UserHandler
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/users/me",
+		id:       "getProfile",
+		tag:      "users",
+		summary:  "The profile of the signed in user",
+		security: []string{securityAccessToken},
+		body:     ProfileResponse{},
+	},
+	{
+		method:      http.MethodPatch,
+		path:        "/api/v1/users/me",
+		id:          "updateProfile",
+		tag:         "users",
+		summary:     "Change the fields present in the request",
+		description: "Send the ETag of the profile in If-Match to refuse the change when it was modified meanwhile.",
+		security:    []string{securityAccessToken},
+		parameters:  []openapi.Parameter{headerParameter("If-Match", "ETag of the profile read")},
+		request:     domain.ProfileUpdate{},
+		body:        ProfileUpdateResponse{},
+	},
+
+	// AccountHandler
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/users/me/export",
+		id:       "exportAccount",
+		tag:      "users",
+		summary:  "Download the data kept about the user",
+		security: []string{securityAccessToken},
+		response: domain.UserExport{},
+	},
+	{
+		method:      http.MethodDelete,
+		path:        "/api/v1/users/me",
+		id:          "deleteAccount",
+		tag:         "users",
+		summary:     "Delete the account",
+		description: "The account is gone at once and purged after the grace period; until then an admin can restore it.",
+		security:    []string{securityAccessToken},
+		request:     DeleteAccountRequest{},
+		body:        DeleteAccountResponse{},
+	},
+
+	// ApiKeyHandler
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/users/me/api-keys",
+		id:          "createApiKey",
+		tag:         "users",
+		summary:     "Create an API key",
+		description: "The key is in this answer only; resource servers check it with the introspection endpoint.",
+		security:    []string{securityAccessToken},
+		request:     CreateApiKeyRequest{},
+		body:        ApiKeyCreatedResponse{},
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/users/me/api-keys",
+		id:       "listApiKeys",
+		tag:      "users",
+		summary:  "List the API keys of the user",
+		security: []string{securityAccessToken},
+		body:     ApiKeysResponse{},
+	},
+	{
+		method:   http.MethodDelete,
+		path:     "/api/v1/users/me/api-keys/:keyId",
+		id:       "deleteApiKey",
+		tag:      "users",
+		summary:  "Revoke an API key",
+		security: []string{securityAccessToken},
+		body:     EmptyResponse{},
+	},
+
+	// PasswordHandler
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/users/me/password",
+		id:          "changePassword",
+		tag:         "users",
+		summary:     "Change the password",
+		description: "Also takes the restricted token of a sign-in with an expired password. Ends the other sessions.",
+		security:    []string{securityAccessToken},
+		request:     ChangePasswordRequest{},
+		body:        TokenPairResponse{},
+	},
+
+	// EmailChangeHandler
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/users/me/email",
+		id:          "requestEmailChange",
+		tag:         "users",
+		summary:     "Start changing the email",
+		description: "Mails a code to the new address and a cancel link to the old one.",
+		security:    []string{securityAccessToken},
+		request:     EmailChangeRequest{},
+		body:        EmailChangeResponse{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/users/me/email/confirm",
+		id:          "confirmEmailChange",
+		tag:         "users",
+		summary:     "Confirm the email change with the mailed code",
+		description: "Ends every session and answers with new tokens.",
+		security:    []string{securityAccessToken},
+		request:     ConfirmEmailChangeRequest{},
+		body:        EmailChangedResponse{},
+	},
+	{
+		method:      http.MethodGet,
+		path:        "/api/v1/users/email/cancel",
+		id:          "cancelEmailChangePage",
+		tag:         "users",
+		summary:     "The page of the cancel link mailed to the old address",
+		description: "Changes nothing; its form posts the token to cancelEmailChange.",
+		parameters:  []openapi.Parameter{queryParameter("token", "the cancel token of the link")},
+		response:    &openapi.Schema{Type: "string"},
+		mediaType:   "text/html",
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/users/email/cancel",
+		id:          "cancelEmailChange",
+		tag:         "users",
+		summary:     "Cancel an email change with the token of the mailed link",
+		description: "Clients accepting text/html get a result page instead of the envelope.",
+		request:     CancelEmailChangeRequest{},
+		form:        true,
+		body:        EmptyResponse{},
+	},
+
+	// AuditHandler
+	{
+		method:     http.MethodGet,
+		path:       "/api/v1/users/me/activity",
+		id:         "listActivity",
+		tag:        "users",
+		summary:    "Audit events by or on the signed in user",
+		security:   []string{securityAccessToken},
+		parameters: auditFilterParameters,
+		body:       ActivityResponse{},
+	},
+	{
+		method:     http.MethodGet,
+		path:       "/api/v1/admin/audit",
+		id:         "queryAudit",
+		tag:        "admin",
+		summary:    "Query the audit log, newest first",
+		security:   []string{securityAccessToken},
+		parameters: adminAuditParameters,
+		body:       AuditEventsResponse{},
+	},
+	{
+		method:      http.MethodGet,
+		path:        "/api/v1/admin/audit/export",
+		id:          "exportAudit",
+		tag:         "admin",
+		summary:     "Download the matching audit events",
+		description: "One event per line, as JSON Lines.",
+		security:    []string{securityAccessToken},
+		parameters:  adminAuditParameters,
+		response:    domain.AuditEvent{},
+		mediaType:   "application/x-ndjson",
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/admin/audit/verify",
+		id:       "verifyAudit",
+		tag:      "admin",
+		summary:  "Check the hash chain of the audit log",
+		security: []string{securityAccessToken},
+		body:     domain.AuditVerification{},
+	},
+
+	// WebhookHandler
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/admin/webhooks",
+		id:       "createWebhook",
+		tag:      "admin",
+		summary:  "Subscribe an endpoint to events, all of them when none are listed",
+		security: []string{securityAccessToken},
+		request:  WebhookRequest{},
+		body:     WebhookCreatedResponse{},
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/admin/webhooks",
+		id:       "listWebhooks",
+		tag:      "admin",
+		summary:  "List the subscriptions and the event types",
+		security: []string{securityAccessToken},
+		body:     WebhooksResponse{},
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/admin/webhooks/:webhookId",
+		id:       "getWebhook",
+		tag:      "admin",
+		summary:  "Get a subscription",
+		security: []string{securityAccessToken},
+		body:     WebhookResponse{},
+	},
+	{
+		method:   http.MethodPatch,
+		path:     "/api/v1/admin/webhooks/:webhookId",
+		id:       "updateWebhook",
+		tag:      "admin",
+		summary:  "Change the fields present in the request",
+		security: []string{securityAccessToken},
+		request:  WebhookRequest{},
+		body:     WebhookResponse{},
+	},
+	{
+		method:   http.MethodDelete,
+		path:     "/api/v1/admin/webhooks/:webhookId",
+		id:       "deleteWebhook",
+		tag:      "admin",
+		summary:  "Delete a subscription",
+		security: []string{securityAccessToken},
+		body:     EmptyResponse{},
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/admin/webhooks/:webhookId/deliveries",
+		id:       "listWebhookDeliveries",
+		tag:      "admin",
+		summary:  "Page through the deliveries, newest first",
+		security: []string{securityAccessToken},
+		parameters: []openapi.Parameter{
+			queryParameter("before_id", "page backwards from this delivery id"),
+			queryParameter("limit", "page size"),
+		},
+		body: DeliveriesResponse{},
+	},
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/admin/webhooks/:webhookId/ping",
+		id:       "pingWebhook",
+		tag:      "admin",
+		summary:  "Deliver a ping event now",
+		security: []string{securityAccessToken},
+		body:     DeliveryResponse{},
+	},
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/admin/webhooks/:webhookId/deliveries/:deliveryId/replay",
+		id:       "replayWebhookDelivery",
+		tag:      "admin",
+		summary:  "Queue a delivery again",
+		security: []string{securityAccessToken},
+		body:     DeliveryResponse{},
+	},
+
+	// OrganizationHandler
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/orgs",
+		id:       "createOrganization",
+		tag:      "organizations",
+		summary:  "Create an organization owned by the user",
+		security: []string{securityAccessToken},
+		request:  CreateOrganizationRequest{},
+		body:     OrganizationResponse{},
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/orgs",
+		id:       "listOrganizations",
+		tag:      "organizations",
+		summary:  "The organizations of the user",
+		security: []string{securityAccessToken},
+		body:     OrganizationsResponse{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/orgs/:orgId/switch",
+		id:          "switchOrganization",
+		tag:         "organizations",
+		summary:     "Get tokens for an organization",
+		description: "The old tokens stay valid for the organization they were issued for.",
+		security:    []string{securityAccessToken},
+		body:        OrganizationTokensResponse{},
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/orgs/:orgId/members",
+		id:       "listMembers",
+		tag:      "organizations",
+		summary:  "List the members",
+		security: []string{securityAccessToken},
+		body:     MembersResponse{},
+	},
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/orgs/:orgId/members",
+		id:       "addMember",
+		tag:      "organizations",
+		summary:  "Add an existing user; admins only",
+		security: []string{securityAccessToken},
+		request:  AddMemberRequest{},
+		body:     MemberResponse{},
+	},
+	{
+		method:   http.MethodPatch,
+		path:     "/api/v1/orgs/:orgId/members/:userId",
+		id:       "changeMemberRole",
+		tag:      "organizations",
+		summary:  "Change the role of a member; admins only",
+		security: []string{securityAccessToken},
+		request:  ChangeRoleRequest{},
+		body:     MemberRoleResponse{},
+	},
+	{
+		method:   http.MethodDelete,
+		path:     "/api/v1/orgs/:orgId/members/:userId",
+		id:       "removeMember",
+		tag:      "organizations",
+		summary:  "Remove a member, or leave the organization",
+		security: []string{securityAccessToken},
+		body:     EmptyResponse{},
+	},
+
+	// InvitationHandler
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/orgs/:orgId/invitations",
+		id:       "invite",
+		tag:      "invitations",
+		summary:  "Invite an email; admins only",
+		security: []string{securityAccessToken},
+		request:  InviteRequest{},
+		body:     domain.Invitation{},
+	},
+	{
+		method:   http.MethodGet,
+		path:     "/api/v1/orgs/:orgId/invitations",
+		id:       "listInvitations",
+		tag:      "invitations",
+		summary:  "List the open invitations; admins only",
+		security: []string{securityAccessToken},
+		body:     InvitationsResponse{},
+	},
+	{
+		method:   http.MethodDelete,
+		path:     "/api/v1/orgs/:orgId/invitations/:invitationId",
+		id:       "revokeInvitation",
+		tag:      "invitations",
+		summary:  "Revoke an invitation; admins only",
+		security: []string{securityAccessToken},
+		body:     EmptyResponse{},
+	},
+	{
+		method:     http.MethodGet,
+		path:       "/api/v1/invitations",
+		id:         "inspectInvitation",
+		tag:        "invitations",
+		summary:    "Show an invitation without accepting it",
+		parameters: []openapi.Parameter{queryParameter("token", "the invitation token")},
+		body:       InvitationInfoResponse{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/invitations/accept",
+		id:          "acceptInvitation",
+		tag:         "invitations",
+		summary:     "Accept an invitation",
+		description: "Signed in, for the user of the token; otherwise for the invited email, creating its account when it has none.",
+		security:    []string{securityAccessToken, ""},
+		request:     AcceptInvitationRequest{},
+		body:        OrganizationTokensResponse{},
+	},
+
+	// OAuthHandler: RFC bodies and real HTTP statuses.
+	{
+		method:        http.MethodPost,
+		path:          "/api/v1/oauth/device/code",
+		id:            "oauthDeviceCode",
+		tag:           "oauth",
+		summary:       "Start a device authorization (RFC 8628)",
+		request:       DeviceCodeRequest{},
+		form:          true,
+		response:      DeviceCodeResponse{},
+		statuses:      oauthErrorStatuses,
+		errorResponse: OAuthErrorResponse{},
+	},
+	{
+		method:        http.MethodPost,
+		path:          "/api/v1/oauth/token",
+		id:            "oauthToken",
+		tag:           "oauth",
+		summary:       "Poll for the tokens of a device authorization",
+		request:       TokenRequest{},
+		form:          true,
+		response:      TokenResponse{},
+		statuses:      oauthErrorStatuses,
+		errorResponse: OAuthErrorResponse{},
+	},
+	{
+		method:        http.MethodPost,
+		path:          "/api/v1/oauth/introspect",
+		id:            "oauthIntrospect",
+		tag:           "oauth",
+		summary:       "Token introspection (RFC 7662)",
+		description:   "Accepts access tokens, refresh tokens and API keys.",
+		security:      []string{securityClient},
+		request:       IntrospectRequest{},
+		form:          true,
+		response:      domain.Introspection{},
+		statuses:      oauthErrorStatuses,
+		errorResponse: OAuthErrorResponse{},
+	},
+	{
+		method:      http.MethodPost,
+		path:        "/api/v1/oauth/revoke",
+		id:          "oauthRevoke",
+		tag:         "oauth",
+		summary:     "Token revocation (RFC 7009)",
+		description: "Tokens that are already invalid count as revoked.",
+		security:    []string{securityClient},
+		request:     RevokeRequest{},
+		form:        true,
+		statuses: map[int]string{
+			http.StatusBadRequest:         "invalid_request, or unauthorized_client for a token of another client",
+			http.StatusUnauthorized:       "invalid_client",
+			http.StatusServiceUnavailable: "temporarily_unavailable",
+		},
+		errorResponse: OAuthErrorResponse{},
+	},
+	{
+		method:     http.MethodGet,
+		path:       "/api/v1/oauth/device",
+		id:         "getDeviceAuthorization",
+		tag:        "oauth",
+		summary:    "The pending device authorization of a user code",
+		security:   []string{securityAccessToken},
+		parameters: []openapi.Parameter{queryParameter("user_code", "the code shown on the device")},
+		body:       DeviceInfoResponse{},
+	},
+	{
+		method:   http.MethodPost,
+		path:     "/api/v1/oauth/device/approve",
+		id:       "approveDeviceAuthorization",
+		tag:      "oauth",
+		summary:  "Approve or deny a device authorization",
+		security: []string{securityAccessToken},
+		request:  DeviceApproveRequest{},
+		body:     EmptyResponse{},
+	},
+}
+
+var oauthErrorStatuses = map[int]string{
+	http.StatusBadRequest:          "invalid_request, unsupported_grant_type, authorization_pending, slow_down, access_denied, expired_token or invalid_grant",
+	http.StatusUnauthorized:        "invalid_client",
+	http.StatusInternalServerError: "server_error",
+}
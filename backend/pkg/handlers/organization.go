@@ -0,0 +1,493 @@
+package handlers
+
+import (
+	"errors"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type CreateOrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+// AddMemberRequest adds a member with Role, by default member.
+type AddMemberRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role,omitempty"`
+}
+
+type ChangeRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type OrganizationResponse struct {
+	Id   uint   `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// OrganizationListEntry is a membership of the user; Active marks the organization the
+// token was issued for.
+type OrganizationListEntry struct {
+	Id     uint   `json:"id"`
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	Active bool   `json:"active"`
+}
+
+type OrganizationsResponse struct {
+	Organizations []OrganizationListEntry `json:"organizations"`
+}
+
+// OrganizationTokensResponse carries a token pair switched to Organization.
+type OrganizationTokensResponse struct {
+	AccessToken  string               `json:"access_token"`
+	RefreshToken string               `json:"refresh_token"`
+	Organization OrganizationResponse `json:"organization"`
+}
+
+type MemberResponse struct {
+	UserId   uint   `json:"user_id"`
+	Email    string `json:"email"`
+	Fullname string `json:"fullname"`
+	Role     string `json:"role"`
+}
+
+type MembersResponse struct {
+	Members []MemberResponse `json:"members"`
+}
+
+type MemberRoleResponse struct {
+	UserId uint   `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type OrganizationHandlerI interface {
+	CreateOrganization(c *gin.Context)
+	ListOrganizations(c *gin.Context)
+	SwitchOrganization(c *gin.Context)
+	ListMembers(c *gin.Context)
+	AddMember(c *gin.Context)
+	ChangeRole(c *gin.Context)
+	RemoveMember(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type OrganizationHandler struct {
+	organizationService services.OrganizationServiceI
+	jwtService          services.JWTServiceI
+	auditService        services.AuditServiceI
+}
+
+func NewOrganizationHandler(organizationService services.OrganizationServiceI, jwtService services.JWTServiceI, auditService services.AuditServiceI) OrganizationHandlerI {
+	return &OrganizationHandler{
+		organizationService: organizationService,
+		jwtService:          jwtService,
+		auditService:        auditService,
+	}
+}
+
+func (organizationHandler *OrganizationHandler) CreateOrganization(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	var createRequest CreateOrganizationRequest
+	if err := c.ShouldBindJSON(&createRequest); err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	membership, err := organizationHandler.organizationService.CreateOrganization(user, createRequest.Name)
+	var validationError *domain.ValidationError
+	if err != nil && errors.As(err.ErrorBase, &validationError) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   newValidationErrorResponse(validationError),
+			"error":  "Validation failed",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("organizationHandler.CreateOrganization.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	organizationHandler.auditService.Record(auditEvent(c, domain.AuditOrgCreate, domain.AuditSuccess, user.ID, user.ID, map[string]string{
+		"org_id": strconv.FormatUint(uint64(membership.OrganizationId), 10),
+		"name":   membership.Organization.Name,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   organizationView(membership),
+		"error":  nil,
+	})
+}
+
+func (organizationHandler *OrganizationHandler) ListOrganizations(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	claimsInterface, _ := c.Get("claims")
+	claims, claimsOk := claimsInterface.(*domain.Claims)
+	if !exists || !ok || !claimsOk {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	memberships, err := organizationHandler.organizationService.ListMemberships(user)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("organizationHandler.ListOrganizations.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	organizations := []OrganizationListEntry{}
+	for _, membership := range memberships {
+		organizations = append(organizations, OrganizationListEntry{
+			Id:     membership.OrganizationId,
+			Name:   membership.Organization.Name,
+			Role:   membership.Role,
+			Active: membership.OrganizationId == claims.OrgId,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": OrganizationsResponse{
+			Organizations: organizations,
+		},
+		"error": nil,
+	})
+}
+
+// SwitchOrganization makes :orgId the active organization by issuing a new token pair
+// that carries it. The old tokens stay valid for the organization they were issued for.
+func (organizationHandler *OrganizationHandler) SwitchOrganization(c *gin.Context) {
+	userInterface, _ := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	claimsInterface, _ := c.Get("claims")
+	claims, claimsOk := claimsInterface.(*domain.Claims)
+	membershipInterface, _ := c.Get("membership")
+	membership, membershipOk := membershipInterface.(*domain.Membership)
+	if !ok || !claimsOk || !membershipOk {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	options := domain.TokenOptions{
+		ClientId:  claims.ClientId,
+		Scope:     claims.Scope,
+		OrgId:     membership.OrganizationId,
+		SessionId: claims.SessionId,
+	}
+	accessToken, refreshToken, err := organizationHandler.jwtService.GenerateTokenPair(user, options)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("organizationHandler.SwitchOrganization.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": OrganizationTokensResponse{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+			Organization: organizationView(membership),
+		},
+		"error": nil,
+	})
+}
+
+func (organizationHandler *OrganizationHandler) ListMembers(c *gin.Context) {
+	membershipInterface, _ := c.Get("membership")
+	membership, ok := membershipInterface.(*domain.Membership)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	memberships, err := organizationHandler.organizationService.ListMembers(membership.OrganizationId)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("organizationHandler.ListMembers.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	members := []MemberResponse{}
+	for _, member := range memberships {
+		members = append(members, memberView(member))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": MembersResponse{
+			Members: members,
+		},
+		"error": nil,
+	})
+}
+
+func (organizationHandler *OrganizationHandler) AddMember(c *gin.Context) {
+	membershipInterface, _ := c.Get("membership")
+	actor, ok := membershipInterface.(*domain.Membership)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	var addMemberRequest AddMemberRequest
+	if err := c.ShouldBindJSON(&addMemberRequest); err != nil || addMemberRequest.Email == "" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	if addMemberRequest.Role == "" {
+		addMemberRequest.Role = domain.OrgRoleMember
+	}
+	membership, err := organizationHandler.organizationService.AddMember(actor, addMemberRequest.Email, addMemberRequest.Role)
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "User not found",
+		})
+		return
+	}
+	if err != nil && organizationErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("organizationHandler.AddMember.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	organizationHandler.auditService.Record(auditEvent(c, domain.AuditOrgMemberAdd, domain.AuditSuccess, actor.UserId, membership.UserId, map[string]string{
+		"org_id": strconv.FormatUint(uint64(membership.OrganizationId), 10),
+		"role":   membership.Role,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   memberView(*membership),
+		"error":  nil,
+	})
+}
+
+func (organizationHandler *OrganizationHandler) ChangeRole(c *gin.Context) {
+	membershipInterface, _ := c.Get("membership")
+	actor, ok := membershipInterface.(*domain.Membership)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	userId, parseErr := strconv.ParseUint(c.Param("userId"), 10, 64)
+	var changeRoleRequest ChangeRoleRequest
+	if err := c.ShouldBindJSON(&changeRoleRequest); err != nil || parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	membership, err := organizationHandler.organizationService.ChangeRole(actor, uint(userId), changeRoleRequest.Role)
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "Member not found",
+		})
+		return
+	}
+	if err != nil && organizationErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("organizationHandler.ChangeRole.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	organizationHandler.auditService.Record(auditEvent(c, domain.AuditOrgMemberRoleChange, domain.AuditSuccess, actor.UserId, membership.UserId, map[string]string{
+		"org_id": strconv.FormatUint(uint64(membership.OrganizationId), 10),
+		"role":   membership.Role,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": MemberRoleResponse{
+			UserId: membership.UserId,
+			Role:   membership.Role,
+		},
+		"error": nil,
+	})
+}
+
+func (organizationHandler *OrganizationHandler) RemoveMember(c *gin.Context) {
+	membershipInterface, _ := c.Get("membership")
+	actor, ok := membershipInterface.(*domain.Membership)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	userId, parseErr := strconv.ParseUint(c.Param("userId"), 10, 64)
+	if parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	err := organizationHandler.organizationService.RemoveMember(actor, uint(userId))
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "Member not found",
+		})
+		return
+	}
+	if err != nil && organizationErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("organizationHandler.RemoveMember.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	organizationHandler.auditService.Record(auditEvent(c, domain.AuditOrgMemberRemove, domain.AuditSuccess, actor.UserId, uint(userId), map[string]string{
+		"org_id": strconv.FormatUint(uint64(actor.OrganizationId), 10),
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   EmptyResponse{},
+		"error":  nil,
+	})
+}
+
+func (organizationHandler *OrganizationHandler) RegisterRoutes(router *gin.RouterGroup) {
+	orgs := router.Group("/orgs")
+	orgs.Use(middlewares.CheckAuth(organizationHandler.jwtService))
+	orgs.POST("", organizationHandler.CreateOrganization)
+	orgs.GET("", organizationHandler.ListOrganizations)
+
+	member := middlewares.RequireOrgRole(organizationHandler.organizationService, domain.OrgRoleMember)
+	admin := middlewares.RequireOrgRole(organizationHandler.organizationService, domain.OrgRoleAdmin)
+	orgs.POST("/:orgId/switch", member, organizationHandler.SwitchOrganization)
+	orgs.GET("/:orgId/members", member, organizationHandler.ListMembers)
+	orgs.POST("/:orgId/members", admin, organizationHandler.AddMember)
+	orgs.PATCH("/:orgId/members/:userId", admin, organizationHandler.ChangeRole)
+	// Members may remove themselves; the service checks the rest.
+	orgs.DELETE("/:orgId/members/:userId", member, organizationHandler.RemoveMember)
+}
+
+func memberView(membership domain.Membership) MemberResponse {
+	return MemberResponse{
+		UserId:   membership.UserId,
+		Email:    membership.User.Email,
+		Fullname: membership.User.Fullname,
+		Role:     membership.Role,
+	}
+}
+
+func organizationView(membership *domain.Membership) OrganizationResponse {
+	return OrganizationResponse{
+		Id:   membership.OrganizationId,
+		Name: membership.Organization.Name,
+		Role: membership.Role,
+	}
+}
+
+// organizationErrorResponse answers the rule violations of the organization service and
+// reports whether it did.
+func organizationErrorResponse(c *gin.Context, err *domain.MyError) bool {
+	switch err.ErrorBase.Error() {
+	case "invalid role":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Invalid role",
+		})
+	case "already a member":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusConflict,
+			"body":   gin.H{},
+			"error":  "Already a member",
+		})
+	case "last owner":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusConflict,
+			"body":   gin.H{},
+			"error":  "Organization needs at least one owner",
+		})
+	case "forbidden":
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusForbidden,
+			"body":   gin.H{},
+			"error":  "Forbidden",
+		})
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"errors"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordHandlerI interface {
+	ChangePassword(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type PasswordHandler struct {
+	authenticationService services.PasswordAuthenticationServiceI
+	jwtService            services.JWTServiceI
+	auditService          services.AuditServiceI
+	background            services.BackgroundI
+}
+
+func NewPasswordHandler(authenticationService services.PasswordAuthenticationServiceI, jwtService services.JWTServiceI, auditService services.AuditServiceI, background services.BackgroundI) PasswordHandlerI {
+	return &PasswordHandler{
+		authenticationService: authenticationService,
+		jwtService:            jwtService,
+		auditService:          auditService,
+		background:            background,
+	}
+}
+
+func (passwordHandler *PasswordHandler) ChangePassword(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	var changePasswordRequest ChangePasswordRequest
+	if err := c.ShouldBindJSON(&changePasswordRequest); err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	err := passwordHandler.authenticationService.ChangePassword(user, changePasswordRequest.CurrentPassword, changePasswordRequest.NewPassword)
+	if err != nil && err.ErrorBase.Error() == "wrong credentials" {
+		passwordHandler.auditService.Record(auditEvent(c, domain.AuditPasswordChange, domain.AuditFailure, user.ID, user.ID, map[string]string{
+			"reason": "wrong credentials",
+		}))
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	var validationError *domain.ValidationError
+	if err != nil && errors.As(err.ErrorBase, &validationError) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   newValidationErrorResponse(validationError),
+			"error":  "Validation failed",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("passwordHandler.ChangePassword.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	passwordHandler.auditService.Record(auditEvent(c, domain.AuditPasswordChange, domain.AuditSuccess, user.ID, user.ID, nil))
+	// Other sessions died with the JWTVersion bump; this one continues on new tokens.
+	options := domain.TokenOptions{}
+	claimsInterface, _ := c.Get("claims")
+	if claims, ok := claimsInterface.(*domain.Claims); ok {
+		options.OrgId = claims.OrgId
+		options.SessionId = claims.SessionId
+	}
+	accessToken, refreshToken, err := passwordHandler.jwtService.GenerateTokenPair(user, options)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("passwordHandler.ChangePassword.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": TokenPairResponse{
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
+		},
+		"error": nil,
+	})
+	notifiedUser := *user
+	passwordHandler.background.Go("authenticationService.SendPasswordChangedNotice", func() {
+		passwordHandler.authenticationService.SendPasswordChangedNotice(notifiedUser)
+	})
+}
+
+func (passwordHandler *PasswordHandler) RegisterRoutes(router *gin.RouterGroup) {
+	me := router.Group("/users/me")
+	me.Use(middlewares.CheckPasswordChangeAuth(passwordHandler.jwtService))
+	me.POST("/password", passwordHandler.ChangePassword)
+}
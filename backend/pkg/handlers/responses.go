@@ -0,0 +1,33 @@
+package handlers
+
+import "hitenok/pkg/domain"
+
+// The structs below are the "body" of the API envelope
+// {"status": ..., "body": ..., "error": ...}. Failures carry an empty body, or a
+// ValidationErrorResponse with the error "Validation failed".
+
+// EmptyResponse is the body of a success that has nothing to tell but the status.
+type EmptyResponse struct{}
+
+type TokenPairResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type UserIdResponse struct {
+	UserId uint `json:"user_id"`
+}
+
+// ValidationErrorResponse lists every violation, and the first message per field in
+// Fields for clients that show one error per input.
+type ValidationErrorResponse struct {
+	Fields     map[string]string       `json:"fields"`
+	Violations []domain.FieldViolation `json:"violations"`
+}
+
+func newValidationErrorResponse(validationError *domain.ValidationError) ValidationErrorResponse {
+	return ValidationErrorResponse{
+		Fields:     validationError.Fields(),
+		Violations: validationError.Violations,
+	}
+}
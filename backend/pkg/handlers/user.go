@@ -1,31 +1,55 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"hitenok/pkg/domain"
 	"hitenok/pkg/middlewares"
 	"hitenok/pkg/services"
+	"log"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
+type ProfileResponse struct {
+	User domain.UserProfile `json:"user"`
+}
+
+type ProfileUpdateResponse struct {
+	User    domain.UserProfile   `json:"user"`
+	Changes []domain.FieldChange `json:"changes"`
+}
+
 type UserHandlerI interface {
 	UserInfo(c *gin.Context)
+	UpdateProfile(c *gin.Context)
 	RegisterRoutes(router *gin.RouterGroup)
 }
 
 type UserHandler struct {
-	userService services.UserServiceI
-	jwtService  services.JWTServiceI
+	userService  services.UserServiceI
+	jwtService   services.JWTServiceI
+	auditService services.AuditServiceI
 }
 
-func NewUserHandler(userService services.UserServiceI, jwtService services.JWTServiceI) UserHandlerI {
+func NewUserHandler(userService services.UserServiceI, jwtService services.JWTServiceI, auditService services.AuditServiceI) UserHandlerI {
 	return &UserHandler{
-		userService: userService,
-		jwtService:  jwtService,
+		userService:  userService,
+		jwtService:   jwtService,
+		auditService: auditService,
 	}
 }
 
+// profileETag fingerprints the fields a PATCH can change or depends on, so unrelated
+// writes to the user row (OTP bookkeeping and the like) do not invalidate it.
+func profileETag(profile domain.UserProfile) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{profile.Email, profile.Fullname, profile.Locale, profile.Timezone}, "\x00")))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
 func (userHandler *UserHandler) UserInfo(c *gin.Context) {
 	userInterface, exists := c.Get("user")
 	user, ok := userInterface.(*domain.User)
@@ -37,10 +61,90 @@ func (userHandler *UserHandler) UserInfo(c *gin.Context) {
 		})
 		return
 	}
+	profile := domain.NewUserProfile(user)
+	c.Header("ETag", profileETag(profile))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": ProfileResponse{
+			User: profile,
+		},
+		"error": nil,
+	})
+}
+
+func (userHandler *UserHandler) UpdateProfile(c *gin.Context) {
+	userInterface, exists := c.Get("user")
+	user, ok := userInterface.(*domain.User)
+	if !exists || !ok {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusUnauthorized,
+			"body":   gin.H{},
+			"error":  "Unauthorized",
+		})
+		return
+	}
+	currentETag := profileETag(domain.NewUserProfile(user))
+	ifMatch := c.Request.Header.Get("If-Match")
+	if ifMatch != "" && ifMatch != "*" && ifMatch != currentETag {
+		c.Header("ETag", currentETag)
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusPreconditionFailed,
+			"body":   gin.H{},
+			"error":  "Profile was modified",
+		})
+		return
+	}
+	var profileUpdate domain.ProfileUpdate
+	if err := c.ShouldBindJSON(&profileUpdate); err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Wrong credentials",
+		})
+		return
+	}
+	changes, err := userHandler.userService.UpdateProfile(user, profileUpdate)
+	var validationError *domain.ValidationError
+	if err != nil && errors.As(err.ErrorBase, &validationError) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   newValidationErrorResponse(validationError),
+			"error":  "Validation failed",
+		})
+		return
+	}
+	if err != nil && err.ErrorBase.Error() == "user changed concurrently" {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusPreconditionFailed,
+			"body":   gin.H{},
+			"error":  "Profile was modified",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("userHandler.UpdateProfile.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	if len(changes) > 0 {
+		metadata := map[string]string{}
+		for _, change := range changes {
+			metadata[change.Field+".old"] = change.Old
+			metadata[change.Field+".new"] = change.New
+		}
+		userHandler.auditService.Record(auditEvent(c, domain.AuditProfileUpdate, domain.AuditSuccess, user.ID, user.ID, metadata))
+	}
+	profile := domain.NewUserProfile(user)
+	c.Header("ETag", profileETag(profile))
 	c.JSON(http.StatusOK, gin.H{
 		"status": http.StatusOK,
-		"body": gin.H{
-			"user": user,
+		"body": ProfileUpdateResponse{
+			User:    profile,
+			Changes: changes,
 		},
 		"error": nil,
 	})
@@ -50,4 +154,5 @@ func (userHandler *UserHandler) RegisterRoutes(router *gin.RouterGroup) {
 	user := router.Group("/users")
 	user.Use(middlewares.CheckAuth(userHandler.jwtService))
 	user.GET("/me", userHandler.UserInfo)
+	user.PATCH("/me", userHandler.UpdateProfile)
 }
@@ -0,0 +1,430 @@
+package handlers
+
+import (
+	"errors"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/middlewares"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type WebhookRequest struct {
+	Url         *string   `json:"url"`
+	Events      *[]string `json:"events"`
+	Description *string   `json:"description"`
+	IsActive    *bool     `json:"is_active"`
+}
+
+// WebhookCreatedResponse is the only answer that shows the signing secret; receivers
+// verify X-Webhook-Signature with it.
+type WebhookCreatedResponse struct {
+	Webhook *domain.WebhookSubscription `json:"webhook"`
+	Secret  string                      `json:"secret"`
+}
+
+type WebhooksResponse struct {
+	Webhooks   []domain.WebhookSubscription `json:"webhooks"`
+	EventTypes []string                     `json:"event_types"`
+}
+
+type WebhookResponse struct {
+	Webhook *domain.WebhookSubscription `json:"webhook"`
+}
+
+type DeliveriesResponse struct {
+	Deliveries []domain.WebhookDelivery `json:"deliveries"`
+}
+
+type DeliveryResponse struct {
+	Delivery *domain.WebhookDelivery `json:"delivery"`
+}
+
+type WebhookHandlerI interface {
+	Create(c *gin.Context)
+	List(c *gin.Context)
+	Get(c *gin.Context)
+	Update(c *gin.Context)
+	Delete(c *gin.Context)
+	Deliveries(c *gin.Context)
+	Ping(c *gin.Context)
+	Replay(c *gin.Context)
+	RegisterRoutes(router *gin.RouterGroup)
+}
+
+type WebhookHandler struct {
+	webhookService services.WebhookServiceI
+	jwtService     services.JWTServiceI
+	auditService   services.AuditServiceI
+}
+
+func NewWebhookHandler(webhookService services.WebhookServiceI, jwtService services.JWTServiceI, auditService services.AuditServiceI) WebhookHandlerI {
+	return &WebhookHandler{
+		webhookService: webhookService,
+		jwtService:     jwtService,
+		auditService:   auditService,
+	}
+}
+
+// webhookErrorResponse answers the errors shared by the webhook endpoints and reports
+// whether it did.
+func webhookErrorResponse(c *gin.Context, err *domain.MyError) bool {
+	var validationError *domain.ValidationError
+	switch {
+	case errors.As(err.ErrorBase, &validationError):
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   newValidationErrorResponse(validationError),
+			"error":  "Validation failed",
+		})
+	case errors.Is(err.ErrorBase, gorm.ErrRecordNotFound):
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "Webhook not found",
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+func (webhookHandler *WebhookHandler) actorId(c *gin.Context) uint {
+	userInterface, _ := c.Get("user")
+	if user, ok := userInterface.(*domain.User); ok {
+		return user.ID
+	}
+	return 0
+}
+
+func (webhookHandler *WebhookHandler) Create(c *gin.Context) {
+	var webhookRequest WebhookRequest
+	if err := c.ShouldBindJSON(&webhookRequest); err != nil || webhookRequest.Url == nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	var events []string
+	if webhookRequest.Events != nil {
+		events = *webhookRequest.Events
+	}
+	description := ""
+	if webhookRequest.Description != nil {
+		description = *webhookRequest.Description
+	}
+	subscription, err := webhookHandler.webhookService.CreateSubscription(*webhookRequest.Url, events, description)
+	if err != nil && webhookErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("webhookHandler.Create.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	webhookHandler.auditService.Record(auditEvent(c, domain.AuditWebhookCreate, domain.AuditSuccess, webhookHandler.actorId(c), 0, map[string]string{
+		"webhook_id": strconv.FormatUint(uint64(subscription.ID), 10),
+		"url":        subscription.Url,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusCreated,
+		"body": WebhookCreatedResponse{
+			Webhook: subscription,
+			Secret:  subscription.Secret,
+		},
+		"error": nil,
+	})
+}
+
+func (webhookHandler *WebhookHandler) List(c *gin.Context) {
+	subscriptions, err := webhookHandler.webhookService.ListSubscriptions()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("webhookHandler.List.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": WebhooksResponse{
+			Webhooks:   subscriptions,
+			EventTypes: domain.WebhookEventTypes,
+		},
+		"error": nil,
+	})
+}
+
+// subscription loads the subscription named by the :webhookId parameter, answering the
+// request itself when it cannot.
+func (webhookHandler *WebhookHandler) subscription(c *gin.Context, functionName string) (*domain.WebhookSubscription, bool) {
+	webhookId, parseErr := strconv.ParseUint(c.Param("webhookId"), 10, 64)
+	if parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "Webhook not found",
+		})
+		return nil, false
+	}
+	subscription, err := webhookHandler.webhookService.GetSubscription(uint(webhookId))
+	if err != nil && webhookErrorResponse(c, err) {
+		return nil, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("webhookHandler.%s.%s: %v", functionName, err.Module, err.ErrorBase)
+		return nil, false
+	}
+	return subscription, true
+}
+
+func (webhookHandler *WebhookHandler) Get(c *gin.Context) {
+	subscription, ok := webhookHandler.subscription(c, "Get")
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": WebhookResponse{
+			Webhook: subscription,
+		},
+		"error": nil,
+	})
+}
+
+// Update changes only the fields present in the request; sending "events": [] switches
+// the subscription to every event.
+func (webhookHandler *WebhookHandler) Update(c *gin.Context) {
+	var webhookRequest WebhookRequest
+	if err := c.ShouldBindJSON(&webhookRequest); err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	subscription, ok := webhookHandler.subscription(c, "Update")
+	if !ok {
+		return
+	}
+	changed := []string{}
+	if webhookRequest.Url != nil {
+		subscription.Url = *webhookRequest.Url
+		changed = append(changed, "url")
+	}
+	if webhookRequest.Events != nil {
+		subscription.Events = *webhookRequest.Events
+		changed = append(changed, "events")
+	}
+	if webhookRequest.Description != nil {
+		subscription.Description = *webhookRequest.Description
+		changed = append(changed, "description")
+	}
+	if webhookRequest.IsActive != nil {
+		subscription.IsActive = *webhookRequest.IsActive
+		changed = append(changed, "is_active")
+	}
+	err := webhookHandler.webhookService.UpdateSubscription(subscription)
+	if err != nil && webhookErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("webhookHandler.Update.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	webhookHandler.auditService.Record(auditEvent(c, domain.AuditWebhookUpdate, domain.AuditSuccess, webhookHandler.actorId(c), 0, map[string]string{
+		"webhook_id": strconv.FormatUint(uint64(subscription.ID), 10),
+		"fields":     strings.Join(changed, ","),
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": WebhookResponse{
+			Webhook: subscription,
+		},
+		"error": nil,
+	})
+}
+
+func (webhookHandler *WebhookHandler) Delete(c *gin.Context) {
+	subscription, ok := webhookHandler.subscription(c, "Delete")
+	if !ok {
+		return
+	}
+	err := webhookHandler.webhookService.DeleteSubscription(subscription.ID)
+	if err != nil && webhookErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("webhookHandler.Delete.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	webhookHandler.auditService.Record(auditEvent(c, domain.AuditWebhookDelete, domain.AuditSuccess, webhookHandler.actorId(c), 0, map[string]string{
+		"webhook_id": strconv.FormatUint(uint64(subscription.ID), 10),
+		"url":        subscription.Url,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body":   EmptyResponse{},
+		"error":  nil,
+	})
+}
+
+// Deliveries pages through the delivery log of a webhook, newest first, with the
+// before_id and limit query parameters.
+func (webhookHandler *WebhookHandler) Deliveries(c *gin.Context) {
+	var beforeId uint64
+	var limit int
+	var parseErr error
+	if value := c.Query("before_id"); value != "" {
+		beforeId, parseErr = strconv.ParseUint(value, 10, 64)
+	}
+	if value := c.Query("limit"); value != "" && parseErr == nil {
+		limit, parseErr = strconv.Atoi(value)
+	}
+	if parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusBadRequest,
+			"body":   gin.H{},
+			"error":  "Bad request",
+		})
+		return
+	}
+	subscription, ok := webhookHandler.subscription(c, "Deliveries")
+	if !ok {
+		return
+	}
+	deliveries, err := webhookHandler.webhookService.ListDeliveries(subscription.ID, uint(beforeId), limit)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("webhookHandler.Deliveries.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": DeliveriesResponse{
+			Deliveries: deliveries,
+		},
+		"error": nil,
+	})
+}
+
+// Ping sends a ping event right away and reports how the endpoint answered.
+func (webhookHandler *WebhookHandler) Ping(c *gin.Context) {
+	subscription, ok := webhookHandler.subscription(c, "Ping")
+	if !ok {
+		return
+	}
+	delivery, err := webhookHandler.webhookService.Ping(subscription.ID)
+	if err != nil && webhookErrorResponse(c, err) {
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("webhookHandler.Ping.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusOK,
+		"body": DeliveryResponse{
+			Delivery: delivery,
+		},
+		"error": nil,
+	})
+}
+
+// Replay queues an earlier delivery of the webhook again, whatever its status.
+func (webhookHandler *WebhookHandler) Replay(c *gin.Context) {
+	subscription, ok := webhookHandler.subscription(c, "Replay")
+	if !ok {
+		return
+	}
+	deliveryId, parseErr := strconv.ParseUint(c.Param("deliveryId"), 10, 64)
+	if parseErr != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "Delivery not found",
+		})
+		return
+	}
+	delivery, err := webhookHandler.webhookService.Replay(subscription.ID, uint(deliveryId))
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusNotFound,
+			"body":   gin.H{},
+			"error":  "Delivery not found",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{
+			"status": http.StatusInternalServerError,
+			"body":   gin.H{},
+			"error":  "Internal server error",
+		})
+		log.Printf("webhookHandler.Replay.%s: %v", err.Module, err.ErrorBase)
+		return
+	}
+	webhookHandler.auditService.Record(auditEvent(c, domain.AuditWebhookReplay, domain.AuditSuccess, webhookHandler.actorId(c), 0, map[string]string{
+		"webhook_id":  strconv.FormatUint(uint64(subscription.ID), 10),
+		"delivery_id": strconv.FormatUint(deliveryId, 10),
+		"event_id":    delivery.EventId,
+	}))
+	c.JSON(http.StatusOK, gin.H{
+		"status": http.StatusAccepted,
+		"body": DeliveryResponse{
+			Delivery: delivery,
+		},
+		"error": nil,
+	})
+}
+
+func (webhookHandler *WebhookHandler) RegisterRoutes(router *gin.RouterGroup) {
+	admin := router.Group("/admin/webhooks")
+	admin.Use(middlewares.CheckAuth(webhookHandler.jwtService), middlewares.RequireSuperuser())
+	admin.POST("", webhookHandler.Create)
+	admin.GET("", webhookHandler.List)
+	admin.GET("/:webhookId", webhookHandler.Get)
+	admin.PATCH("/:webhookId", webhookHandler.Update)
+	admin.DELETE("/:webhookId", webhookHandler.Delete)
+	admin.GET("/:webhookId/deliveries", webhookHandler.Deliveries)
+	admin.POST("/:webhookId/ping", webhookHandler.Ping)
+	admin.POST("/:webhookId/deliveries/:deliveryId/replay", webhookHandler.Replay)
+}
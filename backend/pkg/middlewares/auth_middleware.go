@@ -2,6 +2,7 @@ package middlewares
 
 import (
 	"errors"
+	"hitenok/pkg/domain"
 	"hitenok/pkg/services"
 	"net/http"
 
@@ -10,6 +11,16 @@ import (
 )
 
 func CheckAuth(jwtService services.JWTServiceI) gin.HandlerFunc {
+	return checkAuth(jwtService, false)
+}
+
+// CheckPasswordChangeAuth is CheckAuth that also lets through the restricted token issued
+// on sign-in with an expired password. It guards the change-password endpoint only.
+func CheckPasswordChangeAuth(jwtService services.JWTServiceI) gin.HandlerFunc {
+	return checkAuth(jwtService, true)
+}
+
+func checkAuth(jwtService services.JWTServiceI, allowPasswordChange bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.Request.Header.Get("Authorization")
 
@@ -21,7 +32,7 @@ func CheckAuth(jwtService services.JWTServiceI) gin.HandlerFunc {
 			})
 			return
 		}
-		user, err := jwtService.ValidateToken(token)
+		user, claims, err := jwtService.ValidateTokenClaims(token, domain.AccessTokenType)
 		if err != nil && errors.Is(err.ErrorBase, jwt.ErrTokenExpired) {
 			c.AbortWithStatusJSON(http.StatusOK, gin.H{
 				"status": http.StatusUnauthorized,
@@ -38,7 +49,16 @@ func CheckAuth(jwtService services.JWTServiceI) gin.HandlerFunc {
 			})
 			return
 		}
+		if claims.Scope == domain.PasswordChangeScope && !allowPasswordChange {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusForbidden,
+				"body":   gin.H{},
+				"error":  "Password change required",
+			})
+			return
+		}
 		c.Set("user", user)
+		c.Set("claims", claims)
 		c.Next()
 	}
 }
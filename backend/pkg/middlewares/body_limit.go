@@ -0,0 +1,25 @@
+package middlewares
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimit caps request bodies at maxBytes. A larger body fails to read, which the
+// handlers already answer as a malformed request; a declared Content-Length over the
+// limit is refused before the handler runs.
+func BodyLimit(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxBytes {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusRequestEntityTooLarge,
+				"body":   gin.H{},
+				"error":  "Request body too large",
+			})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
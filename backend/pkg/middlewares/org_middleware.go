@@ -0,0 +1,84 @@
+package middlewares
+
+import (
+	"errors"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/services"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RequireOrgRole lets the request through only if the user is a member of the
+// organization with at least minRole. The organization is the :orgId path parameter
+// or, on routes without one, the active organization of the token. It must run after
+// CheckAuth and leaves the membership in the context as "membership".
+func RequireOrgRole(organizationService services.OrganizationServiceI, minRole string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userInterface, exists := c.Get("user")
+		user, ok := userInterface.(*domain.User)
+		claimsInterface, claimsExists := c.Get("claims")
+		claims, claimsOk := claimsInterface.(*domain.Claims)
+		if !exists || !ok || !claimsExists || !claimsOk {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusUnauthorized,
+				"body":   gin.H{},
+				"error":  "Unauthorized",
+			})
+			return
+		}
+		organizationId := claims.OrgId
+		if param := c.Param("orgId"); param != "" {
+			parsed, err := strconv.ParseUint(param, 10, 64)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusOK, gin.H{
+					"status": http.StatusNotFound,
+					"body":   gin.H{},
+					"error":  "Organization not found",
+				})
+				return
+			}
+			organizationId = uint(parsed)
+		}
+		if organizationId == 0 {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusBadRequest,
+				"body":   gin.H{},
+				"error":  "No organization selected",
+			})
+			return
+		}
+		membership, err := organizationService.GetMembership(organizationId, user.ID)
+		if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+			// Non-members cannot tell a foreign organization from a missing one.
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusNotFound,
+				"body":   gin.H{},
+				"error":  "Organization not found",
+			})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusInternalServerError,
+				"body":   gin.H{},
+				"error":  "Internal server error",
+			})
+			log.Printf("RequireOrgRole.%s: %v", err.Module, err.ErrorBase)
+			return
+		}
+		if domain.OrgRoleRank(membership.Role) < domain.OrgRoleRank(minRole) {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusForbidden,
+				"body":   gin.H{},
+				"error":  "Forbidden",
+			})
+			return
+		}
+		c.Set("membership", membership)
+		c.Next()
+	}
+}
@@ -0,0 +1,62 @@
+package middlewares
+
+import (
+	"hitenok/pkg/config"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimit allows every client address the configured number of requests per fixed
+// window across the routes it guards. The counters live in this process only, so
+// behind several instances the effective limit is multiplied by their number.
+func RateLimit(rateLimitConfig config.RateLimitConfig) gin.HandlerFunc {
+	if !rateLimitConfig.Enabled {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	var mu sync.Mutex
+	windows := map[string]*rateWindow{}
+	lastSweep := time.Now()
+	return func(c *gin.Context) {
+		now := time.Now()
+		mu.Lock()
+		if now.Sub(lastSweep) > rateLimitConfig.Window {
+			for ip, window := range windows {
+				if now.Sub(window.start) > rateLimitConfig.Window {
+					delete(windows, ip)
+				}
+			}
+			lastSweep = now
+		}
+		window, found := windows[c.ClientIP()]
+		if !found || now.Sub(window.start) > rateLimitConfig.Window {
+			window = &rateWindow{start: now}
+			windows[c.ClientIP()] = window
+		}
+		window.count += 1
+		count, retryAfter := window.count, window.start.Add(rateLimitConfig.Window).Sub(now)
+		mu.Unlock()
+
+		if count > rateLimitConfig.Requests {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusTooManyRequests,
+				"body":   gin.H{},
+				"error":  "Too many requests",
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,30 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestId tags every request with an id, taken over from the X-Request-Id header of a
+// proxy when it looks sane and generated otherwise. It is echoed in the response and
+// kept in the context as "request_id" for logs and audit events.
+func RequestId() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.Request.Header.Get(RequestIdHeader)
+		if !requestIdPattern.MatchString(requestId) {
+			raw := make([]byte, 16)
+			rand.Read(raw)
+			requestId = hex.EncodeToString(raw)
+		}
+		c.Set("request_id", requestId)
+		c.Header(RequestIdHeader, requestId)
+		c.Next()
+	}
+}
@@ -0,0 +1,33 @@
+package middlewares
+
+import (
+	"hitenok/pkg/domain"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireSuperuser guards the admin routes. It must run after CheckAuth.
+func RequireSuperuser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userInterface, exists := c.Get("user")
+		user, ok := userInterface.(*domain.User)
+		if !exists || !ok {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusUnauthorized,
+				"body":   gin.H{},
+				"error":  "Unauthorized",
+			})
+			return
+		}
+		if !user.IsSuperuser {
+			c.AbortWithStatusJSON(http.StatusOK, gin.H{
+				"status": http.StatusForbidden,
+				"body":   gin.H{},
+				"error":  "Forbidden",
+			})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,316 @@
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"hitenok/pkg/domain"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Every supported dialect has its own directory, named after the gorm dialector, with
+// the same versions in it.
+//
+//go:embed postgres/*.sql mysql/*.sql sqlite/*.sql
+var files embed.FS
+
+// lockKey identifies the Postgres migration advisory lock and lockName the MySQL one;
+// any constant shared by all replicas does.
+const (
+	lockKey  = 72_450_001
+	lockName = "hitenok_migrations"
+)
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one schema change, kept as NNNN_name.up.sql and NNNN_name.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells whether a migration has been applied, and when.
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"appliedAt"`
+}
+
+// SchemaMigration is a row of schema_migrations, one per applied migration.
+type SchemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+type MigratorI interface {
+	// Up applies every pending migration in order and returns those it applied.
+	Up() ([]Migration, *domain.MyError)
+	// Down reverts the last steps applied migrations, latest first.
+	Down(steps int) ([]Migration, *domain.MyError)
+	Status() ([]MigrationStatus, *domain.MyError)
+	// Check fails unless the schema is exactly at the latest migration, so that a
+	// binary never runs against a schema it was not built for.
+	Check() *domain.MyError
+}
+
+type migrator struct {
+	DB         *gorm.DB
+	dialect    string
+	migrations []Migration
+}
+
+// NewMigrator picks the migrations of the database's dialect. On MySQL schema changes
+// commit on their own, so a migration failing halfway is not rolled back and has to be
+// repaired by hand before running it again.
+func NewMigrator(db *gorm.DB) (MigratorI, *domain.MyError) {
+	dialect := db.Dialector.Name()
+	migrations, err := load(files, dialect)
+	if err != nil {
+		return nil, domain.NewError(fmt.Errorf("dialect %s: %w", dialect, err), "migrations.NewMigrator")
+	}
+	return &migrator{
+		DB:         db,
+		dialect:    dialect,
+		migrations: migrations,
+	}, nil
+}
+
+// load reads the migrations of a directory, ordered by version. Every version needs
+// both files, and versions must not repeat.
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("%s: not a migration file name", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(fsys, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migration, found := byVersion[version]
+		if !found {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("%s: version %d is also named %s", entry.Name(), version, migration.Name)
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+	migrations := []Migration{}
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func (migrator *migrator) Up() ([]Migration, *domain.MyError) {
+	var applied []Migration
+	err := migrator.locked(func(conn *gorm.DB) error {
+		done, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrator.migrations {
+			if _, found := done[migration.Version]; found {
+				continue
+			}
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if err := execScript(tx, migration.Up); err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("%d_%s: %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return applied, domain.NewError(err, "migrator.Up")
+	}
+	return applied, nil
+}
+
+func (migrator *migrator) Down(steps int) ([]Migration, *domain.MyError) {
+	var reverted []Migration
+	err := migrator.locked(func(conn *gorm.DB) error {
+		done, err := appliedVersions(conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrator.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := migrator.migrations[i]
+			if _, found := done[migration.Version]; !found {
+				continue
+			}
+			err := conn.Transaction(func(tx *gorm.DB) error {
+				if err := execScript(tx, migration.Down); err != nil {
+					return err
+				}
+				return tx.Delete(&SchemaMigration{}, migration.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("%d_%s: %w", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return reverted, domain.NewError(err, "migrator.Down")
+	}
+	return reverted, nil
+}
+
+func (migrator *migrator) Status() ([]MigrationStatus, *domain.MyError) {
+	done, err := appliedVersions(migrator.DB)
+	if err != nil {
+		return nil, domain.NewError(err, "migrator.Status")
+	}
+	statuses := []MigrationStatus{}
+	for _, migration := range migrator.migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if row, found := done[migration.Version]; found {
+			status.AppliedAt = &row.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	// Versions applied by a newer binary are listed too, they are why Check fails.
+	for version, row := range done {
+		if !migrator.known(version) {
+			statuses = append(statuses, MigrationStatus{Version: version, Name: row.Name, AppliedAt: &row.AppliedAt})
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+func (migrator *migrator) Check() *domain.MyError {
+	statuses, err := migrator.Status()
+	if err != nil {
+		err.Module = "migrator.Check." + err.Module
+		return err
+	}
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			return domain.NewError(fmt.Errorf("migration %d_%s is not applied, run migrate up", status.Version, status.Name), "migrator.Check")
+		}
+		if !migrator.known(status.Version) {
+			return domain.NewError(fmt.Errorf("migration %d_%s is unknown to this build, the schema is newer", status.Version, status.Name), "migrator.Check")
+		}
+	}
+	return nil
+}
+
+func (migrator *migrator) known(version int) bool {
+	for _, migration := range migrator.migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// locked runs fn on a single connection holding the migration lock, so that replicas
+// starting together apply each migration once. The lock is per session, hence the
+// pinned connection. SQLite needs none: a database file is not shared by replicas and
+// its writers are serialized anyway.
+func (migrator *migrator) locked(fn func(conn *gorm.DB) error) error {
+	return migrator.DB.Connection(func(conn *gorm.DB) error {
+		switch migrator.dialect {
+		case "postgres":
+			if err := conn.Exec("SELECT pg_advisory_lock(?)", lockKey).Error; err != nil {
+				return err
+			}
+			defer conn.Exec("SELECT pg_advisory_unlock(?)", lockKey)
+		case "mysql":
+			var acquired int
+			if err := conn.Raw("SELECT GET_LOCK(?, -1)", lockName).Scan(&acquired).Error; err != nil {
+				return err
+			}
+			if acquired != 1 {
+				return fmt.Errorf("could not take the migration lock")
+			}
+			defer conn.Exec("SELECT RELEASE_LOCK(?)", lockName)
+		}
+		if !conn.Migrator().HasTable(&SchemaMigration{}) {
+			if err := conn.Migrator().CreateTable(&SchemaMigration{}); err != nil {
+				return err
+			}
+		}
+		return fn(conn)
+	})
+}
+
+// execScript runs the statements of a migration file one by one, as not every driver
+// takes several in one call. A statement ends with a semicolon at the end of a line.
+func execScript(tx *gorm.DB, script string) error {
+	var statement strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		statement.WriteString(line)
+		statement.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			if err := tx.Exec(statement.String()).Error; err != nil {
+				return err
+			}
+			statement.Reset()
+		}
+	}
+	if strings.TrimSpace(statement.String()) != "" {
+		return tx.Exec(statement.String()).Error
+	}
+	return nil
+}
+
+func appliedVersions(db *gorm.DB) (map[int]SchemaMigration, error) {
+	done := map[int]SchemaMigration{}
+	if !db.Migrator().HasTable(&SchemaMigration{}) {
+		return done, nil
+	}
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		done[row.Version] = row
+	}
+	return done, nil
+}
@@ -0,0 +1,79 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func openTestDatabase(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file:"+t.TempDir()+"/test.db?_foreign_keys=on"), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatalf("opening the database: %v", err)
+	}
+	return db
+}
+
+func TestExecScript(t *testing.T) {
+	db := openTestDatabase(t)
+	script := strings.Join([]string{
+		"-- A comment; with a semicolon.",
+		"CREATE TABLE `things` (",
+		"  `id` integer PRIMARY KEY,",
+		"  `name` text",
+		");",
+		"",
+		"INSERT INTO `things` (`id`, `name`) VALUES (1, 'a;b');",
+		"INSERT INTO `things` (`id`, `name`) VALUES (2, 'c')",
+	}, "\n")
+	if err := execScript(db, script); err != nil {
+		t.Fatalf("execScript: %v", err)
+	}
+	var names []string
+	if err := db.Table("things").Order("id").Pluck("name", &names).Error; err != nil {
+		t.Fatalf("reading back: %v", err)
+	}
+	if strings.Join(names, ",") != "a;b,c" {
+		t.Errorf("names = %v, want every statement run once", names)
+	}
+}
+
+func TestMigratorUpAndDown(t *testing.T) {
+	db := openTestDatabase(t)
+	schemaMigrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatalf("NewMigrator: %v", err.ErrorBase)
+	}
+	all := schemaMigrator.(*migrator).migrations
+
+	applied, err := schemaMigrator.Up()
+	if err != nil {
+		t.Fatalf("Up: %v", err.ErrorBase)
+	}
+	if len(applied) != len(all) {
+		t.Fatalf("applied %d migrations, want %d", len(applied), len(all))
+	}
+	if err := schemaMigrator.Check(); err != nil {
+		t.Fatalf("Check after Up: %v", err.ErrorBase)
+	}
+	if !db.Migrator().HasTable("revoked_tokens") {
+		t.Errorf("a table created after the first statement of 0001 is missing")
+	}
+
+	reverted, err := schemaMigrator.Down(len(all))
+	if err != nil {
+		t.Fatalf("Down: %v", err.ErrorBase)
+	}
+	if len(reverted) != len(all) {
+		t.Fatalf("reverted %d migrations, want %d", len(reverted), len(all))
+	}
+	if db.Migrator().HasTable("users") || db.Migrator().HasTable("revoked_tokens") {
+		t.Errorf("tables are left after reverting every migration")
+	}
+}
@@ -0,0 +1,25 @@
+-- The initial schema, as AutoMigrate creates it on MySQL 5.7 or newer, except that the
+-- uniquely indexed strings are varchar: MySQL cannot index longtext.
+CREATE TABLE `users` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NULL,`updated_at` datetime(3) NULL,`deleted_at` datetime(3) NULL,`email` varchar(255) NOT NULL,`password` longtext NOT NULL,`fullname` longtext NOT NULL,`locale` longtext,`timezone` longtext,`is_superuser` boolean DEFAULT false,`otp` longtext,`otp_attempts` bigint DEFAULT 0,`otp_spawned_at` datetime(3) NULL,`reset_hash` longtext,`hash_attempts` bigint DEFAULT 0,`reset_hash_spawned_at` datetime(3) NULL,`password_changed_at` datetime(3) NULL,`is_active` boolean DEFAULT false,`jwt_version` bigint unsigned DEFAULT 0,PRIMARY KEY (`id`),INDEX `idx_users_deleted_at` (`deleted_at`));
+
+CREATE TABLE `device_authorizations` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NULL,`updated_at` datetime(3) NULL,`deleted_at` datetime(3) NULL,`device_code` varchar(191) NOT NULL,`user_code` varchar(191) NOT NULL,`client_id` longtext NOT NULL,`scope` longtext,`status` varchar(191) NOT NULL DEFAULT 'pending',`user_id` bigint unsigned,`interval` bigint,`expires_at` datetime(3) NULL,`last_polled_at` datetime(3) NULL,PRIMARY KEY (`id`),INDEX `idx_device_authorizations_user_code` (`user_code`),INDEX `idx_device_authorizations_deleted_at` (`deleted_at`),UNIQUE INDEX `idx_device_authorizations_device_code` (`device_code`));
+
+CREATE TABLE `revoked_tokens` (`jti` varchar(191),`expires_at` datetime(3) NOT NULL,`created_at` datetime(3) NULL,PRIMARY KEY (`jti`),INDEX `idx_revoked_tokens_expires_at` (`expires_at`),INDEX `idx_revoked_tokens_created_at` (`created_at`));
+
+CREATE TABLE `email_changes` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NULL,`updated_at` datetime(3) NULL,`deleted_at` datetime(3) NULL,`user_id` bigint unsigned NOT NULL,`new_email` longtext NOT NULL,`code` longtext NOT NULL,`code_attempts` bigint DEFAULT 0,`cancel_token` varchar(191) NOT NULL,`expires_at` datetime(3) NULL,PRIMARY KEY (`id`),INDEX `idx_email_changes_deleted_at` (`deleted_at`),INDEX `idx_email_changes_user_id` (`user_id`),UNIQUE INDEX `idx_email_changes_cancel_token` (`cancel_token`));
+
+CREATE TABLE `password_histories` (`id` bigint unsigned AUTO_INCREMENT,`user_id` bigint unsigned NOT NULL,`password` longtext NOT NULL,`created_at` datetime(3) NULL,PRIMARY KEY (`id`),INDEX `idx_password_histories_user_id` (`user_id`),INDEX `idx_password_histories_created_at` (`created_at`));
+
+CREATE TABLE `organizations` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NULL,`updated_at` datetime(3) NULL,`deleted_at` datetime(3) NULL,`name` longtext NOT NULL,PRIMARY KEY (`id`),INDEX `idx_organizations_deleted_at` (`deleted_at`));
+
+CREATE TABLE `memberships` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NULL,`updated_at` datetime(3) NULL,`deleted_at` datetime(3) NULL,`organization_id` bigint unsigned NOT NULL,`user_id` bigint unsigned NOT NULL,`role` longtext NOT NULL,PRIMARY KEY (`id`),INDEX `idx_memberships_deleted_at` (`deleted_at`),UNIQUE INDEX `idx_membership_org_user` (`organization_id`,`user_id`),INDEX `idx_memberships_user_id` (`user_id`),CONSTRAINT `fk_memberships_organization` FOREIGN KEY (`organization_id`) REFERENCES `organizations`(`id`),CONSTRAINT `fk_memberships_user` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`));
+
+CREATE TABLE `invitations` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NULL,`updated_at` datetime(3) NULL,`deleted_at` datetime(3) NULL,`organization_id` bigint unsigned NOT NULL,`email` varchar(191) NOT NULL,`role` longtext NOT NULL,`invited_by` bigint unsigned,`expires_at` datetime(3) NULL,`accepted_at` datetime(3) NULL,PRIMARY KEY (`id`),INDEX `idx_invitations_deleted_at` (`deleted_at`),INDEX `idx_invitations_organization_id` (`organization_id`),INDEX `idx_invitations_email` (`email`),CONSTRAINT `fk_invitations_organization` FOREIGN KEY (`organization_id`) REFERENCES `organizations`(`id`));
+
+CREATE TABLE `audit_events` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NOT NULL,`actor_id` bigint unsigned,`subject_id` bigint unsigned,`action` varchar(191) NOT NULL,`outcome` longtext NOT NULL,`ip` longtext,`user_agent` longtext,`request_id` longtext,`metadata` longtext,`prev_hash` longtext NOT NULL,`hash` varchar(191) NOT NULL,PRIMARY KEY (`id`),UNIQUE INDEX `idx_audit_events_hash` (`hash`),INDEX `idx_audit_events_created_at` (`created_at`),INDEX `idx_audit_events_actor_id` (`actor_id`),INDEX `idx_audit_events_subject_id` (`subject_id`),INDEX `idx_audit_events_action` (`action`));
+
+CREATE TABLE `audit_chain_heads` (`id` bigint unsigned AUTO_INCREMENT,`last_event_id` bigint unsigned,`hash` longtext,PRIMARY KEY (`id`));
+
+CREATE TABLE `webhook_subscriptions` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NULL,`updated_at` datetime(3) NULL,`deleted_at` datetime(3) NULL,`url` longtext NOT NULL,`secret` longtext NOT NULL,`events` longtext,`description` longtext,`is_active` boolean,PRIMARY KEY (`id`),INDEX `idx_webhook_subscriptions_deleted_at` (`deleted_at`));
+
+CREATE TABLE `webhook_deliveries` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NULL,`updated_at` datetime(3) NULL,`deleted_at` datetime(3) NULL,`subscription_id` bigint unsigned NOT NULL,`event_id` varchar(191) NOT NULL,`event_type` longtext NOT NULL,`payload` text,`status` varchar(191) NOT NULL,`attempts` bigint,`next_attempt_at` datetime(3) NULL,`last_attempt_at` datetime(3) NULL,`last_status_code` bigint,`last_error` longtext,`delivered_at` datetime(3) NULL,PRIMARY KEY (`id`),INDEX `idx_webhook_deliveries_deleted_at` (`deleted_at`),INDEX `idx_webhook_deliveries_subscription_id` (`subscription_id`),INDEX `idx_webhook_deliveries_event_id` (`event_id`),INDEX `idx_webhook_deliveries_status` (`status`),INDEX `idx_webhook_deliveries_next_attempt_at` (`next_attempt_at`));
@@ -0,0 +1,2 @@
+DROP INDEX `idx_users_email` ON `users`;
+ALTER TABLE `users` DROP COLUMN `live_email`;
@@ -0,0 +1,5 @@
+-- One live account per email. MySQL has no partial indexes, so the unique index is on a
+-- generated column that is NULL for soft-deleted accounts; NULLs never collide. Fails if
+-- live duplicates exist; resolve them first.
+ALTER TABLE `users` ADD COLUMN `live_email` varchar(255) GENERATED ALWAYS AS (IF(`deleted_at` IS NULL, `email`, NULL)) STORED;
+CREATE UNIQUE INDEX `idx_users_email` ON `users` (`live_email`);
@@ -0,0 +1 @@
+CREATE TABLE `sessions` (`id` varchar(191),`user_id` bigint unsigned NOT NULL,`client_id` longtext,`jwt_version` bigint unsigned,`created_at` datetime(3) NULL,`refreshed_at` datetime(3) NULL,`expires_at` datetime(3) NOT NULL,PRIMARY KEY (`id`),INDEX `idx_sessions_user_id` (`user_id`),INDEX `idx_sessions_expires_at` (`expires_at`));
@@ -0,0 +1 @@
+CREATE TABLE `api_keys` (`id` bigint unsigned AUTO_INCREMENT,`created_at` datetime(3) NULL,`updated_at` datetime(3) NULL,`deleted_at` datetime(3) NULL,`user_id` bigint unsigned NOT NULL,`name` longtext NOT NULL,`prefix` longtext NOT NULL,`hash` varchar(191) NOT NULL,`scope` longtext,`expires_at` datetime(3) NULL,`last_used_at` datetime(3) NULL,PRIMARY KEY (`id`),INDEX `idx_api_keys_deleted_at` (`deleted_at`),INDEX `idx_api_keys_user_id` (`user_id`),UNIQUE INDEX `idx_api_keys_hash` (`hash`));
@@ -0,0 +1,3 @@
+DROP INDEX `idx_invitations_invited_by` ON `invitations`;
+DROP INDEX `idx_invitations_accepted_by` ON `invitations`;
+ALTER TABLE `invitations` DROP COLUMN `accepted_by`;
@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS "webhook_deliveries";
+DROP TABLE IF EXISTS "webhook_subscriptions";
+DROP TABLE IF EXISTS "audit_chain_heads";
+DROP TABLE IF EXISTS "audit_events";
+DROP TABLE IF EXISTS "invitations";
+DROP TABLE IF EXISTS "memberships";
+DROP TABLE IF EXISTS "organizations";
+DROP TABLE IF EXISTS "password_histories";
+DROP TABLE IF EXISTS "email_changes";
+DROP TABLE IF EXISTS "revoked_tokens";
+DROP TABLE IF EXISTS "device_authorizations";
+DROP TABLE IF EXISTS "users";
@@ -0,0 +1,54 @@
+-- The schema as the last AutoMigrate release left it. Everything is IF NOT EXISTS so that
+-- databases created by AutoMigrate are adopted as they are.
+CREATE TABLE IF NOT EXISTS "users" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"email" text NOT NULL,"password" text NOT NULL,"fullname" text NOT NULL,"locale" text,"timezone" text,"is_superuser" boolean DEFAULT false,"otp" text,"otp_attempts" bigint DEFAULT 0,"otp_spawned_at" timestamptz,"reset_hash" text,"hash_attempts" bigint DEFAULT 0,"reset_hash_spawned_at" timestamptz,"password_changed_at" timestamptz,"is_active" boolean DEFAULT false,"jwt_version" bigint DEFAULT 0,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "device_authorizations" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"device_code" text NOT NULL,"user_code" text NOT NULL,"client_id" text NOT NULL,"scope" text,"status" text NOT NULL DEFAULT 'pending',"user_id" bigint,"interval" bigint,"expires_at" timestamptz,"last_polled_at" timestamptz,PRIMARY KEY ("id"));
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_device_authorizations_device_code" ON "device_authorizations" ("device_code");
+CREATE INDEX IF NOT EXISTS "idx_device_authorizations_deleted_at" ON "device_authorizations" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_device_authorizations_user_code" ON "device_authorizations" ("user_code");
+
+CREATE TABLE IF NOT EXISTS "revoked_tokens" ("jti" text,"expires_at" timestamptz NOT NULL,"created_at" timestamptz,PRIMARY KEY ("jti"));
+CREATE INDEX IF NOT EXISTS "idx_revoked_tokens_created_at" ON "revoked_tokens" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_revoked_tokens_expires_at" ON "revoked_tokens" ("expires_at");
+
+CREATE TABLE IF NOT EXISTS "email_changes" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"user_id" bigint NOT NULL,"new_email" text NOT NULL,"code" text NOT NULL,"code_attempts" bigint DEFAULT 0,"cancel_token" text NOT NULL,"expires_at" timestamptz,PRIMARY KEY ("id"));
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_email_changes_cancel_token" ON "email_changes" ("cancel_token");
+CREATE INDEX IF NOT EXISTS "idx_email_changes_user_id" ON "email_changes" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_email_changes_deleted_at" ON "email_changes" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "password_histories" ("id" bigserial,"user_id" bigint NOT NULL,"password" text NOT NULL,"created_at" timestamptz,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_password_histories_created_at" ON "password_histories" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_password_histories_user_id" ON "password_histories" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "organizations" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"name" text NOT NULL,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_organizations_deleted_at" ON "organizations" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "memberships" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"organization_id" bigint NOT NULL,"user_id" bigint NOT NULL,"role" text NOT NULL,PRIMARY KEY ("id"),CONSTRAINT "fk_memberships_user" FOREIGN KEY ("user_id") REFERENCES "users"("id"),CONSTRAINT "fk_memberships_organization" FOREIGN KEY ("organization_id") REFERENCES "organizations"("id"));
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_membership_org_user" ON "memberships" ("organization_id","user_id");
+CREATE INDEX IF NOT EXISTS "idx_memberships_deleted_at" ON "memberships" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_memberships_user_id" ON "memberships" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "invitations" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"organization_id" bigint NOT NULL,"email" text NOT NULL,"role" text NOT NULL,"invited_by" bigint,"expires_at" timestamptz,"accepted_at" timestamptz,PRIMARY KEY ("id"),CONSTRAINT "fk_invitations_organization" FOREIGN KEY ("organization_id") REFERENCES "organizations"("id"));
+CREATE INDEX IF NOT EXISTS "idx_invitations_email" ON "invitations" ("email");
+CREATE INDEX IF NOT EXISTS "idx_invitations_organization_id" ON "invitations" ("organization_id");
+CREATE INDEX IF NOT EXISTS "idx_invitations_deleted_at" ON "invitations" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "audit_events" ("id" bigserial,"created_at" timestamptz NOT NULL,"actor_id" bigint,"subject_id" bigint,"action" text NOT NULL,"outcome" text NOT NULL,"ip" text,"user_agent" text,"request_id" text,"metadata" text,"prev_hash" text NOT NULL,"hash" text NOT NULL,PRIMARY KEY ("id"));
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_audit_events_hash" ON "audit_events" ("hash");
+CREATE INDEX IF NOT EXISTS "idx_audit_events_action" ON "audit_events" ("action");
+CREATE INDEX IF NOT EXISTS "idx_audit_events_subject_id" ON "audit_events" ("subject_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_events_actor_id" ON "audit_events" ("actor_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_events_created_at" ON "audit_events" ("created_at");
+
+CREATE TABLE IF NOT EXISTS "audit_chain_heads" ("id" bigserial,"last_event_id" bigint,"hash" text,PRIMARY KEY ("id"));
+
+CREATE TABLE IF NOT EXISTS "webhook_subscriptions" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"url" text NOT NULL,"secret" text NOT NULL,"events" text,"description" text,"is_active" boolean,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_webhook_subscriptions_deleted_at" ON "webhook_subscriptions" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "webhook_deliveries" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"subscription_id" bigint NOT NULL,"event_id" text NOT NULL,"event_type" text NOT NULL,"payload" text,"status" text NOT NULL,"attempts" bigint,"next_attempt_at" timestamptz,"last_attempt_at" timestamptz,"last_status_code" bigint,"last_error" text,"delivered_at" timestamptz,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_webhook_deliveries_status" ON "webhook_deliveries" ("status");
+CREATE INDEX IF NOT EXISTS "idx_webhook_deliveries_event_id" ON "webhook_deliveries" ("event_id");
+CREATE INDEX IF NOT EXISTS "idx_webhook_deliveries_subscription_id" ON "webhook_deliveries" ("subscription_id");
+CREATE INDEX IF NOT EXISTS "idx_webhook_deliveries_deleted_at" ON "webhook_deliveries" ("deleted_at");
+CREATE INDEX IF NOT EXISTS "idx_webhook_deliveries_next_attempt_at" ON "webhook_deliveries" ("next_attempt_at");
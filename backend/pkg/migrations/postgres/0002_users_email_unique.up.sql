@@ -0,0 +1,4 @@
+-- One live account per email. Soft-deleted accounts keep their email during the grace
+-- period and must not block signing up again, hence the partial index. Fails if live
+-- duplicates exist; resolve them first.
+CREATE UNIQUE INDEX "idx_users_email" ON "users" ("email") WHERE "deleted_at" IS NULL;
@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS "sessions" ("id" text,"user_id" bigint NOT NULL,"client_id" text,"jwt_version" bigint,"created_at" timestamptz,"refreshed_at" timestamptz,"expires_at" timestamptz NOT NULL,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_sessions_user_id" ON "sessions" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_sessions_expires_at" ON "sessions" ("expires_at");
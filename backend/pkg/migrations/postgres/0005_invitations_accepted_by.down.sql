@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS "idx_invitations_invited_by";
+DROP INDEX IF EXISTS "idx_invitations_accepted_by";
+ALTER TABLE "invitations" DROP COLUMN "accepted_by";
@@ -0,0 +1,5 @@
+-- The account that accepted the invitation, so that purging an account removes the
+-- invitations it used and not those of whoever holds its old email address now.
+ALTER TABLE "invitations" ADD COLUMN "accepted_by" bigint;
+CREATE INDEX IF NOT EXISTS "idx_invitations_accepted_by" ON "invitations" ("accepted_by");
+CREATE INDEX IF NOT EXISTS "idx_invitations_invited_by" ON "invitations" ("invited_by");
@@ -0,0 +1,53 @@
+-- The initial schema, as AutoMigrate creates it on SQLite.
+CREATE TABLE `users` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`email` text NOT NULL,`password` text NOT NULL,`fullname` text NOT NULL,`locale` text,`timezone` text,`is_superuser` numeric DEFAULT false,`otp` text,`otp_attempts` integer DEFAULT 0,`otp_spawned_at` datetime,`reset_hash` text,`hash_attempts` integer DEFAULT 0,`reset_hash_spawned_at` datetime,`password_changed_at` datetime,`is_active` numeric DEFAULT false,`jwt_version` integer DEFAULT 0);
+CREATE INDEX `idx_users_deleted_at` ON `users`(`deleted_at`);
+
+CREATE TABLE `device_authorizations` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`device_code` text NOT NULL,`user_code` text NOT NULL,`client_id` text NOT NULL,`scope` text,`status` text NOT NULL DEFAULT 'pending',`user_id` integer,`interval` integer,`expires_at` datetime,`last_polled_at` datetime);
+CREATE INDEX `idx_device_authorizations_user_code` ON `device_authorizations`(`user_code`);
+CREATE UNIQUE INDEX `idx_device_authorizations_device_code` ON `device_authorizations`(`device_code`);
+CREATE INDEX `idx_device_authorizations_deleted_at` ON `device_authorizations`(`deleted_at`);
+
+CREATE TABLE `revoked_tokens` (`jti` text,`expires_at` datetime NOT NULL,`created_at` datetime,PRIMARY KEY (`jti`));
+CREATE INDEX `idx_revoked_tokens_created_at` ON `revoked_tokens`(`created_at`);
+CREATE INDEX `idx_revoked_tokens_expires_at` ON `revoked_tokens`(`expires_at`);
+
+CREATE TABLE `email_changes` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`user_id` integer NOT NULL,`new_email` text NOT NULL,`code` text NOT NULL,`code_attempts` integer DEFAULT 0,`cancel_token` text NOT NULL,`expires_at` datetime);
+CREATE UNIQUE INDEX `idx_email_changes_cancel_token` ON `email_changes`(`cancel_token`);
+CREATE INDEX `idx_email_changes_user_id` ON `email_changes`(`user_id`);
+CREATE INDEX `idx_email_changes_deleted_at` ON `email_changes`(`deleted_at`);
+
+CREATE TABLE `password_histories` (`id` integer PRIMARY KEY AUTOINCREMENT,`user_id` integer NOT NULL,`password` text NOT NULL,`created_at` datetime);
+CREATE INDEX `idx_password_histories_created_at` ON `password_histories`(`created_at`);
+CREATE INDEX `idx_password_histories_user_id` ON `password_histories`(`user_id`);
+
+CREATE TABLE `organizations` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`name` text NOT NULL);
+CREATE INDEX `idx_organizations_deleted_at` ON `organizations`(`deleted_at`);
+
+CREATE TABLE `memberships` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`organization_id` integer NOT NULL,`user_id` integer NOT NULL,`role` text NOT NULL,CONSTRAINT `fk_memberships_organization` FOREIGN KEY (`organization_id`) REFERENCES `organizations`(`id`),CONSTRAINT `fk_memberships_user` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`));
+CREATE INDEX `idx_memberships_user_id` ON `memberships`(`user_id`);
+CREATE UNIQUE INDEX `idx_membership_org_user` ON `memberships`(`organization_id`,`user_id`);
+CREATE INDEX `idx_memberships_deleted_at` ON `memberships`(`deleted_at`);
+
+CREATE TABLE `invitations` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`organization_id` integer NOT NULL,`email` text NOT NULL,`role` text NOT NULL,`invited_by` integer,`expires_at` datetime,`accepted_at` datetime,CONSTRAINT `fk_invitations_organization` FOREIGN KEY (`organization_id`) REFERENCES `organizations`(`id`));
+CREATE INDEX `idx_invitations_email` ON `invitations`(`email`);
+CREATE INDEX `idx_invitations_organization_id` ON `invitations`(`organization_id`);
+CREATE INDEX `idx_invitations_deleted_at` ON `invitations`(`deleted_at`);
+
+CREATE TABLE `audit_events` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime NOT NULL,`actor_id` integer,`subject_id` integer,`action` text NOT NULL,`outcome` text NOT NULL,`ip` text,`user_agent` text,`request_id` text,`metadata` text,`prev_hash` text NOT NULL,`hash` text NOT NULL);
+CREATE UNIQUE INDEX `idx_audit_events_hash` ON `audit_events`(`hash`);
+CREATE INDEX `idx_audit_events_action` ON `audit_events`(`action`);
+CREATE INDEX `idx_audit_events_subject_id` ON `audit_events`(`subject_id`);
+CREATE INDEX `idx_audit_events_actor_id` ON `audit_events`(`actor_id`);
+CREATE INDEX `idx_audit_events_created_at` ON `audit_events`(`created_at`);
+
+CREATE TABLE `audit_chain_heads` (`id` integer PRIMARY KEY AUTOINCREMENT,`last_event_id` integer,`hash` text);
+
+CREATE TABLE `webhook_subscriptions` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`url` text NOT NULL,`secret` text NOT NULL,`events` text,`description` text,`is_active` numeric);
+CREATE INDEX `idx_webhook_subscriptions_deleted_at` ON `webhook_subscriptions`(`deleted_at`);
+
+CREATE TABLE `webhook_deliveries` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`subscription_id` integer NOT NULL,`event_id` text NOT NULL,`event_type` text NOT NULL,`payload` text,`status` text NOT NULL,`attempts` integer,`next_attempt_at` datetime,`last_attempt_at` datetime,`last_status_code` integer,`last_error` text,`delivered_at` datetime);
+CREATE INDEX `idx_webhook_deliveries_next_attempt_at` ON `webhook_deliveries`(`next_attempt_at`);
+CREATE INDEX `idx_webhook_deliveries_status` ON `webhook_deliveries`(`status`);
+CREATE INDEX `idx_webhook_deliveries_event_id` ON `webhook_deliveries`(`event_id`);
+CREATE INDEX `idx_webhook_deliveries_subscription_id` ON `webhook_deliveries`(`subscription_id`);
+CREATE INDEX `idx_webhook_deliveries_deleted_at` ON `webhook_deliveries`(`deleted_at`);
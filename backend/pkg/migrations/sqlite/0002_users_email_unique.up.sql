@@ -0,0 +1,3 @@
+-- One live account per email; soft-deleted accounts must not block signing up again.
+-- Fails if live duplicates exist; resolve them first.
+CREATE UNIQUE INDEX `idx_users_email` ON `users` (`email`) WHERE `deleted_at` IS NULL;
@@ -0,0 +1,3 @@
+CREATE TABLE `sessions` (`id` text,`user_id` integer NOT NULL,`client_id` text,`jwt_version` integer,`created_at` datetime,`refreshed_at` datetime,`expires_at` datetime NOT NULL,PRIMARY KEY (`id`));
+CREATE INDEX `idx_sessions_user_id` ON `sessions`(`user_id`);
+CREATE INDEX `idx_sessions_expires_at` ON `sessions`(`expires_at`);
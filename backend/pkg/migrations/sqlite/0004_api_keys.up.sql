@@ -0,0 +1,4 @@
+CREATE TABLE `api_keys` (`id` integer PRIMARY KEY AUTOINCREMENT,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`user_id` integer NOT NULL,`name` text NOT NULL,`prefix` text NOT NULL,`hash` text NOT NULL,`scope` text,`expires_at` datetime,`last_used_at` datetime);
+CREATE INDEX `idx_api_keys_deleted_at` ON `api_keys`(`deleted_at`);
+CREATE INDEX `idx_api_keys_user_id` ON `api_keys`(`user_id`);
+CREATE UNIQUE INDEX `idx_api_keys_hash` ON `api_keys`(`hash`);
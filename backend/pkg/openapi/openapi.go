@@ -0,0 +1,299 @@
+// Package openapi models the parts of an OpenAPI 3.1 document the API uses and derives
+// the body schemas from Go types, the way encoding/json sees them, so the document
+// cannot drift from the structs the handlers send.
+package openapi
+
+import (
+	"encoding/json"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const Version = "3.1.0"
+
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Servers    []Server            `json:"servers,omitempty"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+
+	names     map[reflect.Type]string
+	overrides map[reflect.Type]*Schema
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Server struct {
+	Url string `json:"url"`
+}
+
+// PathItem maps lower case HTTP methods to their operations.
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationId string                `json:"operationId"`
+	Tags        []string              `json:"tags,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter is a path, query or header parameter.
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Headers     map[string]Header    `json:"headers,omitempty"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Header struct {
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+	Name        string `json:"name,omitempty"`
+	In          string `json:"in,omitempty"`
+	Scheme      string `json:"scheme,omitempty"`
+}
+
+// Schema is a JSON Schema. Type holds a string, or a list of them for a nullable value.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 interface{}        `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MaxProperties        *int               `json:"maxProperties,omitempty"`
+}
+
+func NewDocument(info Info, servers ...Server) *Document {
+	return &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Servers: servers,
+		Paths:   map[string]PathItem{},
+		Components: Components{
+			Schemas:         map[string]*Schema{},
+			SecuritySchemes: map[string]SecurityScheme{},
+		},
+		names:     map[reflect.Type]string{},
+		overrides: map[reflect.Type]*Schema{},
+	}
+}
+
+// Add puts an operation under a path in the gin syntax, declaring the path parameters
+// it has no description for.
+func (document *Document) Add(method, ginPath string, operation *Operation) {
+	template, names := PathTemplate(ginPath)
+	for _, name := range names {
+		declared := false
+		for _, parameter := range operation.Parameters {
+			declared = declared || (parameter.In == "path" && parameter.Name == name)
+		}
+		if !declared {
+			operation.Parameters = append(operation.Parameters, Parameter{
+				Name:     name,
+				In:       "path",
+				Required: true,
+				Schema:   &Schema{Type: "string"},
+			})
+		}
+	}
+	if document.Paths[template] == nil {
+		document.Paths[template] = PathItem{}
+	}
+	document.Paths[template][strings.ToLower(method)] = operation
+}
+
+// PathTemplate turns a gin path such as /orgs/:orgId into /orgs/{orgId} and returns the
+// parameter names.
+func PathTemplate(ginPath string) (string, []string) {
+	segments := strings.Split(ginPath, "/")
+	names := []string{}
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			names = append(names, segment[1:])
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), names
+}
+
+// Define fixes the schema of the type of value, for types that marshal themselves.
+func (document *Document) Define(value interface{}, schema *Schema) {
+	document.overrides[reflect.TypeOf(value)] = schema
+}
+
+// Schema describes the JSON encoding of the type of value. Named structs become
+// components and are referenced; a *Schema is taken as it is.
+func (document *Document) Schema(value interface{}) *Schema {
+	if value == nil {
+		return &Schema{}
+	}
+	if schema, ok := value.(*Schema); ok {
+		return schema
+	}
+	return document.schemaOf(reflect.TypeOf(value))
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	zero          = 0.0
+)
+
+func (document *Document) schemaOf(t reflect.Type) *Schema {
+	if override, ok := document.overrides[t]; ok {
+		copied := *override
+		return &copied
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() != reflect.Pointer && (t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType)):
+		// Marshals itself in a way reflection cannot tell.
+		return &Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return nullable(document.schemaOf(t.Elem()))
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer", Minimum: &zero}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		// A nil slice encodes as null.
+		return nullable(&Schema{Type: "array", Items: document.schemaOf(t.Elem())})
+	case reflect.Array:
+		return &Schema{Type: "array", Items: document.schemaOf(t.Elem())}
+	case reflect.Map:
+		return nullable(&Schema{Type: "object", AdditionalProperties: document.schemaOf(t.Elem())})
+	case reflect.Struct:
+		if t.Name() == "" {
+			return document.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + document.component(t)}
+	}
+	return &Schema{}
+}
+
+// component names and describes a named struct once. The name is reserved before the
+// fields are described, so recursive types end in a reference.
+func (document *Document) component(t reflect.Type) string {
+	if name, ok := document.names[t]; ok {
+		return name
+	}
+	name := t.Name()
+	if _, taken := document.Components.Schemas[name]; taken {
+		name = path.Base(t.PkgPath()) + "." + name
+	}
+	document.names[t] = name
+	document.Components.Schemas[name] = &Schema{}
+	document.Components.Schemas[name] = document.structSchema(t)
+	return name
+}
+
+// structSchema lists the fields encoding/json writes. Fields are required unless they
+// are pointers or omitempty; embedded structs without a tag are flattened.
+func (document *Document) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	document.addFields(schema, t)
+	return schema
+}
+
+func (document *Document) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		fieldType := field.Type
+		if field.Anonymous && name == "" {
+			if fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct {
+				document.addFields(schema, fieldType)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := document.schemaOf(fieldType)
+		if strings.Contains(options, "string") {
+			property = &Schema{Type: "string"}
+		}
+		schema.Properties[name] = property
+		if !strings.Contains(options, "omitempty") && fieldType.Kind() != reflect.Pointer {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+// nullable lets a schema also be null.
+func nullable(schema *Schema) *Schema {
+	switch types := schema.Type.(type) {
+	case string:
+		schema.Type = []string{types, "null"}
+		return schema
+	case []string:
+		return schema
+	}
+	return &Schema{OneOf: []*Schema{schema, {Type: "null"}}}
+}
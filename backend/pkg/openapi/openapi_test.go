@@ -0,0 +1,73 @@
+package openapi
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPathTemplate(t *testing.T) {
+	template, names := PathTemplate("/api/v1/orgs/:orgId/members/:userId")
+	if template != "/api/v1/orgs/{orgId}/members/{userId}" {
+		t.Errorf("template is %q", template)
+	}
+	if !reflect.DeepEqual(names, []string{"orgId", "userId"}) {
+		t.Errorf("names are %v", names)
+	}
+}
+
+type base struct {
+	Id        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type sample struct {
+	base
+	Name     string            `json:"name"`
+	Nickname string            `json:"nickname,omitempty"`
+	Parent   *sample           `json:"parent"`
+	Tags     []string          `json:"tags"`
+	Labels   map[string]string `json:"labels"`
+	Secret   string            `json:"-"`
+	hidden   string
+}
+
+func TestStructsBecomeComponents(t *testing.T) {
+	document := NewDocument(Info{Title: "test", Version: "1"})
+	schema := document.Schema(sample{})
+	if schema.Ref != "#/components/schemas/sample" {
+		t.Fatalf("schema is %+v, want a reference", schema)
+	}
+	component := document.Components.Schemas["sample"]
+	if component == nil {
+		t.Fatalf("no sample component")
+	}
+	for _, name := range []string{"id", "created_at", "name", "nickname", "parent", "tags", "labels"} {
+		if component.Properties[name] == nil {
+			t.Errorf("property %s is missing", name)
+		}
+	}
+	if len(component.Properties) != 7 {
+		t.Errorf("properties are %v, want the embedded ones flattened and no skipped ones", component.Properties)
+	}
+	if !reflect.DeepEqual(component.Required, []string{"id", "created_at", "name", "tags", "labels"}) {
+		t.Errorf("required are %v", component.Required)
+	}
+	if created := component.Properties["created_at"]; created.Type != "string" || created.Format != "date-time" {
+		t.Errorf("created_at is %+v", created)
+	}
+	if parent := component.Properties["parent"]; len(parent.OneOf) != 2 || parent.OneOf[0].Ref != schema.Ref {
+		t.Errorf("parent is %+v, want a nullable reference to sample", parent)
+	}
+	if tags := component.Properties["tags"]; !reflect.DeepEqual(tags.Type, []string{"array", "null"}) {
+		t.Errorf("tags is %+v, want a nullable array", tags)
+	}
+}
+
+func TestDefineOverridesReflection(t *testing.T) {
+	document := NewDocument(Info{Title: "test", Version: "1"})
+	document.Define(time.Duration(0), &Schema{Type: "string"})
+	if schema := document.Schema(time.Duration(0)); schema.Type != "string" {
+		t.Errorf("schema is %+v, want the defined one", schema)
+	}
+}
@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"hitenok/pkg/domain"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type ApiKeyRepositoryI interface {
+	FindApiKeyByHash(hash string) (*domain.ApiKey, *domain.MyError)
+	FindUserApiKey(user *domain.User, id uint) (*domain.ApiKey, *domain.MyError)
+	FindUserApiKeys(user *domain.User) ([]domain.ApiKey, *domain.MyError)
+	SaveApiKey(apiKey *domain.ApiKey) *domain.MyError
+	TouchApiKey(apiKey *domain.ApiKey, usedAt time.Time) *domain.MyError
+	DeleteApiKey(apiKey *domain.ApiKey) *domain.MyError
+}
+
+type apiKeyRepository struct {
+	DB *gorm.DB
+}
+
+func NewApiKeyRepository(db *gorm.DB) ApiKeyRepositoryI {
+	return &apiKeyRepository{
+		DB: db,
+	}
+}
+
+func (apiKeyRepo *apiKeyRepository) FindApiKeyByHash(hash string) (*domain.ApiKey, *domain.MyError) {
+	var apiKey domain.ApiKey
+	err := apiKeyRepo.DB.Where("hash = ?", hash).First(&apiKey).Error
+	if err != nil {
+		return &apiKey, domain.NewError(err, "apiKeyRepository.FindApiKeyByHash")
+	}
+	return &apiKey, nil
+}
+
+// FindUserApiKey loads a key of the user; a key of somebody else is not found.
+func (apiKeyRepo *apiKeyRepository) FindUserApiKey(user *domain.User, id uint) (*domain.ApiKey, *domain.MyError) {
+	var apiKey domain.ApiKey
+	err := apiKeyRepo.DB.Where("id = ? AND user_id = ?", id, user.ID).First(&apiKey).Error
+	if err != nil {
+		return &apiKey, domain.NewError(err, "apiKeyRepository.FindUserApiKey")
+	}
+	return &apiKey, nil
+}
+
+func (apiKeyRepo *apiKeyRepository) FindUserApiKeys(user *domain.User) ([]domain.ApiKey, *domain.MyError) {
+	apiKeys := []domain.ApiKey{}
+	err := apiKeyRepo.DB.Where("user_id = ?", user.ID).Order("id").Find(&apiKeys).Error
+	if err != nil {
+		return apiKeys, domain.NewError(err, "apiKeyRepository.FindUserApiKeys")
+	}
+	return apiKeys, nil
+}
+
+func (apiKeyRepo *apiKeyRepository) SaveApiKey(apiKey *domain.ApiKey) *domain.MyError {
+	err := apiKeyRepo.DB.Save(apiKey).Error
+	if err != nil {
+		return domain.NewError(err, "apiKeyRepository.SaveApiKey")
+	}
+	return nil
+}
+
+// TouchApiKey records when the key was last used. Only that column is written, so it
+// cannot undo a concurrent delete.
+func (apiKeyRepo *apiKeyRepository) TouchApiKey(apiKey *domain.ApiKey, usedAt time.Time) *domain.MyError {
+	err := apiKeyRepo.DB.Model(apiKey).UpdateColumn("last_used_at", usedAt).Error
+	if err != nil {
+		return domain.NewError(err, "apiKeyRepository.TouchApiKey")
+	}
+	apiKey.LastUsedAt = &usedAt
+	return nil
+}
+
+func (apiKeyRepo *apiKeyRepository) DeleteApiKey(apiKey *domain.ApiKey) *domain.MyError {
+	err := apiKeyRepo.DB.Delete(apiKey).Error
+	if err != nil {
+		return domain.NewError(err, "apiKeyRepository.DeleteApiKey")
+	}
+	return nil
+}
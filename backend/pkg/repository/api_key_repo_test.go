@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"errors"
+	"hitenok/pkg/domain"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestApiKeysBelongToTheirUser(t *testing.T) {
+	repo := NewApiKeyRepository(openTestDatabase(t))
+	apiKey := &domain.ApiKey{UserId: 1, Name: "ci", Prefix: "hk_abc", Hash: "hash"}
+	if err := repo.SaveApiKey(apiKey); err != nil {
+		t.Fatalf("SaveApiKey: %v", err.ErrorBase)
+	}
+	owner := &domain.User{}
+	owner.ID = 1
+	stranger := &domain.User{}
+	stranger.ID = 2
+
+	if _, err := repo.FindUserApiKey(owner, apiKey.ID); err != nil {
+		t.Fatalf("FindUserApiKey of the owner: %v", err.ErrorBase)
+	}
+	if _, err := repo.FindUserApiKey(stranger, apiKey.ID); err == nil || !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		t.Errorf("FindUserApiKey of another user returned %v, want not found", err)
+	}
+	if apiKeys, err := repo.FindUserApiKeys(stranger); err != nil || len(apiKeys) != 0 {
+		t.Errorf("FindUserApiKeys of another user returned %d keys, %v", len(apiKeys), err)
+	}
+
+	if err := repo.DeleteApiKey(apiKey); err != nil {
+		t.Fatalf("DeleteApiKey: %v", err.ErrorBase)
+	}
+	if _, err := repo.FindApiKeyByHash("hash"); err == nil || !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		t.Errorf("FindApiKeyByHash of a deleted key returned %v, want not found", err)
+	}
+}
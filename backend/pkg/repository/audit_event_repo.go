@@ -0,0 +1,148 @@
+package repository
+
+import (
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const auditBatchSize = 500
+
+type AuditEventRepositoryI interface {
+	AppendAuditEvent(event *domain.AuditEvent) *domain.MyError
+	FindAuditEvents(filter domain.AuditFilter) ([]domain.AuditEvent, *domain.MyError)
+	EachAuditEvent(filter domain.AuditFilter, ascending bool, fn func(event *domain.AuditEvent) error) *domain.MyError
+	FindAuditChainHead() (*domain.AuditChainHead, *domain.MyError)
+}
+
+type auditEventRepository struct {
+	DB        *gorm.DB
+	appConfig *config.AppConfig
+	// mu only saves the local writers from queueing on the row lock.
+	mu sync.Mutex
+}
+
+func NewAuditEventRepository(db *gorm.DB, appConfig *config.AppConfig) AuditEventRepositoryI {
+	return &auditEventRepository{
+		DB:        db,
+		appConfig: appConfig,
+	}
+}
+
+// AppendAuditEvent links the event to the chain head and stores it, hashed under the
+// current audit key. The id is taken from the head rather than the sequence so that it
+// is part of the hash and gapless.
+func (auditEventRepo *auditEventRepository) AppendAuditEvent(event *domain.AuditEvent) *domain.MyError {
+	auditEventRepo.mu.Lock()
+	defer auditEventRepo.mu.Unlock()
+	err := auditEventRepo.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&domain.AuditChainHead{ID: 1}).Error
+		if err != nil {
+			return err
+		}
+		var head domain.AuditChainHead
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", 1).First(&head).Error
+		if err != nil {
+			return err
+		}
+		event.ID = head.LastEventId + 1
+		event.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+		event.PrevHash = head.Hash
+		event.Hash = auditEventRepo.appConfig.Keys.Audit.Sign(event.HashMessage())
+		if err := tx.Create(event).Error; err != nil {
+			return err
+		}
+		return tx.Model(&head).Updates(map[string]interface{}{
+			"last_event_id": event.ID,
+			"hash":          event.Hash,
+		}).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "auditEventRepository.AppendAuditEvent")
+	}
+	return nil
+}
+
+func (auditEventRepo *auditEventRepository) FindAuditEvents(filter domain.AuditFilter) ([]domain.AuditEvent, *domain.MyError) {
+	var events []domain.AuditEvent
+	query := auditFilterQuery(auditEventRepo.DB, filter)
+	if filter.BeforeId != 0 {
+		query = query.Where("id < ?", filter.BeforeId)
+	}
+	err := query.Order("id DESC").Limit(filter.Limit).Find(&events).Error
+	if err != nil {
+		return events, domain.NewError(err, "auditEventRepository.FindAuditEvents")
+	}
+	return events, nil
+}
+
+// EachAuditEvent streams every event matching the filter to fn in batches, oldest first
+// when ascending. Limit and BeforeId are ignored. An error from fn stops the walk and is
+// returned.
+func (auditEventRepo *auditEventRepository) EachAuditEvent(filter domain.AuditFilter, ascending bool, fn func(event *domain.AuditEvent) error) *domain.MyError {
+	var cursor uint
+	for {
+		var events []domain.AuditEvent
+		query := auditFilterQuery(auditEventRepo.DB, filter)
+		if ascending {
+			query = query.Where("id > ?", cursor).Order("id ASC")
+		} else {
+			if cursor != 0 {
+				query = query.Where("id < ?", cursor)
+			}
+			query = query.Order("id DESC")
+		}
+		err := query.Limit(auditBatchSize).Find(&events).Error
+		if err != nil {
+			return domain.NewError(err, "auditEventRepository.EachAuditEvent")
+		}
+		for i := range events {
+			if err := fn(&events[i]); err != nil {
+				return domain.NewError(err, "auditEventRepository.EachAuditEvent")
+			}
+		}
+		if len(events) < auditBatchSize {
+			return nil
+		}
+		cursor = events[len(events)-1].ID
+	}
+}
+
+func (auditEventRepo *auditEventRepository) FindAuditChainHead() (*domain.AuditChainHead, *domain.MyError) {
+	var head domain.AuditChainHead
+	err := auditEventRepo.DB.Where("id = ?", 1).First(&head).Error
+	if err != nil {
+		return &head, domain.NewError(err, "auditEventRepository.FindAuditChainHead")
+	}
+	return &head, nil
+}
+
+func auditFilterQuery(db *gorm.DB, filter domain.AuditFilter) *gorm.DB {
+	query := db.Model(&domain.AuditEvent{})
+	if filter.ActorId != 0 {
+		query = query.Where("actor_id = ?", filter.ActorId)
+	}
+	if filter.SubjectId != 0 {
+		query = query.Where("subject_id = ?", filter.SubjectId)
+	}
+	if filter.UserId != 0 {
+		query = query.Where("actor_id = ? OR subject_id = ?", filter.UserId, filter.UserId)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.Outcome != "" {
+		query = query.Where("outcome = ?", filter.Outcome)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	return query
+}
@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// mysqlTlsName is the name the TLS settings are registered under with the MySQL driver.
+const mysqlTlsName = "hitenok"
+
+// OpenDatabase connects with the configured driver. The repositories only use queries
+// that every driver understands, so they work on whichever database this returns.
+func OpenDatabase(dbConfig config.DbConfig) (*gorm.DB, *domain.MyError) {
+	var dialector gorm.Dialector
+	switch dbConfig.Driver {
+	case "postgres":
+		dsn := dbConfig.Dsn
+		if dsn == "" {
+			dsn = postgresDsn(dbConfig)
+		}
+		dialector = postgres.Open(dsn)
+	case "mysql":
+		dsn := dbConfig.Dsn
+		if dsn == "" {
+			var err error
+			dsn, err = mysqlDsn(dbConfig)
+			if err != nil {
+				return nil, domain.NewError(err, "repository.OpenDatabase")
+			}
+		}
+		dialector = mysql.Open(dsn)
+	case "sqlite":
+		dsn := dbConfig.Dsn
+		if dsn == "" {
+			// Immediate transactions take the write lock up front; a deferred one that
+			// reads first could fail to upgrade instead of waiting.
+			dsn = "file:" + dbConfig.Name + "?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"
+		}
+		dialector = sqlite.Open(dsn)
+	default:
+		return nil, domain.NewError(fmt.Errorf("unknown driver %q", dbConfig.Driver), "repository.OpenDatabase")
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, domain.NewError(err, "repository.OpenDatabase")
+	}
+	return db, nil
+}
+
+func postgresDsn(dbConfig config.DbConfig) string {
+	params := []string{
+		"host=" + postgresValue(dbConfig.Host),
+		"port=" + postgresValue(dbConfig.Port),
+		"user=" + postgresValue(dbConfig.User),
+		"password=" + postgresValue(dbConfig.Password),
+		"dbname=" + postgresValue(dbConfig.Name),
+		"sslmode=" + postgresValue(dbConfig.SslMode),
+		"TimeZone=" + postgresValue(dbConfig.TimeZone),
+	}
+	if dbConfig.TlsCaFile != "" {
+		params = append(params, "sslrootcert="+postgresValue(dbConfig.TlsCaFile))
+	}
+	if dbConfig.TlsCertFile != "" {
+		params = append(params, "sslcert="+postgresValue(dbConfig.TlsCertFile), "sslkey="+postgresValue(dbConfig.TlsKeyFile))
+	}
+	return strings.Join(params, " ")
+}
+
+// postgresValue quotes a keyword/value connection string value when it is empty or
+// holds spaces, quotes or backslashes.
+func postgresValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " '\\") {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+func mysqlDsn(dbConfig config.DbConfig) (string, error) {
+	location, err := time.LoadLocation(dbConfig.TimeZone)
+	if err != nil {
+		return "", err
+	}
+	tlsName, err := mysqlTls(dbConfig)
+	if err != nil {
+		return "", err
+	}
+	mysqlConfig := mysqlDriver.NewConfig()
+	mysqlConfig.User = dbConfig.User
+	mysqlConfig.Passwd = dbConfig.Password
+	mysqlConfig.Net = "tcp"
+	mysqlConfig.Addr = net.JoinHostPort(dbConfig.Host, dbConfig.Port)
+	mysqlConfig.DBName = dbConfig.Name
+	mysqlConfig.Params = map[string]string{"charset": "utf8mb4"}
+	mysqlConfig.ParseTime = true
+	mysqlConfig.Loc = location
+	mysqlConfig.TLSConfig = tlsName
+	// Conditional updates check RowsAffected; like Postgres, count the rows matched
+	// rather than only those whose values changed.
+	mysqlConfig.ClientFoundRows = true
+	return mysqlConfig.FormatDSN(), nil
+}
+
+// mysqlTls maps the Postgres style sslmode onto the MySQL driver, registering a TLS
+// configuration for the modes that need certificates.
+func mysqlTls(dbConfig config.DbConfig) (string, error) {
+	switch dbConfig.SslMode {
+	case "disable":
+		return "false", nil
+	case "prefer":
+		return "preferred", nil
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         dbConfig.Host,
+		InsecureSkipVerify: dbConfig.SslMode == "require",
+	}
+	if dbConfig.TlsCaFile != "" {
+		pem, err := os.ReadFile(dbConfig.TlsCaFile)
+		if err != nil {
+			return "", err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("%s: no certificates found", dbConfig.TlsCaFile)
+		}
+	}
+	if dbConfig.TlsCertFile != "" {
+		pair, err := tls.LoadX509KeyPair(dbConfig.TlsCertFile, dbConfig.TlsKeyFile)
+		if err != nil {
+			return "", err
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	if dbConfig.SslMode == "verify-ca" {
+		// The chain is verified, the host name is not.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("the server sent no certificate")
+			}
+			options := x509.VerifyOptions{Roots: tlsConfig.RootCAs, Intermediates: x509.NewCertPool()}
+			for _, certificate := range state.PeerCertificates[1:] {
+				options.Intermediates.AddCert(certificate)
+			}
+			_, err := state.PeerCertificates[0].Verify(options)
+			return err
+		}
+	}
+	if err := mysqlDriver.RegisterTLSConfig(mysqlTlsName, tlsConfig); err != nil {
+		return "", err
+	}
+	return mysqlTlsName, nil
+}
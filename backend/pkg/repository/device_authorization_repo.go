@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"fmt"
+	"hitenok/pkg/domain"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type DeviceAuthorizationRepositoryI interface {
+	FindByDeviceCode(deviceCode string) (*domain.DeviceAuthorization, *domain.MyError)
+	FindPendingByUserCode(userCode string) (*domain.DeviceAuthorization, *domain.MyError)
+	SaveDeviceAuthorization(deviceAuthorization *domain.DeviceAuthorization) *domain.MyError
+	DeleteDeviceAuthorization(deviceAuthorization *domain.DeviceAuthorization) *domain.MyError
+	ConsumeDeviceAuthorization(deviceAuthorization *domain.DeviceAuthorization) *domain.MyError
+	DecideDeviceAuthorization(deviceAuthorization *domain.DeviceAuthorization, status string, userId uint) *domain.MyError
+	RecordDevicePoll(deviceAuthorization *domain.DeviceAuthorization, polledAt time.Time, interval int) *domain.MyError
+}
+
+type deviceAuthorizationRepository struct {
+	DB *gorm.DB
+}
+
+func NewDeviceAuthorizationRepository(db *gorm.DB) DeviceAuthorizationRepositoryI {
+	return &deviceAuthorizationRepository{
+		DB: db,
+	}
+}
+
+func (deviceRepo *deviceAuthorizationRepository) FindByDeviceCode(deviceCode string) (*domain.DeviceAuthorization, *domain.MyError) {
+	var deviceAuthorization domain.DeviceAuthorization
+	err := deviceRepo.DB.Where("device_code = ?", deviceCode).First(&deviceAuthorization).Error
+	if err != nil {
+		return &deviceAuthorization, domain.NewError(err, "deviceAuthorizationRepository.FindByDeviceCode")
+	}
+	return &deviceAuthorization, nil
+}
+
+func (deviceRepo *deviceAuthorizationRepository) FindPendingByUserCode(userCode string) (*domain.DeviceAuthorization, *domain.MyError) {
+	var deviceAuthorization domain.DeviceAuthorization
+	err := deviceRepo.DB.Where("user_code = ? AND status = ? AND expires_at > ?", userCode, domain.DeviceAuthorizationPending, time.Now()).First(&deviceAuthorization).Error
+	if err != nil {
+		return &deviceAuthorization, domain.NewError(err, "deviceAuthorizationRepository.FindPendingByUserCode")
+	}
+	return &deviceAuthorization, nil
+}
+
+func (deviceRepo *deviceAuthorizationRepository) SaveDeviceAuthorization(deviceAuthorization *domain.DeviceAuthorization) *domain.MyError {
+	err := deviceRepo.DB.Save(deviceAuthorization).Error
+	if err != nil {
+		return domain.NewError(err, "deviceAuthorizationRepository.SaveDeviceAuthorization")
+	}
+	return nil
+}
+
+func (deviceRepo *deviceAuthorizationRepository) DeleteDeviceAuthorization(deviceAuthorization *domain.DeviceAuthorization) *domain.MyError {
+	err := deviceRepo.DB.Unscoped().Delete(deviceAuthorization).Error
+	if err != nil {
+		return domain.NewError(err, "deviceAuthorizationRepository.DeleteDeviceAuthorization")
+	}
+	return nil
+}
+
+// ConsumeDeviceAuthorization deletes an approved authorization so its device code can be
+// redeemed once. When a concurrent poll deleted it first, "device code already used" is
+// reported.
+func (deviceRepo *deviceAuthorizationRepository) ConsumeDeviceAuthorization(deviceAuthorization *domain.DeviceAuthorization) *domain.MyError {
+	result := deviceRepo.DB.Unscoped().
+		Where("status = ?", domain.DeviceAuthorizationApproved).
+		Delete(deviceAuthorization)
+	if result.Error != nil {
+		return domain.NewError(result.Error, "deviceAuthorizationRepository.ConsumeDeviceAuthorization")
+	}
+	if result.RowsAffected != 1 {
+		return domain.NewError(fmt.Errorf("device code already used"), "deviceAuthorizationRepository.ConsumeDeviceAuthorization")
+	}
+	return nil
+}
+
+// DecideDeviceAuthorization approves or denies a pending authorization on behalf of the
+// user. When it is no longer pending, because it was decided or consumed concurrently,
+// gorm.ErrRecordNotFound is reported as for an unknown code.
+func (deviceRepo *deviceAuthorizationRepository) DecideDeviceAuthorization(deviceAuthorization *domain.DeviceAuthorization, status string, userId uint) *domain.MyError {
+	result := deviceRepo.DB.Model(deviceAuthorization).
+		Where("status = ?", domain.DeviceAuthorizationPending).
+		Updates(map[string]interface{}{
+			"status":  status,
+			"user_id": userId,
+		})
+	if result.Error != nil {
+		return domain.NewError(result.Error, "deviceAuthorizationRepository.DecideDeviceAuthorization")
+	}
+	if result.RowsAffected != 1 {
+		return domain.NewError(gorm.ErrRecordNotFound, "deviceAuthorizationRepository.DecideDeviceAuthorization")
+	}
+	deviceAuthorization.Status = status
+	deviceAuthorization.UserId = userId
+	return nil
+}
+
+// RecordDevicePoll stores the time and the interval of a poll, only while the
+// authorization is pending, so that a poll never writes over a decision made after it
+// read the row.
+func (deviceRepo *deviceAuthorizationRepository) RecordDevicePoll(deviceAuthorization *domain.DeviceAuthorization, polledAt time.Time, interval int) *domain.MyError {
+	err := deviceRepo.DB.Model(deviceAuthorization).
+		Where("status = ?", domain.DeviceAuthorizationPending).
+		Updates(map[string]interface{}{
+			"last_polled_at": polledAt,
+			"interval":       interval,
+		}).Error
+	if err != nil {
+		return domain.NewError(err, "deviceAuthorizationRepository.RecordDevicePoll")
+	}
+	deviceAuthorization.LastPolledAt = polledAt
+	deviceAuthorization.Interval = interval
+	return nil
+}
@@ -0,0 +1,87 @@
+package repository
+
+import (
+	"errors"
+	"hitenok/pkg/domain"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestConsumeDeviceAuthorizationOnce(t *testing.T) {
+	repo := NewDeviceAuthorizationRepository(openTestDatabase(t))
+	approved := &domain.DeviceAuthorization{
+		DeviceCode: "device-code",
+		UserCode:   "USERCODE",
+		ClientId:   "cli",
+		Status:     domain.DeviceAuthorizationApproved,
+		UserId:     1,
+		ExpiresAt:  time.Now().Add(time.Minute),
+	}
+	if err := repo.SaveDeviceAuthorization(approved); err != nil {
+		t.Fatalf("SaveDeviceAuthorization: %v", err.ErrorBase)
+	}
+	// Two polls that both read the approved row before either consumed it.
+	first, _ := repo.FindByDeviceCode("device-code")
+	second, _ := repo.FindByDeviceCode("device-code")
+
+	if err := repo.ConsumeDeviceAuthorization(first); err != nil {
+		t.Fatalf("first ConsumeDeviceAuthorization: %v", err.ErrorBase)
+	}
+	err := repo.ConsumeDeviceAuthorization(second)
+	if err == nil || err.ErrorBase.Error() != "device code already used" {
+		t.Fatalf("second ConsumeDeviceAuthorization error = %v, want device code already used", err)
+	}
+}
+
+func TestConsumeDeviceAuthorizationNeedsApproval(t *testing.T) {
+	repo := NewDeviceAuthorizationRepository(openTestDatabase(t))
+	pending := &domain.DeviceAuthorization{
+		DeviceCode: "device-code",
+		UserCode:   "USERCODE",
+		ClientId:   "cli",
+		Status:     domain.DeviceAuthorizationPending,
+		ExpiresAt:  time.Now().Add(time.Minute),
+	}
+	repo.SaveDeviceAuthorization(pending)
+	if err := repo.ConsumeDeviceAuthorization(pending); err == nil {
+		t.Fatalf("a pending authorization was consumed")
+	}
+	if _, err := repo.FindByDeviceCode("device-code"); err != nil {
+		t.Errorf("the pending authorization is gone: %v", err.ErrorBase)
+	}
+}
+
+// TestDevicePollKeepsADecision has a poll that read the row while it was pending store
+// its poll after the user approved it in between.
+func TestDevicePollKeepsADecision(t *testing.T) {
+	repo := NewDeviceAuthorizationRepository(openTestDatabase(t))
+	pending := &domain.DeviceAuthorization{
+		DeviceCode: "device-code",
+		UserCode:   "USERCODE",
+		ClientId:   "cli",
+		Status:     domain.DeviceAuthorizationPending,
+		Interval:   5,
+		ExpiresAt:  time.Now().Add(time.Minute),
+	}
+	if err := repo.SaveDeviceAuthorization(pending); err != nil {
+		t.Fatalf("SaveDeviceAuthorization: %v", err.ErrorBase)
+	}
+	polled, _ := repo.FindByDeviceCode("device-code")
+	decided, _ := repo.FindPendingByUserCode("USERCODE")
+
+	if err := repo.DecideDeviceAuthorization(decided, domain.DeviceAuthorizationApproved, 7); err != nil {
+		t.Fatalf("DecideDeviceAuthorization: %v", err.ErrorBase)
+	}
+	if err := repo.RecordDevicePoll(polled, time.Now(), 10); err != nil {
+		t.Fatalf("RecordDevicePoll: %v", err.ErrorBase)
+	}
+	stored, _ := repo.FindByDeviceCode("device-code")
+	if stored.Status != domain.DeviceAuthorizationApproved || stored.UserId != 7 {
+		t.Errorf("status %q user %d, want the approval by user 7 kept", stored.Status, stored.UserId)
+	}
+	if err := repo.DecideDeviceAuthorization(decided, domain.DeviceAuthorizationDenied, 8); err == nil || !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		t.Errorf("deciding again error = %v, want not found", err)
+	}
+}
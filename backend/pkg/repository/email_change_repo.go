@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"hitenok/pkg/domain"
+
+	"gorm.io/gorm"
+)
+
+type EmailChangeRepositoryI interface {
+	FindEmailChangeByUser(userId uint) (*domain.EmailChange, *domain.MyError)
+	FindEmailChangeByCancelToken(cancelToken string) (*domain.EmailChange, *domain.MyError)
+	SaveEmailChange(emailChange *domain.EmailChange) *domain.MyError
+	DeleteEmailChanges(userId uint) *domain.MyError
+	ApplyEmailChange(emailChange *domain.EmailChange, user *domain.User) *domain.MyError
+}
+
+type emailChangeRepository struct {
+	DB *gorm.DB
+}
+
+func NewEmailChangeRepository(db *gorm.DB) EmailChangeRepositoryI {
+	return &emailChangeRepository{
+		DB: db,
+	}
+}
+
+func (emailChangeRepo *emailChangeRepository) FindEmailChangeByUser(userId uint) (*domain.EmailChange, *domain.MyError) {
+	var emailChange domain.EmailChange
+	err := emailChangeRepo.DB.Where("user_id = ?", userId).Order("id DESC").First(&emailChange).Error
+	if err != nil {
+		return &emailChange, domain.NewError(err, "emailChangeRepository.FindEmailChangeByUser")
+	}
+	return &emailChange, nil
+}
+
+func (emailChangeRepo *emailChangeRepository) FindEmailChangeByCancelToken(cancelToken string) (*domain.EmailChange, *domain.MyError) {
+	var emailChange domain.EmailChange
+	err := emailChangeRepo.DB.Where("cancel_token = ?", cancelToken).First(&emailChange).Error
+	if err != nil {
+		return &emailChange, domain.NewError(err, "emailChangeRepository.FindEmailChangeByCancelToken")
+	}
+	return &emailChange, nil
+}
+
+func (emailChangeRepo *emailChangeRepository) SaveEmailChange(emailChange *domain.EmailChange) *domain.MyError {
+	err := emailChangeRepo.DB.Save(emailChange).Error
+	if err != nil {
+		return domain.NewError(err, "emailChangeRepository.SaveEmailChange")
+	}
+	return nil
+}
+
+func (emailChangeRepo *emailChangeRepository) DeleteEmailChanges(userId uint) *domain.MyError {
+	err := emailChangeRepo.DB.Unscoped().Where("user_id = ?", userId).Delete(&domain.EmailChange{}).Error
+	if err != nil {
+		return domain.NewError(err, "emailChangeRepository.DeleteEmailChanges")
+	}
+	return nil
+}
+
+// ApplyEmailChange moves the user to the new address and bumps JWTVersion in one
+// transaction, re-checking that nobody has taken the address in the meantime.
+func (emailChangeRepo *emailChangeRepository) ApplyEmailChange(emailChange *domain.EmailChange, user *domain.User) *domain.MyError {
+	err := emailChangeRepo.DB.Transaction(func(tx *gorm.DB) error {
+		var existing domain.User
+		err := tx.Where("email = ? AND id <> ?", emailChange.NewEmail, user.ID).First(&existing).Error
+		if err == nil {
+			return fmt.Errorf("email already taken")
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		result := tx.Model(&domain.User{}).Where("id = ? AND jwt_version = ?", user.ID, user.JWTVersion).Updates(map[string]interface{}{
+			"email":       emailChange.NewEmail,
+			"jwt_version": user.JWTVersion + 1,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("user changed concurrently")
+		}
+		return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&domain.EmailChange{}).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "emailChangeRepository.ApplyEmailChange")
+	}
+	user.Email = emailChange.NewEmail
+	user.JWTVersion += 1
+	return nil
+}
@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"context"
+	"hitenok/pkg/domain"
+
+	"gorm.io/gorm"
+)
+
+type HealthRepositoryI interface {
+	Ping(ctx context.Context) *domain.MyError
+}
+
+type healthRepository struct {
+	DB *gorm.DB
+}
+
+func NewHealthRepository(db *gorm.DB) HealthRepositoryI {
+	return &healthRepository{
+		DB: db,
+	}
+}
+
+// Ping takes a connection from the pool and round-trips to the database.
+func (healthRepo *healthRepository) Ping(ctx context.Context) *domain.MyError {
+	sqlDB, err := healthRepo.DB.DB()
+	if err != nil {
+		return domain.NewError(err, "healthRepository.Ping")
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return domain.NewError(err, "healthRepository.Ping")
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"fmt"
+	"hitenok/pkg/domain"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type InvitationRepositoryI interface {
+	FindInvitationById(id uint) (*domain.Invitation, *domain.MyError)
+	FindPendingInvitations(organizationId uint, now time.Time) ([]domain.Invitation, *domain.MyError)
+	SaveInvitation(invitation *domain.Invitation) *domain.MyError
+	DeleteInvitation(invitation *domain.Invitation) *domain.MyError
+	AcceptInvitation(invitation *domain.Invitation, membership *domain.Membership) *domain.MyError
+}
+
+type invitationRepository struct {
+	DB *gorm.DB
+}
+
+func NewInvitationRepository(db *gorm.DB) InvitationRepositoryI {
+	return &invitationRepository{
+		DB: db,
+	}
+}
+
+func (invitationRepo *invitationRepository) FindInvitationById(id uint) (*domain.Invitation, *domain.MyError) {
+	var invitation domain.Invitation
+	err := invitationRepo.DB.Preload("Organization").Where("id = ?", id).First(&invitation).Error
+	if err != nil {
+		return &invitation, domain.NewError(err, "invitationRepository.FindInvitationById")
+	}
+	return &invitation, nil
+}
+
+func (invitationRepo *invitationRepository) FindPendingInvitations(organizationId uint, now time.Time) ([]domain.Invitation, *domain.MyError) {
+	var invitations []domain.Invitation
+	err := invitationRepo.DB.
+		Where("organization_id = ? AND accepted_at IS NULL AND expires_at > ?", organizationId, now).
+		Order("id").Find(&invitations).Error
+	if err != nil {
+		return invitations, domain.NewError(err, "invitationRepository.FindPendingInvitations")
+	}
+	return invitations, nil
+}
+
+func (invitationRepo *invitationRepository) SaveInvitation(invitation *domain.Invitation) *domain.MyError {
+	err := invitationRepo.DB.Omit(clause.Associations).Save(invitation).Error
+	if err != nil {
+		return domain.NewError(err, "invitationRepository.SaveInvitation")
+	}
+	return nil
+}
+
+func (invitationRepo *invitationRepository) DeleteInvitation(invitation *domain.Invitation) *domain.MyError {
+	err := invitationRepo.DB.Delete(invitation).Error
+	if err != nil {
+		return domain.NewError(err, "invitationRepository.DeleteInvitation")
+	}
+	return nil
+}
+
+// AcceptInvitation marks the invitation used and creates the membership in one go. The
+// update only matches an unused invitation, so two concurrent accepts cannot both win;
+// the loser gets "invitation already used".
+func (invitationRepo *invitationRepository) AcceptInvitation(invitation *domain.Invitation, membership *domain.Membership) *domain.MyError {
+	now := time.Now()
+	err := invitationRepo.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(invitation).Where("accepted_at IS NULL").Updates(map[string]interface{}{
+			"accepted_at": now,
+			"accepted_by": membership.UserId,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fmt.Errorf("invitation already used")
+		}
+		return tx.Omit(clause.Associations).Create(membership).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "invitationRepository.AcceptInvitation")
+	}
+	invitation.AcceptedAt = &now
+	acceptedBy := membership.UserId
+	invitation.AcceptedBy = &acceptedBy
+	return nil
+}
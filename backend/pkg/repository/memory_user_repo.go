@@ -0,0 +1,245 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"hitenok/pkg/domain"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+type memoryUserRepository struct {
+	mu     sync.Mutex
+	users  map[uint]domain.User
+	nextId uint
+	schema *schema.Schema
+	// now stamps CreatedAt, UpdatedAt and DeletedAt, as gorm's NowFunc does.
+	now func() time.Time
+}
+
+// NewMemoryUserRepository keeps users in a map, for tests and tools that run without a
+// database. It behaves as userRepository does on the migrated schema: lookups skip
+// soft-deleted users and fail with gorm.ErrRecordNotFound, saving assigns ids and
+// timestamps, and two live users cannot share an email. Users are copied in and out,
+// so a caller's changes are not seen until saved. The rows other repositories own are
+// not kept, so PurgeUser only handles the user itself.
+func NewMemoryUserRepository(now func() time.Time) UserRepositoryI {
+	userSchema, err := schema.Parse(&domain.User{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		panic(err)
+	}
+	if now == nil {
+		now = time.Now
+	}
+	return &memoryUserRepository{
+		users:  map[uint]domain.User{},
+		schema: userSchema,
+		now:    now,
+	}
+}
+
+func (memoryRepo *memoryUserRepository) FindUserById(id uint) (*domain.User, *domain.MyError) {
+	memoryRepo.mu.Lock()
+	defer memoryRepo.mu.Unlock()
+	user, found := memoryRepo.users[id]
+	if !found || user.DeletedAt.Valid {
+		return &domain.User{}, domain.NewError(gorm.ErrRecordNotFound, "memoryUserRepository.FindUserById")
+	}
+	return &user, nil
+}
+
+// FindUserByEmail returns the live user with the lowest id, as First orders by the
+// primary key.
+func (memoryRepo *memoryUserRepository) FindUserByEmail(email string) (*domain.User, *domain.MyError) {
+	memoryRepo.mu.Lock()
+	defer memoryRepo.mu.Unlock()
+	for _, id := range memoryRepo.ids() {
+		user := memoryRepo.users[id]
+		if !user.DeletedAt.Valid && user.Email == email {
+			return &user, nil
+		}
+	}
+	return &domain.User{}, domain.NewError(gorm.ErrRecordNotFound, "memoryUserRepository.FindUserByEmail")
+}
+
+// SaveUser inserts a user without an id and writes every field of one with an id,
+// inserting it when missing, like gorm's Save.
+func (memoryRepo *memoryUserRepository) SaveUser(user *domain.User) *domain.MyError {
+	memoryRepo.mu.Lock()
+	defer memoryRepo.mu.Unlock()
+	if memoryRepo.emailTaken(user) {
+		return domain.NewError(gorm.ErrDuplicatedKey, "memoryUserRepository.SaveUser")
+	}
+	now := memoryRepo.now()
+	if user.ID == 0 {
+		memoryRepo.nextId += 1
+		user.ID = memoryRepo.nextId
+	}
+	if user.ID > memoryRepo.nextId {
+		memoryRepo.nextId = user.ID
+	}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	user.UpdatedAt = now
+	memoryRepo.users[user.ID] = *user
+	return nil
+}
+
+// UpdateUserColumns is the compare-and-swap of userRepository. As with gorm, the new
+// values are assigned to user even when the row no longer matches.
+func (memoryRepo *memoryUserRepository) UpdateUserColumns(user *domain.User, previous, columns map[string]interface{}) *domain.MyError {
+	memoryRepo.mu.Lock()
+	defer memoryRepo.mu.Unlock()
+	ctx := context.Background()
+	target := reflect.ValueOf(user).Elem()
+	for column, value := range columns {
+		field, found := memoryRepo.schema.FieldsByDBName[column]
+		if !found {
+			return domain.NewError(fmt.Errorf("unknown column %q", column), "memoryUserRepository.UpdateUserColumns")
+		}
+		if err := field.Set(ctx, target, value); err != nil {
+			return domain.NewError(err, "memoryUserRepository.UpdateUserColumns")
+		}
+	}
+	now := memoryRepo.now()
+	user.UpdatedAt = now
+
+	stored, found := memoryRepo.users[user.ID]
+	if !found || stored.DeletedAt.Valid {
+		return domain.NewError(fmt.Errorf("user changed concurrently"), "memoryUserRepository.UpdateUserColumns")
+	}
+	row := reflect.ValueOf(&stored).Elem()
+	for column, value := range previous {
+		field, found := memoryRepo.schema.FieldsByDBName[column]
+		if !found {
+			return domain.NewError(fmt.Errorf("unknown column %q", column), "memoryUserRepository.UpdateUserColumns")
+		}
+		current, _ := field.ValueOf(ctx, row)
+		if !columnEqual(current, value) {
+			return domain.NewError(fmt.Errorf("user changed concurrently"), "memoryUserRepository.UpdateUserColumns")
+		}
+	}
+	for column, value := range columns {
+		if err := memoryRepo.schema.FieldsByDBName[column].Set(ctx, row, value); err != nil {
+			return domain.NewError(err, "memoryUserRepository.UpdateUserColumns")
+		}
+	}
+	stored.UpdatedAt = now
+	memoryRepo.users[user.ID] = stored
+	return nil
+}
+
+func (memoryRepo *memoryUserRepository) SoftDeleteUser(user *domain.User) *domain.MyError {
+	memoryRepo.mu.Lock()
+	defer memoryRepo.mu.Unlock()
+	now := memoryRepo.now()
+	user.IsActive = false
+	user.JWTVersion += 1
+	user.UpdatedAt = now
+	user.DeletedAt = gorm.DeletedAt{Time: now, Valid: true}
+	memoryRepo.users[user.ID] = *user
+	return nil
+}
+
+func (memoryRepo *memoryUserRepository) RestoreUser(id uint) (*domain.User, *domain.MyError) {
+	memoryRepo.mu.Lock()
+	defer memoryRepo.mu.Unlock()
+	user, found := memoryRepo.users[id]
+	if !found || !user.DeletedAt.Valid || strings.HasSuffix(user.Email, "@"+domain.AnonymizedEmailDomain) {
+		return &domain.User{}, domain.NewError(gorm.ErrRecordNotFound, "memoryUserRepository.RestoreUser")
+	}
+	user.IsActive = true
+	user.DeletedAt = gorm.DeletedAt{}
+	if memoryRepo.emailTaken(&user) {
+		return &user, domain.NewError(fmt.Errorf("user already exists"), "memoryUserRepository.RestoreUser")
+	}
+	user.UpdatedAt = memoryRepo.now()
+	memoryRepo.users[id] = user
+	return &user, nil
+}
+
+func (memoryRepo *memoryUserRepository) FindUsersDeletedBefore(cutoff time.Time) ([]domain.User, *domain.MyError) {
+	memoryRepo.mu.Lock()
+	defer memoryRepo.mu.Unlock()
+	users := []domain.User{}
+	for _, id := range memoryRepo.ids() {
+		user := memoryRepo.users[id]
+		if user.DeletedAt.Valid && user.DeletedAt.Time.Before(cutoff) && !strings.HasSuffix(user.Email, "@"+domain.AnonymizedEmailDomain) {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (memoryRepo *memoryUserRepository) PurgeUser(user *domain.User, anonymize bool) *domain.MyError {
+	memoryRepo.mu.Lock()
+	defer memoryRepo.mu.Unlock()
+	if !anonymize {
+		delete(memoryRepo.users, user.ID)
+		return nil
+	}
+	user.Email = fmt.Sprintf("deleted-%d@%s", user.ID, domain.AnonymizedEmailDomain)
+	user.Fullname = ""
+	user.Password = ""
+	user.Locale = ""
+	user.Timezone = ""
+	user.OTP = ""
+	user.OTPSpawnedAt = time.Time{}
+	user.ResetHash = ""
+	user.ResetHashSpawnedAt = time.Time{}
+	user.UpdatedAt = memoryRepo.now()
+	memoryRepo.users[user.ID] = *user
+	return nil
+}
+
+// ids lists the stored ids in ascending order, the order of the primary key.
+func (memoryRepo *memoryUserRepository) ids() []uint {
+	ids := make([]uint, 0, len(memoryRepo.users))
+	for id := range memoryRepo.users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// emailTaken mirrors idx_users_email, the unique index on the email of live users.
+func (memoryRepo *memoryUserRepository) emailTaken(user *domain.User) bool {
+	if user.DeletedAt.Valid {
+		return false
+	}
+	for id, other := range memoryRepo.users {
+		if id != user.ID && !other.DeletedAt.Valid && other.Email == user.Email {
+			return true
+		}
+	}
+	return false
+}
+
+// columnEqual compares a stored field with a value given for its column, converting
+// the value to the field's type first as the database would.
+func columnEqual(current, value interface{}) bool {
+	if currentTime, ok := current.(time.Time); ok {
+		valueTime, ok := value.(time.Time)
+		return ok && currentTime.Equal(valueTime)
+	}
+	currentValue, givenValue := reflect.ValueOf(current), reflect.ValueOf(value)
+	if !givenValue.IsValid() {
+		return !currentValue.IsValid() || currentValue.IsZero()
+	}
+	if givenValue.Type() != currentValue.Type() {
+		if !givenValue.CanConvert(currentValue.Type()) {
+			return false
+		}
+		givenValue = givenValue.Convert(currentValue.Type())
+	}
+	return reflect.DeepEqual(currentValue.Interface(), givenValue.Interface())
+}
@@ -0,0 +1,220 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"hitenok/pkg/domain"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestMemoryUserRepositoryNotFound(t *testing.T) {
+	repo := NewMemoryUserRepository(nil)
+	deleted := &domain.User{Email: "deleted@example.com"}
+	repo.SaveUser(deleted)
+	repo.SoftDeleteUser(deleted)
+
+	tests := []struct {
+		name string
+		find func() (*domain.User, *domain.MyError)
+	}{
+		{name: "unknown id", find: func() (*domain.User, *domain.MyError) { return repo.FindUserById(42) }},
+		{name: "unknown email", find: func() (*domain.User, *domain.MyError) { return repo.FindUserByEmail("nobody@example.com") }},
+		{name: "deleted by id", find: func() (*domain.User, *domain.MyError) { return repo.FindUserById(deleted.ID) }},
+		{name: "deleted by email", find: func() (*domain.User, *domain.MyError) { return repo.FindUserByEmail(deleted.Email) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := test.find()
+			if err == nil || !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+				t.Fatalf("error = %v, want gorm.ErrRecordNotFound", err)
+			}
+			if user == nil || user.ID != 0 {
+				t.Errorf("user = %+v, want an empty user", user)
+			}
+		})
+	}
+}
+
+func TestMemoryUserRepositorySaveUser(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	repo := NewMemoryUserRepository(func() time.Time { return now })
+
+	user := &domain.User{Email: "user@example.com"}
+	if err := repo.SaveUser(user); err != nil {
+		t.Fatalf("SaveUser: %v", err.ErrorBase)
+	}
+	if user.ID != 1 || !user.CreatedAt.Equal(now) || !user.UpdatedAt.Equal(now) {
+		t.Errorf("saved id %d created %v updated %v, want 1 stamped now", user.ID, user.CreatedAt, user.UpdatedAt)
+	}
+
+	// Changes are not seen until saved.
+	user.Fullname = "Changed"
+	stored, _ := repo.FindUserById(user.ID)
+	if stored.Fullname != "" {
+		t.Errorf("unsaved change is visible")
+	}
+	stored.Fullname = "Also changed"
+	if again, _ := repo.FindUserById(user.ID); again.Fullname != "" {
+		t.Errorf("change to a found copy is visible")
+	}
+
+	duplicate := &domain.User{Email: "user@example.com"}
+	if err := repo.SaveUser(duplicate); err == nil || !errors.Is(err.ErrorBase, gorm.ErrDuplicatedKey) {
+		t.Errorf("saving a second live user with the email: %v, want gorm.ErrDuplicatedKey", err)
+	}
+	repo.SoftDeleteUser(user)
+	if err := repo.SaveUser(duplicate); err != nil {
+		t.Errorf("saving after the first user was deleted: %v", err.ErrorBase)
+	}
+	if duplicate.ID != 2 {
+		t.Errorf("second id = %d, want 2", duplicate.ID)
+	}
+}
+
+func TestMemoryUserRepositoryUpdateUserColumns(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous map[string]interface{}
+		columns  map[string]interface{}
+		wantErr  string
+		want     func(user *domain.User) bool
+	}{
+		{
+			name:     "matching",
+			previous: map[string]interface{}{"is_active": false},
+			columns:  map[string]interface{}{"is_active": true},
+			want:     func(user *domain.User) bool { return user.IsActive },
+		},
+		{
+			name:     "changed concurrently",
+			previous: map[string]interface{}{"password": "other"},
+			columns:  map[string]interface{}{"password": "new"},
+			wantErr:  "user changed concurrently",
+			want:     func(user *domain.User) bool { return user.Password == "old" },
+		},
+		{
+			name:     "converted types",
+			previous: map[string]interface{}{"jwt_version": 3},
+			columns:  map[string]interface{}{"jwt_version": 4, "fullname": "New Name"},
+			want:     func(user *domain.User) bool { return user.JWTVersion == 4 && user.Fullname == "New Name" },
+		},
+		{
+			name:     "without a condition",
+			previous: map[string]interface{}{},
+			columns:  map[string]interface{}{"locale": "ru"},
+			want:     func(user *domain.User) bool { return user.Locale == "ru" },
+		},
+		{
+			name:    "unknown column",
+			columns: map[string]interface{}{"nope": 1},
+			wantErr: `unknown column "nope"`,
+			want:    func(user *domain.User) bool { return true },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo := NewMemoryUserRepository(nil)
+			user := &domain.User{Email: "user@example.com", Password: "old", JWTVersion: 3}
+			repo.SaveUser(user)
+
+			err := repo.UpdateUserColumns(user, test.previous, test.columns)
+			gotErr := ""
+			if err != nil {
+				gotErr = err.ErrorBase.Error()
+			}
+			if gotErr != test.wantErr {
+				t.Fatalf("UpdateUserColumns error = %q, want %q", gotErr, test.wantErr)
+			}
+			stored, _ := repo.FindUserById(user.ID)
+			if !test.want(stored) {
+				t.Errorf("stored user = %+v", stored)
+			}
+		})
+	}
+}
+
+func TestMemoryUserRepositoryConcurrentCompareAndSwap(t *testing.T) {
+	repo := NewMemoryUserRepository(nil)
+	user := &domain.User{Email: "user@example.com"}
+	repo.SaveUser(user)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, _ := repo.FindUserById(user.ID)
+			err := repo.UpdateUserColumns(found, map[string]interface{}{"is_active": false}, map[string]interface{}{"is_active": true})
+			if err == nil {
+				mu.Lock()
+				winners += 1
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Errorf("%d updates won the compare-and-swap, want 1", winners)
+	}
+}
+
+func TestMemoryUserRepositoryConcurrentSaves(t *testing.T) {
+	repo := NewMemoryUserRepository(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			repo.SaveUser(&domain.User{Email: fmt.Sprintf("user%d@example.com", i)})
+		}()
+	}
+	wg.Wait()
+	for i := uint(1); i <= 50; i++ {
+		if _, err := repo.FindUserById(i); err != nil {
+			t.Errorf("user %d: %v", i, err.ErrorBase)
+		}
+	}
+}
+
+func TestMemoryUserRepositoryPurge(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	repo := NewMemoryUserRepository(func() time.Time { return now })
+	kept := &domain.User{Email: "kept@example.com", Fullname: "Kept"}
+	dropped := &domain.User{Email: "dropped@example.com"}
+	live := &domain.User{Email: "live@example.com"}
+	for _, user := range []*domain.User{kept, dropped, live} {
+		repo.SaveUser(user)
+	}
+	repo.SoftDeleteUser(kept)
+	repo.SoftDeleteUser(dropped)
+
+	due, _ := repo.FindUsersDeletedBefore(now.Add(time.Second))
+	if len(due) != 2 || due[0].ID != kept.ID || due[1].ID != dropped.ID {
+		t.Fatalf("due = %v, want the two deleted users", due)
+	}
+	if early, _ := repo.FindUsersDeletedBefore(now); len(early) != 0 {
+		t.Errorf("users deleted now are due before now")
+	}
+
+	if restored, err := repo.RestoreUser(live.ID); err == nil {
+		t.Errorf("restored a live user: %+v", restored)
+	}
+	repo.PurgeUser(kept, true)
+	repo.PurgeUser(dropped, false)
+	if _, err := repo.RestoreUser(kept.ID); err == nil {
+		t.Errorf("restored a purged user")
+	}
+	due, _ = repo.FindUsersDeletedBefore(now.Add(time.Second))
+	if len(due) != 0 {
+		t.Errorf("due after the purge = %v, want none", due)
+	}
+	if kept.Email != fmt.Sprintf("deleted-%d@%s", kept.ID, domain.AnonymizedEmailDomain) || kept.Fullname != "" {
+		t.Errorf("anonymized user = %+v", kept)
+	}
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"fmt"
+	"hitenok/pkg/domain"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OrganizationRepositoryI interface {
+	CreateOrganization(organization *domain.Organization, owner *domain.User) (*domain.Membership, *domain.MyError)
+	FindMembership(organizationId, userId uint) (*domain.Membership, *domain.MyError)
+	FindMembershipsByUser(userId uint) ([]domain.Membership, *domain.MyError)
+	FindMembershipsByOrganization(organizationId uint) ([]domain.Membership, *domain.MyError)
+	SaveMembership(membership *domain.Membership) *domain.MyError
+	DeleteMembership(membership *domain.Membership) *domain.MyError
+	DemoteOwner(membership *domain.Membership, role string) *domain.MyError
+	DeleteOwnerMembership(membership *domain.Membership) *domain.MyError
+}
+
+type organizationRepository struct {
+	DB *gorm.DB
+}
+
+func NewOrganizationRepository(db *gorm.DB) OrganizationRepositoryI {
+	return &organizationRepository{
+		DB: db,
+	}
+}
+
+// CreateOrganization stores the organization together with the owner membership of its
+// creator, so an organization never exists without an owner.
+func (organizationRepo *organizationRepository) CreateOrganization(organization *domain.Organization, owner *domain.User) (*domain.Membership, *domain.MyError) {
+	membership := &domain.Membership{
+		UserId: owner.ID,
+		Role:   domain.OrgRoleOwner,
+	}
+	err := organizationRepo.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(organization).Error; err != nil {
+			return err
+		}
+		membership.OrganizationId = organization.ID
+		return tx.Omit(clause.Associations).Create(membership).Error
+	})
+	if err != nil {
+		return membership, domain.NewError(err, "organizationRepository.CreateOrganization")
+	}
+	membership.Organization = *organization
+	return membership, nil
+}
+
+func (organizationRepo *organizationRepository) FindMembership(organizationId, userId uint) (*domain.Membership, *domain.MyError) {
+	var membership domain.Membership
+	err := organizationRepo.DB.Preload("Organization").
+		Where("organization_id = ? AND user_id = ?", organizationId, userId).First(&membership).Error
+	if err != nil {
+		return &membership, domain.NewError(err, "organizationRepository.FindMembership")
+	}
+	return &membership, nil
+}
+
+func (organizationRepo *organizationRepository) FindMembershipsByUser(userId uint) ([]domain.Membership, *domain.MyError) {
+	var memberships []domain.Membership
+	err := organizationRepo.DB.Preload("Organization").Where("user_id = ?", userId).Order("id").Find(&memberships).Error
+	if err != nil {
+		return memberships, domain.NewError(err, "organizationRepository.FindMembershipsByUser")
+	}
+	return memberships, nil
+}
+
+func (organizationRepo *organizationRepository) FindMembershipsByOrganization(organizationId uint) ([]domain.Membership, *domain.MyError) {
+	var memberships []domain.Membership
+	err := organizationRepo.DB.Preload("User").Where("organization_id = ?", organizationId).Order("id").Find(&memberships).Error
+	if err != nil {
+		return memberships, domain.NewError(err, "organizationRepository.FindMembershipsByOrganization")
+	}
+	return memberships, nil
+}
+
+func (organizationRepo *organizationRepository) SaveMembership(membership *domain.Membership) *domain.MyError {
+	err := organizationRepo.DB.Omit(clause.Associations).Save(membership).Error
+	if err != nil {
+		return domain.NewError(err, "organizationRepository.SaveMembership")
+	}
+	return nil
+}
+
+// DeleteMembership removes the row for good so the user can be added again later
+// without tripping over the unique (organization, user) index.
+func (organizationRepo *organizationRepository) DeleteMembership(membership *domain.Membership) *domain.MyError {
+	err := organizationRepo.DB.Unscoped().Delete(membership).Error
+	if err != nil {
+		return domain.NewError(err, "organizationRepository.DeleteMembership")
+	}
+	return nil
+}
+
+// DemoteOwner gives an owner role instead, failing with "last owner" when they are the
+// only owner left. See lockOtherOwners for why two demotions cannot both pass.
+func (organizationRepo *organizationRepository) DemoteOwner(membership *domain.Membership, role string) *domain.MyError {
+	err := organizationRepo.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOtherOwners(tx, membership); err != nil {
+			return err
+		}
+		return tx.Model(membership).Update("role", role).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "organizationRepository.DemoteOwner")
+	}
+	membership.Role = role
+	return nil
+}
+
+// DeleteOwnerMembership removes an owner like DeleteMembership, failing with "last
+// owner" when they are the only owner left.
+func (organizationRepo *organizationRepository) DeleteOwnerMembership(membership *domain.Membership) *domain.MyError {
+	err := organizationRepo.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOtherOwners(tx, membership); err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(membership).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "organizationRepository.DeleteOwnerMembership")
+	}
+	return nil
+}
+
+// lockOtherOwners locks the owner rows of the organization and checks that one besides
+// membership remains. A concurrent demotion or removal waits on the lock and then counts
+// the owners as they are after this transaction, so the organization keeps an owner.
+func lockOtherOwners(tx *gorm.DB, membership *domain.Membership) error {
+	var owners []domain.Membership
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("organization_id = ? AND role = ?", membership.OrganizationId, domain.OrgRoleOwner).
+		Find(&owners).Error
+	if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		if owner.ID != membership.ID {
+			return nil
+		}
+	}
+	return fmt.Errorf("last owner")
+}
@@ -0,0 +1,38 @@
+package repository
+
+import (
+	"hitenok/pkg/domain"
+	"testing"
+)
+
+func TestOrganizationKeepsAnOwner(t *testing.T) {
+	db := openTestDatabase(t)
+	repo := NewOrganizationRepository(db)
+	first := &domain.User{Email: "first@example.com"}
+	second := &domain.User{Email: "second@example.com"}
+	if err := db.Create([]*domain.User{first, second}).Error; err != nil {
+		t.Fatalf("creating the users: %v", err)
+	}
+	firstOwner, err := repo.CreateOrganization(&domain.Organization{Name: "acme"}, first)
+	if err != nil {
+		t.Fatalf("CreateOrganization: %v", err.ErrorBase)
+	}
+	secondOwner := &domain.Membership{OrganizationId: firstOwner.OrganizationId, UserId: second.ID, Role: domain.OrgRoleOwner}
+	if err := repo.SaveMembership(secondOwner); err != nil {
+		t.Fatalf("SaveMembership: %v", err.ErrorBase)
+	}
+
+	if err := repo.DemoteOwner(firstOwner, domain.OrgRoleAdmin); err != nil {
+		t.Fatalf("DemoteOwner of one of two owners: %v", err.ErrorBase)
+	}
+	if err := repo.DemoteOwner(secondOwner, domain.OrgRoleAdmin); err == nil || err.ErrorBase.Error() != "last owner" {
+		t.Errorf("DemoteOwner of the last owner error = %v, want last owner", err)
+	}
+	if err := repo.DeleteOwnerMembership(secondOwner); err == nil || err.ErrorBase.Error() != "last owner" {
+		t.Errorf("DeleteOwnerMembership of the last owner error = %v, want last owner", err)
+	}
+	stored, _ := repo.FindMembership(secondOwner.OrganizationId, second.ID)
+	if stored.Role != domain.OrgRoleOwner {
+		t.Errorf("role of the last owner = %q, want it kept", stored.Role)
+	}
+}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"hitenok/pkg/domain"
+
+	"gorm.io/gorm"
+)
+
+type PasswordHistoryRepositoryI interface {
+	FindPasswordHistory(userId uint, limit int) ([]domain.PasswordHistory, *domain.MyError)
+	SavePasswordChange(user *domain.User, keep int) *domain.MyError
+	RehashPasswordHistory(userId uint, oldHash, newHash string) *domain.MyError
+}
+
+type passwordHistoryRepository struct {
+	DB *gorm.DB
+}
+
+func NewPasswordHistoryRepository(db *gorm.DB) PasswordHistoryRepositoryI {
+	return &passwordHistoryRepository{
+		DB: db,
+	}
+}
+
+// FindPasswordHistory returns up to limit of the user's most recent password hashes.
+func (passwordHistoryRepo *passwordHistoryRepository) FindPasswordHistory(userId uint, limit int) ([]domain.PasswordHistory, *domain.MyError) {
+	var history []domain.PasswordHistory
+	err := passwordHistoryRepo.DB.Where("user_id = ?", userId).Order("created_at DESC, id DESC").Limit(limit).Find(&history).Error
+	if err != nil {
+		return history, domain.NewError(err, "passwordHistoryRepository.FindPasswordHistory")
+	}
+	return history, nil
+}
+
+// SavePasswordChange saves the user with its new password and records the hash in the
+// history, trimming it down to the keep newest entries. With keep 0 the history is
+// cleared instead.
+func (passwordHistoryRepo *passwordHistoryRepository) SavePasswordChange(user *domain.User, keep int) *domain.MyError {
+	err := passwordHistoryRepo.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		if keep > 0 {
+			entry := &domain.PasswordHistory{UserId: user.ID, Password: user.Password}
+			if err := tx.Create(entry).Error; err != nil {
+				return err
+			}
+		}
+		// Trimmed in Go: MySQL has no OFFSET without a LIMIT.
+		var ids []uint
+		err := tx.Model(&domain.PasswordHistory{}).Where("user_id = ?", user.ID).
+			Order("created_at DESC, id DESC").Pluck("id", &ids).Error
+		if err != nil || len(ids) <= keep {
+			return err
+		}
+		return tx.Where("id IN ?", ids[keep:]).Delete(&domain.PasswordHistory{}).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "passwordHistoryRepository.SavePasswordChange")
+	}
+	return nil
+}
+
+// RehashPasswordHistory replaces a hash in the user's history, for when the current
+// password is rehashed under a new pepper.
+func (passwordHistoryRepo *passwordHistoryRepository) RehashPasswordHistory(userId uint, oldHash, newHash string) *domain.MyError {
+	err := passwordHistoryRepo.DB.Model(&domain.PasswordHistory{}).
+		Where("user_id = ? AND password = ?", userId, oldHash).
+		Update("password", newHash).Error
+	if err != nil {
+		return domain.NewError(err, "passwordHistoryRepository.RehashPasswordHistory")
+	}
+	return nil
+}
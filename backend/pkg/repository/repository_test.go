@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"hitenok/pkg/config"
+	"hitenok/pkg/migrations"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDatabase opens a fresh, migrated SQLite file for the tests of the gorm
+// repositories.
+func openTestDatabase(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := OpenDatabase(config.DbConfig{Driver: "sqlite", Name: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatalf("OpenDatabase.%s: %v", err.Module, err.ErrorBase)
+	}
+	db.Logger = logger.Discard
+	migrator, err := migrations.NewMigrator(db)
+	if err != nil {
+		t.Fatalf("NewMigrator.%s: %v", err.Module, err.ErrorBase)
+	}
+	if _, err := migrator.Up(); err != nil {
+		t.Fatalf("Up.%s: %v", err.Module, err.ErrorBase)
+	}
+	t.Cleanup(func() {
+		if sqlDb, err := db.DB(); err == nil {
+			sqlDb.Close()
+		}
+	})
+	return db
+}
@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"hitenok/pkg/domain"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type RevokedTokenRepositoryI interface {
+	SaveRevokedToken(revokedToken *domain.RevokedToken) (bool, *domain.MyError)
+	FindRevokedTokensSince(since time.Time) ([]domain.RevokedToken, *domain.MyError)
+	DeleteExpiredRevokedTokens(now time.Time) *domain.MyError
+}
+
+type revokedTokenRepository struct {
+	DB *gorm.DB
+}
+
+func NewRevokedTokenRepository(db *gorm.DB) RevokedTokenRepositoryI {
+	return &revokedTokenRepository{
+		DB: db,
+	}
+}
+
+// SaveRevokedToken stores the entry unless the id is revoked already, and reports
+// whether it was this call that stored it. The insert is the claim: of two replicas
+// revoking the same id, exactly one gets true.
+func (revokedTokenRepo *revokedTokenRepository) SaveRevokedToken(revokedToken *domain.RevokedToken) (bool, *domain.MyError) {
+	result := revokedTokenRepo.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(revokedToken)
+	if result.Error != nil {
+		return false, domain.NewError(result.Error, "revokedTokenRepository.SaveRevokedToken")
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (revokedTokenRepo *revokedTokenRepository) FindRevokedTokensSince(since time.Time) ([]domain.RevokedToken, *domain.MyError) {
+	var revokedTokens []domain.RevokedToken
+	err := revokedTokenRepo.DB.Where("created_at >= ? AND expires_at > ?", since, time.Now()).Find(&revokedTokens).Error
+	if err != nil {
+		return revokedTokens, domain.NewError(err, "revokedTokenRepository.FindRevokedTokensSince")
+	}
+	return revokedTokens, nil
+}
+
+func (revokedTokenRepo *revokedTokenRepository) DeleteExpiredRevokedTokens(now time.Time) *domain.MyError {
+	err := revokedTokenRepo.DB.Where("expires_at <= ?", now).Delete(&domain.RevokedToken{}).Error
+	if err != nil {
+		return domain.NewError(err, "revokedTokenRepository.DeleteExpiredRevokedTokens")
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"hitenok/pkg/domain"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type SessionRepositoryI interface {
+	SaveSession(session *domain.Session) *domain.MyError
+	FindActiveSessions(user *domain.User, now time.Time) ([]domain.Session, *domain.MyError)
+	DeleteSession(sessionId string) *domain.MyError
+}
+
+type sessionRepository struct {
+	DB *gorm.DB
+}
+
+func NewSessionRepository(db *gorm.DB) SessionRepositoryI {
+	return &sessionRepository{
+		DB: db,
+	}
+}
+
+// SaveSession records a new session or, for one that continues, its renewal; CreatedAt
+// is kept from the first save. The user's expired sessions are dropped on the way, which
+// keeps the table down to about the live sessions.
+func (sessionRepo *sessionRepository) SaveSession(session *domain.Session) *domain.MyError {
+	err := sessionRepo.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND expires_at <= ?", session.UserId, session.RefreshedAt).Delete(&domain.Session{}).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"client_id", "jwt_version", "refreshed_at", "expires_at"}),
+		}).Create(session).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "sessionRepository.SaveSession")
+	}
+	return nil
+}
+
+// FindActiveSessions returns the sessions of the user that tokens can still come from,
+// newest first.
+func (sessionRepo *sessionRepository) FindActiveSessions(user *domain.User, now time.Time) ([]domain.Session, *domain.MyError) {
+	var sessions []domain.Session
+	err := sessionRepo.DB.Where("user_id = ? AND jwt_version = ? AND expires_at > ?", user.ID, user.JWTVersion, now).
+		Order("created_at DESC").Find(&sessions).Error
+	if err != nil {
+		return sessions, domain.NewError(err, "sessionRepository.FindActiveSessions")
+	}
+	return sessions, nil
+}
+
+func (sessionRepo *sessionRepository) DeleteSession(sessionId string) *domain.MyError {
+	err := sessionRepo.DB.Where("id = ?", sessionId).Delete(&domain.Session{}).Error
+	if err != nil {
+		return domain.NewError(err, "sessionRepository.DeleteSession")
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"hitenok/pkg/domain"
+	"testing"
+	"time"
+)
+
+func TestSaveSessionKeepsItsStart(t *testing.T) {
+	repo := NewSessionRepository(openTestDatabase(t))
+	start := time.Now().UTC().Truncate(time.Second)
+	session := &domain.Session{Id: "sid", UserId: 1, CreatedAt: start, RefreshedAt: start, ExpiresAt: start.Add(time.Hour)}
+	if err := repo.SaveSession(session); err != nil {
+		t.Fatalf("SaveSession: %v", err.ErrorBase)
+	}
+	renewed := &domain.Session{Id: "sid", UserId: 1, JWTVersion: 1, CreatedAt: start.Add(time.Minute), RefreshedAt: start.Add(time.Minute), ExpiresAt: start.Add(2 * time.Hour)}
+	if err := repo.SaveSession(renewed); err != nil {
+		t.Fatalf("SaveSession of the renewal: %v", err.ErrorBase)
+	}
+
+	user := &domain.User{JWTVersion: 1}
+	user.ID = 1
+	sessions, err := repo.FindActiveSessions(user, start.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("FindActiveSessions: %v", err.ErrorBase)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions, want the renewed one", len(sessions))
+	}
+	if !sessions[0].CreatedAt.Equal(start) || !sessions[0].ExpiresAt.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("created %v expires %v, want the first start and the renewed expiry", sessions[0].CreatedAt, sessions[0].ExpiresAt)
+	}
+}
+
+func TestFindActiveSessions(t *testing.T) {
+	db := openTestDatabase(t)
+	repo := NewSessionRepository(db)
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, session := range []domain.Session{
+		{Id: "live", UserId: 1, JWTVersion: 2, ExpiresAt: now.Add(time.Hour)},
+		{Id: "older-version", UserId: 1, JWTVersion: 1, ExpiresAt: now.Add(time.Hour)},
+		{Id: "expired", UserId: 1, JWTVersion: 2, ExpiresAt: now.Add(-time.Hour)},
+		{Id: "other-user", UserId: 2, JWTVersion: 2, ExpiresAt: now.Add(time.Hour)},
+	} {
+		if err := db.Create(&session).Error; err != nil {
+			t.Fatalf("creating session %s: %v", session.Id, err)
+		}
+	}
+	user := &domain.User{JWTVersion: 2}
+	user.ID = 1
+	sessions, err := repo.FindActiveSessions(user, now)
+	if err != nil {
+		t.Fatalf("FindActiveSessions: %v", err.ErrorBase)
+	}
+	if len(sessions) != 1 || sessions[0].Id != "live" {
+		t.Errorf("sessions = %+v, want only the live one", sessions)
+	}
+
+	// A new sign-in of the user sweeps the expired session.
+	repo.SaveSession(&domain.Session{Id: "new", UserId: 1, JWTVersion: 2, RefreshedAt: now, ExpiresAt: now.Add(time.Hour)})
+	var expired int64
+	db.Model(&domain.Session{}).Where("id = ?", "expired").Count(&expired)
+	if expired != 0 {
+		t.Errorf("the expired session is still stored")
+	}
+}
@@ -1,16 +1,24 @@
 package repository
 
 import (
+	"fmt"
 	"hitenok/pkg/config"
 	"hitenok/pkg/domain"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type UserRepositoryI interface {
 	FindUserById(id uint) (*domain.User, *domain.MyError)
 	FindUserByEmail(email string) (*domain.User, *domain.MyError)
 	SaveUser(user *domain.User) *domain.MyError
+	UpdateUserColumns(user *domain.User, previous, columns map[string]interface{}) *domain.MyError
+	SoftDeleteUser(user *domain.User) *domain.MyError
+	RestoreUser(id uint) (*domain.User, *domain.MyError)
+	FindUsersDeletedBefore(cutoff time.Time) ([]domain.User, *domain.MyError)
+	PurgeUser(user *domain.User, anonymize bool) *domain.MyError
 }
 
 type userRepository struct {
@@ -50,3 +58,128 @@ func (baseRepo *userRepository) SaveUser(user *domain.User) *domain.MyError {
 	}
 	return nil
 }
+
+// UpdateUserColumns is a compare-and-swap: the columns are written only if the row still
+// holds the previous values, otherwise "user changed concurrently" is reported.
+func (baseRepo *userRepository) UpdateUserColumns(user *domain.User, previous, columns map[string]interface{}) *domain.MyError {
+	query := baseRepo.DB.Model(user)
+	for column, value := range previous {
+		query = query.Where(clause.Eq{Column: clause.Column{Name: column}, Value: value})
+	}
+	result := query.Updates(columns)
+	if result.Error != nil {
+		return domain.NewError(result.Error, "userRepository.UpdateUserColumns")
+	}
+	if result.RowsAffected == 0 {
+		return domain.NewError(fmt.Errorf("user changed concurrently"), "userRepository.UpdateUserColumns")
+	}
+	return nil
+}
+
+// SoftDeleteUser deactivates the user, ends their sessions and sets DeletedAt, after
+// which every scoped query treats the account as gone.
+func (baseRepo *userRepository) SoftDeleteUser(user *domain.User) *domain.MyError {
+	err := baseRepo.DB.Transaction(func(tx *gorm.DB) error {
+		user.IsActive = false
+		user.JWTVersion += 1
+		if err := tx.Save(user).Error; err != nil {
+			return err
+		}
+		return tx.Delete(user).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "userRepository.SoftDeleteUser")
+	}
+	return nil
+}
+
+// RestoreUser undoes SoftDeleteUser for an account that has not been purged yet and
+// activates it again; the sessions it had stay ended. An unknown, live or purged account
+// is gorm.ErrRecordNotFound, and one whose email a new account has taken meanwhile is
+// "user already exists".
+func (baseRepo *userRepository) RestoreUser(id uint) (*domain.User, *domain.MyError) {
+	var user domain.User
+	err := baseRepo.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND deleted_at IS NOT NULL AND email NOT LIKE ?", id, "%@"+domain.AnonymizedEmailDomain).
+			First(&user).Error
+		if err != nil {
+			return err
+		}
+		var live int64
+		if err := tx.Model(&domain.User{}).Where("email = ?", user.Email).Count(&live).Error; err != nil {
+			return err
+		}
+		if live > 0 {
+			return fmt.Errorf("user already exists")
+		}
+		user.IsActive = true
+		user.DeletedAt = gorm.DeletedAt{}
+		return tx.Unscoped().Save(&user).Error
+	})
+	if err != nil {
+		return &user, domain.NewError(err, "userRepository.RestoreUser")
+	}
+	return &user, nil
+}
+
+// FindUsersDeletedBefore returns soft-deleted users whose grace period is over and who
+// have not been anonymized yet.
+func (baseRepo *userRepository) FindUsersDeletedBefore(cutoff time.Time) ([]domain.User, *domain.MyError) {
+	var users []domain.User
+	err := baseRepo.DB.Unscoped().
+		Where("deleted_at IS NOT NULL AND deleted_at < ? AND email NOT LIKE ?", cutoff, "%@"+domain.AnonymizedEmailDomain).
+		Find(&users).Error
+	if err != nil {
+		return users, domain.NewError(err, "userRepository.FindUsersDeletedBefore")
+	}
+	return users, nil
+}
+
+// PurgeUser removes the personal data of a soft-deleted user together with the rows that
+// reference it. Anonymizing keeps the row, and so its id, for anything that still points
+// at it; otherwise the row is deleted.
+func (baseRepo *userRepository) PurgeUser(user *domain.User, anonymize bool) *domain.MyError {
+	err := baseRepo.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&domain.EmailChange{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&domain.DeviceAuthorization{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&domain.Session{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&domain.ApiKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&domain.PasswordHistory{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&domain.Membership{}).Error; err != nil {
+			return err
+		}
+		// By id, not email: a new account may have signed up with the address meanwhile.
+		if err := tx.Unscoped().Where("invited_by = ? OR accepted_by = ?", user.ID, user.ID).Delete(&domain.Invitation{}).Error; err != nil {
+			return err
+		}
+		if !anonymize {
+			return tx.Unscoped().Delete(user).Error
+		}
+		return tx.Unscoped().Model(user).Updates(map[string]interface{}{
+			"email":                 fmt.Sprintf("deleted-%d@%s", user.ID, domain.AnonymizedEmailDomain),
+			"fullname":              "",
+			"password":              "",
+			"locale":                "",
+			"timezone":              "",
+			"otp":                   "",
+			"otp_spawned_at":        time.Time{},
+			"reset_hash":            "",
+			"reset_hash_spawned_at": time.Time{},
+		}).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "userRepository.PurgeUser")
+	}
+	return nil
+}
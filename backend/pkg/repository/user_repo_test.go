@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"errors"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestPurgeUserKeepsTheInvitationsOfANewAccount(t *testing.T) {
+	db := openTestDatabase(t)
+	userRepo := NewUserRepository(db, &config.AppConfig{})
+	invitationRepo := NewInvitationRepository(db)
+	owner := &domain.User{Email: "owner@example.com"}
+	deleted := &domain.User{Email: "alice@example.com"}
+	if err := db.Create([]*domain.User{owner, deleted}).Error; err != nil {
+		t.Fatalf("creating the users: %v", err)
+	}
+	ownerMembership, err := NewOrganizationRepository(db).CreateOrganization(&domain.Organization{Name: "acme"}, owner)
+	if err != nil {
+		t.Fatalf("CreateOrganization: %v", err.ErrorBase)
+	}
+	invite := func() *domain.Invitation {
+		invitation := &domain.Invitation{
+			OrganizationId: ownerMembership.OrganizationId,
+			Email:          "alice@example.com",
+			Role:           domain.OrgRoleMember,
+			InvitedBy:      owner.ID,
+			ExpiresAt:      time.Now().Add(time.Hour),
+		}
+		if err := db.Create(invitation).Error; err != nil {
+			t.Fatalf("creating the invitation: %v", err)
+		}
+		return invitation
+	}
+	used := invite()
+	membership := &domain.Membership{OrganizationId: ownerMembership.OrganizationId, UserId: deleted.ID, Role: domain.OrgRoleMember}
+	if err := invitationRepo.AcceptInvitation(used, membership); err != nil {
+		t.Fatalf("AcceptInvitation: %v", err.ErrorBase)
+	}
+	if err := userRepo.SoftDeleteUser(deleted); err != nil {
+		t.Fatalf("SoftDeleteUser: %v", err.ErrorBase)
+	}
+	newcomer := &domain.User{Email: "alice@example.com"}
+	if err := userRepo.SaveUser(newcomer); err != nil {
+		t.Fatalf("signing up again with the email: %v", err.ErrorBase)
+	}
+	pending := invite()
+
+	if err := userRepo.PurgeUser(deleted, true); err != nil {
+		t.Fatalf("PurgeUser: %v", err.ErrorBase)
+	}
+	if _, err := invitationRepo.FindInvitationById(used.ID); err == nil {
+		t.Errorf("the invitation the purged user accepted is kept")
+	}
+	if _, err := invitationRepo.FindInvitationById(pending.ID); err != nil {
+		t.Errorf("the invitation of the new account with the same email is gone: %v", err.ErrorBase)
+	}
+}
+
+func TestRestoreUser(t *testing.T) {
+	db := openTestDatabase(t)
+	repo := NewUserRepository(db, &config.AppConfig{})
+	restored := &domain.User{Email: "restored@example.com", IsActive: true}
+	taken := &domain.User{Email: "taken@example.com", IsActive: true}
+	purged := &domain.User{Email: "purged@example.com", IsActive: true}
+	for _, user := range []*domain.User{restored, taken, purged} {
+		if err := repo.SaveUser(user); err != nil {
+			t.Fatalf("SaveUser: %v", err.ErrorBase)
+		}
+		if err := repo.SoftDeleteUser(user); err != nil {
+			t.Fatalf("SoftDeleteUser: %v", err.ErrorBase)
+		}
+	}
+	if err := repo.SaveUser(&domain.User{Email: "taken@example.com"}); err != nil {
+		t.Fatalf("signing up again with the email: %v", err.ErrorBase)
+	}
+	if err := repo.PurgeUser(purged, true); err != nil {
+		t.Fatalf("PurgeUser: %v", err.ErrorBase)
+	}
+
+	user, err := repo.RestoreUser(restored.ID)
+	if err != nil {
+		t.Fatalf("RestoreUser: %v", err.ErrorBase)
+	}
+	if !user.IsActive || user.JWTVersion != restored.JWTVersion {
+		t.Errorf("restored user = %+v, want it active with the sessions still ended", user)
+	}
+	if _, err := repo.FindUserByEmail("restored@example.com"); err != nil {
+		t.Errorf("the restored user is not found: %v", err.ErrorBase)
+	}
+	if _, err := repo.RestoreUser(restored.ID); err == nil || !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		t.Errorf("restoring a live user error = %v, want record not found", err)
+	}
+	if _, err := repo.RestoreUser(taken.ID); err == nil || err.ErrorBase.Error() != "user already exists" {
+		t.Errorf("restoring over a new account error = %v, want user already exists", err)
+	}
+	if _, err := repo.RestoreUser(purged.ID); err == nil || !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		t.Errorf("restoring a purged user error = %v, want record not found", err)
+	}
+}
@@ -0,0 +1,165 @@
+package repository
+
+import (
+	"hitenok/pkg/domain"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type WebhookRepositoryI interface {
+	FindWebhookSubscriptionById(id uint) (*domain.WebhookSubscription, *domain.MyError)
+	FindWebhookSubscriptions(activeOnly bool) ([]domain.WebhookSubscription, *domain.MyError)
+	SaveWebhookSubscription(subscription *domain.WebhookSubscription) *domain.MyError
+	DeleteWebhookSubscription(subscription *domain.WebhookSubscription) *domain.MyError
+	FindWebhookDeliveryById(id uint) (*domain.WebhookDelivery, *domain.MyError)
+	FindWebhookDeliveries(subscriptionId uint, beforeId uint, limit int) ([]domain.WebhookDelivery, *domain.MyError)
+	FindDueWebhookDeliveries(now time.Time, limit int) ([]domain.WebhookDelivery, *domain.MyError)
+	CreateWebhookDeliveries(deliveries []domain.WebhookDelivery) *domain.MyError
+	ClaimWebhookDelivery(delivery *domain.WebhookDelivery, until time.Time) (bool, *domain.MyError)
+	SaveWebhookDelivery(delivery *domain.WebhookDelivery) *domain.MyError
+	RequeueFailedWebhookDeliveries(subscriptionId uint, now time.Time) (int, *domain.MyError)
+}
+
+type webhookRepository struct {
+	DB *gorm.DB
+}
+
+func NewWebhookRepository(db *gorm.DB) WebhookRepositoryI {
+	return &webhookRepository{
+		DB: db,
+	}
+}
+
+func (webhookRepo *webhookRepository) FindWebhookSubscriptionById(id uint) (*domain.WebhookSubscription, *domain.MyError) {
+	var subscription domain.WebhookSubscription
+	err := webhookRepo.DB.Where("id = ?", id).First(&subscription).Error
+	if err != nil {
+		return &subscription, domain.NewError(err, "webhookRepository.FindWebhookSubscriptionById")
+	}
+	return &subscription, nil
+}
+
+func (webhookRepo *webhookRepository) FindWebhookSubscriptions(activeOnly bool) ([]domain.WebhookSubscription, *domain.MyError) {
+	var subscriptions []domain.WebhookSubscription
+	query := webhookRepo.DB.Order("id")
+	if activeOnly {
+		query = query.Where("is_active = ?", true)
+	}
+	err := query.Find(&subscriptions).Error
+	if err != nil {
+		return subscriptions, domain.NewError(err, "webhookRepository.FindWebhookSubscriptions")
+	}
+	return subscriptions, nil
+}
+
+func (webhookRepo *webhookRepository) SaveWebhookSubscription(subscription *domain.WebhookSubscription) *domain.MyError {
+	err := webhookRepo.DB.Save(subscription).Error
+	if err != nil {
+		return domain.NewError(err, "webhookRepository.SaveWebhookSubscription")
+	}
+	return nil
+}
+
+// DeleteWebhookSubscription soft-deletes the subscription and drops its undelivered
+// events; the delivery log of what was already sent is kept.
+func (webhookRepo *webhookRepository) DeleteWebhookSubscription(subscription *domain.WebhookSubscription) *domain.MyError {
+	err := webhookRepo.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("subscription_id = ? AND status = ?", subscription.ID, domain.WebhookDeliveryPending).Delete(&domain.WebhookDelivery{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(subscription).Error
+	})
+	if err != nil {
+		return domain.NewError(err, "webhookRepository.DeleteWebhookSubscription")
+	}
+	return nil
+}
+
+func (webhookRepo *webhookRepository) FindWebhookDeliveryById(id uint) (*domain.WebhookDelivery, *domain.MyError) {
+	var delivery domain.WebhookDelivery
+	err := webhookRepo.DB.Where("id = ?", id).First(&delivery).Error
+	if err != nil {
+		return &delivery, domain.NewError(err, "webhookRepository.FindWebhookDeliveryById")
+	}
+	return &delivery, nil
+}
+
+// FindWebhookDeliveries pages through the delivery log of a subscription, newest first.
+func (webhookRepo *webhookRepository) FindWebhookDeliveries(subscriptionId uint, beforeId uint, limit int) ([]domain.WebhookDelivery, *domain.MyError) {
+	var deliveries []domain.WebhookDelivery
+	query := webhookRepo.DB.Where("subscription_id = ?", subscriptionId).Order("id DESC").Limit(limit)
+	if beforeId > 0 {
+		query = query.Where("id < ?", beforeId)
+	}
+	err := query.Find(&deliveries).Error
+	if err != nil {
+		return deliveries, domain.NewError(err, "webhookRepository.FindWebhookDeliveries")
+	}
+	return deliveries, nil
+}
+
+func (webhookRepo *webhookRepository) FindDueWebhookDeliveries(now time.Time, limit int) ([]domain.WebhookDelivery, *domain.MyError) {
+	var deliveries []domain.WebhookDelivery
+	err := webhookRepo.DB.Where("status = ? AND next_attempt_at <= ?", domain.WebhookDeliveryPending, now).Order("next_attempt_at").Limit(limit).Find(&deliveries).Error
+	if err != nil {
+		return deliveries, domain.NewError(err, "webhookRepository.FindDueWebhookDeliveries")
+	}
+	return deliveries, nil
+}
+
+func (webhookRepo *webhookRepository) CreateWebhookDeliveries(deliveries []domain.WebhookDelivery) *domain.MyError {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	err := webhookRepo.DB.Create(&deliveries).Error
+	if err != nil {
+		return domain.NewError(err, "webhookRepository.CreateWebhookDeliveries")
+	}
+	return nil
+}
+
+// ClaimWebhookDelivery leases a due delivery to this instance by pushing its next
+// attempt to until, guarded on the value that was read. It reports false when another
+// instance got there first.
+func (webhookRepo *webhookRepository) ClaimWebhookDelivery(delivery *domain.WebhookDelivery, until time.Time) (bool, *domain.MyError) {
+	result := webhookRepo.DB.Model(&domain.WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", delivery.ID, domain.WebhookDeliveryPending, delivery.NextAttemptAt).
+		Update("next_attempt_at", until)
+	if result.Error != nil {
+		return false, domain.NewError(result.Error, "webhookRepository.ClaimWebhookDelivery")
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	delivery.NextAttemptAt = until
+	return true, nil
+}
+
+func (webhookRepo *webhookRepository) SaveWebhookDelivery(delivery *domain.WebhookDelivery) *domain.MyError {
+	err := webhookRepo.DB.Save(delivery).Error
+	if err != nil {
+		return domain.NewError(err, "webhookRepository.SaveWebhookDelivery")
+	}
+	return nil
+}
+
+// RequeueFailedWebhookDeliveries makes the failed deliveries due again with a fresh
+// attempt budget, those of one subscription or of all when subscriptionId is 0. The
+// last error is kept until the next attempt replaces it.
+func (webhookRepo *webhookRepository) RequeueFailedWebhookDeliveries(subscriptionId uint, now time.Time) (int, *domain.MyError) {
+	query := webhookRepo.DB.Model(&domain.WebhookDelivery{}).Where("status = ?", domain.WebhookDeliveryFailed)
+	if subscriptionId != 0 {
+		query = query.Where("subscription_id = ?", subscriptionId)
+	}
+	result := query.Updates(map[string]interface{}{
+		"status":          domain.WebhookDeliveryPending,
+		"attempts":        0,
+		"next_attempt_at": now,
+	})
+	if result.Error != nil {
+		return 0, domain.NewError(result.Error, "webhookRepository.RequeueFailedWebhookDeliveries")
+	}
+	return int(result.RowsAffected), nil
+}
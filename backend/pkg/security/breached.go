@@ -0,0 +1,74 @@
+package security
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type BreachedCorpusI interface {
+	Contains(password string) (bool, error)
+}
+
+// BreachedCorpus is an offline list of breached passwords stored as a file of raw,
+// ascending SHA-1 digests, 20 bytes each, looked up with a binary search directly on
+// disk. Such a file can be produced from the Pwned Passwords "ordered by hash" SHA-1
+// dump with:
+//
+//	cut -d: -f1 pwned-passwords-sha1-ordered-by-hash.txt | xxd -r -p > breached.bin
+type BreachedCorpus struct {
+	file  *os.File
+	count int64
+}
+
+func OpenBreachedCorpus(path string) (*BreachedCorpus, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size()%sha1.Size != 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s: size is not a multiple of %d bytes", path, sha1.Size)
+	}
+	return &BreachedCorpus{
+		file:  file,
+		count: info.Size() / sha1.Size,
+	}, nil
+}
+
+func (corpus *BreachedCorpus) Contains(password string) (bool, error) {
+	digest := sha1.Sum([]byte(password))
+	record := make([]byte, sha1.Size)
+	var readErr error
+	index := sort.Search(int(corpus.count), func(i int) bool {
+		if readErr != nil {
+			return true
+		}
+		if _, err := corpus.file.ReadAt(record, int64(i)*sha1.Size); err != nil {
+			readErr = err
+			return true
+		}
+		return bytes.Compare(record, digest[:]) >= 0
+	})
+	if readErr != nil {
+		return false, readErr
+	}
+	if index >= int(corpus.count) {
+		return false, nil
+	}
+	if _, err := corpus.file.ReadAt(record, int64(index)*sha1.Size); err != nil {
+		return false, err
+	}
+	return bytes.Equal(record, digest[:]), nil
+}
+
+func (corpus *BreachedCorpus) Close() error {
+	return corpus.file.Close()
+}
@@ -0,0 +1,45 @@
+package security
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// Certificate serves a TLS key pair from files that can be read again while the server
+// runs, so a renewed certificate is picked up by new handshakes without a restart.
+type Certificate struct {
+	mu       sync.RWMutex
+	certFile string
+	keyFile  string
+	pair     *tls.Certificate
+}
+
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	certificate := &Certificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := certificate.Reload(); err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+// Reload reads the files again; on error the previous pair stays in use.
+func (certificate *Certificate) Reload() error {
+	pair, err := tls.LoadX509KeyPair(certificate.certFile, certificate.keyFile)
+	if err != nil {
+		return err
+	}
+	certificate.mu.Lock()
+	certificate.pair = &pair
+	certificate.mu.Unlock()
+	return nil
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate.
+func (certificate *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate.mu.RLock()
+	defer certificate.mu.RUnlock()
+	return certificate.pair, nil
+}
@@ -1,10 +1,100 @@
 package security
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The argon2id cost of new password hashes, the OWASP minimum for argon2id. A hash made
+// with other parameters still verifies and is reported for rehashing.
+const (
+	argon2Memory      = 19 * 1024
+	argon2Iterations  = 2
+	argon2Parallelism = 1
+	argon2SaltLength  = 16
+	argon2KeyLength   = 32
+	argon2Prefix      = "argon2id$"
 )
 
-func HashPassword(password string, salt string) string {
-	return fmt.Sprintf("%x", sha256.Sum256([]byte(salt+password)))
+// HashPassword hashes the password with argon2id under a random salt. The password is
+// peppered first with the current key of the ring, so a leaked table is of no use
+// without the pepper either. The result is
+// "argon2id$kid$v=19$m=...,t=...,p=...$salt$hash", salt and hash in unpadded base64.
+func HashPassword(password string, pepper *Keyring) string {
+	salt := make([]byte, argon2SaltLength)
+	// crypto/rand.Read never fails; it crashes the program instead.
+	rand.Read(salt)
+	key := pepper.Current()
+	return formatArgon2Hash(key.Id, salt, argon2Hash(key.Secret, password, salt, argon2Memory, argon2Iterations, argon2Parallelism))
+}
+
+// VerifyPassword checks a password against a stored hash. rehash tells that the
+// password is right but the hash should be replaced by HashPassword: it is made with an
+// older pepper or other argon2 parameters, or it is of an older scheme. Those are the
+// peppered HMACs of before argon2id, "kid$hex", and the hashes from before the pepper
+// keyring, which have no key id and are checked against legacySalt, the SECRET_KEY they
+// were made with.
+func VerifyPassword(hash, password string, pepper *Keyring, legacySalt string) (valid bool, rehash bool) {
+	if password == "" {
+		return false, false
+	}
+	if strings.HasPrefix(hash, argon2Prefix) {
+		return verifyArgon2(hash, password, pepper)
+	}
+	if strings.Contains(hash, "$") {
+		valid, _ := pepper.Verify(password, hash)
+		return valid, valid
+	}
+	if legacySalt == "" {
+		return false, false
+	}
+	legacy := fmt.Sprintf("%x", sha256.Sum256([]byte(legacySalt+password)))
+	valid = subtle.ConstantTimeCompare([]byte(legacy), []byte(hash)) == 1
+	return valid, valid
+}
+
+func verifyArgon2(hash, password string, pepper *Keyring) (valid bool, rehash bool) {
+	parts := strings.Split(strings.TrimPrefix(hash, argon2Prefix), "$")
+	if len(parts) != 5 || parts[1] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false, false
+	}
+	key, found := pepper.Key(parts[0])
+	if !found {
+		return false, false
+	}
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[2], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, false
+	}
+	digest, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(digest) != argon2KeyLength {
+		return false, false
+	}
+	if subtle.ConstantTimeCompare(digest, argon2Hash(key.Secret, password, salt, memory, iterations, parallelism)) != 1 {
+		return false, false
+	}
+	outdated := key.Id != pepper.Current().Id ||
+		memory != argon2Memory || iterations != argon2Iterations || parallelism != argon2Parallelism
+	return true, outdated
+}
+
+func argon2Hash(pepper []byte, password string, salt []byte, memory, iterations uint32, parallelism uint8) []byte {
+	return argon2.IDKey(keyedHash(pepper, password), salt, iterations, memory, parallelism, argon2KeyLength)
+}
+
+func formatArgon2Hash(keyId string, salt, digest []byte) string {
+	return fmt.Sprintf("%s%s$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, keyId, argon2.Version,
+		argon2Memory, argon2Iterations, argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(digest))
 }
@@ -0,0 +1,143 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// LegacyKeyId names the key derived from SECRET_KEY for deployments that predate the
+// keyrings; tokens signed without a kid header are checked against it.
+const LegacyKeyId = "legacy"
+
+type Key struct {
+	Id     string
+	Secret []byte
+}
+
+// Keyring is an ordered set of keys told apart by their id. The first key is current
+// and produces new signatures; the others only verify, so a key is rotated by putting
+// a new one in front and dropping the old one once nothing signed with it is left.
+// The keys can be replaced while the ring is in use, see Replace.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys []Key
+}
+
+// NewKeyring parses "kid:secret" entries, current key first.
+func NewKeyring(entries []string) (*Keyring, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	keyring := &Keyring{}
+	for _, entry := range entries {
+		id, secret, found := strings.Cut(entry, ":")
+		if !found || id == "" || secret == "" {
+			return nil, fmt.Errorf("malformed key, expected kid:secret")
+		}
+		if strings.Contains(id, "$") {
+			return nil, fmt.Errorf("key id %q contains $", id)
+		}
+		if _, found := keyring.Key(id); found {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		keyring.keys = append(keyring.keys, Key{Id: id, Secret: []byte(secret)})
+	}
+	return keyring, nil
+}
+
+// Replace swaps in the keys of another ring, for a configuration reload; everyone
+// holding this ring uses the new keys from then on.
+func (keyring *Keyring) Replace(other *Keyring) {
+	other.mu.RLock()
+	keys := other.keys
+	other.mu.RUnlock()
+	keyring.mu.Lock()
+	keyring.keys = keys
+	keyring.mu.Unlock()
+}
+
+func (keyring *Keyring) Current() Key {
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+	return keyring.keys[0]
+}
+
+func (keyring *Keyring) Key(id string) (Key, bool) {
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+	for _, key := range keyring.keys {
+		if key.Id == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// Ids lists the key ids, current first.
+func (keyring *Keyring) Ids() []string {
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+	ids := make([]string, len(keyring.keys))
+	for i, key := range keyring.keys {
+		ids[i] = key.Id
+	}
+	return ids
+}
+
+// Sign returns "kid$hex" where hex is the HMAC-SHA256 of the message under the current
+// key.
+func (keyring *Keyring) Sign(message string) string {
+	key := keyring.Current()
+	return key.Id + "$" + hex.EncodeToString(keyedHash(key.Secret, message))
+}
+
+// Verify checks a value produced by Sign with any key of the ring. current is false
+// when the value is valid but made with an older key and should be signed again.
+func (keyring *Keyring) Verify(message, signed string) (valid bool, current bool) {
+	id, digest, found := strings.Cut(signed, "$")
+	if !found {
+		return false, false
+	}
+	key, found := keyring.Key(id)
+	if !found {
+		return false, false
+	}
+	expected, err := hex.DecodeString(digest)
+	if err != nil || !hmac.Equal(expected, keyedHash(key.Secret, message)) {
+		return false, false
+	}
+	return true, id == keyring.Current().Id
+}
+
+func keyedHash(secret []byte, message string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// RandomString draws length characters of charset from crypto/rand, for codes that
+// must not be guessable.
+func RandomString(charset string, length int) (string, error) {
+	return RandomStringFrom(rand.Reader, charset, length)
+}
+
+// RandomStringFrom is RandomString with another source of randomness, which tests use
+// to get known codes.
+func RandomStringFrom(random io.Reader, charset string, length int) (string, error) {
+	result := make([]byte, length)
+	for i := range result {
+		index, err := rand.Int(random, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return "", err
+		}
+		result[i] = charset[index.Int64()]
+	}
+	return string(result), nil
+}
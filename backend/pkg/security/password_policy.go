@@ -0,0 +1,139 @@
+package security
+
+import (
+	"fmt"
+	"hitenok/pkg/domain"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy decides whether a password may be set. Validate reports every broken
+// rule at once so a client can show them together.
+type PasswordPolicy struct {
+	MinLength      int
+	MaxLength      int
+	MinCharClasses int
+	// MinStrength is the lowest accepted EstimateStrength score, 0 to 4.
+	MinStrength int
+	// Breached is optional; without it the breached-password check is skipped.
+	Breached BreachedCorpusI
+}
+
+// Validate checks password against the policy. userInputs are values the password must
+// not be built from, such as the email and full name of the account.
+func (policy *PasswordPolicy) Validate(field, password string, userInputs ...string) []domain.FieldViolation {
+	violations := []domain.FieldViolation{}
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		violations = append(violations, domain.FieldViolation{
+			Field:   field,
+			Code:    "too_short",
+			Message: fmt.Sprintf("must be at least %d characters", policy.MinLength),
+		})
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, domain.FieldViolation{
+			Field:   field,
+			Code:    "too_long",
+			Message: fmt.Sprintf("must be at most %d characters", policy.MaxLength),
+		})
+		// Anything below is pointless work on an input we reject anyway.
+		return violations
+	}
+	if classes := charClasses(password); classes < policy.MinCharClasses {
+		violations = append(violations, domain.FieldViolation{
+			Field:   field,
+			Code:    "char_classes",
+			Message: fmt.Sprintf("must mix at least %d of lowercase, uppercase, digits and symbols", policy.MinCharClasses),
+		})
+	}
+	if containsUserInput(password, userInputs) {
+		violations = append(violations, domain.FieldViolation{
+			Field:   field,
+			Code:    "contains_user_info",
+			Message: "must not contain your email or name",
+		})
+	}
+	if EstimateStrength(password, userInputs...) < policy.MinStrength {
+		violations = append(violations, domain.FieldViolation{
+			Field:   field,
+			Code:    "too_weak",
+			Message: "is too easy to guess",
+		})
+	}
+	if policy.Breached != nil {
+		breached, err := policy.Breached.Contains(password)
+		if err != nil {
+			// A broken corpus must not lock everyone out of setting passwords.
+			log.Printf("PasswordPolicy.Validate.Breached: %v", err)
+		}
+		if breached {
+			violations = append(violations, domain.FieldViolation{
+				Field:   field,
+				Code:    "breached",
+				Message: "appears in a known data breach",
+			})
+		}
+	}
+	return violations
+}
+
+func charClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
+
+// userInputTokens splits emails and names into the pieces people reuse in passwords:
+// the whole value, the email local part and every word of at least three characters.
+func userInputTokens(userInputs []string) []string {
+	tokens := []string{}
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if input == "" {
+			continue
+		}
+		tokens = append(tokens, input)
+		if local, _, found := strings.Cut(input, "@"); found {
+			input = local
+			tokens = append(tokens, local)
+		}
+		for _, word := range strings.FieldsFunc(input, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if utf8.RuneCountInString(word) >= 3 {
+				tokens = append(tokens, word)
+			}
+		}
+	}
+	return tokens
+}
+
+func containsUserInput(password string, userInputs []string) bool {
+	password = strings.ToLower(password)
+	for _, token := range userInputTokens(userInputs) {
+		if utf8.RuneCountInString(token) >= 3 && strings.Contains(password, token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package security
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// EstimateStrength scores how hard a password is to guess on the 0..4 scale of zxcvbn.
+// It follows the same idea in a much smaller form: the password is covered with the
+// cheapest sequence of patterns (common passwords, the user's own data, runs such as
+// "abcd" or "4321", repeats, keyboard walks, years), unmatched characters are brute
+// forced, and the score is bucketed from the resulting number of guesses.
+func EstimateStrength(password string, userInputs ...string) int {
+	log10Guesses := estimateLog10Guesses(password, userInputTokens(userInputs))
+	switch {
+	case log10Guesses < 3:
+		return 0
+	case log10Guesses < 6:
+		return 1
+	case log10Guesses < 8:
+		return 2
+	case log10Guesses < 10:
+		return 3
+	}
+	return 4
+}
+
+// commonPasswords is ordered by popularity; a word's rank is its position plus one.
+var commonPasswords = []string{
+	"password", "123456", "12345678", "qwerty", "123456789", "12345", "1234", "111111",
+	"1234567", "dragon", "123123", "baseball", "abc123", "football", "monkey", "letmein",
+	"696969", "shadow", "master", "666666", "qwertyuiop", "123321", "mustang", "1234567890",
+	"michael", "654321", "superman", "1qaz2wsx", "7777777", "121212", "000000", "qazwsx",
+	"123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter",
+	"buster", "soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+	"2000", "charlie", "robert", "thomas", "hockey", "ranger", "daniel", "starwars",
+	"klaster", "112233", "george", "computer", "michelle", "jessica", "pepper", "1111",
+	"zxcvbn", "555555", "11111111", "131313", "freedom", "777777", "pass", "maggie",
+	"159753", "aaaaaa", "ginger", "princess", "joshua", "cheese", "amanda", "summer",
+	"love", "ashley", "nicole", "chelsea", "biteme", "matthew", "access", "yankees",
+	"987654321", "dallas", "austin", "thunder", "taylor", "matrix", "admin", "welcome",
+	"login", "secret", "hello", "flower", "passw0rd", "whatever", "qwerty123", "football1",
+	"password1", "password123", "welcome1", "admin123", "changeme", "default", "root",
+	"test", "guest", "user", "letmein1", "monkey1", "dragon1", "master1", "sunshine1",
+	"qwe123", "asdf", "asdfasdf", "zaq12wsx", "passpass", "abcdef", "abcd1234", "winter",
+	"spring", "autumn", "august", "october", "november", "december", "january", "february",
+	"march", "april", "june", "july", "september", "monday", "friday", "company", "service",
+	"system", "server", "internet", "google", "facebook", "apple", "samsung", "microsoft",
+	"parol", "privet", "qwerty1", "1q2w3e4r", "1q2w3e", "marina", "natasha", "sergey",
+	"vladimir", "alexander", "dmitry", "andrey", "maxim", "svetlana", "olga", "anna",
+}
+
+var commonPasswordRanks = func() map[string]int {
+	ranks := make(map[string]int, len(commonPasswords))
+	for i, word := range commonPasswords {
+		ranks[word] = i + 1
+	}
+	return ranks
+}()
+
+var keyboardRows = []string{
+	"`1234567890-=", "qwertyuiop[]\\", "asdfghjkl;'", "zxcvbnm,./",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p",
+}
+
+var leetSubstitutions = strings.NewReplacer(
+	"@", "a", "4", "a", "0", "o", "1", "i", "!", "i", "3", "e", "5", "s", "$", "s", "7", "t", "+", "t",
+)
+
+const maxPatternLength = 32
+
+func estimateLog10Guesses(password string, userTokens []string) float64 {
+	runes := []rune(password)
+	n := len(runes)
+	if n == 0 {
+		return 0
+	}
+	userRanks := map[string]int{}
+	for i, token := range userTokens {
+		userRanks[token] = i + 1
+	}
+
+	// best[i] is the lowest log10 number of guesses covering runes[:i].
+	best := make([]float64, n+1)
+	for i := 1; i <= n; i++ {
+		best[i] = best[i-1] + math.Log10(float64(bruteforceCardinality(runes[i-1])))
+		for start := max(0, i-maxPatternLength); start <= i-2; start++ {
+			if guesses, ok := patternGuesses(runes[start:i], userRanks); ok {
+				if candidate := best[start] + math.Log10(guesses); candidate < best[i] {
+					best[i] = candidate
+				}
+			}
+		}
+	}
+	return best[n]
+}
+
+// patternGuesses returns the number of guesses an attacker enumerating the pattern the
+// token fits would need, or false when the token fits none.
+func patternGuesses(token []rune, userRanks map[string]int) (float64, bool) {
+	length := len(token)
+	lower := strings.ToLower(string(token))
+	guesses := math.Inf(1)
+
+	if length >= 3 {
+		for _, candidate := range []string{lower, leetSubstitutions.Replace(lower)} {
+			variations := 1.0
+			if candidate != lower {
+				variations *= 2
+			}
+			if lower != string(token) {
+				variations *= 2
+			}
+			if rank, ok := userRanks[candidate]; ok {
+				guesses = math.Min(guesses, float64(rank)*variations)
+			}
+			if rank, ok := commonPasswordRanks[candidate]; ok {
+				guesses = math.Min(guesses, float64(rank)*variations)
+			}
+			if rank, ok := commonPasswordRanks[reverse(candidate)]; ok {
+				guesses = math.Min(guesses, float64(rank)*variations*2)
+			}
+		}
+		if isRepeat(token) {
+			guesses = math.Min(guesses, float64(bruteforceCardinality(token[0])*length))
+		}
+		if step, ok := sequenceStep(token); ok {
+			base := 26.0
+			if unicode.IsDigit(token[0]) {
+				base = 10
+			}
+			if token[0] == 'a' || token[0] == 'A' || token[0] == '1' || token[0] == '0' {
+				base = 4
+			}
+			if step < 0 {
+				base *= 2
+			}
+			guesses = math.Min(guesses, base*float64(length))
+		}
+	}
+	if length >= 4 && isKeyboardWalk(lower) {
+		guesses = math.Min(guesses, 40*float64(length))
+	}
+	if length == 4 && lower >= "1900" && lower <= "2039" {
+		guesses = math.Min(guesses, 140)
+	}
+	return guesses, !math.IsInf(guesses, 1)
+}
+
+func bruteforceCardinality(r rune) int {
+	switch {
+	case unicode.IsDigit(r):
+		return 10
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return 26
+	case r < unicode.MaxASCII:
+		return 33
+	}
+	// Non-ASCII letters: assume an attacker's alphabet the size of a typical script.
+	return 40
+}
+
+func isRepeat(token []rune) bool {
+	for _, r := range token[1:] {
+		if r != token[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func sequenceStep(token []rune) (int, bool) {
+	step := int(token[1] - token[0])
+	if step != 1 && step != -1 {
+		return 0, false
+	}
+	for i := 2; i < len(token); i++ {
+		if int(token[i]-token[i-1]) != step {
+			return 0, false
+		}
+	}
+	return step, true
+}
+
+func isKeyboardWalk(token string) bool {
+	reversed := reverse(token)
+	for _, row := range keyboardRows {
+		if strings.Contains(row, token) || strings.Contains(row, reversed) {
+			return true
+		}
+	}
+	return false
+}
+
+func reverse(value string) string {
+	runes := []rune(value)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
@@ -0,0 +1,20 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// SignWebhook returns the X-Webhook-Signature value for a delivery body, in the form
+// "t=<unix seconds>,v1=<hex HMAC-SHA256>" where the MAC covers "<t>.<body>". Receivers
+// recompute it with their secret and reject stale timestamps to stop replays.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"errors"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
+	"hitenok/pkg/repository"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type AccountServiceI interface {
+	Export(user *domain.User) (*domain.UserExport, *domain.MyError)
+	DeleteAccount(user *domain.User) (time.Time, *domain.MyError)
+	RestoreAccount(userId uint) (*domain.User, *domain.MyError)
+	PurgeDeletedAccounts() (int, *domain.MyError)
+}
+
+type accountService struct {
+	userRepo        repository.UserRepositoryI
+	emailChangeRepo repository.EmailChangeRepositoryI
+	sessionRepo     repository.SessionRepositoryI
+	auditEventRepo  repository.AuditEventRepositoryI
+	eventBus        events.EventBusI
+	appConfig       *config.AppConfig
+}
+
+func NewAccountService(userRepo repository.UserRepositoryI, emailChangeRepo repository.EmailChangeRepositoryI, sessionRepo repository.SessionRepositoryI, auditEventRepo repository.AuditEventRepositoryI, eventBus events.EventBusI, appConfig *config.AppConfig) AccountServiceI {
+	return &accountService{
+		userRepo:        userRepo,
+		emailChangeRepo: emailChangeRepo,
+		sessionRepo:     sessionRepo,
+		auditEventRepo:  auditEventRepo,
+		eventBus:        eventBus,
+		appConfig:       appConfig,
+	}
+}
+
+// Export gathers the archive, with the active sessions and every audit event the user
+// took part in, sign-ins included, oldest first.
+func (accountService *accountService) Export(user *domain.User) (*domain.UserExport, *domain.MyError) {
+	now := time.Now()
+	export := &domain.UserExport{
+		ExportedAt:  now,
+		Profile:     domain.NewUserProfile(user),
+		IsSuperuser: user.IsSuperuser,
+		AuditEvents: []domain.AuditEvent{},
+	}
+	emailChange, err := accountService.emailChangeRepo.FindEmailChangeByUser(user.ID)
+	if err != nil && !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		err.Module = "accountService.Export." + err.Module
+		return export, err
+	}
+	if err == nil {
+		export.PendingEmailChange = emailChange
+	}
+	export.Sessions, err = accountService.sessionRepo.FindActiveSessions(user, now)
+	if err != nil {
+		err.Module = "accountService.Export." + err.Module
+		return export, err
+	}
+	err = accountService.auditEventRepo.EachAuditEvent(domain.AuditFilter{UserId: user.ID}, true, func(event *domain.AuditEvent) error {
+		export.AuditEvents = append(export.AuditEvents, *event)
+		return nil
+	})
+	if err != nil {
+		err.Module = "accountService.Export." + err.Module
+		return export, err
+	}
+	return export, nil
+}
+
+// DeleteAccount soft-deletes the user and returns the moment after which the purge job
+// will remove their personal data. The caller is expected to have re-authenticated them.
+func (accountService *accountService) DeleteAccount(user *domain.User) (time.Time, *domain.MyError) {
+	err := accountService.userRepo.SoftDeleteUser(user)
+	if err != nil {
+		err.Module = "accountService.DeleteAccount." + err.Module
+		return time.Time{}, err
+	}
+	purgeAfter := time.Now().Add(accountService.appConfig.AccountDeletionGracePeriod)
+	accountService.eventBus.Publish(events.UserDeactivated{UserId: user.ID, Email: user.Email, PurgeAfter: purgeAfter.UTC()})
+	return purgeAfter, nil
+}
+
+// RestoreAccount brings back an account deleted within the grace period; the owner
+// signs in again, as every session ended with the deletion.
+func (accountService *accountService) RestoreAccount(userId uint) (*domain.User, *domain.MyError) {
+	user, err := accountService.userRepo.RestoreUser(userId)
+	if err != nil {
+		err.Module = "accountService.RestoreAccount." + err.Module
+		return user, err
+	}
+	accountService.eventBus.Publish(events.UserRestored{UserId: user.ID, Email: user.Email})
+	return user, nil
+}
+
+// PurgeDeletedAccounts processes accounts whose grace period is over; it is run
+// periodically from app.New. A failing account is logged and retried on the next run.
+func (accountService *accountService) PurgeDeletedAccounts() (int, *domain.MyError) {
+	cutoff := time.Now().Add(-accountService.appConfig.AccountDeletionGracePeriod)
+	users, err := accountService.userRepo.FindUsersDeletedBefore(cutoff)
+	if err != nil {
+		err.Module = "accountService.PurgeDeletedAccounts." + err.Module
+		return 0, err
+	}
+	anonymize := accountService.appConfig.AccountDeletionMode == "anonymize"
+	purged := 0
+	for i := range users {
+		userId := users[i].ID
+		err := accountService.userRepo.PurgeUser(&users[i], anonymize)
+		if err != nil {
+			log.Printf("accountService.PurgeDeletedAccounts.%s: %v", err.Module, err.ErrorBase)
+			continue
+		}
+		// The personal data is gone by now, so the event carries only the id.
+		accountService.eventBus.Publish(events.UserDeleted{UserId: userId, Mode: accountService.appConfig.AccountDeletionMode})
+		purged++
+	}
+	return purged, nil
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"io"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const (
+	apiKeyLength       = 32
+	apiKeyPrefixLength = len(domain.ApiKeyPrefix) + 8
+	apiKeyNameLength   = 100
+	apiKeyScopeLength  = 200
+)
+
+// ApiKeyServiceI manages the API keys of users. Create returns the key itself, which is
+// never available again; everything else works from its SHA-256, which is enough since
+// a key is 256 random bits and cannot be guessed from its hash.
+type ApiKeyServiceI interface {
+	Create(user *domain.User, name string, scope string, expiresIn time.Duration) (*domain.ApiKey, string, *domain.MyError)
+	List(user *domain.User) ([]domain.ApiKey, *domain.MyError)
+	Delete(user *domain.User, id uint) (*domain.ApiKey, *domain.MyError)
+	Authenticate(key string) (*domain.User, *domain.ApiKey, *domain.MyError)
+}
+
+type ApiKeyService struct {
+	apiKeyRepo repository.ApiKeyRepositoryI
+	userRepo   repository.UserRepositoryI
+	now        func() time.Time
+	random     io.Reader
+}
+
+func NewApiKeyService(apiKeyRepo repository.ApiKeyRepositoryI, userRepo repository.UserRepositoryI) ApiKeyServiceI {
+	return &ApiKeyService{
+		apiKeyRepo: apiKeyRepo,
+		userRepo:   userRepo,
+		now:        time.Now,
+		random:     rand.Reader,
+	}
+}
+
+// Create issues a key named name for the user. A zero expiresIn makes a key that lasts
+// until it is deleted.
+func (apiKeyService *ApiKeyService) Create(user *domain.User, name string, scope string, expiresIn time.Duration) (*domain.ApiKey, string, *domain.MyError) {
+	apiKey := &domain.ApiKey{
+		UserId: user.ID,
+		Name:   strings.TrimSpace(name),
+		Scope:  strings.Join(strings.Fields(scope), " "),
+	}
+	if err := validateApiKey(apiKey, expiresIn); err != nil {
+		err.Module = "ApiKeyService.Create." + err.Module
+		return apiKey, "", err
+	}
+	secret := make([]byte, apiKeyLength)
+	if _, err := io.ReadFull(apiKeyService.random, secret); err != nil {
+		return apiKey, "", domain.NewError(err, "ApiKeyService.Create")
+	}
+	key := domain.ApiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	apiKey.Prefix = key[:apiKeyPrefixLength]
+	apiKey.Hash = apiKeyHash(key)
+	if expiresIn > 0 {
+		expiresAt := apiKeyService.now().Add(expiresIn)
+		apiKey.ExpiresAt = &expiresAt
+	}
+	if err := apiKeyService.apiKeyRepo.SaveApiKey(apiKey); err != nil {
+		err.Module = "ApiKeyService.Create." + err.Module
+		return apiKey, "", err
+	}
+	return apiKey, key, nil
+}
+
+func validateApiKey(apiKey *domain.ApiKey, expiresIn time.Duration) *domain.MyError {
+	var violations []domain.FieldViolation
+	if apiKey.Name == "" {
+		violations = append(violations, domain.FieldViolation{
+			Field:   "name",
+			Code:    "required",
+			Message: "must not be empty",
+		})
+	} else if utf8.RuneCountInString(apiKey.Name) > apiKeyNameLength {
+		violations = append(violations, domain.FieldViolation{
+			Field:   "name",
+			Code:    "too_long",
+			Message: "must be at most 100 characters",
+		})
+	}
+	if len(apiKey.Scope) > apiKeyScopeLength {
+		violations = append(violations, domain.FieldViolation{
+			Field:   "scope",
+			Code:    "too_long",
+			Message: "must be at most 200 characters",
+		})
+	}
+	for _, scope := range strings.Fields(apiKey.Scope) {
+		if scope == domain.PasswordChangeScope {
+			violations = append(violations, domain.FieldViolation{
+				Field:   "scope",
+				Code:    "reserved",
+				Message: "must not contain " + domain.PasswordChangeScope,
+			})
+		}
+	}
+	if expiresIn < 0 {
+		violations = append(violations, domain.FieldViolation{
+			Field:   "expires_in",
+			Code:    "invalid",
+			Message: "must not be negative",
+		})
+	}
+	if len(violations) > 0 {
+		return domain.NewError(domain.NewValidationError(violations...), "validateApiKey")
+	}
+	return nil
+}
+
+func (apiKeyService *ApiKeyService) List(user *domain.User) ([]domain.ApiKey, *domain.MyError) {
+	apiKeys, err := apiKeyService.apiKeyRepo.FindUserApiKeys(user)
+	if err != nil {
+		err.Module = "ApiKeyService.List." + err.Module
+		return apiKeys, err
+	}
+	return apiKeys, nil
+}
+
+// Delete revokes a key of the user; a key of somebody else is reported as not found.
+func (apiKeyService *ApiKeyService) Delete(user *domain.User, id uint) (*domain.ApiKey, *domain.MyError) {
+	apiKey, err := apiKeyService.apiKeyRepo.FindUserApiKey(user, id)
+	if err != nil {
+		err.Module = "ApiKeyService.Delete." + err.Module
+		return apiKey, err
+	}
+	if err := apiKeyService.apiKeyRepo.DeleteApiKey(apiKey); err != nil {
+		err.Module = "ApiKeyService.Delete." + err.Module
+		return apiKey, err
+	}
+	return apiKey, nil
+}
+
+// Authenticate resolves a key to its owner. Unknown, expired and deleted keys, and keys
+// of users who are gone or deactivated, fail with "invalid api key".
+func (apiKeyService *ApiKeyService) Authenticate(key string) (*domain.User, *domain.ApiKey, *domain.MyError) {
+	if !strings.HasPrefix(key, domain.ApiKeyPrefix) {
+		return nil, nil, domain.NewError(errors.New("invalid api key"), "ApiKeyService.Authenticate")
+	}
+	apiKey, err := apiKeyService.apiKeyRepo.FindApiKeyByHash(apiKeyHash(key))
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		return nil, nil, domain.NewError(errors.New("invalid api key"), "ApiKeyService.Authenticate")
+	}
+	if err != nil {
+		err.Module = "ApiKeyService.Authenticate." + err.Module
+		return nil, nil, err
+	}
+	now := apiKeyService.now()
+	if apiKey.Expired(now) {
+		return nil, nil, domain.NewError(errors.New("invalid api key"), "ApiKeyService.Authenticate")
+	}
+	user, err := apiKeyService.userRepo.FindUserById(apiKey.UserId)
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		return nil, nil, domain.NewError(errors.New("invalid api key"), "ApiKeyService.Authenticate")
+	}
+	if err != nil {
+		err.Module = "ApiKeyService.Authenticate." + err.Module
+		return nil, nil, err
+	}
+	if !user.IsActive {
+		return nil, nil, domain.NewError(errors.New("invalid api key"), "ApiKeyService.Authenticate")
+	}
+	// Like auditing, a failure to record the use must not fail the request.
+	if err := apiKeyService.apiKeyRepo.TouchApiKey(apiKey, now); err != nil {
+		log.Printf("ApiKeyService.Authenticate.%s: %v", err.Module, err.ErrorBase)
+	}
+	return user, apiKey, nil
+}
+
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"errors"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestApiKeyService(t *testing.T) (*ApiKeyService, *fakeApiKeyRepository, repository.UserRepositoryI, *testClock) {
+	t.Helper()
+	clock := newTestClock()
+	userRepo := repository.NewMemoryUserRepository(clock.Now)
+	apiKeyRepo := &fakeApiKeyRepository{apiKeys: map[uint]domain.ApiKey{}}
+	service := NewApiKeyService(apiKeyRepo, userRepo).(*ApiKeyService)
+	service.now = clock.Now
+	service.random = &countingReader{}
+	return service, apiKeyRepo, userRepo, clock
+}
+
+func TestApiKeyServiceAuthenticate(t *testing.T) {
+	service, apiKeyRepo, userRepo, clock := newTestApiKeyService(t)
+	user := &domain.User{Email: "user@example.com", IsActive: true}
+	userRepo.SaveUser(user)
+
+	apiKey, key, err := service.Create(user, " ci ", "read  write", time.Hour)
+	if err != nil {
+		t.Fatalf("Create: %v", err.ErrorBase)
+	}
+	if !strings.HasPrefix(key, domain.ApiKeyPrefix) || !strings.HasPrefix(key, apiKey.Prefix) {
+		t.Errorf("key %q with prefix %q, want it to start with %s and the prefix", key, apiKey.Prefix, domain.ApiKeyPrefix)
+	}
+	stored := apiKeyRepo.apiKeys[apiKey.ID]
+	if stored.Hash == key || stored.Hash != apiKeyHash(key) {
+		t.Errorf("stored hash %q, want the SHA-256 of the key", stored.Hash)
+	}
+	if stored.Name != "ci" || stored.Scope != "read write" {
+		t.Errorf("stored name %q scope %q, want them trimmed", stored.Name, stored.Scope)
+	}
+
+	clock.Advance(time.Minute)
+	owner, _, err := service.Authenticate(key)
+	if err != nil || owner.ID != user.ID {
+		t.Fatalf("Authenticate returned %v, %s, want the owner", owner, errorText(err))
+	}
+	if lastUsed := apiKeyRepo.apiKeys[apiKey.ID].LastUsedAt; lastUsed == nil || !lastUsed.Equal(clock.Now()) {
+		t.Errorf("last used at %v, want now", lastUsed)
+	}
+	if _, _, err := service.Authenticate(key + "x"); err == nil || !IsTokenError(err) {
+		t.Errorf("Authenticate of a wrong key returned %s, want an invalid api key", errorText(err))
+	}
+
+	clock.Advance(time.Hour)
+	if _, _, err := service.Authenticate(key); err == nil || !IsTokenError(err) {
+		t.Errorf("Authenticate of an expired key returned %s, want an invalid api key", errorText(err))
+	}
+}
+
+func TestApiKeyServiceRefusesInactiveUsers(t *testing.T) {
+	service, _, userRepo, _ := newTestApiKeyService(t)
+	user := &domain.User{Email: "user@example.com", IsActive: true}
+	userRepo.SaveUser(user)
+	_, key, err := service.Create(user, "ci", "", 0)
+	if err != nil {
+		t.Fatalf("Create: %v", err.ErrorBase)
+	}
+	user.IsActive = false
+	userRepo.SaveUser(user)
+	if _, _, err := service.Authenticate(key); err == nil || !IsTokenError(err) {
+		t.Errorf("Authenticate for a deactivated user returned %s, want an invalid api key", errorText(err))
+	}
+}
+
+func TestApiKeyServiceValidates(t *testing.T) {
+	service, apiKeyRepo, userRepo, _ := newTestApiKeyService(t)
+	user := &domain.User{Email: "user@example.com", IsActive: true}
+	userRepo.SaveUser(user)
+	_, _, err := service.Create(user, " ", domain.PasswordChangeScope, -time.Second)
+	var validationError *domain.ValidationError
+	if err == nil || !errors.As(err.ErrorBase, &validationError) {
+		t.Fatalf("Create returned %s, want a validation error", errorText(err))
+	}
+	fields := validationError.Fields()
+	for _, field := range []string{"name", "scope", "expires_in"} {
+		if fields[field] == "" {
+			t.Errorf("no violation for %s in %v", field, fields)
+		}
+	}
+	if len(apiKeyRepo.apiKeys) != 0 {
+		t.Errorf("%d keys stored, want none", len(apiKeyRepo.apiKeys))
+	}
+}
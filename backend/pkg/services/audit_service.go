@@ -0,0 +1,136 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"io"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+type AuditServiceI interface {
+	Record(event domain.AuditEvent)
+	Query(filter domain.AuditFilter) ([]domain.AuditEvent, *domain.MyError)
+	Export(filter domain.AuditFilter, w io.Writer) *domain.MyError
+	Verify() (*domain.AuditVerification, *domain.MyError)
+}
+
+type auditService struct {
+	auditEventRepo repository.AuditEventRepositoryI
+	appConfig      *config.AppConfig
+}
+
+func NewAuditService(auditEventRepo repository.AuditEventRepositoryI, appConfig *config.AppConfig) AuditServiceI {
+	return &auditService{
+		auditEventRepo: auditEventRepo,
+		appConfig:      appConfig,
+	}
+}
+
+// Record appends the event to the audit log. A failing audit write must not fail the
+// request it describes, so errors are only logged.
+func (auditService *auditService) Record(event domain.AuditEvent) {
+	err := auditService.auditEventRepo.AppendAuditEvent(&event)
+	if err != nil {
+		log.Printf("auditService.Record.%s: %v (%s %s actor=%d subject=%d)", err.Module, err.ErrorBase, event.Action, event.Outcome, event.ActorId, event.SubjectId)
+	}
+}
+
+func (auditService *auditService) Query(filter domain.AuditFilter) ([]domain.AuditEvent, *domain.MyError) {
+	if filter.Limit <= 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	filter.Limit = min(filter.Limit, maxAuditLimit)
+	events, err := auditService.auditEventRepo.FindAuditEvents(filter)
+	if err != nil {
+		err.Module = "auditService.Query." + err.Module
+		return events, err
+	}
+	return events, nil
+}
+
+// Export writes every matching event, oldest first, as JSON Lines.
+func (auditService *auditService) Export(filter domain.AuditFilter, w io.Writer) *domain.MyError {
+	encoder := json.NewEncoder(w)
+	err := auditService.auditEventRepo.EachAuditEvent(filter, true, func(event *domain.AuditEvent) error {
+		return encoder.Encode(event)
+	})
+	if err != nil {
+		err.Module = "auditService.Export." + err.Module
+		return err
+	}
+	return nil
+}
+
+// Verify walks the whole chain from the first event and recomputes every hash with the
+// audit key it names, retired keys included. The head row is checked last, which
+// catches events cut off the end of the log.
+func (auditService *auditService) Verify() (*domain.AuditVerification, *domain.MyError) {
+	verification := &domain.AuditVerification{Valid: true}
+	var lastId uint
+	lastHash := ""
+	err := auditService.auditEventRepo.EachAuditEvent(domain.AuditFilter{}, true, func(event *domain.AuditEvent) error {
+		reason := ""
+		switch {
+		case event.ID != lastId+1:
+			reason = fmt.Sprintf("expected event %d", lastId+1)
+		case event.PrevHash != lastHash:
+			reason = "previous hash does not match"
+		case !auditService.validHash(event):
+			reason = "content does not match its hash"
+		}
+		if reason != "" {
+			verification.Valid = false
+			verification.BrokenAt = event.ID
+			verification.Reason = reason
+			return errVerificationStop
+		}
+		verification.Checked++
+		lastId = event.ID
+		lastHash = event.Hash
+		return nil
+	})
+	if err != nil && !errors.Is(err.ErrorBase, errVerificationStop) {
+		err.Module = "auditService.Verify." + err.Module
+		return verification, err
+	}
+	if !verification.Valid {
+		return verification, nil
+	}
+	head, err := auditService.auditEventRepo.FindAuditChainHead()
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		if lastId != 0 {
+			verification.Valid = false
+			verification.Reason = "chain head is missing"
+		}
+		return verification, nil
+	}
+	if err != nil {
+		err.Module = "auditService.Verify." + err.Module
+		return verification, err
+	}
+	if head.LastEventId != lastId || head.Hash != lastHash {
+		verification.Valid = false
+		verification.BrokenAt = lastId + 1
+		verification.Reason = "events missing at the end of the log"
+	}
+	return verification, nil
+}
+
+// validHash checks the hash with the audit key it names.
+func (auditService *auditService) validHash(event *domain.AuditEvent) bool {
+	valid, _ := auditService.appConfig.Keys.Audit.Verify(event.HashMessage(), event.Hash)
+	return valid
+}
+
+var errVerificationStop = errors.New("verification stopped")
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// BackgroundI runs work that outlives the request that started it, such as sending an
+// email, so that a shutdown can wait for it instead of killing it half way.
+type BackgroundI interface {
+	// Go runs fn on its own goroutine; a panic is logged under name and swallowed.
+	Go(name string, fn func())
+	// Wait blocks until everything started with Go has returned or ctx is done.
+	Wait(ctx context.Context) error
+}
+
+type background struct {
+	running sync.WaitGroup
+}
+
+func NewBackground() BackgroundI {
+	return &background{}
+}
+
+func (background *background) Go(name string, fn func()) {
+	background.running.Add(1)
+	go func() {
+		defer background.running.Done()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				log.Printf("background.%s: panic: %v", name, recovered)
+			}
+		}()
+		fn()
+	}()
+}
+
+func (background *background) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		background.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
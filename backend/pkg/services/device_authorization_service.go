@@ -0,0 +1,198 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// RFC 8628 section 6.1 recommends a charset without vowels and ambiguous characters.
+	userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength  = 8
+
+	deviceCodeLifetime   = 10 * time.Minute
+	devicePollInterval   = 5
+	deviceSlowDownAmount = 5
+)
+
+type DeviceAuthorizationServiceI interface {
+	CreateAuthorization(clientId, scope string) (*domain.DeviceAuthorization, *domain.MyError)
+	GetPendingAuthorization(userCode string) (*domain.DeviceAuthorization, *domain.MyError)
+	Approve(userCode string, user *domain.User) *domain.MyError
+	Deny(userCode string, user *domain.User) *domain.MyError
+	Poll(deviceCode, clientId string) (*domain.User, string, *domain.MyError)
+}
+
+type deviceAuthorizationService struct {
+	deviceRepo repository.DeviceAuthorizationRepositoryI
+	userRepo   repository.UserRepositoryI
+}
+
+func NewDeviceAuthorizationService(deviceRepo repository.DeviceAuthorizationRepositoryI, userRepo repository.UserRepositoryI) DeviceAuthorizationServiceI {
+	return &deviceAuthorizationService{
+		deviceRepo: deviceRepo,
+		userRepo:   userRepo,
+	}
+}
+
+// NormalizeUserCode strips the separators users tend to type and uppercases the code,
+// so "bcdf-ghjk" and "BCDFGHJK" refer to the same authorization.
+func NormalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	userCode = strings.ReplaceAll(userCode, "-", "")
+	userCode = strings.ReplaceAll(userCode, " ", "")
+	return userCode
+}
+
+// FormatUserCode renders a stored user code as XXXX-XXXX for display.
+func FormatUserCode(userCode string) string {
+	if len(userCode) != userCodeLength {
+		return userCode
+	}
+	return userCode[:userCodeLength/2] + "-" + userCode[userCodeLength/2:]
+}
+
+func (deviceService *deviceAuthorizationService) CreateAuthorization(clientId, scope string) (*domain.DeviceAuthorization, *domain.MyError) {
+	if clientId == "" {
+		return &domain.DeviceAuthorization{}, domain.NewError(fmt.Errorf("invalid_client"), "deviceAuthorizationService.CreateAuthorization")
+	}
+	deviceCode := make([]byte, 32)
+	if _, err := rand.Read(deviceCode); err != nil {
+		return &domain.DeviceAuthorization{}, domain.NewError(err, "deviceAuthorizationService.CreateAuthorization")
+	}
+	userCode := make([]byte, userCodeLength)
+	for i := range userCode {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeCharset))))
+		if err != nil {
+			return &domain.DeviceAuthorization{}, domain.NewError(err, "deviceAuthorizationService.CreateAuthorization")
+		}
+		userCode[i] = userCodeCharset[n.Int64()]
+	}
+	deviceAuthorization := &domain.DeviceAuthorization{
+		DeviceCode: hex.EncodeToString(deviceCode),
+		UserCode:   string(userCode),
+		ClientId:   clientId,
+		Scope:      scope,
+		Status:     domain.DeviceAuthorizationPending,
+		Interval:   devicePollInterval,
+		ExpiresAt:  time.Now().Add(deviceCodeLifetime),
+	}
+	err := deviceService.deviceRepo.SaveDeviceAuthorization(deviceAuthorization)
+	if err != nil {
+		err.Module = "deviceAuthorizationService.CreateAuthorization." + err.Module
+		return deviceAuthorization, err
+	}
+	return deviceAuthorization, nil
+}
+
+func (deviceService *deviceAuthorizationService) GetPendingAuthorization(userCode string) (*domain.DeviceAuthorization, *domain.MyError) {
+	deviceAuthorization, err := deviceService.deviceRepo.FindPendingByUserCode(NormalizeUserCode(userCode))
+	if err != nil {
+		err.Module = "deviceAuthorizationService.GetPendingAuthorization." + err.Module
+		return deviceAuthorization, err
+	}
+	return deviceAuthorization, nil
+}
+
+func (deviceService *deviceAuthorizationService) Approve(userCode string, user *domain.User) *domain.MyError {
+	return deviceService.decide(userCode, user, domain.DeviceAuthorizationApproved)
+}
+
+func (deviceService *deviceAuthorizationService) Deny(userCode string, user *domain.User) *domain.MyError {
+	return deviceService.decide(userCode, user, domain.DeviceAuthorizationDenied)
+}
+
+func (deviceService *deviceAuthorizationService) decide(userCode string, user *domain.User, status string) *domain.MyError {
+	deviceAuthorization, err := deviceService.deviceRepo.FindPendingByUserCode(NormalizeUserCode(userCode))
+	if err != nil {
+		err.Module = "deviceAuthorizationService.decide." + err.Module
+		return err
+	}
+	err = deviceService.deviceRepo.DecideDeviceAuthorization(deviceAuthorization, status, user.ID)
+	if err != nil {
+		err.Module = "deviceAuthorizationService.decide." + err.Module
+		return err
+	}
+	return nil
+}
+
+// Poll implements the device access token request of RFC 8628 section 3.4. On approval it
+// returns the user and the granted scope; otherwise the error message is the OAuth error
+// code the token endpoint should answer with.
+func (deviceService *deviceAuthorizationService) Poll(deviceCode, clientId string) (*domain.User, string, *domain.MyError) {
+	deviceAuthorization, err := deviceService.deviceRepo.FindByDeviceCode(deviceCode)
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		return nil, "", domain.NewError(fmt.Errorf("invalid_grant"), "deviceAuthorizationService.Poll")
+	}
+	if err != nil {
+		err.Module = "deviceAuthorizationService.Poll." + err.Module
+		return nil, "", err
+	}
+	if deviceAuthorization.ClientId != clientId {
+		return nil, "", domain.NewError(fmt.Errorf("invalid_grant"), "deviceAuthorizationService.Poll")
+	}
+	if deviceAuthorization.ExpiresAt.Before(time.Now()) {
+		deviceService.discard(deviceAuthorization)
+		return nil, "", domain.NewError(fmt.Errorf("expired_token"), "deviceAuthorizationService.Poll")
+	}
+
+	switch deviceAuthorization.Status {
+	case domain.DeviceAuthorizationDenied:
+		deviceService.discard(deviceAuthorization)
+		return nil, "", domain.NewError(fmt.Errorf("access_denied"), "deviceAuthorizationService.Poll")
+	case domain.DeviceAuthorizationApproved:
+		// The device code is single use: drop it before handing out tokens, and only the
+		// poll that dropped it gets them.
+		err = deviceService.deviceRepo.ConsumeDeviceAuthorization(deviceAuthorization)
+		if err != nil && err.ErrorBase.Error() == "device code already used" {
+			return nil, "", domain.NewError(fmt.Errorf("invalid_grant"), "deviceAuthorizationService.Poll")
+		}
+		if err != nil {
+			err.Module = "deviceAuthorizationService.Poll." + err.Module
+			return nil, "", err
+		}
+		user, err := deviceService.userRepo.FindUserById(deviceAuthorization.UserId)
+		if err != nil {
+			err.Module = "deviceAuthorizationService.Poll." + err.Module
+			return nil, "", err
+		}
+		if !user.IsActive {
+			return nil, "", domain.NewError(fmt.Errorf("access_denied"), "deviceAuthorizationService.Poll")
+		}
+		return user, deviceAuthorization.Scope, nil
+	}
+
+	// A decision made since the row was read is left alone; the next poll sees it.
+	now := time.Now()
+	tooFast := now.Sub(deviceAuthorization.LastPolledAt) < time.Duration(deviceAuthorization.Interval)*time.Second
+	interval := deviceAuthorization.Interval
+	if tooFast {
+		interval += deviceSlowDownAmount
+	}
+	err = deviceService.deviceRepo.RecordDevicePoll(deviceAuthorization, now, interval)
+	if err != nil {
+		err.Module = "deviceAuthorizationService.Poll." + err.Module
+		return nil, "", err
+	}
+	if tooFast {
+		return nil, "", domain.NewError(fmt.Errorf("slow_down"), "deviceAuthorizationService.Poll")
+	}
+	return nil, "", domain.NewError(fmt.Errorf("authorization_pending"), "deviceAuthorizationService.Poll")
+}
+
+func (deviceService *deviceAuthorizationService) discard(deviceAuthorization *domain.DeviceAuthorization) {
+	err := deviceService.deviceRepo.DeleteDeviceAuthorization(deviceAuthorization)
+	if err != nil {
+		log.Printf("deviceAuthorizationService.discard.%s: %v", err.Module, err.ErrorBase)
+	}
+}
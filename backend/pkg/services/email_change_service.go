@@ -0,0 +1,165 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
+	"hitenok/pkg/repository"
+	"log"
+	"math/big"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	emailChangeCodeLength = 6
+	emailChangeLifetime   = 30 * time.Minute
+	emailChangeAttempts   = 3
+)
+
+type EmailChangeServiceI interface {
+	RequestChange(user *domain.User, newEmail string) (*domain.EmailChange, *domain.MyError)
+	SendNotifications(user domain.User, emailChange domain.EmailChange)
+	Confirm(user *domain.User, code string) *domain.MyError
+	Cancel(cancelToken string) (*domain.EmailChange, *domain.MyError)
+}
+
+type emailChangeService struct {
+	emailChangeRepo repository.EmailChangeRepositoryI
+	userRepo        repository.UserRepositoryI
+	mailer          MailerI
+	eventBus        events.EventBusI
+	appConfig       *config.AppConfig
+}
+
+func NewEmailChangeService(emailChangeRepo repository.EmailChangeRepositoryI, userRepo repository.UserRepositoryI, mailer MailerI, eventBus events.EventBusI, appConfig *config.AppConfig) EmailChangeServiceI {
+	return &emailChangeService{
+		emailChangeRepo: emailChangeRepo,
+		userRepo:        userRepo,
+		mailer:          mailer,
+		eventBus:        eventBus,
+		appConfig:       appConfig,
+	}
+}
+
+// RequestChange replaces any earlier pending change of the user with a new one. The
+// caller is expected to have checked the current password already.
+func (emailChangeService *emailChangeService) RequestChange(user *domain.User, newEmail string) (*domain.EmailChange, *domain.MyError) {
+	newEmail = strings.TrimSpace(newEmail)
+	address, parseErr := mail.ParseAddress(newEmail)
+	if parseErr != nil || address.Address != newEmail {
+		return &domain.EmailChange{}, domain.NewError(fmt.Errorf("invalid email"), "emailChangeService.RequestChange")
+	}
+	if strings.EqualFold(newEmail, user.Email) {
+		return &domain.EmailChange{}, domain.NewError(fmt.Errorf("invalid email"), "emailChangeService.RequestChange")
+	}
+	_, err := emailChangeService.userRepo.FindUserByEmail(newEmail)
+	if err == nil {
+		return &domain.EmailChange{}, domain.NewError(fmt.Errorf("email already taken"), "emailChangeService.RequestChange")
+	}
+	if !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		err.Module = "emailChangeService.RequestChange." + err.Module
+		return &domain.EmailChange{}, err
+	}
+
+	code := make([]byte, emailChangeCodeLength)
+	for i := range code {
+		n, randErr := rand.Int(rand.Reader, big.NewInt(int64(len(OTPCharset))))
+		if randErr != nil {
+			return &domain.EmailChange{}, domain.NewError(randErr, "emailChangeService.RequestChange")
+		}
+		code[i] = OTPCharset[n.Int64()]
+	}
+	cancelToken := make([]byte, 32)
+	if _, randErr := rand.Read(cancelToken); randErr != nil {
+		return &domain.EmailChange{}, domain.NewError(randErr, "emailChangeService.RequestChange")
+	}
+
+	err = emailChangeService.emailChangeRepo.DeleteEmailChanges(user.ID)
+	if err != nil {
+		err.Module = "emailChangeService.RequestChange." + err.Module
+		return &domain.EmailChange{}, err
+	}
+	emailChange := &domain.EmailChange{
+		UserId:       user.ID,
+		NewEmail:     newEmail,
+		Code:         string(code),
+		CodeAttempts: emailChangeAttempts,
+		CancelToken:  hex.EncodeToString(cancelToken),
+		ExpiresAt:    time.Now().Add(emailChangeLifetime),
+	}
+	err = emailChangeService.emailChangeRepo.SaveEmailChange(emailChange)
+	if err != nil {
+		err.Module = "emailChangeService.RequestChange." + err.Module
+		return emailChange, err
+	}
+	return emailChange, nil
+}
+
+// SendNotifications mails the confirmation code to the new address and a cancel link to
+// the current one, so a hijacked session cannot silently take over the account.
+func (emailChangeService *emailChangeService) SendNotifications(user domain.User, emailChange domain.EmailChange) {
+	err := emailChangeService.mailer.Send(emailChange.NewEmail, "Подтверждение смены почты", "Код подтверждения: "+emailChange.Code)
+	if err != nil {
+		log.Printf("emailChangeService.SendNotifications: %v", err)
+	}
+	cancelUrl := emailChangeService.appConfig.PublicUrl + "/api/v1/users/email/cancel?token=" + emailChange.CancelToken
+	body := "Запрошена смена почты аккаунта на " + emailChange.NewEmail + ".\n" +
+		"Если это были не вы, отмените смену: " + cancelUrl
+	err = emailChangeService.mailer.Send(user.Email, "Смена почты аккаунта", body)
+	if err != nil {
+		log.Printf("emailChangeService.SendNotifications: %v", err)
+	}
+}
+
+// Confirm applies the pending change when the code matches. On success the user carries
+// the new email and a bumped JWTVersion, which invalidates every other session.
+func (emailChangeService *emailChangeService) Confirm(user *domain.User, code string) *domain.MyError {
+	emailChange, err := emailChangeService.emailChangeRepo.FindEmailChangeByUser(user.ID)
+	if err != nil {
+		err.Module = "emailChangeService.Confirm." + err.Module
+		return err
+	}
+	if emailChange.ExpiresAt.Before(time.Now()) || emailChange.CodeAttempts <= 0 {
+		return domain.NewError(fmt.Errorf("code expired"), "emailChangeService.Confirm")
+	}
+	if subtle.ConstantTimeCompare([]byte(emailChange.Code), []byte(code)) != 1 {
+		emailChange.CodeAttempts -= 1
+		err = emailChangeService.emailChangeRepo.SaveEmailChange(emailChange)
+		if err != nil {
+			err.Module = "emailChangeService.Confirm." + err.Module
+			return err
+		}
+		return domain.NewError(fmt.Errorf("wrong code"), "emailChangeService.Confirm")
+	}
+	oldEmail := user.Email
+	err = emailChangeService.emailChangeRepo.ApplyEmailChange(emailChange, user)
+	if err != nil {
+		err.Module = "emailChangeService.Confirm." + err.Module
+		return err
+	}
+	emailChangeService.eventBus.Publish(events.EmailChanged{UserId: user.ID, OldEmail: oldEmail, NewEmail: user.Email})
+	return nil
+}
+
+func (emailChangeService *emailChangeService) Cancel(cancelToken string) (*domain.EmailChange, *domain.MyError) {
+	emailChange, err := emailChangeService.emailChangeRepo.FindEmailChangeByCancelToken(cancelToken)
+	if err != nil {
+		err.Module = "emailChangeService.Cancel." + err.Module
+		return emailChange, err
+	}
+	err = emailChangeService.emailChangeRepo.DeleteEmailChanges(emailChange.UserId)
+	if err != nil {
+		err.Module = "emailChangeService.Cancel." + err.Module
+		return emailChange, err
+	}
+	return emailChange, nil
+}
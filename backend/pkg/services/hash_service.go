@@ -1,60 +1,77 @@
 package services
 
 import (
+	"crypto/rand"
+	"fmt"
+	"hitenok/pkg/config"
 	"hitenok/pkg/domain"
 	"hitenok/pkg/repository"
-	"math/rand"
+	"hitenok/pkg/security"
+	"io"
 	"time"
 )
 
 const hashCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
+// HashServiceI issues the password reset hash an OTP is traded for. Like the OTP it is
+// stored as an HMAC under the OTP keyring, and GenerateHash returns the hash itself. The
+// service writes only the hash columns of the user.
 type HashServiceI interface {
-	GenerateHash(user *domain.User) *domain.MyError
+	GenerateHash(user *domain.User) (string, *domain.MyError)
 	ValidateHash(user *domain.User, hash string) (bool, *domain.MyError)
 	ClearHash(user *domain.User) *domain.MyError
 }
 
 type HashService struct {
-	userRepo repository.UserRepositoryI
+	userRepo  repository.UserRepositoryI
+	appConfig *config.AppConfig
+	now       func() time.Time
+	random    io.Reader
 }
 
-func NewHashService(userRepo repository.UserRepositoryI) HashServiceI {
+func NewHashService(userRepo repository.UserRepositoryI, appConfig *config.AppConfig) HashServiceI {
 	return &HashService{
-		userRepo: userRepo,
+		userRepo:  userRepo,
+		appConfig: appConfig,
+		now:       time.Now,
+		random:    rand.Reader,
 	}
 }
 
-func (hashService *HashService) GenerateHash(user *domain.User) *domain.MyError {
-	newHash := make([]byte, 16)
-	for i := range newHash {
-		newHash[i] = hashCharset[rand.Intn(len(hashCharset))]
+func (hashService *HashService) GenerateHash(user *domain.User) (string, *domain.MyError) {
+	newHash, randErr := security.RandomStringFrom(hashService.random, hashCharset, 16)
+	if randErr != nil {
+		return "", domain.NewError(randErr, "HashService.GenerateHash")
 	}
-	user.ResetHash = string(newHash)
-	user.ResetHashSpawnedAt = time.Now()
-	user.HashAttempts = 3
-	err := hashService.userRepo.SaveUser(user)
+	err := hashService.userRepo.UpdateUserColumns(user, nil, map[string]interface{}{
+		"reset_hash":            hashService.appConfig.Keys.Otp.Sign(resetHashMessage(user, newHash)),
+		"hash_attempts":         hashService.appConfig.Otp.ResetAttempts,
+		"reset_hash_spawned_at": hashService.now(),
+	})
 	if err != nil {
 		err.Module = "HashService.GenerateHash." + err.Module
-		return err
+		return "", err
 	}
-	return nil
+	return newHash, nil
+}
+
+func resetHashMessage(user *domain.User, hash string) string {
+	return fmt.Sprintf("reset:%d:%s", user.ID, hash)
 }
 
 func (hashService *HashService) ValidateHash(user *domain.User, hash string) (bool, *domain.MyError) {
 	if user.ResetHash == "" {
 		return false, nil
 	}
-	if user.ResetHashSpawnedAt.Add(5 * time.Minute).Before(time.Now()) {
+	if user.ResetHashSpawnedAt.Add(hashService.appConfig.Otp.ResetTtl).Before(hashService.now()) {
 		return false, nil
 	}
 	if user.HashAttempts <= 0 {
 		return false, nil
 	}
-	if hash != user.ResetHash {
-		user.HashAttempts -= 1
-		err := hashService.userRepo.SaveUser(user)
-		if err != nil {
+	if valid, _ := hashService.appConfig.Keys.Otp.Verify(resetHashMessage(user, hash), user.ResetHash); !valid {
+		err := hashService.userRepo.UpdateUserColumns(user, map[string]interface{}{"hash_attempts": user.HashAttempts}, map[string]interface{}{"hash_attempts": user.HashAttempts - 1})
+		if err != nil && err.ErrorBase.Error() != "user changed concurrently" {
 			err.Module = "HashService.ValidateHash." + err.Module
 			return false, err
 		}
@@ -63,11 +80,14 @@ func (hashService *HashService) ValidateHash(user *domain.User, hash string) (bo
 	return true, nil
 }
 
+// ClearHash spends the hash. A password reset does not need it, setting the password
+// clears the hash in the same write.
 func (hashService *HashService) ClearHash(user *domain.User) *domain.MyError {
-	user.HashAttempts = 0
-	user.ResetHash = ""
-	user.ResetHashSpawnedAt = time.Time{}
-	err := hashService.userRepo.SaveUser(user)
+	err := hashService.userRepo.UpdateUserColumns(user, nil, map[string]interface{}{
+		"reset_hash":            "",
+		"hash_attempts":         0,
+		"reset_hash_spawned_at": time.Time{},
+	})
 	if err != nil {
 		err.Module = "HashService.ClearHash." + err.Module
 		return err
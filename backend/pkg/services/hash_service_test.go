@@ -0,0 +1,127 @@
+package services
+
+import (
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHashService(t *testing.T) (*HashService, repository.UserRepositoryI, *testClock) {
+	t.Helper()
+	clock := newTestClock()
+	repo := repository.NewMemoryUserRepository(clock.Now)
+	service := NewHashService(repo, testConfig(t)).(*HashService)
+	service.now = clock.Now
+	service.random = &countingReader{}
+	return service, repo, clock
+}
+
+func TestHashServiceGenerateHash(t *testing.T) {
+	service, repo, _ := newTestHashService(t)
+	user := &domain.User{Email: "user@example.com"}
+	repo.SaveUser(user)
+
+	hash, err := service.GenerateHash(user)
+	if err != nil {
+		t.Fatalf("GenerateHash: %v", err.ErrorBase)
+	}
+	if hash != "ABCDEFGHIJKLMNOP" {
+		t.Errorf("hash = %q, want ABCDEFGHIJKLMNOP from the counting reader", hash)
+	}
+	stored, _ := repo.FindUserById(user.ID)
+	if stored.ResetHash == hash || !strings.HasPrefix(stored.ResetHash, "otp-1$") {
+		t.Errorf("stored hash = %q, want an HMAC under otp-1", stored.ResetHash)
+	}
+	if stored.HashAttempts != 2 || !stored.ResetHashSpawnedAt.Equal(testEpoch) {
+		t.Errorf("stored attempts %d spawned %v, want 2 at the epoch", stored.HashAttempts, stored.ResetHashSpawnedAt)
+	}
+	// The reset hash and the OTP are signed with the same keyring but over different
+	// messages, so one cannot stand in for the other.
+	if valid, _ := service.appConfig.Keys.Otp.Verify(otpMessage(user, hash), stored.ResetHash); valid {
+		t.Errorf("reset hash verifies as an OTP")
+	}
+}
+
+func TestHashServiceValidateHash(t *testing.T) {
+	tests := []struct {
+		name         string
+		prepare      func(user *domain.User, clock *testClock)
+		hash         string
+		want         bool
+		wantAttempts int
+	}{
+		{name: "right hash", hash: "ABCDEFGHIJKLMNOP", want: true, wantAttempts: 2},
+		{name: "wrong hash", hash: "PONMLKJIHGFEDCBA", want: false, wantAttempts: 1},
+		{name: "at the end of its life", hash: "ABCDEFGHIJKLMNOP", want: true, wantAttempts: 2, prepare: func(user *domain.User, clock *testClock) {
+			clock.Advance(10 * time.Minute)
+		}},
+		{name: "expired", hash: "ABCDEFGHIJKLMNOP", want: false, wantAttempts: 2, prepare: func(user *domain.User, clock *testClock) {
+			clock.Advance(10*time.Minute + time.Second)
+		}},
+		{name: "no attempts left", hash: "ABCDEFGHIJKLMNOP", want: false, wantAttempts: 0, prepare: func(user *domain.User, clock *testClock) {
+			user.HashAttempts = 0
+		}},
+		{name: "cleared", hash: "ABCDEFGHIJKLMNOP", want: false, wantAttempts: 2, prepare: func(user *domain.User, clock *testClock) {
+			user.ResetHash = ""
+		}},
+		{name: "signing key retired", hash: "ABCDEFGHIJKLMNOP", want: false, wantAttempts: 1, prepare: func(user *domain.User, clock *testClock) {
+			user.ResetHash = strings.Replace(user.ResetHash, "otp-1$", "otp-0$", 1)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, repo, clock := newTestHashService(t)
+			user := &domain.User{Email: "user@example.com"}
+			repo.SaveUser(user)
+			if _, err := service.GenerateHash(user); err != nil {
+				t.Fatalf("GenerateHash: %v", err.ErrorBase)
+			}
+			if test.prepare != nil {
+				test.prepare(user, clock)
+			}
+
+			valid, err := service.ValidateHash(user, test.hash)
+			if err != nil {
+				t.Fatalf("ValidateHash: %v", err.ErrorBase)
+			}
+			if valid != test.want {
+				t.Errorf("ValidateHash = %v, want %v", valid, test.want)
+			}
+			if user.HashAttempts != test.wantAttempts {
+				t.Errorf("attempts = %d, want %d", user.HashAttempts, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestHashServiceValidateHashAfterRotation(t *testing.T) {
+	service, repo, _ := newTestHashService(t)
+	user := &domain.User{Email: "user@example.com"}
+	repo.SaveUser(user)
+	hash, _ := service.GenerateHash(user)
+
+	service.appConfig.Keys.Otp = testKeyring(t, "otp-2:rotated-secret", "otp-1:otp-secret")
+	if valid, _ := service.ValidateHash(user, hash); !valid {
+		t.Errorf("hash issued before the rotation is refused")
+	}
+}
+
+func TestHashServiceClearHash(t *testing.T) {
+	service, repo, _ := newTestHashService(t)
+	user := &domain.User{Email: "user@example.com"}
+	repo.SaveUser(user)
+	hash, _ := service.GenerateHash(user)
+
+	if err := service.ClearHash(user); err != nil {
+		t.Fatalf("ClearHash: %v", err.ErrorBase)
+	}
+	stored, _ := repo.FindUserById(user.ID)
+	if stored.ResetHash != "" || stored.HashAttempts != 0 || !stored.ResetHashSpawnedAt.IsZero() {
+		t.Errorf("stored hash %q attempts %d spawned %v, want all cleared", stored.ResetHash, stored.HashAttempts, stored.ResetHashSpawnedAt)
+	}
+	if valid, _ := service.ValidateHash(stored, hash); valid {
+		t.Errorf("cleared hash accepted")
+	}
+}
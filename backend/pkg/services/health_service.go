@@ -0,0 +1,163 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"hitenok/pkg/security"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HealthServiceI interface {
+	// Ready runs the readiness checks, or returns the last report while it is younger
+	// than the cache interval.
+	Ready() domain.HealthReport
+}
+
+type healthService struct {
+	healthRepo repository.HealthRepositoryI
+	mailer     MailerI
+	heartbeats HeartbeatsI
+	appConfig  *config.AppConfig
+
+	mu     sync.Mutex
+	report *domain.HealthReport
+}
+
+func NewHealthService(healthRepo repository.HealthRepositoryI, mailer MailerI, heartbeats HeartbeatsI, appConfig *config.AppConfig) HealthServiceI {
+	return &healthService{
+		healthRepo: healthRepo,
+		mailer:     mailer,
+		heartbeats: heartbeats,
+		appConfig:  appConfig,
+	}
+}
+
+type healthCheck struct {
+	name string
+	// critical checks make the instance unready; the others only warn.
+	critical bool
+	run      func(ctx context.Context) error
+}
+
+func (healthService *healthService) Ready() domain.HealthReport {
+	// Holding the lock through the checks makes concurrent probes share one run.
+	healthService.mu.Lock()
+	defer healthService.mu.Unlock()
+	if healthService.report != nil && time.Since(healthService.report.CheckedAt) < healthService.appConfig.Health.CacheTtl {
+		return *healthService.report
+	}
+
+	checks := []healthCheck{
+		{name: "database", critical: true, run: func(ctx context.Context) error {
+			if err := healthService.healthRepo.Ping(ctx); err != nil {
+				return err.ErrorBase
+			}
+			return nil
+		}},
+		{name: "keys", critical: true, run: healthService.checkKeys},
+		{name: "workers", critical: true, run: func(ctx context.Context) error {
+			return healthService.checkWorkers(true)
+		}},
+		{name: "background_workers", run: func(ctx context.Context) error {
+			return healthService.checkWorkers(false)
+		}},
+	}
+	if healthService.appConfig.Health.CheckMailer {
+		checks = append(checks, healthCheck{name: "mailer", run: healthService.mailer.Ping})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthService.appConfig.Health.CheckTimeout)
+	defer cancel()
+	results := make([]domain.HealthCheck, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = runHealthCheck(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	report := &domain.HealthReport{
+		Status:    domain.HealthOk,
+		CheckedAt: time.Now(),
+		Checks:    map[string]domain.HealthCheck{},
+	}
+	for i, check := range checks {
+		report.Checks[check.name] = results[i]
+		if results[i].Status == domain.HealthFail {
+			report.Status = domain.HealthFail
+		}
+	}
+	healthService.report = report
+	return *report
+}
+
+// runHealthCheck times one check. A check that outlives the timeout is reported as
+// failed even if it has not returned yet.
+func runHealthCheck(ctx context.Context, check healthCheck) domain.HealthCheck {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- fmt.Errorf("panic: %v", recovered)
+			}
+		}()
+		done <- check.run(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result := domain.HealthCheck{
+		Status:    domain.HealthOk,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = domain.HealthWarn
+		if check.critical {
+			result.Status = domain.HealthFail
+		}
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkKeys makes sure every keyring has a usable current key by signing and
+// verifying with it.
+func (healthService *healthService) checkKeys(ctx context.Context) error {
+	keyrings := map[string]*security.Keyring{
+		"jwt":    healthService.appConfig.Keys.Jwt,
+		"pepper": healthService.appConfig.Keys.Pepper,
+		"otp":    healthService.appConfig.Keys.Otp,
+		"audit":  healthService.appConfig.Keys.Audit,
+	}
+	for name, keyring := range keyrings {
+		if keyring == nil {
+			return fmt.Errorf("%s keyring is not loaded", name)
+		}
+		if valid, _ := keyring.Verify("health", keyring.Sign("health")); !valid {
+			return fmt.Errorf("%s keyring cannot verify its own signature", name)
+		}
+	}
+	return nil
+}
+
+func (healthService *healthService) checkWorkers(critical bool) error {
+	stale := healthService.heartbeats.Stale(critical)
+	if len(stale) == 0 {
+		return nil
+	}
+	sort.Strings(stale)
+	return fmt.Errorf("no heartbeat from %s", strings.Join(stale, ", "))
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// minHeartbeatTolerance keeps fast workers from being reported over one slow run.
+const minHeartbeatTolerance = time.Minute
+
+// HeartbeatsI tracks that the periodic workers keep running. A worker is stale when it
+// has not beaten for three intervals, and at least a minute. Critical workers are the
+// ones an instance cannot serve correctly without; the others may lag behind without
+// taking it out of rotation.
+type HeartbeatsI interface {
+	Register(name string, interval time.Duration, critical bool)
+	Beat(name string)
+	Stale(critical bool) []string
+}
+
+type heartbeat struct {
+	interval time.Duration
+	critical bool
+	last     time.Time
+}
+
+type heartbeats struct {
+	mu      sync.Mutex
+	workers map[string]*heartbeat
+}
+
+func NewHeartbeats() HeartbeatsI {
+	return &heartbeats{
+		workers: map[string]*heartbeat{},
+	}
+}
+
+// Register starts tracking a worker as if it had just beaten.
+func (heartbeats *heartbeats) Register(name string, interval time.Duration, critical bool) {
+	heartbeats.mu.Lock()
+	defer heartbeats.mu.Unlock()
+	heartbeats.workers[name] = &heartbeat{interval: interval, critical: critical, last: time.Now()}
+}
+
+func (heartbeats *heartbeats) Beat(name string) {
+	heartbeats.mu.Lock()
+	defer heartbeats.mu.Unlock()
+	if worker, found := heartbeats.workers[name]; found {
+		worker.last = time.Now()
+	}
+}
+
+// Stale lists the stale workers that are critical, or the ones that are not.
+func (heartbeats *heartbeats) Stale(critical bool) []string {
+	heartbeats.mu.Lock()
+	defer heartbeats.mu.Unlock()
+	var stale []string
+	for name, worker := range heartbeats.workers {
+		if worker.critical == critical && time.Since(worker.last) > max(3*worker.interval, minHeartbeatTolerance) {
+			stale = append(stale, name)
+		}
+	}
+	return stale
+}
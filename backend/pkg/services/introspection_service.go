@@ -0,0 +1,212 @@
+package services
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// introspectionCacheLimit bounds the number of cached responses; once reached, expired
+// entries are swept and, failing that, the cache starts over.
+const introspectionCacheLimit = 10000
+
+type IntrospectionServiceI interface {
+	Introspect(token string) (*domain.Introspection, *domain.MyError)
+	Forget(token string)
+	ForgetSession(sessionId string)
+	ForgetUser(userId uint)
+}
+
+type introspectionCacheEntry struct {
+	introspection *domain.Introspection
+	sessionId     string
+	userId        uint
+	expiresAt     time.Time
+}
+
+type introspectionService struct {
+	jwtService    JWTServiceI
+	apiKeyService ApiKeyServiceI
+	appConfig     *config.AppConfig
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspectionCacheEntry
+}
+
+func NewIntrospectionService(jwtService JWTServiceI, apiKeyService ApiKeyServiceI, appConfig *config.AppConfig) IntrospectionServiceI {
+	return &introspectionService{
+		jwtService:    jwtService,
+		apiKeyService: apiKeyService,
+		appConfig:     appConfig,
+		cache:         map[[sha256.Size]byte]introspectionCacheEntry{},
+	}
+}
+
+// Introspect answers whether the token, a JWT or an API key, is currently usable. Any
+// validation failure (bad signature, expired, revoked, stale JWTVersion, deleted key or
+// user) is reported as an inactive token rather than an error; only storage failures are
+// returned as errors.
+func (introspectionService *introspectionService) Introspect(token string) (*domain.Introspection, *domain.MyError) {
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	introspectionService.mu.Lock()
+	entry, ok := introspectionService.cache[key]
+	introspectionService.mu.Unlock()
+	if ok && entry.expiresAt.After(now) {
+		return entry.introspection, nil
+	}
+
+	var introspection *domain.Introspection
+	var sessionId string
+	var userId uint
+	var err *domain.MyError
+	if strings.HasPrefix(token, domain.ApiKeyPrefix) {
+		introspection, sessionId, userId, err = introspectionService.introspectApiKey(token)
+	} else {
+		introspection, sessionId, userId, err = introspectionService.introspectJWT(token)
+	}
+	if err != nil {
+		err.Module = "introspectionService.Introspect." + err.Module
+		return introspection, err
+	}
+
+	// ForgetUser only reaches this process; the sessions of a user can also end in
+	// another replica or from the CLI. Active answers are therefore kept no longer than
+	// a revocation takes to sync.
+	ttl := introspectionService.appConfig.IntrospectionCacheTtl
+	if syncInterval := introspectionService.appConfig.DenylistSyncInterval; introspection.Active && syncInterval > 0 && syncInterval < ttl {
+		ttl = syncInterval
+	}
+	expiresAt := now.Add(ttl)
+	if introspection.Exp != 0 && time.Unix(introspection.Exp, 0).Before(expiresAt) {
+		expiresAt = time.Unix(introspection.Exp, 0)
+	}
+	introspectionService.mu.Lock()
+	if len(introspectionService.cache) >= introspectionCacheLimit {
+		for cachedKey, cachedEntry := range introspectionService.cache {
+			if !cachedEntry.expiresAt.After(now) {
+				delete(introspectionService.cache, cachedKey)
+			}
+		}
+		if len(introspectionService.cache) >= introspectionCacheLimit {
+			introspectionService.cache = map[[sha256.Size]byte]introspectionCacheEntry{}
+		}
+	}
+	introspectionService.cache[key] = introspectionCacheEntry{
+		introspection: introspection,
+		sessionId:     sessionId,
+		userId:        userId,
+		expiresAt:     expiresAt,
+	}
+	introspectionService.mu.Unlock()
+	return introspection, nil
+}
+
+func (introspectionService *introspectionService) introspectJWT(token string) (*domain.Introspection, string, uint, *domain.MyError) {
+	user, claims, err := introspectionService.jwtService.ValidateTokenClaims(token, domain.AnyTokenType)
+	if err != nil && !IsTokenError(err) {
+		return &domain.Introspection{Active: false}, "", 0, err
+	}
+	// A password-change token is no credential for resource servers.
+	if err != nil || !user.IsActive || claims.Scope == domain.PasswordChangeScope {
+		return &domain.Introspection{Active: false}, "", 0, nil
+	}
+	introspection := &domain.Introspection{
+		Active:    true,
+		Sub:       claims.Subject,
+		Username:  user.Email,
+		Scope:     claims.Scope,
+		ClientId:  claims.ClientId,
+		TokenType: claims.TokenType,
+		OrgId:     claims.OrgId,
+	}
+	if claims.ExpiresAt != nil {
+		introspection.Exp = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		introspection.Iat = claims.IssuedAt.Unix()
+	}
+	return introspection, claims.SessionId, user.ID, nil
+}
+
+// introspectApiKey describes an API key the way a token is described, its creation
+// standing in for the issue time. The key is cached under a pseudo session id, so
+// deleting it can drop the cached response.
+func (introspectionService *introspectionService) introspectApiKey(key string) (*domain.Introspection, string, uint, *domain.MyError) {
+	user, apiKey, err := introspectionService.apiKeyService.Authenticate(key)
+	if err != nil && !IsTokenError(err) {
+		return &domain.Introspection{Active: false}, "", 0, err
+	}
+	if err != nil {
+		return &domain.Introspection{Active: false}, "", 0, nil
+	}
+	introspection := &domain.Introspection{
+		Active:    true,
+		Sub:       strconv.FormatUint(uint64(user.ID), 10),
+		Username:  user.Email,
+		Iat:       apiKey.CreatedAt.Unix(),
+		Scope:     apiKey.Scope,
+		TokenType: domain.ApiKeyTokenType,
+	}
+	if apiKey.ExpiresAt != nil {
+		introspection.Exp = apiKey.ExpiresAt.Unix()
+	}
+	return introspection, apiKey.SessionId(), user.ID, nil
+}
+
+// Forget drops a cached response so a revoked token stops being reported active at once.
+func (introspectionService *introspectionService) Forget(token string) {
+	key := sha256.Sum256([]byte(token))
+	introspectionService.mu.Lock()
+	delete(introspectionService.cache, key)
+	introspectionService.mu.Unlock()
+}
+
+// ForgetSession drops the cached responses of every token of a session that has ended.
+func (introspectionService *introspectionService) ForgetSession(sessionId string) {
+	if sessionId == "" {
+		return
+	}
+	introspectionService.mu.Lock()
+	for key, entry := range introspectionService.cache {
+		if entry.sessionId == sessionId {
+			delete(introspectionService.cache, key)
+		}
+	}
+	introspectionService.mu.Unlock()
+}
+
+// ForgetUser drops the cached responses of every token of a user whose tokens stopped
+// being valid all at once: a password change, a deactivation or a deletion.
+func (introspectionService *introspectionService) ForgetUser(userId uint) {
+	introspectionService.mu.Lock()
+	for key, entry := range introspectionService.cache {
+		if entry.userId == userId {
+			delete(introspectionService.cache, key)
+		}
+	}
+	introspectionService.mu.Unlock()
+}
+
+// IsTokenError tells errors caused by the token itself apart from storage failures.
+func IsTokenError(err *domain.MyError) bool {
+	return errors.Is(err.ErrorBase, jwt.ErrTokenMalformed) ||
+		errors.Is(err.ErrorBase, jwt.ErrTokenUnverifiable) ||
+		errors.Is(err.ErrorBase, jwt.ErrTokenSignatureInvalid) ||
+		errors.Is(err.ErrorBase, jwt.ErrTokenInvalidClaims) ||
+		errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) ||
+		err.ErrorBase.Error() == "invalid token" ||
+		err.ErrorBase.Error() == "token revoked" ||
+		err.ErrorBase.Error() == "wrong token type" ||
+		err.ErrorBase.Error() == "password change required" ||
+		err.ErrorBase.Error() == "invalid api key"
+}
@@ -0,0 +1,258 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"log"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+type InvitationServiceI interface {
+	Invite(actor *domain.Membership, inviter *domain.User, email, role string) (*domain.Invitation, string, *domain.MyError)
+	SendInvitation(invitation domain.Invitation, organizationName, token string)
+	ListInvitations(organizationId uint) ([]domain.Invitation, *domain.MyError)
+	RevokeInvitation(actor *domain.Membership, invitationId uint) *domain.MyError
+	Inspect(token string) (*domain.Invitation, bool, *domain.MyError)
+	Accept(token string, user *domain.User, fullname, password string) (*domain.User, *domain.Membership, *domain.MyError)
+}
+
+type invitationService struct {
+	invitationRepo        repository.InvitationRepositoryI
+	organizationRepo      repository.OrganizationRepositoryI
+	userRepo              repository.UserRepositoryI
+	authenticationService PasswordAuthenticationServiceI
+	mailer                MailerI
+	appConfig             *config.AppConfig
+}
+
+func NewInvitationService(invitationRepo repository.InvitationRepositoryI, organizationRepo repository.OrganizationRepositoryI, userRepo repository.UserRepositoryI, authenticationService PasswordAuthenticationServiceI, mailer MailerI, appConfig *config.AppConfig) InvitationServiceI {
+	return &invitationService{
+		invitationRepo:        invitationRepo,
+		organizationRepo:      organizationRepo,
+		userRepo:              userRepo,
+		authenticationService: authenticationService,
+		mailer:                mailer,
+		appConfig:             appConfig,
+	}
+}
+
+// Invite records an invitation into the actor's organization and returns it with its
+// signed token. As with AddMember nobody can offer a role above their own.
+func (invitationService *invitationService) Invite(actor *domain.Membership, inviter *domain.User, email, role string) (*domain.Invitation, string, *domain.MyError) {
+	if domain.OrgRoleRank(role) == 0 {
+		return &domain.Invitation{}, "", domain.NewError(fmt.Errorf("invalid role"), "invitationService.Invite")
+	}
+	if domain.OrgRoleRank(role) > domain.OrgRoleRank(actor.Role) {
+		return &domain.Invitation{}, "", domain.NewError(fmt.Errorf("forbidden"), "invitationService.Invite")
+	}
+	email = strings.TrimSpace(email)
+	address, parseErr := mail.ParseAddress(email)
+	if parseErr != nil || address.Address != email {
+		return &domain.Invitation{}, "", domain.NewError(fmt.Errorf("invalid email"), "invitationService.Invite")
+	}
+	user, err := invitationService.userRepo.FindUserByEmail(email)
+	if err != nil && !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		err.Module = "invitationService.Invite." + err.Module
+		return &domain.Invitation{}, "", err
+	}
+	if err == nil {
+		_, err = invitationService.organizationRepo.FindMembership(actor.OrganizationId, user.ID)
+		if err == nil {
+			return &domain.Invitation{}, "", domain.NewError(fmt.Errorf("already a member"), "invitationService.Invite")
+		}
+		if !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+			err.Module = "invitationService.Invite." + err.Module
+			return &domain.Invitation{}, "", err
+		}
+	}
+
+	invitation := &domain.Invitation{
+		OrganizationId: actor.OrganizationId,
+		Email:          email,
+		Role:           role,
+		InvitedBy:      inviter.ID,
+		ExpiresAt:      time.Now().Add(invitationService.appConfig.InvitationTtl),
+	}
+	err = invitationService.invitationRepo.SaveInvitation(invitation)
+	if err != nil {
+		err.Module = "invitationService.Invite." + err.Module
+		return invitation, "", err
+	}
+	token, err := invitationService.signInvitation(invitation)
+	if err != nil {
+		err.Module = "invitationService.Invite." + err.Module
+		return invitation, "", err
+	}
+	return invitation, token, nil
+}
+
+func (invitationService *invitationService) SendInvitation(invitation domain.Invitation, organizationName, token string) {
+	inviteUrl := invitationService.appConfig.InvitationUrl + "?token=" + url.QueryEscape(token)
+	body := "Вас пригласили в организацию " + organizationName + ".\n" +
+		"Чтобы принять приглашение, перейдите по ссылке: " + inviteUrl + "\n" +
+		"Приглашение действует до " + invitation.ExpiresAt.Format("02.01.2006 15:04 MST") + "."
+	err := invitationService.mailer.Send(invitation.Email, "Приглашение в организацию", body)
+	if err != nil {
+		log.Printf("invitationService.SendInvitation: %v", err)
+	}
+}
+
+func (invitationService *invitationService) ListInvitations(organizationId uint) ([]domain.Invitation, *domain.MyError) {
+	invitations, err := invitationService.invitationRepo.FindPendingInvitations(organizationId, time.Now())
+	if err != nil {
+		err.Module = "invitationService.ListInvitations." + err.Module
+		return invitations, err
+	}
+	return invitations, nil
+}
+
+// RevokeInvitation withdraws a pending invitation of the actor's organization; its token
+// stops working right away.
+func (invitationService *invitationService) RevokeInvitation(actor *domain.Membership, invitationId uint) *domain.MyError {
+	invitation, err := invitationService.invitationRepo.FindInvitationById(invitationId)
+	if err != nil {
+		err.Module = "invitationService.RevokeInvitation." + err.Module
+		return err
+	}
+	if invitation.OrganizationId != actor.OrganizationId {
+		return domain.NewError(gorm.ErrRecordNotFound, "invitationService.RevokeInvitation")
+	}
+	err = invitationService.invitationRepo.DeleteInvitation(invitation)
+	if err != nil {
+		err.Module = "invitationService.RevokeInvitation." + err.Module
+		return err
+	}
+	return nil
+}
+
+// Inspect resolves an invite token for the accept page and tells whether the invited
+// email already has an account, i.e. whether a password or a fresh profile is needed.
+func (invitationService *invitationService) Inspect(token string) (*domain.Invitation, bool, *domain.MyError) {
+	invitation, err := invitationService.parseInvitation(token)
+	if err != nil {
+		err.Module = "invitationService.Inspect." + err.Module
+		return invitation, false, err
+	}
+	_, err = invitationService.userRepo.FindUserByEmail(invitation.Email)
+	if err != nil && !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		err.Module = "invitationService.Inspect." + err.Module
+		return invitation, false, err
+	}
+	return invitation, err == nil, nil
+}
+
+// Accept joins the invited person to the organization. A signed in user must be the
+// invited email; otherwise an existing account proves itself with its password, and a
+// missing one is created, already active, from fullname and password.
+func (invitationService *invitationService) Accept(token string, user *domain.User, fullname, password string) (*domain.User, *domain.Membership, *domain.MyError) {
+	invitation, err := invitationService.parseInvitation(token)
+	if err != nil {
+		err.Module = "invitationService.Accept." + err.Module
+		return user, &domain.Membership{}, err
+	}
+	if user != nil && !strings.EqualFold(user.Email, invitation.Email) {
+		return user, &domain.Membership{}, domain.NewError(fmt.Errorf("invitation email mismatch"), "invitationService.Accept")
+	}
+	if user == nil {
+		user, err = invitationService.userRepo.FindUserByEmail(invitation.Email)
+		if err != nil && !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+			err.Module = "invitationService.Accept." + err.Module
+			return user, &domain.Membership{}, err
+		}
+		if err == nil {
+			if !invitationService.authenticationService.CheckPassword(user, password) {
+				return user, &domain.Membership{}, domain.NewError(fmt.Errorf("wrong credentials"), "invitationService.Accept")
+			}
+			// The invite email proves the ownership the activation OTP would have.
+			err = invitationService.authenticationService.Activate(user)
+			if err != nil {
+				err.Module = "invitationService.Accept." + err.Module
+				return user, &domain.Membership{}, err
+			}
+		} else {
+			user, err = invitationService.authenticationService.RegisterInvited(invitation.Email, strings.TrimSpace(fullname), password)
+			if err != nil {
+				err.Module = "invitationService.Accept." + err.Module
+				return user, &domain.Membership{}, err
+			}
+		}
+	}
+
+	_, err = invitationService.organizationRepo.FindMembership(invitation.OrganizationId, user.ID)
+	if err == nil {
+		return user, &domain.Membership{}, domain.NewError(fmt.Errorf("already a member"), "invitationService.Accept")
+	}
+	if !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		err.Module = "invitationService.Accept." + err.Module
+		return user, &domain.Membership{}, err
+	}
+	membership := &domain.Membership{
+		OrganizationId: invitation.OrganizationId,
+		UserId:         user.ID,
+		Role:           invitation.Role,
+		Organization:   invitation.Organization,
+	}
+	err = invitationService.invitationRepo.AcceptInvitation(invitation, membership)
+	if err != nil {
+		err.Module = "invitationService.Accept." + err.Module
+		return user, membership, err
+	}
+	return user, membership, nil
+}
+
+func (invitationService *invitationService) signInvitation(invitation *domain.Invitation) (string, *domain.MyError) {
+	claims := domain.InvitationClaims{
+		InvitationId: invitation.ID,
+		Email:        invitation.Email,
+		TokenType:    domain.InvitationTokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(invitation.CreatedAt),
+			ExpiresAt: jwt.NewNumericDate(invitation.ExpiresAt),
+		},
+	}
+	token, err := signJWT(invitationService.appConfig.Keys.Jwt, claims)
+	if err != nil {
+		return "", domain.NewError(err, "invitationService.signInvitation")
+	}
+	return token, nil
+}
+
+// parseInvitation checks the token and the invitation behind it. Anything wrong with the
+// token itself, or a revoked invitation, is "invalid invitation".
+func (invitationService *invitationService) parseInvitation(token string) (*domain.Invitation, *domain.MyError) {
+	claims := &domain.InvitationClaims{}
+	_, parseErr := jwt.ParseWithClaims(token, claims, jwtKeyFunc(invitationService.appConfig.Keys.Jwt), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if errors.Is(parseErr, jwt.ErrTokenExpired) {
+		return &domain.Invitation{}, domain.NewError(fmt.Errorf("invitation expired"), "invitationService.parseInvitation")
+	}
+	if parseErr != nil || claims.TokenType != domain.InvitationTokenType {
+		return &domain.Invitation{}, domain.NewError(fmt.Errorf("invalid invitation"), "invitationService.parseInvitation")
+	}
+	invitation, err := invitationService.invitationRepo.FindInvitationById(claims.InvitationId)
+	if err != nil && errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		return invitation, domain.NewError(fmt.Errorf("invalid invitation"), "invitationService.parseInvitation")
+	}
+	if err != nil {
+		err.Module = "invitationService.parseInvitation." + err.Module
+		return invitation, err
+	}
+	if invitation.Email != claims.Email {
+		return invitation, domain.NewError(fmt.Errorf("invalid invitation"), "invitationService.parseInvitation")
+	}
+	if invitation.AcceptedAt != nil {
+		return invitation, domain.NewError(fmt.Errorf("invitation already used"), "invitationService.parseInvitation")
+	}
+	if invitation.ExpiresAt.Before(time.Now()) {
+		return invitation, domain.NewError(fmt.Errorf("invitation expired"), "invitationService.parseInvitation")
+	}
+	return invitation, nil
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"fmt"
+	"hitenok/pkg/security"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signJWT signs HS256 tokens with the current key of the ring and names it in the kid
+// header, so that the token still verifies after the key is rotated out of first place.
+func signJWT(keyring *security.Keyring, claims jwt.Claims) (string, error) {
+	key := keyring.Current()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.Secret)
+}
+
+// jwtKeyFunc finds the verification key by the kid header. Tokens issued before the
+// keyrings have none and are checked against the legacy key, if it is still in the ring.
+func jwtKeyFunc(keyring *security.Keyring) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		id, _ := t.Header["kid"].(string)
+		if id == "" {
+			id = security.LegacyKeyId
+		}
+		key, found := keyring.Key(id)
+		if !found {
+			return nil, fmt.Errorf("unknown key id %q", id)
+		}
+		return key.Secret, nil
+	}
+}
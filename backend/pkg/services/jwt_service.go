@@ -1,47 +1,98 @@
 package services
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"hitenok/pkg/config"
 	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
 	"hitenok/pkg/repository"
+	"io"
+	"log"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 )
 
 type JWTServiceI interface {
 	GenerateToken(user *domain.User, isAccess bool) (string, *domain.MyError)
+	GenerateTokenWithOptions(user *domain.User, isAccess bool, options domain.TokenOptions) (string, *domain.MyError)
+	GenerateTokenPair(user *domain.User, options domain.TokenOptions) (string, string, *domain.MyError)
 	ValidateToken(token string) (*domain.User, *domain.MyError)
+	ValidateTokenClaims(token, tokenType string) (*domain.User, *domain.Claims, *domain.MyError)
+	RefreshTokens(refreshToken string) (string, string, *domain.MyError)
+	EndSession(claims *domain.Claims) *domain.MyError
 }
 
 type JWTService struct {
-	appConfig *config.AppConfig
-	userRepo  repository.UserRepositoryI
+	appConfig        *config.AppConfig
+	userRepo         repository.UserRepositoryI
+	organizationRepo repository.OrganizationRepositoryI
+	sessionRepo      repository.SessionRepositoryI
+	denylistService  TokenDenylistServiceI
+	eventBus         events.EventBusI
+	// now dates the tokens and checks their expiry; random makes the token ids.
+	now    func() time.Time
+	random io.Reader
 }
 
-func NewJWTService(appConfig *config.AppConfig, userRepo repository.UserRepositoryI) JWTServiceI {
+func NewJWTService(appConfig *config.AppConfig, userRepo repository.UserRepositoryI, organizationRepo repository.OrganizationRepositoryI, sessionRepo repository.SessionRepositoryI, denylistService TokenDenylistServiceI, eventBus events.EventBusI) JWTServiceI {
 	return &JWTService{
-		appConfig: appConfig,
-		userRepo:  userRepo,
+		appConfig:        appConfig,
+		userRepo:         userRepo,
+		organizationRepo: organizationRepo,
+		sessionRepo:      sessionRepo,
+		denylistService:  denylistService,
+		eventBus:         eventBus,
+		now:              time.Now,
+		random:           rand.Reader,
 	}
 }
 
 func (jwtService *JWTService) GenerateToken(user *domain.User, isAccess bool) (string, *domain.MyError) {
-	expireTime := time.Now().Add(1 * time.Hour)
+	return jwtService.GenerateTokenWithOptions(user, isAccess, domain.TokenOptions{})
+}
+
+// GenerateTokenWithOptions issues a single token. Without options.SessionId it starts a
+// session of its own; GenerateTokenPair issues tokens that share one.
+func (jwtService *JWTService) GenerateTokenWithOptions(user *domain.User, isAccess bool, options domain.TokenOptions) (string, *domain.MyError) {
+	jti, err := jwtService.randomId()
+	if err != nil {
+		return "", domain.NewError(err, "JWTService.GenerateToken")
+	}
+	if options.SessionId == "" {
+		options.SessionId, err = jwtService.randomId()
+		if err != nil {
+			return "", domain.NewError(err, "JWTService.GenerateToken")
+		}
+	}
+	now := jwtService.now()
+	expireTime := now.Add(jwtService.appConfig.Jwt.AccessTtl)
+	tokenType := domain.AccessTokenType
 	if !isAccess {
-		expireTime = time.Now().AddDate(0, 1, 0)
+		expireTime = now.Add(jwtService.appConfig.Jwt.RefreshTtl)
+		tokenType = domain.RefreshTokenType
 	}
 	claims := domain.Claims{
-		UserId:  user.ID,
-		Version: user.JWTVersion,
+		UserId:    user.ID,
+		Version:   user.JWTVersion,
+		TokenType: tokenType,
+		ClientId:  options.ClientId,
+		Scope:     options.Scope,
+		OrgId:     options.OrgId,
+		SessionId: options.SessionId,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   strconv.FormatUint(uint64(user.ID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
 			ExpiresAt: jwt.NewNumericDate(expireTime),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	tokenString, err := token.SignedString([]byte(jwtService.appConfig.SecretKey))
+	tokenString, err := signJWT(jwtService.appConfig.Keys.Jwt, claims)
 	if err != nil {
 		return "", domain.NewError(err, "JWTService.GenerateToken")
 	}
@@ -49,22 +100,188 @@ func (jwtService *JWTService) GenerateToken(user *domain.User, isAccess bool) (s
 	return tokenString, nil
 }
 
-func (jwtService *JWTService) ValidateToken(token string) (*domain.User, *domain.MyError) {
-	tokenClaims := &domain.Claims{}
-	_, err := jwt.ParseWithClaims(token, tokenClaims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(jwtService.appConfig.SecretKey), nil
+// GenerateTokenPair issues an access and a refresh token of the same session, a new one
+// unless options.SessionId continues one, and records the session as lasting as long as
+// the refresh token.
+func (jwtService *JWTService) GenerateTokenPair(user *domain.User, options domain.TokenOptions) (string, string, *domain.MyError) {
+	if options.SessionId == "" {
+		sessionId, err := jwtService.randomId()
+		if err != nil {
+			return "", "", domain.NewError(err, "JWTService.GenerateTokenPair")
+		}
+		options.SessionId = sessionId
+	}
+	accessToken, err := jwtService.GenerateTokenWithOptions(user, true, options)
+	if err != nil {
+		err.Module = "JWTService.GenerateTokenPair." + err.Module
+		return "", "", err
+	}
+	refreshToken, err := jwtService.GenerateTokenWithOptions(user, false, options)
+	if err != nil {
+		err.Module = "JWTService.GenerateTokenPair." + err.Module
+		return "", "", err
+	}
+	now := jwtService.now()
+	err = jwtService.sessionRepo.SaveSession(&domain.Session{
+		Id:          options.SessionId,
+		UserId:      user.ID,
+		ClientId:    options.ClientId,
+		JWTVersion:  user.JWTVersion,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		ExpiresAt:   now.Add(jwtService.appConfig.Jwt.RefreshTtl),
 	})
 	if err != nil {
-		return nil, domain.NewError(err, "JWTService.ValidateToken")
+		err.Module = "JWTService.GenerateTokenPair." + err.Module
+		return "", "", err
+	}
+	return accessToken, refreshToken, nil
+}
+
+func (jwtService *JWTService) randomId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(jwtService.random, id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// ValidateToken is ValidateTokenClaims for callers that need a fully privileged access
+// token, so the restricted password-change token is refused with "password change
+// required".
+func (jwtService *JWTService) ValidateToken(token string) (*domain.User, *domain.MyError) {
+	user, claims, err := jwtService.ValidateTokenClaims(token, domain.AccessTokenType)
+	if err != nil {
+		return user, err
+	}
+	if claims.Scope == domain.PasswordChangeScope {
+		return nil, domain.NewError(fmt.Errorf("password change required"), "JWTService.ValidateToken")
+	}
+	return user, nil
+}
+
+// ValidateTokenClaims checks the token and that it is of tokenType, so that a refresh
+// token is not taken as an access token nor the other way round; AnyTokenType takes
+// both. The active organization is dropped from the claims once the user is no longer
+// a member of it, so neither a refresh nor an introspection carries it on.
+func (jwtService *JWTService) ValidateTokenClaims(token, tokenType string) (*domain.User, *domain.Claims, *domain.MyError) {
+	tokenClaims, err := jwtService.parseClaims(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tokenType != domain.AnyTokenType && tokenClaims.TokenType != tokenType {
+		return nil, nil, domain.NewError(fmt.Errorf("wrong token type"), "JWTService.ValidateToken")
+	}
+	if jwtService.denylistService.IsRevoked(tokenClaims.ID) || jwtService.denylistService.IsRevoked(tokenClaims.SessionId) {
+		return nil, nil, domain.NewError(fmt.Errorf("token revoked"), "JWTService.ValidateToken")
 	}
 	user, customErr := jwtService.userRepo.FindUserById(tokenClaims.UserId)
 	if customErr != nil {
 		customErr.Module = "JWTService.ValidateToken" + customErr.Module
-		return nil, customErr
+		return nil, nil, customErr
 	}
 	if user.JWTVersion != tokenClaims.Version {
-		return nil, domain.NewError(fmt.Errorf("invalid token"), "JWTService.ValidateToken")
+		return nil, nil, domain.NewError(fmt.Errorf("invalid token"), "JWTService.ValidateToken")
 	}
-	return user, nil
+	if tokenClaims.OrgId != 0 {
+		_, customErr = jwtService.organizationRepo.FindMembership(tokenClaims.OrgId, user.ID)
+		if customErr != nil && !errors.Is(customErr.ErrorBase, gorm.ErrRecordNotFound) {
+			customErr.Module = "JWTService.ValidateToken." + customErr.Module
+			return nil, nil, customErr
+		}
+		if customErr != nil {
+			tokenClaims.OrgId = 0
+		}
+	}
+	return user, tokenClaims, nil
+}
+
+// parseClaims checks the signature and the expiry of the token, and nothing else.
+func (jwtService *JWTService) parseClaims(token string) (*domain.Claims, *domain.MyError) {
+	tokenClaims := &domain.Claims{}
+	_, err := jwt.ParseWithClaims(token, tokenClaims, jwtKeyFunc(jwtService.appConfig.Keys.Jwt),
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithTimeFunc(jwtService.now))
+	if err != nil {
+		return nil, domain.NewError(err, "JWTService.ValidateToken")
+	}
+	return tokenClaims, nil
+}
 
+// RefreshTokens trades a valid refresh token for a new access and refresh pair that
+// keeps acting for the same client and, while the user is still a member,
+// organization. Each refresh token can be used once: it is claimed in the denylist
+// before the pair is issued, so of two concurrent refreshes only one wins, on any
+// replica. A refresh token presented again means it leaked, so the whole session is
+// ended, cutting off whoever holds the pair it was already traded for. Restricted
+// password-change tokens cannot be refreshed.
+func (jwtService *JWTService) RefreshTokens(refreshToken string) (string, string, *domain.MyError) {
+	user, claims, err := jwtService.ValidateTokenClaims(refreshToken, domain.RefreshTokenType)
+	if err != nil && err.ErrorBase.Error() == "token revoked" {
+		jwtService.endReusedSession(refreshToken)
+	}
+	if err != nil {
+		err.Module = "JWTService.RefreshTokens." + err.Module
+		return "", "", err
+	}
+	if claims.Scope == domain.PasswordChangeScope {
+		return "", "", domain.NewError(fmt.Errorf("password change required"), "JWTService.RefreshTokens")
+	}
+	claimed, err := jwtService.denylistService.Claim(claims)
+	if err != nil {
+		err.Module = "JWTService.RefreshTokens." + err.Module
+		return "", "", err
+	}
+	if !claimed {
+		jwtService.endReusedSession(refreshToken)
+		return "", "", domain.NewError(fmt.Errorf("token revoked"), "JWTService.RefreshTokens")
+	}
+	options := domain.TokenOptions{
+		ClientId:  claims.ClientId,
+		Scope:     claims.Scope,
+		OrgId:     claims.OrgId,
+		SessionId: claims.SessionId,
+	}
+	accessToken, newRefreshToken, err := jwtService.GenerateTokenPair(user, options)
+	if err != nil {
+		err.Module = "JWTService.RefreshTokens." + err.Module
+		return "", "", err
+	}
+	jwtService.eventBus.Publish(events.TokenRefreshed{UserId: user.ID, ClientId: claims.ClientId, OrgId: claims.OrgId})
+	return accessToken, newRefreshToken, nil
+}
+
+// endReusedSession ends the session of a refresh token that was used before. The
+// refresh fails either way, so a failure here is only logged.
+func (jwtService *JWTService) endReusedSession(refreshToken string) {
+	claims, err := jwtService.parseClaims(refreshToken)
+	if err != nil || claims.TokenType != domain.RefreshTokenType || claims.SessionId == "" ||
+		jwtService.denylistService.IsRevoked(claims.SessionId) {
+		return
+	}
+	log.Printf("JWTService.RefreshTokens: refresh token %s of user %d reused, ending session %s", claims.ID, claims.UserId, claims.SessionId)
+	if err := jwtService.EndSession(claims); err != nil {
+		log.Printf("JWTService.RefreshTokens.%s: %v", err.Module, err.ErrorBase)
+	}
+}
+
+// EndSession revokes the token and every other token of its session. Refreshing stops
+// with the revocation, so the session is revoked for as long as a token issued now
+// would live.
+func (jwtService *JWTService) EndSession(claims *domain.Claims) *domain.MyError {
+	err := jwtService.denylistService.Revoke(claims)
+	if err != nil {
+		err.Module = "JWTService.EndSession." + err.Module
+		return err
+	}
+	err = jwtService.denylistService.RevokeSession(claims.SessionId, jwtService.now().Add(jwtService.appConfig.Jwt.RefreshTtl))
+	if err != nil {
+		err.Module = "JWTService.EndSession." + err.Module
+		return err
+	}
+	err = jwtService.sessionRepo.DeleteSession(claims.SessionId)
+	if err != nil {
+		err.Module = "JWTService.EndSession." + err.Module
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,396 @@
+package services
+
+import (
+	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
+	"hitenok/pkg/repository"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type jwtFixture struct {
+	service       *JWTService
+	repo          repository.UserRepositoryI
+	organizations *fakeOrganizationRepository
+	sessions      *fakeSessionRepository
+	denylist      *fakeDenylistService
+	clock         *testClock
+	events        *[]events.Event
+	user          *domain.User
+}
+
+func newJWTFixture(t *testing.T) *jwtFixture {
+	t.Helper()
+	clock := newTestClock()
+	repo := repository.NewMemoryUserRepository(clock.Now)
+	organizations := &fakeOrganizationRepository{memberships: map[[2]uint]bool{}}
+	sessions := &fakeSessionRepository{sessions: map[string]domain.Session{}}
+	denylist := &fakeDenylistService{revoked: map[string]bool{}, stored: map[string]bool{}}
+	bus := events.NewEventBus()
+	recorded := recordEvents(bus, "auth.token_refreshed")
+	service := NewJWTService(testConfig(t), repo, organizations, sessions, denylist, bus).(*JWTService)
+	service.now = clock.Now
+	service.random = &countingReader{}
+	user := &domain.User{Email: "user@example.com", IsActive: true}
+	repo.SaveUser(user)
+	return &jwtFixture{
+		service:       service,
+		repo:          repo,
+		organizations: organizations,
+		sessions:      sessions,
+		denylist:      denylist,
+		clock:         clock,
+		events:        recorded,
+		user:          user,
+	}
+}
+
+func TestJWTServiceGenerateToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		isAccess  bool
+		wantType  string
+		wantTtl   time.Duration
+		wantJwtId string
+	}{
+		{name: "access", isAccess: true, wantType: domain.AccessTokenType, wantTtl: time.Hour, wantJwtId: "000102030405060708090a0b0c0d0e0f"},
+		{name: "refresh", isAccess: false, wantType: domain.RefreshTokenType, wantTtl: 24 * time.Hour, wantJwtId: "000102030405060708090a0b0c0d0e0f"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := newJWTFixture(t)
+			token, err := fixture.service.GenerateToken(fixture.user, test.isAccess)
+			if err != nil {
+				t.Fatalf("GenerateToken: %v", err.ErrorBase)
+			}
+			_, claims, err := fixture.service.ValidateTokenClaims(token, test.wantType)
+			if err != nil {
+				t.Fatalf("ValidateTokenClaims: %v", err.ErrorBase)
+			}
+			if claims.TokenType != test.wantType || claims.UserId != fixture.user.ID || claims.Subject != strconv.Itoa(int(fixture.user.ID)) {
+				t.Errorf("claims type %q user %d subject %q, want %q for user %d", claims.TokenType, claims.UserId, claims.Subject, test.wantType, fixture.user.ID)
+			}
+			if !claims.IssuedAt.Time.Equal(testEpoch) || !claims.ExpiresAt.Time.Equal(testEpoch.Add(test.wantTtl)) {
+				t.Errorf("issued %v expires %v, want the epoch and %v later", claims.IssuedAt.Time, claims.ExpiresAt.Time, test.wantTtl)
+			}
+			if claims.ID != test.wantJwtId {
+				t.Errorf("jti = %q, want %q", claims.ID, test.wantJwtId)
+			}
+		})
+	}
+}
+
+func TestJWTServiceValidateToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   func(t *testing.T, fixture *jwtFixture) string
+		wantErr string
+	}{
+		{name: "valid", token: func(t *testing.T, fixture *jwtFixture) string {
+			return mustToken(t, fixture, true)
+		}},
+		{name: "access token at its expiry", wantErr: "token is expired", token: func(t *testing.T, fixture *jwtFixture) string {
+			token := mustToken(t, fixture, true)
+			fixture.clock.Advance(time.Hour)
+			return token
+		}},
+		{name: "refresh token", wantErr: "wrong token type", token: func(t *testing.T, fixture *jwtFixture) string {
+			return mustToken(t, fixture, false)
+		}},
+		{name: "refresh token expired", wantErr: "token is expired", token: func(t *testing.T, fixture *jwtFixture) string {
+			token := mustToken(t, fixture, false)
+			fixture.clock.Advance(25 * time.Hour)
+			return token
+		}},
+		{name: "revoked", wantErr: "token revoked", token: func(t *testing.T, fixture *jwtFixture) string {
+			token := mustToken(t, fixture, true)
+			fixture.denylist.revoked["000102030405060708090a0b0c0d0e0f"] = true
+			return token
+		}},
+		{name: "sessions ended", wantErr: "invalid token", token: func(t *testing.T, fixture *jwtFixture) string {
+			token := mustToken(t, fixture, true)
+			fixture.user.JWTVersion += 1
+			fixture.repo.SaveUser(fixture.user)
+			return token
+		}},
+		{name: "user deleted", wantErr: "record not found", token: func(t *testing.T, fixture *jwtFixture) string {
+			token := mustToken(t, fixture, true)
+			fixture.repo.SoftDeleteUser(fixture.user)
+			return token
+		}},
+		{name: "tampered", wantErr: "signature is invalid", token: func(t *testing.T, fixture *jwtFixture) string {
+			token := mustToken(t, fixture, true)
+			return token[:len(token)-2] + "xx"
+		}},
+		{name: "unknown key", wantErr: `unknown key id "jwt-9"`, token: func(t *testing.T, fixture *jwtFixture) string {
+			token, _ := signJWT(testKeyring(t, "jwt-9:other-secret"), testClaims(fixture))
+			return token
+		}},
+		{name: "signed before a rotation", token: func(t *testing.T, fixture *jwtFixture) string {
+			token := mustToken(t, fixture, true)
+			fixture.service.appConfig.Keys.Jwt = testKeyring(t, "jwt-2:rotated-secret", "jwt-1:jwt-secret")
+			return token
+		}},
+		{name: "legacy token without kid", token: func(t *testing.T, fixture *jwtFixture) string {
+			fixture.service.appConfig.Keys.Jwt = testKeyring(t, "jwt-1:jwt-secret", "legacy:legacy-secret")
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims(fixture)).SignedString([]byte("legacy-secret"))
+			return token
+		}},
+		{name: "legacy token after the legacy key is dropped", wantErr: `unknown key id "legacy"`, token: func(t *testing.T, fixture *jwtFixture) string {
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims(fixture)).SignedString([]byte("legacy-secret"))
+			return token
+		}},
+		{name: "unsigned", wantErr: "signing method none is invalid", token: func(t *testing.T, fixture *jwtFixture) string {
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodNone, testClaims(fixture)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return token
+		}},
+		{name: "password change token", wantErr: "password change required", token: func(t *testing.T, fixture *jwtFixture) string {
+			token, _ := fixture.service.GenerateTokenWithOptions(fixture.user, true, domain.TokenOptions{Scope: domain.PasswordChangeScope})
+			return token
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := newJWTFixture(t)
+			token := test.token(t, fixture)
+
+			user, err := fixture.service.ValidateToken(token)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ValidateToken: %v", err.ErrorBase)
+				}
+				if user.ID != fixture.user.ID {
+					t.Errorf("user = %d, want %d", user.ID, fixture.user.ID)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.ErrorBase.Error(), test.wantErr) {
+				t.Fatalf("ValidateToken error = %q, want it to contain %q", errorText(err), test.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTServiceRefreshTokens(t *testing.T) {
+	fixture := newJWTFixture(t)
+	fixture.organizations.memberships[[2]uint{fixture.user.ID, 7}] = true
+	options := domain.TokenOptions{ClientId: "cli", Scope: "read", OrgId: 7}
+	refreshToken, err := fixture.service.GenerateTokenWithOptions(fixture.user, false, options)
+	if err != nil {
+		t.Fatalf("GenerateTokenWithOptions: %v", err.ErrorBase)
+	}
+	_, refreshedClaims, _ := fixture.service.ValidateTokenClaims(refreshToken, domain.RefreshTokenType)
+	fixture.clock.Advance(time.Minute)
+
+	accessToken, newRefreshToken, err := fixture.service.RefreshTokens(refreshToken)
+	if err != nil {
+		t.Fatalf("RefreshTokens: %v", err.ErrorBase)
+	}
+	if newRefreshToken == refreshToken {
+		t.Errorf("refresh token was not renewed")
+	}
+	_, claims, err := fixture.service.ValidateTokenClaims(accessToken, domain.AccessTokenType)
+	if err != nil {
+		t.Fatalf("ValidateTokenClaims: %v", err.ErrorBase)
+	}
+	if claims.ClientId != "cli" || claims.Scope != "read" || claims.OrgId != 7 {
+		t.Errorf("claims client %q scope %q org %d, want the options of the refreshed token", claims.ClientId, claims.Scope, claims.OrgId)
+	}
+	if claims.SessionId == "" || claims.SessionId != refreshedClaims.SessionId {
+		t.Errorf("session %q, want the session %q of the refreshed token", claims.SessionId, refreshedClaims.SessionId)
+	}
+	if !claims.IssuedAt.Time.Equal(testEpoch.Add(time.Minute)) {
+		t.Errorf("issued at %v, want a minute after the epoch", claims.IssuedAt.Time)
+	}
+	if len(*fixture.events) != 1 {
+		t.Fatalf("events = %d, want one auth.token_refreshed", len(*fixture.events))
+	}
+	if refreshed := (*fixture.events)[0].(events.TokenRefreshed); refreshed.UserId != fixture.user.ID || refreshed.ClientId != "cli" {
+		t.Errorf("event = %+v, want the user and client", refreshed)
+	}
+
+	if !fixture.denylist.revoked["000102030405060708090a0b0c0d0e0f"] {
+		t.Errorf("the refresh token traded in was not revoked")
+	}
+	if _, _, err := fixture.service.RefreshTokens(refreshToken); errorText(err) != "token revoked" {
+		t.Errorf("refreshing with a used refresh token error = %q, want token revoked", errorText(err))
+	}
+	if _, _, err := fixture.service.RefreshTokens(accessToken); errorText(err) != "wrong token type" {
+		t.Errorf("refreshing with an access token error = %q, want wrong token type", errorText(err))
+	}
+
+	passwordChangeToken, _ := fixture.service.GenerateTokenWithOptions(fixture.user, false, domain.TokenOptions{Scope: domain.PasswordChangeScope})
+	if _, _, err := fixture.service.RefreshTokens(passwordChangeToken); errorText(err) != "password change required" {
+		t.Errorf("refreshing a password change token error = %q, want password change required", errorText(err))
+	}
+}
+
+// TestJWTServiceRefreshTokenReuse uses a refresh token twice, on this replica and on one
+// that has not synced the denylist yet; either way the second use fails and ends the
+// session, so the pair from the first use stops working too.
+func TestJWTServiceRefreshTokenReuse(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		synced bool
+	}{
+		{name: "same replica", synced: true},
+		{name: "replica not synced", synced: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := newJWTFixture(t)
+			_, refreshToken, err := fixture.service.GenerateTokenPair(fixture.user, domain.TokenOptions{})
+			if err != nil {
+				t.Fatalf("GenerateTokenPair: %v", err.ErrorBase)
+			}
+			_, claims, _ := fixture.service.ValidateTokenClaims(refreshToken, domain.RefreshTokenType)
+			accessToken, newRefreshToken, err := fixture.service.RefreshTokens(refreshToken)
+			if err != nil {
+				t.Fatalf("first RefreshTokens: %v", err.ErrorBase)
+			}
+			if !test.synced {
+				delete(fixture.denylist.revoked, claims.ID)
+			}
+
+			if _, _, err := fixture.service.RefreshTokens(refreshToken); errorText(err) != "token revoked" {
+				t.Fatalf("second RefreshTokens error = %q, want token revoked", errorText(err))
+			}
+			if !fixture.denylist.stored[claims.SessionId] {
+				t.Errorf("session %s was not revoked on reuse", claims.SessionId)
+			}
+			if _, err := fixture.service.ValidateToken(accessToken); errorText(err) != "token revoked" {
+				t.Errorf("access token of the first refresh error = %q, want token revoked", errorText(err))
+			}
+			if _, _, err := fixture.service.RefreshTokens(newRefreshToken); errorText(err) != "token revoked" {
+				t.Errorf("refresh token of the first refresh error = %q, want token revoked", errorText(err))
+			}
+		})
+	}
+}
+
+func TestJWTServiceDropsAnOrganizationLeft(t *testing.T) {
+	fixture := newJWTFixture(t)
+	fixture.organizations.memberships[[2]uint{fixture.user.ID, 7}] = true
+	accessToken, refreshToken, err := fixture.service.GenerateTokenPair(fixture.user, domain.TokenOptions{OrgId: 7})
+	if err != nil {
+		t.Fatalf("GenerateTokenPair: %v", err.ErrorBase)
+	}
+	delete(fixture.organizations.memberships, [2]uint{fixture.user.ID, 7})
+
+	_, claims, err := fixture.service.ValidateTokenClaims(accessToken, domain.AccessTokenType)
+	if err != nil {
+		t.Fatalf("ValidateTokenClaims: %v", err.ErrorBase)
+	}
+	if claims.OrgId != 0 {
+		t.Errorf("access token of an organization left acts in organization %d, want none", claims.OrgId)
+	}
+	refreshedAccessToken, _, err := fixture.service.RefreshTokens(refreshToken)
+	if err != nil {
+		t.Fatalf("RefreshTokens: %v", err.ErrorBase)
+	}
+	fixture.organizations.memberships[[2]uint{fixture.user.ID, 7}] = true
+	if _, claims, _ = fixture.service.ValidateTokenClaims(refreshedAccessToken, domain.AccessTokenType); claims.OrgId != 0 {
+		t.Errorf("refreshed token acts in organization %d, want the one left dropped", claims.OrgId)
+	}
+}
+
+func TestJWTServiceRecordsSessions(t *testing.T) {
+	fixture := newJWTFixture(t)
+	_, refreshToken, err := fixture.service.GenerateTokenPair(fixture.user, domain.TokenOptions{ClientId: "cli"})
+	if err != nil {
+		t.Fatalf("GenerateTokenPair: %v", err.ErrorBase)
+	}
+	_, claims, _ := fixture.service.ValidateTokenClaims(refreshToken, domain.RefreshTokenType)
+	fixture.clock.Advance(time.Minute)
+	accessToken, _, err := fixture.service.RefreshTokens(refreshToken)
+	if err != nil {
+		t.Fatalf("RefreshTokens: %v", err.ErrorBase)
+	}
+
+	session, found := fixture.sessions.sessions[claims.SessionId]
+	if !found || len(fixture.sessions.sessions) != 1 {
+		t.Fatalf("sessions %+v, want the one of the pair", fixture.sessions.sessions)
+	}
+	if session.UserId != fixture.user.ID || session.ClientId != "cli" || !session.CreatedAt.Equal(testEpoch) {
+		t.Errorf("session %+v, want the user and client, started at the epoch", session)
+	}
+	if !session.RefreshedAt.Equal(testEpoch.Add(time.Minute)) || !session.ExpiresAt.Equal(testEpoch.Add(time.Minute+24*time.Hour)) {
+		t.Errorf("refreshed %v expires %v, want the refresh to renew the session", session.RefreshedAt, session.ExpiresAt)
+	}
+
+	_, claims, _ = fixture.service.ValidateTokenClaims(accessToken, domain.AccessTokenType)
+	if err := fixture.service.EndSession(claims); err != nil {
+		t.Fatalf("EndSession: %v", err.ErrorBase)
+	}
+	if len(fixture.sessions.sessions) != 0 {
+		t.Errorf("sessions %+v after the logout, want none", fixture.sessions.sessions)
+	}
+}
+
+func TestJWTServiceRefreshTokenOutlivesAccessToken(t *testing.T) {
+	fixture := newJWTFixture(t)
+	accessToken := mustToken(t, fixture, true)
+	refreshToken := mustToken(t, fixture, false)
+	fixture.clock.Advance(2 * time.Hour)
+
+	if _, err := fixture.service.ValidateToken(accessToken); !strings.Contains(errorText(err), "token is expired") {
+		t.Errorf("access token after two hours error = %q, want it expired", errorText(err))
+	}
+	if _, _, err := fixture.service.ValidateTokenClaims(refreshToken, domain.RefreshTokenType); err != nil {
+		t.Errorf("refresh token after two hours: %v", err.ErrorBase)
+	}
+}
+
+func TestJWTServiceEndSession(t *testing.T) {
+	fixture := newJWTFixture(t)
+	accessToken, refreshToken, err := fixture.service.GenerateTokenPair(fixture.user, domain.TokenOptions{})
+	if err != nil {
+		t.Fatalf("GenerateTokenPair: %v", err.ErrorBase)
+	}
+	otherAccessToken, _, _ := fixture.service.GenerateTokenPair(fixture.user, domain.TokenOptions{})
+	_, claims, err := fixture.service.ValidateTokenClaims(accessToken, domain.AccessTokenType)
+	if err != nil {
+		t.Fatalf("ValidateTokenClaims: %v", err.ErrorBase)
+	}
+	_, refreshClaims, _ := fixture.service.ValidateTokenClaims(refreshToken, domain.RefreshTokenType)
+	if claims.SessionId == "" || claims.SessionId != refreshClaims.SessionId {
+		t.Fatalf("sessions %q and %q, want the pair to share one", claims.SessionId, refreshClaims.SessionId)
+	}
+
+	if err := fixture.service.EndSession(claims); err != nil {
+		t.Fatalf("EndSession: %v", err.ErrorBase)
+	}
+	if _, err := fixture.service.ValidateToken(accessToken); errorText(err) != "token revoked" {
+		t.Errorf("access token error = %q, want token revoked", errorText(err))
+	}
+	if _, _, err := fixture.service.RefreshTokens(refreshToken); errorText(err) != "token revoked" {
+		t.Errorf("refresh token error = %q, want token revoked", errorText(err))
+	}
+	if _, err := fixture.service.ValidateToken(otherAccessToken); err != nil {
+		t.Errorf("the token of another session: %v", err.ErrorBase)
+	}
+}
+
+func mustToken(t *testing.T, fixture *jwtFixture, isAccess bool) string {
+	t.Helper()
+	token, err := fixture.service.GenerateToken(fixture.user, isAccess)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err.ErrorBase)
+	}
+	return token
+}
+
+func testClaims(fixture *jwtFixture) domain.Claims {
+	return domain.Claims{
+		UserId:    fixture.user.ID,
+		TokenType: domain.AccessTokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "legacy-jti",
+			IssuedAt:  jwt.NewNumericDate(testEpoch),
+			ExpiresAt: jwt.NewNumericDate(testEpoch.Add(time.Hour)),
+		},
+	}
+}
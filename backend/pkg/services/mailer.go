@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"hitenok/pkg/config"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+type MailerI interface {
+	Send(to, subject, body string) error
+	// Ping checks that the relay is reachable and greets, without authenticating.
+	Ping(ctx context.Context) error
+}
+
+type smtpMailer struct {
+	appConfig *config.AppConfig
+}
+
+func NewSMTPMailer(appConfig *config.AppConfig) MailerI {
+	return &smtpMailer{
+		appConfig: appConfig,
+	}
+}
+
+func (smtpMailer *smtpMailer) Send(to, subject, body string) error {
+	from := smtpMailer.appConfig.Smtp.From
+	user := smtpMailer.appConfig.Smtp.User
+	password := smtpMailer.appConfig.Smtp.Password
+
+	smtpHost := smtpMailer.appConfig.Smtp.Host
+	smtpPort := smtpMailer.appConfig.Smtp.Port
+
+	message, err := buildMessage(from, to, subject, body)
+	if err != nil {
+		return err
+	}
+	conn, err := tls.Dial("tcp", smtpHost+":"+smtpPort, &tls.Config{
+		InsecureSkipVerify: smtpMailer.appConfig.Smtp.InsecureSkipVerify,
+		ServerName:         smtpHost,
+	})
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, smtpHost)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	auth := smtp.PlainAuth("", user, password, smtpHost)
+	if err = c.Auth(auth); err != nil {
+		return err
+	}
+
+	if err = c.Mail(from); err != nil {
+		return err
+	}
+
+	if err = c.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(message)
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMessage lays out a plain text mail. A line break in a header value would let it
+// add headers of its own, or recipients, so one is refused; the subject is encoded, as
+// headers are ASCII only.
+func buildMessage(from, to, subject, body string) ([]byte, error) {
+	for _, header := range []struct{ name, value string }{{"From", from}, {"To", to}, {"Subject", subject}} {
+		if strings.ContainsAny(header.value, "\r\n") {
+			return nil, fmt.Errorf("mail %s header contains a line break", header.name)
+		}
+	}
+	return []byte(strings.Join([]string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")), nil
+}
+
+func (smtpMailer *smtpMailer) Ping(ctx context.Context) error {
+	smtpHost := smtpMailer.appConfig.Smtp.Host
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{},
+		Config: &tls.Config{
+			InsecureSkipVerify: smtpMailer.appConfig.Smtp.InsecureSkipVerify,
+			ServerName:         smtpHost,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", smtpHost+":"+smtpMailer.appConfig.Smtp.Port)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, smtpHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	return c.Quit()
+}
@@ -0,0 +1,32 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildMessage(t *testing.T) {
+	message, err := buildMessage("noreply@example.com", "user@example.com", "Ваш код", "body")
+	if err != nil {
+		t.Fatalf("buildMessage: %v", err)
+	}
+	if !strings.Contains(string(message), "\r\nSubject: =?utf-8?q?") {
+		t.Errorf("message %q, want the subject Q-encoded", message)
+	}
+
+	tests := []struct {
+		name    string
+		to      string
+		subject string
+	}{
+		{name: "line break in the recipient", to: "user@example.com\r\nBcc: victim@example.com", subject: "Code"},
+		{name: "line feed in the subject", to: "user@example.com", subject: "Code\nBcc: victim@example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := buildMessage("noreply@example.com", test.to, test.subject, "body"); err == nil {
+				t.Errorf("buildMessage accepted a header with a line break")
+			}
+		})
+	}
+}
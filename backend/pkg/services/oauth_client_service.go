@@ -0,0 +1,33 @@
+package services
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+)
+
+type OAuthClientServiceI interface {
+	AuthenticateClient(clientId, clientSecret string) *domain.MyError
+}
+
+type oauthClientService struct {
+	appConfig *config.AppConfig
+}
+
+func NewOAuthClientService(appConfig *config.AppConfig) OAuthClientServiceI {
+	return &oauthClientService{
+		appConfig: appConfig,
+	}
+}
+
+func (clientService *oauthClientService) AuthenticateClient(clientId, clientSecret string) *domain.MyError {
+	expectedSecret, ok := clientService.appConfig.OAuthClients[clientId]
+	if !ok || clientSecret == "" {
+		return domain.NewError(fmt.Errorf("invalid_client"), "oauthClientService.AuthenticateClient")
+	}
+	if subtle.ConstantTimeCompare([]byte(expectedSecret), []byte(clientSecret)) != 1 {
+		return domain.NewError(fmt.Errorf("invalid_client"), "oauthClientService.AuthenticateClient")
+	}
+	return nil
+}
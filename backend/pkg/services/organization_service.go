@@ -0,0 +1,171 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const maxOrganizationNameLength = 100
+
+type OrganizationServiceI interface {
+	CreateOrganization(user *domain.User, name string) (*domain.Membership, *domain.MyError)
+	ListMemberships(user *domain.User) ([]domain.Membership, *domain.MyError)
+	GetMembership(organizationId, userId uint) (*domain.Membership, *domain.MyError)
+	ListMembers(organizationId uint) ([]domain.Membership, *domain.MyError)
+	AddMember(actor *domain.Membership, email, role string) (*domain.Membership, *domain.MyError)
+	ChangeRole(actor *domain.Membership, userId uint, role string) (*domain.Membership, *domain.MyError)
+	RemoveMember(actor *domain.Membership, userId uint) *domain.MyError
+}
+
+type organizationService struct {
+	organizationRepo repository.OrganizationRepositoryI
+	userRepo         repository.UserRepositoryI
+}
+
+func NewOrganizationService(organizationRepo repository.OrganizationRepositoryI, userRepo repository.UserRepositoryI) OrganizationServiceI {
+	return &organizationService{
+		organizationRepo: organizationRepo,
+		userRepo:         userRepo,
+	}
+}
+
+// CreateOrganization creates an organization owned by user.
+func (organizationService *organizationService) CreateOrganization(user *domain.User, name string) (*domain.Membership, *domain.MyError) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return &domain.Membership{}, domain.NewError(domain.NewValidationError(domain.FieldViolation{
+			Field: "name", Code: "required", Message: "must not be empty",
+		}), "organizationService.CreateOrganization")
+	}
+	if utf8.RuneCountInString(name) > maxOrganizationNameLength {
+		return &domain.Membership{}, domain.NewError(domain.NewValidationError(domain.FieldViolation{
+			Field: "name", Code: "too_long", Message: fmt.Sprintf("must be at most %d characters", maxOrganizationNameLength),
+		}), "organizationService.CreateOrganization")
+	}
+	membership, err := organizationService.organizationRepo.CreateOrganization(&domain.Organization{Name: name}, user)
+	if err != nil {
+		err.Module = "organizationService.CreateOrganization." + err.Module
+		return membership, err
+	}
+	return membership, nil
+}
+
+func (organizationService *organizationService) ListMemberships(user *domain.User) ([]domain.Membership, *domain.MyError) {
+	memberships, err := organizationService.organizationRepo.FindMembershipsByUser(user.ID)
+	if err != nil {
+		err.Module = "organizationService.ListMemberships." + err.Module
+		return memberships, err
+	}
+	return memberships, nil
+}
+
+func (organizationService *organizationService) GetMembership(organizationId, userId uint) (*domain.Membership, *domain.MyError) {
+	membership, err := organizationService.organizationRepo.FindMembership(organizationId, userId)
+	if err != nil {
+		err.Module = "organizationService.GetMembership." + err.Module
+		return membership, err
+	}
+	return membership, nil
+}
+
+func (organizationService *organizationService) ListMembers(organizationId uint) ([]domain.Membership, *domain.MyError) {
+	memberships, err := organizationService.organizationRepo.FindMembershipsByOrganization(organizationId)
+	if err != nil {
+		err.Module = "organizationService.ListMembers." + err.Module
+		return memberships, err
+	}
+	return memberships, nil
+}
+
+// AddMember adds an existing account to the actor's organization. Nobody can hand out a
+// role above their own.
+func (organizationService *organizationService) AddMember(actor *domain.Membership, email, role string) (*domain.Membership, *domain.MyError) {
+	if domain.OrgRoleRank(role) == 0 {
+		return &domain.Membership{}, domain.NewError(fmt.Errorf("invalid role"), "organizationService.AddMember")
+	}
+	if domain.OrgRoleRank(role) > domain.OrgRoleRank(actor.Role) {
+		return &domain.Membership{}, domain.NewError(fmt.Errorf("forbidden"), "organizationService.AddMember")
+	}
+	user, err := organizationService.userRepo.FindUserByEmail(strings.TrimSpace(email))
+	if err != nil {
+		err.Module = "organizationService.AddMember." + err.Module
+		return &domain.Membership{}, err
+	}
+	_, err = organizationService.organizationRepo.FindMembership(actor.OrganizationId, user.ID)
+	if err == nil {
+		return &domain.Membership{}, domain.NewError(fmt.Errorf("already a member"), "organizationService.AddMember")
+	}
+	if !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+		err.Module = "organizationService.AddMember." + err.Module
+		return &domain.Membership{}, err
+	}
+	membership := &domain.Membership{
+		OrganizationId: actor.OrganizationId,
+		UserId:         user.ID,
+		Role:           role,
+		User:           *user,
+	}
+	err = organizationService.organizationRepo.SaveMembership(membership)
+	if err != nil {
+		err.Module = "organizationService.AddMember." + err.Module
+		return membership, err
+	}
+	return membership, nil
+}
+
+// ChangeRole sets the role of another member. The actor must rank at least as high as
+// both the member's current and new role, and the last owner cannot be demoted.
+func (organizationService *organizationService) ChangeRole(actor *domain.Membership, userId uint, role string) (*domain.Membership, *domain.MyError) {
+	if domain.OrgRoleRank(role) == 0 {
+		return &domain.Membership{}, domain.NewError(fmt.Errorf("invalid role"), "organizationService.ChangeRole")
+	}
+	membership, err := organizationService.organizationRepo.FindMembership(actor.OrganizationId, userId)
+	if err != nil {
+		err.Module = "organizationService.ChangeRole." + err.Module
+		return membership, err
+	}
+	if domain.OrgRoleRank(role) > domain.OrgRoleRank(actor.Role) || domain.OrgRoleRank(membership.Role) > domain.OrgRoleRank(actor.Role) {
+		return membership, domain.NewError(fmt.Errorf("forbidden"), "organizationService.ChangeRole")
+	}
+	if membership.Role == domain.OrgRoleOwner && role != domain.OrgRoleOwner {
+		err = organizationService.organizationRepo.DemoteOwner(membership, role)
+	} else {
+		membership.Role = role
+		err = organizationService.organizationRepo.SaveMembership(membership)
+	}
+	if err != nil {
+		err.Module = "organizationService.ChangeRole." + err.Module
+		return membership, err
+	}
+	return membership, nil
+}
+
+// RemoveMember removes a member, or lets the actor leave when userId is their own. As
+// with ChangeRole nobody removes a member ranking above them, and the last owner stays.
+func (organizationService *organizationService) RemoveMember(actor *domain.Membership, userId uint) *domain.MyError {
+	membership, err := organizationService.organizationRepo.FindMembership(actor.OrganizationId, userId)
+	if err != nil {
+		err.Module = "organizationService.RemoveMember." + err.Module
+		return err
+	}
+	if membership.UserId != actor.UserId &&
+		(domain.OrgRoleRank(actor.Role) < domain.OrgRoleRank(domain.OrgRoleAdmin) || domain.OrgRoleRank(membership.Role) > domain.OrgRoleRank(actor.Role)) {
+		return domain.NewError(fmt.Errorf("forbidden"), "organizationService.RemoveMember")
+	}
+	if membership.Role == domain.OrgRoleOwner {
+		err = organizationService.organizationRepo.DeleteOwnerMembership(membership)
+	} else {
+		err = organizationService.organizationRepo.DeleteMembership(membership)
+	}
+	if err != nil {
+		err.Module = "organizationService.RemoveMember." + err.Module
+		return err
+	}
+	return nil
+}
@@ -1,14 +1,14 @@
 package services
 
 import (
-	"crypto/tls"
+	"crypto/rand"
 	"fmt"
 	"hitenok/pkg/config"
 	"hitenok/pkg/domain"
 	"hitenok/pkg/repository"
+	"hitenok/pkg/security"
+	"io"
 	"log"
-	"math/rand"
-	"net/smtp"
 	"time"
 )
 
@@ -16,30 +16,42 @@ const (
 	OTPCharset = "0123456789"
 )
 
+// OTPServiceI issues the emailed one-time codes. Only an HMAC of the code under the OTP
+// keyring is stored, so GenerateOTP hands the code itself back for SendOTP.
 type OTPServiceI interface {
-	GenerateOTP(user *domain.User) *domain.MyError
+	GenerateOTP(user *domain.User) (string, *domain.MyError)
 	VerifyOTP(user *domain.User, otp string) (bool, *domain.MyError)
-	SendOTP(user domain.User)
+	SendOTP(user domain.User, otp string)
 	ClearOTP(user *domain.User) *domain.MyError
 }
 
 type mailOTPService struct {
 	repo      repository.UserRepositoryI
+	mailer    MailerI
 	appConfig *config.AppConfig
+	// now and random are the clock and the source of the codes, swapped out in tests.
+	now    func() time.Time
+	random io.Reader
 }
 
-func NewMailOTPService(repo repository.UserRepositoryI, appConfig *config.AppConfig) OTPServiceI {
+func NewMailOTPService(repo repository.UserRepositoryI, mailer MailerI, appConfig *config.AppConfig) OTPServiceI {
 	return &mailOTPService{
 		repo:      repo,
+		mailer:    mailer,
 		appConfig: appConfig,
+		now:       time.Now,
+		random:    rand.Reader,
 	}
 }
 
+// ClearOTP, like the other writes of the service, updates only the OTP columns, so that
+// it can run in the background without writing back a stale copy of the rest of the user.
 func (mailOTPService *mailOTPService) ClearOTP(user *domain.User) *domain.MyError {
-	user.OTP = ""
-	user.OTPAttempts = 0
-	user.OTPSpawnedAt = time.Time{}
-	err := mailOTPService.repo.SaveUser(user)
+	err := mailOTPService.repo.UpdateUserColumns(user, nil, map[string]interface{}{
+		"otp":            "",
+		"otp_attempts":   0,
+		"otp_spawned_at": time.Time{},
+	})
 	if err != nil {
 		err.Module = "mailOTPService.ClearOTP" + err.Module
 		return err
@@ -47,23 +59,30 @@ func (mailOTPService *mailOTPService) ClearOTP(user *domain.User) *domain.MyErro
 	return nil
 }
 
-func (mailOTPService *mailOTPService) GenerateOTP(user *domain.User) *domain.MyError {
-	if user.OTPSpawnedAt.Add(5 * time.Minute).After(time.Now()) {
-		return domain.NewError(fmt.Errorf("not now"), "mailOTPService.GenerateOTP")
+func (mailOTPService *mailOTPService) GenerateOTP(user *domain.User) (string, *domain.MyError) {
+	if user.OTPSpawnedAt.Add(mailOTPService.appConfig.Otp.ResendInterval).After(mailOTPService.now()) {
+		return "", domain.NewError(fmt.Errorf("not now"), "mailOTPService.GenerateOTP")
 	}
-	otp := make([]byte, 4)
-	for i := range otp {
-		otp[i] = OTPCharset[rand.Intn(len(OTPCharset))]
+	otp, randErr := security.RandomStringFrom(mailOTPService.random, OTPCharset, mailOTPService.appConfig.Otp.Length)
+	if randErr != nil {
+		return "", domain.NewError(randErr, "mailOTPService.GenerateOTP")
 	}
-	user.OTP = string(otp)
-	user.OTPSpawnedAt = time.Now()
-	user.OTPAttempts = 3
-	err := mailOTPService.repo.SaveUser(user)
+	err := mailOTPService.repo.UpdateUserColumns(user, nil, map[string]interface{}{
+		"otp":            mailOTPService.appConfig.Keys.Otp.Sign(otpMessage(user, otp)),
+		"otp_attempts":   mailOTPService.appConfig.Otp.Attempts,
+		"otp_spawned_at": mailOTPService.now(),
+	})
 	if err != nil {
 		err.Module = "mailOTPService.GenerateOTP" + err.Module
-		return err
+		return "", err
 	}
-	return nil
+	return otp, nil
+}
+
+// otpMessage binds the code to the user, so a stored value cannot be copied to another
+// account.
+func otpMessage(user *domain.User, otp string) string {
+	return fmt.Sprintf("otp:%d:%s", user.ID, otp)
 }
 
 func (mailOTPService *mailOTPService) VerifyOTP(user *domain.User, otp string) (bool, *domain.MyError) {
@@ -71,16 +90,16 @@ func (mailOTPService *mailOTPService) VerifyOTP(user *domain.User, otp string) (
 		return false, nil
 	}
 
-	if user.OTPSpawnedAt.Add(5 * time.Minute).Before(time.Now()) {
+	if user.OTPSpawnedAt.Add(mailOTPService.appConfig.Otp.Ttl).Before(mailOTPService.now()) {
 		return false, nil
 	}
 	if user.OTPAttempts <= 0 {
 		return false, nil
 	}
-	if user.OTP != otp {
-		user.OTPAttempts -= 1
-		err := mailOTPService.repo.SaveUser(user)
-		if err != nil {
+	if valid, _ := mailOTPService.appConfig.Keys.Otp.Verify(otpMessage(user, otp), user.OTP); !valid {
+		// Guesses racing each other cannot share an attempt: all but one lose the swap.
+		err := mailOTPService.repo.UpdateUserColumns(user, map[string]interface{}{"otp_attempts": user.OTPAttempts}, map[string]interface{}{"otp_attempts": user.OTPAttempts - 1})
+		if err != nil && err.ErrorBase.Error() != "user changed concurrently" {
 			err.Module = "mailOTPService.VerifyOTP" + err.Module
 			return false, err
 		}
@@ -90,66 +109,9 @@ func (mailOTPService *mailOTPService) VerifyOTP(user *domain.User, otp string) (
 	return true, nil
 }
 
-func (mailOTPService *mailOTPService) SendOTP(user domain.User) {
-	from := mailOTPService.appConfig.Email
-	password := mailOTPService.appConfig.EmailToken
-
-	to := []string{user.Email}
-	smtpHost := "smtp.mail.ru"
-	smtpPort := "465"
-
-	subject := "Subject: Благодарим за регистрацию на сайте\r\n"
-	body := "\nВаш пароль: " + user.OTP + "\n"
-	message := []byte(subject + "\r\n" + body)
-	conn, err := tls.Dial("tcp", smtpHost+":"+smtpPort, &tls.Config{
-		InsecureSkipVerify: true,
-		ServerName:         smtpHost,
-	})
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	c, err := smtp.NewClient(conn, smtpHost)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	auth := smtp.PlainAuth("", from, password, smtpHost)
-	if err = c.Auth(auth); err != nil {
-		log.Println(err)
-		return
-	}
-
-	if err = c.Mail(from); err != nil {
-		log.Println(err)
-		return
-	}
-
-	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
-			log.Println(err)
-			return
-		}
-	}
-
-	w, err := c.Data()
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	_, err = w.Write(message)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
-	err = w.Close()
+func (mailOTPService *mailOTPService) SendOTP(user domain.User, otp string) {
+	err := mailOTPService.mailer.Send(user.Email, "Благодарим за регистрацию на сайте", "Ваш пароль: "+otp)
 	if err != nil {
-		log.Println(err)
-		return
+		log.Printf("mailOTPService.SendOTP: %v", err)
 	}
-	c.Quit()
 }
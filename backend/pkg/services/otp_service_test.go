@@ -0,0 +1,188 @@
+package services
+
+import (
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestOTPService(t *testing.T) (*mailOTPService, repository.UserRepositoryI, *testClock, *fakeMailer) {
+	t.Helper()
+	clock := newTestClock()
+	repo := repository.NewMemoryUserRepository(clock.Now)
+	mailer := &fakeMailer{}
+	service := NewMailOTPService(repo, mailer, testConfig(t)).(*mailOTPService)
+	service.now = clock.Now
+	service.random = &countingReader{}
+	return service, repo, clock, mailer
+}
+
+func TestMailOTPServiceGenerateOTP(t *testing.T) {
+	service, repo, clock, _ := newTestOTPService(t)
+	user := &domain.User{Email: "user@example.com"}
+	repo.SaveUser(user)
+
+	otp, err := service.GenerateOTP(user)
+	if err != nil {
+		t.Fatalf("GenerateOTP: %v", err.ErrorBase)
+	}
+	if otp != "012345" {
+		t.Errorf("otp = %q, want 012345 from the counting reader", otp)
+	}
+	stored, _ := repo.FindUserById(user.ID)
+	if stored.OTP == otp || !strings.HasPrefix(stored.OTP, "otp-1$") {
+		t.Errorf("stored OTP = %q, want an HMAC under otp-1", stored.OTP)
+	}
+	if stored.OTPAttempts != 3 || !stored.OTPSpawnedAt.Equal(testEpoch) {
+		t.Errorf("stored attempts %d spawned %v, want 3 at the epoch", stored.OTPAttempts, stored.OTPSpawnedAt)
+	}
+
+	resends := []struct {
+		name    string
+		advance time.Duration
+		wantErr string
+	}{
+		{name: "right away", advance: 0, wantErr: "not now"},
+		{name: "before the resend interval", advance: 59 * time.Second, wantErr: "not now"},
+		{name: "after the resend interval", advance: 2 * time.Second},
+	}
+	for _, resend := range resends {
+		clock.Advance(resend.advance)
+		next, err := service.GenerateOTP(user)
+		if errorText(err) != resend.wantErr {
+			t.Fatalf("%s: GenerateOTP error = %q, want %q", resend.name, errorText(err), resend.wantErr)
+		}
+		if err == nil && next == otp {
+			t.Errorf("%s: the new code repeats the old one", resend.name)
+		}
+	}
+}
+
+func TestMailOTPServiceVerifyOTP(t *testing.T) {
+	tests := []struct {
+		name         string
+		prepare      func(user *domain.User, clock *testClock)
+		code         string
+		want         bool
+		wantAttempts int
+	}{
+		{name: "right code", code: "012345", want: true, wantAttempts: 3},
+		{name: "wrong code", code: "543210", want: false, wantAttempts: 2},
+		{name: "empty code", code: "", want: false, wantAttempts: 2},
+		{name: "at the end of its life", code: "012345", want: true, wantAttempts: 3, prepare: func(user *domain.User, clock *testClock) {
+			clock.Advance(5 * time.Minute)
+		}},
+		{name: "expired", code: "012345", want: false, wantAttempts: 3, prepare: func(user *domain.User, clock *testClock) {
+			clock.Advance(5*time.Minute + time.Second)
+		}},
+		{name: "no attempts left", code: "012345", want: false, wantAttempts: 0, prepare: func(user *domain.User, clock *testClock) {
+			user.OTPAttempts = 0
+		}},
+		{name: "cleared", code: "012345", want: false, wantAttempts: 3, prepare: func(user *domain.User, clock *testClock) {
+			user.OTP = ""
+		}},
+		{name: "issued to another user", code: "012345", want: false, wantAttempts: 2, prepare: func(user *domain.User, clock *testClock) {
+			user.ID += 1
+			user.Email = "other@example.com"
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, repo, clock, _ := newTestOTPService(t)
+			user := &domain.User{Email: "user@example.com"}
+			repo.SaveUser(user)
+			if _, err := service.GenerateOTP(user); err != nil {
+				t.Fatalf("GenerateOTP: %v", err.ErrorBase)
+			}
+			if test.prepare != nil {
+				test.prepare(user, clock)
+			}
+
+			valid, err := service.VerifyOTP(user, test.code)
+			if err != nil {
+				t.Fatalf("VerifyOTP: %v", err.ErrorBase)
+			}
+			if valid != test.want {
+				t.Errorf("VerifyOTP = %v, want %v", valid, test.want)
+			}
+			if user.OTPAttempts != test.wantAttempts {
+				t.Errorf("attempts = %d, want %d", user.OTPAttempts, test.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestMailOTPServiceAttemptsRunOut(t *testing.T) {
+	service, repo, _, _ := newTestOTPService(t)
+	user := &domain.User{Email: "user@example.com"}
+	repo.SaveUser(user)
+	otp, _ := service.GenerateOTP(user)
+
+	for i := 0; i < 3; i++ {
+		if valid, _ := service.VerifyOTP(user, "999999"); valid {
+			t.Fatalf("wrong code %d accepted", i)
+		}
+	}
+	if valid, _ := service.VerifyOTP(user, otp); valid {
+		t.Errorf("right code accepted after the attempts ran out")
+	}
+	stored, _ := repo.FindUserById(user.ID)
+	if stored.OTPAttempts != 0 {
+		t.Errorf("stored attempts = %d, want 0", stored.OTPAttempts)
+	}
+}
+
+func TestMailOTPServiceClearOTP(t *testing.T) {
+	service, repo, _, _ := newTestOTPService(t)
+	user := &domain.User{Email: "user@example.com"}
+	repo.SaveUser(user)
+	otp, _ := service.GenerateOTP(user)
+
+	if err := service.ClearOTP(user); err != nil {
+		t.Fatalf("ClearOTP: %v", err.ErrorBase)
+	}
+	stored, _ := repo.FindUserById(user.ID)
+	if stored.OTP != "" || stored.OTPAttempts != 0 || !stored.OTPSpawnedAt.IsZero() {
+		t.Errorf("stored OTP %q attempts %d spawned %v, want all cleared", stored.OTP, stored.OTPAttempts, stored.OTPSpawnedAt)
+	}
+	if valid, _ := service.VerifyOTP(stored, otp); valid {
+		t.Errorf("cleared code accepted")
+	}
+	// A cleared code does not hold back the next one.
+	if _, err := service.GenerateOTP(stored); err != nil {
+		t.Errorf("GenerateOTP after ClearOTP: %v", err.ErrorBase)
+	}
+}
+
+// TestMailOTPServiceClearOTPKeepsOtherColumns clears the code with a copy of the user
+// read before the role changed, as the activation subscriber may.
+func TestMailOTPServiceClearOTPKeepsOtherColumns(t *testing.T) {
+	service, repo, _, _ := newTestOTPService(t)
+	user := &domain.User{Email: "user@example.com"}
+	repo.SaveUser(user)
+	service.GenerateOTP(user)
+	stale, _ := repo.FindUserById(user.ID)
+	repo.UpdateUserColumns(user, nil, map[string]interface{}{"is_superuser": true})
+
+	if err := service.ClearOTP(stale); err != nil {
+		t.Fatalf("ClearOTP: %v", err.ErrorBase)
+	}
+	stored, _ := repo.FindUserById(user.ID)
+	if !stored.IsSuperuser || stored.OTP != "" {
+		t.Errorf("stored superuser %v OTP %q, want the role kept and the code cleared", stored.IsSuperuser, stored.OTP)
+	}
+}
+
+func TestMailOTPServiceSendOTP(t *testing.T) {
+	service, _, _, mailer := newTestOTPService(t)
+	service.SendOTP(domain.User{Email: "user@example.com"}, "012345")
+
+	if len(mailer.sent) != 1 {
+		t.Fatalf("sent %d mails, want 1", len(mailer.sent))
+	}
+	if mailer.sent[0].To != "user@example.com" || !strings.Contains(mailer.sent[0].Body, "012345") {
+		t.Errorf("mail = %+v, want the code sent to the user", mailer.sent[0])
+	}
+}
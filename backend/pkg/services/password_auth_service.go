@@ -5,8 +5,13 @@ import (
 	"fmt"
 	"hitenok/pkg/config"
 	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
 	"hitenok/pkg/repository"
 	"hitenok/pkg/security"
+	"log"
+	"slices"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -14,55 +19,317 @@ import (
 type PasswordAuthenticationServiceI interface {
 	Authenticate(credentials, password string) (*domain.User, *domain.MyError)
 	Register(credentials, fullname, password string) (*domain.User, *domain.MyError)
+	RegisterInvited(email, fullname, password string) (*domain.User, *domain.MyError)
+	Activate(user *domain.User) *domain.MyError
+	CheckPassword(user *domain.User, password string) bool
+	ChangePassword(user *domain.User, currentPassword, newPassword string) *domain.MyError
+	ResetPassword(user *domain.User, newPassword string) *domain.MyError
+	PasswordExpired(user *domain.User) bool
+	SendPasswordChangedNotice(user domain.User)
 }
 
 type mailAuthenticationService struct {
-	repo      repository.UserRepositoryI
-	appConfig *config.AppConfig
+	repo                repository.UserRepositoryI
+	passwordHistoryRepo repository.PasswordHistoryRepositoryI
+	mailer              MailerI
+	passwordPolicy      *security.PasswordPolicy
+	eventBus            events.EventBusI
+	appConfig           *config.AppConfig
+	now                 func() time.Time
 }
 
-func NewMailAuthenticationService(repo repository.UserRepositoryI, appConfig *config.AppConfig) PasswordAuthenticationServiceI {
+func NewMailAuthenticationService(repo repository.UserRepositoryI, passwordHistoryRepo repository.PasswordHistoryRepositoryI, mailer MailerI, passwordPolicy *security.PasswordPolicy, eventBus events.EventBusI, appConfig *config.AppConfig) PasswordAuthenticationServiceI {
 	return &mailAuthenticationService{
-		repo:      repo,
-		appConfig: appConfig,
+		repo:                repo,
+		passwordHistoryRepo: passwordHistoryRepo,
+		mailer:              mailer,
+		passwordPolicy:      passwordPolicy,
+		eventBus:            eventBus,
+		appConfig:           appConfig,
+		now:                 time.Now,
 	}
 }
 
 func (mailAuthenticationService *mailAuthenticationService) Authenticate(email, password string) (*domain.User, *domain.MyError) {
 	user, err := mailAuthenticationService.repo.FindUserByEmail(email)
 	if err != nil {
+		if errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
+			mailAuthenticationService.eventBus.Publish(events.SignInFailed{Email: email, Reason: "unknown email"})
+		}
 		err.Module = "mailAuthenticationService.Authenticate" + err.Module
 		return user, err
 	}
 	if !user.IsActive {
+		mailAuthenticationService.eventBus.Publish(events.SignInFailed{UserId: user.ID, Email: email, Reason: "user is not active"})
 		return user, domain.NewError(fmt.Errorf("user is not active"), "mailAuthenticationService.Authenticate")
 	}
-	if user.Password == security.HashPassword(password, mailAuthenticationService.appConfig.SecretKey) {
+	if mailAuthenticationService.verifyPassword(user, password) {
+		mailAuthenticationService.eventBus.Publish(events.SignInSucceeded{UserId: user.ID, Email: user.Email})
 		return user, nil
 	}
+	mailAuthenticationService.eventBus.Publish(events.SignInFailed{UserId: user.ID, Email: email, Reason: "wrong credentials"})
 	return user, domain.NewError(fmt.Errorf("wrong credentials"), "mailAuthenticationService.Authenticate")
 }
 
+// Register creates an inactive account that is activated with the emailed OTP. It is
+// subject to REGISTRATION_MODE and fails with "registration closed" where sign-up is
+// not open to the email.
 func (mailAuthenticationService *mailAuthenticationService) Register(email, fullname, password string) (*domain.User, *domain.MyError) {
 	if (email == "") || (fullname == "") || (password == "") {
 		return &domain.User{}, domain.NewError(fmt.Errorf("invalid credentials"), "mailAuthenticationService.Register")
 	}
+	if !mailAuthenticationService.registrationOpen(email) {
+		return &domain.User{}, domain.NewError(fmt.Errorf("registration closed"), "mailAuthenticationService.Register")
+	}
+	user, err := mailAuthenticationService.register(email, fullname, password, false)
+	if err != nil {
+		err.Module = "mailAuthenticationService.Register." + err.Module
+		return user, err
+	}
+	mailAuthenticationService.eventBus.Publish(events.UserRegistered{UserId: user.ID, Email: user.Email})
+	return user, nil
+}
+
+// RegisterInvited creates the account of someone accepting an invitation. The invite
+// reached them by email, which proves ownership, so the account starts active, and the
+// registration mode does not apply.
+func (mailAuthenticationService *mailAuthenticationService) RegisterInvited(email, fullname, password string) (*domain.User, *domain.MyError) {
+	if (email == "") || (fullname == "") || (password == "") {
+		return &domain.User{}, domain.NewError(fmt.Errorf("invalid credentials"), "mailAuthenticationService.RegisterInvited")
+	}
+	user, err := mailAuthenticationService.register(email, fullname, password, true)
+	if err != nil {
+		err.Module = "mailAuthenticationService.RegisterInvited." + err.Module
+		return user, err
+	}
+	mailAuthenticationService.eventBus.Publish(events.UserRegistered{UserId: user.ID, Email: user.Email, Invited: true})
+	mailAuthenticationService.eventBus.Publish(events.UserActivated{UserId: user.ID, Email: user.Email})
+	return user, nil
+}
+
+// Activate marks the account as active once its email is proven, by the activation OTP
+// or by an accepted invitation. Activating an active account is a no-op; the flag is
+// flipped with a compare-and-swap so that racing activations emit a single event.
+func (mailAuthenticationService *mailAuthenticationService) Activate(user *domain.User) *domain.MyError {
+	if user.IsActive {
+		return nil
+	}
+	err := mailAuthenticationService.repo.UpdateUserColumns(user, map[string]interface{}{"is_active": false}, map[string]interface{}{"is_active": true})
+	if err != nil && err.ErrorBase.Error() == "user changed concurrently" {
+		user.IsActive = true
+		return nil
+	}
+	if err != nil {
+		err.Module = "mailAuthenticationService.Activate." + err.Module
+		return err
+	}
+	user.IsActive = true
+	mailAuthenticationService.eventBus.Publish(events.UserActivated{UserId: user.ID, Email: user.Email})
+	return nil
+}
+
+func (mailAuthenticationService *mailAuthenticationService) registrationOpen(email string) bool {
+	switch mailAuthenticationService.appConfig.RegistrationMode {
+	case "invite-only":
+		return false
+	case "domain-allowlist":
+		_, emailDomain, found := strings.Cut(email, "@")
+		return found && slices.Contains(mailAuthenticationService.appConfig.RegistrationAllowedDomains, strings.ToLower(emailDomain))
+	}
+	return true
+}
+
+func (mailAuthenticationService *mailAuthenticationService) register(email, fullname, password string, active bool) (*domain.User, *domain.MyError) {
+	if violations := mailAuthenticationService.passwordPolicy.Validate("password", password, email, fullname); len(violations) > 0 {
+		return &domain.User{}, domain.NewError(domain.NewValidationError(violations...), "mailAuthenticationService.register")
+	}
 	_, err := mailAuthenticationService.repo.FindUserByEmail(email)
 	if err == nil {
-		return &domain.User{}, domain.NewError(fmt.Errorf("user already exists"), "mailAuthenticationService.Register")
+		return &domain.User{}, domain.NewError(fmt.Errorf("user already exists"), "mailAuthenticationService.register")
 	}
 	if !errors.Is(err.ErrorBase, gorm.ErrRecordNotFound) {
 		return &domain.User{}, err
 	}
 	user := &domain.User{
-		Email:    email,
-		Fullname: fullname,
-		Password: security.HashPassword(password, mailAuthenticationService.appConfig.SecretKey),
+		Email:             email,
+		Fullname:          fullname,
+		Password:          security.HashPassword(password, mailAuthenticationService.appConfig.Keys.Pepper),
+		PasswordChangedAt: mailAuthenticationService.now(),
+		IsActive:          active,
 	}
-	err = mailAuthenticationService.repo.SaveUser(user)
+	err = mailAuthenticationService.passwordHistoryRepo.SavePasswordChange(user, mailAuthenticationService.appConfig.PasswordHistorySize)
 	if err != nil {
-		err.Module = "mailAuthenticationService.Register" + err.Module
+		err.Module = "mailAuthenticationService.register." + err.Module
 		return user, err
 	}
 	return user, nil
 }
+
+// CheckPassword re-verifies the password of an already authenticated user before a
+// sensitive change.
+func (mailAuthenticationService *mailAuthenticationService) CheckPassword(user *domain.User, password string) bool {
+	return mailAuthenticationService.verifyPassword(user, password)
+}
+
+// verifyPassword checks the password and, when the stored hash is made with a retired
+// pepper or predates the pepper keyring, replaces it with one under the current pepper,
+// so that the old key can be dropped once everyone has signed in. The history entry of
+// the current password is rehashed with it; older entries cannot be, their passwords
+// are unknown, so they stop counting for reuse once their pepper is dropped. A failed
+// rehash is only logged; the password was right.
+func (mailAuthenticationService *mailAuthenticationService) verifyPassword(user *domain.User, password string) bool {
+	valid, rehash := security.VerifyPassword(user.Password, password, mailAuthenticationService.appConfig.Keys.Pepper, mailAuthenticationService.appConfig.SecretKey)
+	if !valid || !rehash {
+		return valid
+	}
+	oldHash := user.Password
+	hash := security.HashPassword(password, mailAuthenticationService.appConfig.Keys.Pepper)
+	err := mailAuthenticationService.repo.UpdateUserColumns(user, map[string]interface{}{"password": oldHash}, map[string]interface{}{"password": hash})
+	if err != nil && err.ErrorBase.Error() != "user changed concurrently" {
+		log.Printf("mailAuthenticationService.verifyPassword.%s: %v", err.Module, err.ErrorBase)
+	}
+	if err != nil {
+		return true
+	}
+	user.Password = hash
+	err = mailAuthenticationService.passwordHistoryRepo.RehashPasswordHistory(user.ID, oldHash, hash)
+	if err != nil {
+		log.Printf("mailAuthenticationService.verifyPassword.%s: %v", err.Module, err.ErrorBase)
+	}
+	return true
+}
+
+// ChangePassword sets a new password for a logged in user and bumps JWTVersion, which
+// ends every existing session; the caller issues fresh tokens for the current one.
+func (mailAuthenticationService *mailAuthenticationService) ChangePassword(user *domain.User, currentPassword, newPassword string) *domain.MyError {
+	if !mailAuthenticationService.CheckPassword(user, currentPassword) {
+		return domain.NewError(fmt.Errorf("wrong credentials"), "mailAuthenticationService.ChangePassword")
+	}
+	violations := mailAuthenticationService.passwordPolicy.Validate("new_password", newPassword, user.Email, user.Fullname)
+	if newPassword == currentPassword {
+		violations = append(violations, domain.FieldViolation{
+			Field:   "new_password",
+			Code:    "unchanged",
+			Message: "must differ from the current password",
+		})
+	} else {
+		reused, err := mailAuthenticationService.passwordReused(user, newPassword)
+		if err != nil {
+			err.Module = "mailAuthenticationService.ChangePassword." + err.Module
+			return err
+		}
+		if reused {
+			violations = append(violations, mailAuthenticationService.reusedViolation())
+		}
+	}
+	if len(violations) > 0 {
+		return domain.NewError(domain.NewValidationError(violations...), "mailAuthenticationService.ChangePassword")
+	}
+	err := mailAuthenticationService.setPassword(user, newPassword)
+	if err != nil {
+		err.Module = "mailAuthenticationService.ChangePassword." + err.Module
+		return err
+	}
+	mailAuthenticationService.eventBus.Publish(events.PasswordChanged{UserId: user.ID})
+	return nil
+}
+
+// ResetPassword sets a new password at the end of the reset flow and, like
+// ChangePassword, ends every existing session.
+func (mailAuthenticationService *mailAuthenticationService) ResetPassword(user *domain.User, newPassword string) *domain.MyError {
+	violations := mailAuthenticationService.passwordPolicy.Validate("new_password", newPassword, user.Email, user.Fullname)
+	reused, err := mailAuthenticationService.passwordReused(user, newPassword)
+	if err != nil {
+		err.Module = "mailAuthenticationService.ResetPassword." + err.Module
+		return err
+	}
+	if reused {
+		violations = append(violations, mailAuthenticationService.reusedViolation())
+	}
+	if len(violations) > 0 {
+		return domain.NewError(domain.NewValidationError(violations...), "mailAuthenticationService.ResetPassword")
+	}
+	err = mailAuthenticationService.setPassword(user, newPassword)
+	if err != nil {
+		err.Module = "mailAuthenticationService.ResetPassword." + err.Module
+		return err
+	}
+	mailAuthenticationService.eventBus.Publish(events.PasswordReset{UserId: user.ID, Email: user.Email})
+	return nil
+}
+
+// PasswordExpired reports whether the password is older than PASSWORD_MAX_AGE. Accounts
+// from before PasswordChangedAt existed count from their creation.
+func (mailAuthenticationService *mailAuthenticationService) PasswordExpired(user *domain.User) bool {
+	maxAge := mailAuthenticationService.appConfig.PasswordMaxAge
+	if maxAge <= 0 {
+		return false
+	}
+	changedAt := user.PasswordChangedAt
+	if changedAt.IsZero() {
+		changedAt = user.CreatedAt
+	}
+	return mailAuthenticationService.now().Sub(changedAt) > maxAge
+}
+
+// setPassword also spends any pending reset hash in the same write, so that it cannot
+// be used again once the password is set, not even for a moment.
+func (mailAuthenticationService *mailAuthenticationService) setPassword(user *domain.User, newPassword string) *domain.MyError {
+	user.Password = security.HashPassword(newPassword, mailAuthenticationService.appConfig.Keys.Pepper)
+	user.PasswordChangedAt = mailAuthenticationService.now()
+	user.JWTVersion += 1
+	user.ResetHash = ""
+	user.HashAttempts = 0
+	user.ResetHashSpawnedAt = time.Time{}
+	err := mailAuthenticationService.passwordHistoryRepo.SavePasswordChange(user, mailAuthenticationService.appConfig.PasswordHistorySize)
+	if err != nil {
+		err.Module = "mailAuthenticationService.setPassword." + err.Module
+		return err
+	}
+	return nil
+}
+
+// passwordReused checks the new password against the current one and the remembered
+// previous ones.
+func (mailAuthenticationService *mailAuthenticationService) passwordReused(user *domain.User, newPassword string) (bool, *domain.MyError) {
+	pepper, legacySalt := mailAuthenticationService.appConfig.Keys.Pepper, mailAuthenticationService.appConfig.SecretKey
+	if valid, _ := security.VerifyPassword(user.Password, newPassword, pepper, legacySalt); valid {
+		return true, nil
+	}
+	historySize := mailAuthenticationService.appConfig.PasswordHistorySize
+	if historySize <= 0 {
+		return false, nil
+	}
+	history, err := mailAuthenticationService.passwordHistoryRepo.FindPasswordHistory(user.ID, historySize)
+	if err != nil {
+		err.Module = "mailAuthenticationService.passwordReused." + err.Module
+		return false, err
+	}
+	for _, entry := range history {
+		if valid, _ := security.VerifyPassword(entry.Password, newPassword, pepper, legacySalt); valid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (mailAuthenticationService *mailAuthenticationService) reusedViolation() domain.FieldViolation {
+	message := "must differ from the current password"
+	if historySize := mailAuthenticationService.appConfig.PasswordHistorySize; historySize > 0 {
+		message = fmt.Sprintf("must differ from your last %d passwords", historySize)
+	}
+	return domain.FieldViolation{
+		Field:   "new_password",
+		Code:    "reused",
+		Message: message,
+	}
+}
+
+func (mailAuthenticationService *mailAuthenticationService) SendPasswordChangedNotice(user domain.User) {
+	body := "Пароль вашего аккаунта был изменён. Все остальные сеансы завершены.\n" +
+		"Если это были не вы, восстановите доступ через сброс пароля."
+	err := mailAuthenticationService.mailer.Send(user.Email, "Пароль изменён", body)
+	if err != nil {
+		log.Printf("mailAuthenticationService.SendPasswordChangedNotice: %v", err)
+	}
+}
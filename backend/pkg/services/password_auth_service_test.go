@@ -0,0 +1,382 @@
+package services
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
+	"hitenok/pkg/repository"
+	"hitenok/pkg/security"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type authFixture struct {
+	service     *mailAuthenticationService
+	repo        repository.UserRepositoryI
+	historyRepo *fakePasswordHistoryRepository
+	clock       *testClock
+	appConfig   *config.AppConfig
+	events      *[]events.Event
+}
+
+func newAuthFixture(t *testing.T) *authFixture {
+	t.Helper()
+	clock := newTestClock()
+	repo := repository.NewMemoryUserRepository(clock.Now)
+	historyRepo := &fakePasswordHistoryRepository{userRepo: repo, history: map[uint][]domain.PasswordHistory{}}
+	appConfig := testConfig(t)
+	bus := events.NewEventBus()
+	recorded := recordEvents(bus, "user.registered", "user.activated", "auth.sign_in_succeeded", "auth.sign_in_failed", "user.password_reset", "user.password_changed")
+	policy := &security.PasswordPolicy{MinLength: 8, MaxLength: 64, MinCharClasses: 1}
+	service := NewMailAuthenticationService(repo, historyRepo, &fakeMailer{}, policy, bus, appConfig).(*mailAuthenticationService)
+	service.now = clock.Now
+	return &authFixture{
+		service:     service,
+		repo:        repo,
+		historyRepo: historyRepo,
+		clock:       clock,
+		appConfig:   appConfig,
+		events:      recorded,
+	}
+}
+
+// addUser stores an active user with the given password, hashed under the current
+// pepper.
+func (fixture *authFixture) addUser(t *testing.T, email, password string) *domain.User {
+	t.Helper()
+	user := &domain.User{
+		Email:             email,
+		Fullname:          "Test User",
+		Password:          security.HashPassword(password, fixture.appConfig.Keys.Pepper),
+		PasswordChangedAt: fixture.clock.Now(),
+		IsActive:          true,
+	}
+	if err := fixture.historyRepo.SavePasswordChange(user, fixture.appConfig.PasswordHistorySize); err != nil {
+		t.Fatalf("SavePasswordChange: %v", err.ErrorBase)
+	}
+	return user
+}
+
+func eventNames(recorded []events.Event) []string {
+	names := []string{}
+	for _, event := range recorded {
+		names = append(names, event.EventName())
+	}
+	return names
+}
+
+func TestMailAuthenticationServiceRegister(t *testing.T) {
+	tests := []struct {
+		name           string
+		mode           string
+		allowedDomains []string
+		email          string
+		fullname       string
+		password       string
+		wantErr        string
+	}{
+		{name: "open", mode: "open", email: "new@example.com", fullname: "New User", password: "correct-horse-7"},
+		{name: "missing fullname", mode: "open", email: "new@example.com", password: "correct-horse-7", wantErr: "invalid credentials"},
+		{name: "missing password", mode: "open", email: "new@example.com", fullname: "New User", wantErr: "invalid credentials"},
+		{name: "short password", mode: "open", email: "new@example.com", fullname: "New User", password: "short", wantErr: "validation failed: password: must be at least 8 characters"},
+		{name: "email taken", mode: "open", email: "taken@example.com", fullname: "New User", password: "correct-horse-7", wantErr: "user already exists"},
+		{name: "invite only", mode: "invite-only", email: "new@example.com", fullname: "New User", password: "correct-horse-7", wantErr: "registration closed"},
+		{name: "allowed domain", mode: "domain-allowlist", allowedDomains: []string{"example.com"}, email: "new@EXAMPLE.com", fullname: "New User", password: "correct-horse-7"},
+		{name: "other domain", mode: "domain-allowlist", allowedDomains: []string{"example.com"}, email: "new@example.org", fullname: "New User", password: "correct-horse-7", wantErr: "registration closed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := newAuthFixture(t)
+			fixture.addUser(t, "taken@example.com", "battery-staple-8")
+			fixture.appConfig.RegistrationMode = test.mode
+			fixture.appConfig.RegistrationAllowedDomains = test.allowedDomains
+			*fixture.events = nil
+
+			user, err := fixture.service.Register(test.email, test.fullname, test.password)
+			if errorText(err) != test.wantErr {
+				t.Fatalf("Register error = %q, want %q", errorText(err), test.wantErr)
+			}
+			if test.wantErr != "" {
+				if len(*fixture.events) != 0 {
+					t.Errorf("events = %v, want none", eventNames(*fixture.events))
+				}
+				return
+			}
+			stored, findErr := fixture.repo.FindUserByEmail(test.email)
+			if findErr != nil {
+				t.Fatalf("FindUserByEmail: %v", findErr.ErrorBase)
+			}
+			if stored.ID != user.ID || stored.IsActive {
+				t.Errorf("stored user %d active %v, want %d inactive", stored.ID, stored.IsActive, user.ID)
+			}
+			if !stored.PasswordChangedAt.Equal(testEpoch) {
+				t.Errorf("PasswordChangedAt = %v, want %v", stored.PasswordChangedAt, testEpoch)
+			}
+			if valid, _ := security.VerifyPassword(stored.Password, test.password, fixture.appConfig.Keys.Pepper, ""); !valid {
+				t.Errorf("stored hash does not verify the password")
+			}
+			if names := strings.Join(eventNames(*fixture.events), ","); names != "user.registered" {
+				t.Errorf("events = %s, want user.registered", names)
+			}
+		})
+	}
+}
+
+func TestMailAuthenticationServiceRegisterInvited(t *testing.T) {
+	fixture := newAuthFixture(t)
+	fixture.appConfig.RegistrationMode = "invite-only"
+
+	user, err := fixture.service.RegisterInvited("invited@example.com", "Invited User", "correct-horse-7")
+	if err != nil {
+		t.Fatalf("RegisterInvited: %v", err.ErrorBase)
+	}
+	if !user.IsActive {
+		t.Errorf("invited user is not active")
+	}
+	if names := strings.Join(eventNames(*fixture.events), ","); names != "user.registered,user.activated" {
+		t.Errorf("events = %s, want user.registered,user.activated", names)
+	}
+}
+
+func TestMailAuthenticationServiceAuthenticate(t *testing.T) {
+	tests := []struct {
+		name       string
+		email      string
+		password   string
+		inactive   bool
+		wantErr    error
+		wantEvent  string
+		wantReason string
+	}{
+		{name: "right password", email: "user@example.com", password: "correct-horse-7", wantEvent: "auth.sign_in_succeeded"},
+		{name: "wrong password", email: "user@example.com", password: "correct-horse-8", wantErr: errors.New("wrong credentials"), wantEvent: "auth.sign_in_failed", wantReason: "wrong credentials"},
+		{name: "empty password", email: "user@example.com", password: "", wantErr: errors.New("wrong credentials"), wantEvent: "auth.sign_in_failed", wantReason: "wrong credentials"},
+		{name: "unknown email", email: "nobody@example.com", password: "correct-horse-7", wantErr: gorm.ErrRecordNotFound, wantEvent: "auth.sign_in_failed", wantReason: "unknown email"},
+		{name: "inactive", email: "user@example.com", password: "correct-horse-7", inactive: true, wantErr: errors.New("user is not active"), wantEvent: "auth.sign_in_failed", wantReason: "user is not active"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := newAuthFixture(t)
+			user := fixture.addUser(t, "user@example.com", "correct-horse-7")
+			if test.inactive {
+				user.IsActive = false
+				fixture.repo.SaveUser(user)
+			}
+
+			_, err := fixture.service.Authenticate(test.email, test.password)
+			switch {
+			case test.wantErr == nil && err != nil:
+				t.Fatalf("Authenticate: %v", err.ErrorBase)
+			case test.wantErr != nil && err == nil:
+				t.Fatalf("Authenticate succeeded, want %v", test.wantErr)
+			case test.wantErr != nil && !errors.Is(err.ErrorBase, test.wantErr) && err.ErrorBase.Error() != test.wantErr.Error():
+				t.Fatalf("Authenticate error = %v, want %v", err.ErrorBase, test.wantErr)
+			}
+			if len(*fixture.events) != 1 || (*fixture.events)[0].EventName() != test.wantEvent {
+				t.Fatalf("events = %v, want %s", eventNames(*fixture.events), test.wantEvent)
+			}
+			if failed, ok := (*fixture.events)[0].(events.SignInFailed); ok && failed.Reason != test.wantReason {
+				t.Errorf("reason = %q, want %q", failed.Reason, test.wantReason)
+			}
+		})
+	}
+}
+
+func TestMailAuthenticationServiceAuthenticateRehashes(t *testing.T) {
+	tests := []struct {
+		name string
+		hash func(fixture *authFixture, password string) string
+	}{
+		{name: "legacy salted hash", hash: func(fixture *authFixture, password string) string {
+			return fmt.Sprintf("%x", sha256.Sum256([]byte(fixture.appConfig.SecretKey+password)))
+		}},
+		{name: "peppered HMAC", hash: func(fixture *authFixture, password string) string {
+			return fixture.appConfig.Keys.Pepper.Sign(password)
+		}},
+		{name: "retired pepper", hash: func(fixture *authFixture, password string) string {
+			fixture.appConfig.Keys.Pepper = testKeyring(t, "pepper-2:new-pepper", "pepper-1:pepper-secret")
+			return security.HashPassword(password, testKeyring(t, "pepper-1:pepper-secret"))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := newAuthFixture(t)
+			user := fixture.addUser(t, "user@example.com", "correct-horse-7")
+			user.Password = test.hash(fixture, "correct-horse-7")
+			fixture.repo.SaveUser(user)
+			fixture.historyRepo.history[user.ID][0].Password = user.Password
+
+			if _, err := fixture.service.Authenticate("user@example.com", "correct-horse-7"); err != nil {
+				t.Fatalf("Authenticate: %v", err.ErrorBase)
+			}
+			stored, _ := fixture.repo.FindUserById(user.ID)
+			currentId := fixture.appConfig.Keys.Pepper.Current().Id
+			if !strings.HasPrefix(stored.Password, "argon2id$"+currentId+"$") {
+				t.Errorf("stored hash %q is not an argon2id hash under the current pepper %s", stored.Password, currentId)
+			}
+			if valid, rehash := security.VerifyPassword(stored.Password, "correct-horse-7", fixture.appConfig.Keys.Pepper, ""); !valid || rehash {
+				t.Errorf("rehashed password valid %v, rehash %v", valid, rehash)
+			}
+			if history := fixture.historyRepo.history[user.ID]; history[0].Password != stored.Password {
+				t.Errorf("history entry %q was not rehashed with the password", history[0].Password)
+			}
+		})
+	}
+}
+
+func TestHashPasswordIsSalted(t *testing.T) {
+	pepper := testKeyring(t, "pepper-1:pepper-secret")
+	first := security.HashPassword("correct-horse-7", pepper)
+	second := security.HashPassword("correct-horse-7", pepper)
+	if first == second {
+		t.Errorf("the same password hashed twice to %q, want different salts", first)
+	}
+	for _, hash := range []string{first, second} {
+		if valid, rehash := security.VerifyPassword(hash, "correct-horse-7", pepper, ""); !valid || rehash {
+			t.Errorf("hash %q valid %v, rehash %v", hash, valid, rehash)
+		}
+		if valid, _ := security.VerifyPassword(hash, "correct-horse-8", pepper, ""); valid {
+			t.Errorf("hash %q takes a wrong password", hash)
+		}
+	}
+}
+
+func TestMailAuthenticationServiceActivate(t *testing.T) {
+	fixture := newAuthFixture(t)
+	user, err := fixture.service.Register("new@example.com", "New User", "correct-horse-7")
+	if err != nil {
+		t.Fatalf("Register: %v", err.ErrorBase)
+	}
+	stale := *user
+
+	if err := fixture.service.Activate(user); err != nil {
+		t.Fatalf("Activate: %v", err.ErrorBase)
+	}
+	// A racing request still holding the inactive copy loses the compare-and-swap
+	// quietly.
+	if err := fixture.service.Activate(&stale); err != nil {
+		t.Fatalf("second Activate: %v", err.ErrorBase)
+	}
+	if !stale.IsActive {
+		t.Errorf("losing copy is not marked active")
+	}
+	stored, _ := fixture.repo.FindUserById(user.ID)
+	if !stored.IsActive {
+		t.Errorf("stored user is not active")
+	}
+	if names := strings.Join(eventNames(*fixture.events), ","); names != "user.registered,user.activated" {
+		t.Errorf("events = %s, want a single user.activated", names)
+	}
+}
+
+func TestMailAuthenticationServiceChangePassword(t *testing.T) {
+	tests := []struct {
+		name            string
+		currentPassword string
+		newPassword     string
+		wantErr         string
+	}{
+		{name: "changed", currentPassword: "battery-staple-8", newPassword: "tr0ub4dor-and-3"},
+		{name: "wrong current password", currentPassword: "correct-horse-7", newPassword: "tr0ub4dor-and-3", wantErr: "wrong credentials"},
+		{name: "unchanged", currentPassword: "battery-staple-8", newPassword: "battery-staple-8", wantErr: "validation failed: new_password: must differ from the current password"},
+		{name: "reused", currentPassword: "battery-staple-8", newPassword: "correct-horse-7", wantErr: "validation failed: new_password: must differ from your last 2 passwords"},
+		{name: "too short", currentPassword: "battery-staple-8", newPassword: "short", wantErr: "validation failed: new_password: must be at least 8 characters"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := newAuthFixture(t)
+			user := fixture.addUser(t, "user@example.com", "correct-horse-7")
+			if err := fixture.service.ChangePassword(user, "correct-horse-7", "battery-staple-8"); err != nil {
+				t.Fatalf("first ChangePassword: %v", err.ErrorBase)
+			}
+			fixture.clock.Advance(time.Hour)
+			version := user.JWTVersion
+
+			err := fixture.service.ChangePassword(user, test.currentPassword, test.newPassword)
+			if errorText(err) != test.wantErr {
+				t.Fatalf("ChangePassword error = %q, want %q", errorText(err), test.wantErr)
+			}
+			stored, _ := fixture.repo.FindUserById(user.ID)
+			if test.wantErr != "" {
+				if stored.JWTVersion != version {
+					t.Errorf("JWTVersion moved to %d on a refused change", stored.JWTVersion)
+				}
+				if names := strings.Join(eventNames(*fixture.events), ","); names != "user.password_changed" {
+					t.Errorf("events = %s, want only the first change", names)
+				}
+				return
+			}
+			if names := strings.Join(eventNames(*fixture.events), ","); names != "user.password_changed,user.password_changed" {
+				t.Errorf("events = %s, want both changes", names)
+			}
+			if stored.JWTVersion != version+1 {
+				t.Errorf("JWTVersion = %d, want %d", stored.JWTVersion, version+1)
+			}
+			if !stored.PasswordChangedAt.Equal(testEpoch.Add(time.Hour)) {
+				t.Errorf("PasswordChangedAt = %v, want an hour after the epoch", stored.PasswordChangedAt)
+			}
+			if !fixture.service.CheckPassword(stored, test.newPassword) {
+				t.Errorf("new password does not verify")
+			}
+		})
+	}
+}
+
+func TestMailAuthenticationServiceResetPassword(t *testing.T) {
+	fixture := newAuthFixture(t)
+	user := fixture.addUser(t, "user@example.com", "correct-horse-7")
+
+	err := fixture.service.ResetPassword(user, "correct-horse-7")
+	if want := "validation failed: new_password: must differ from your last 2 passwords"; errorText(err) != want {
+		t.Fatalf("ResetPassword to the current password error = %q, want %q", errorText(err), want)
+	}
+	user.ResetHash = "pending-hash"
+	user.HashAttempts = 3
+	user.ResetHashSpawnedAt = fixture.clock.Now()
+	fixture.repo.SaveUser(user)
+	if err := fixture.service.ResetPassword(user, "battery-staple-8"); err != nil {
+		t.Fatalf("ResetPassword: %v", err.ErrorBase)
+	}
+	// The hash is spent by the time ResetPassword returns, not by a later side effect.
+	stored, _ := fixture.repo.FindUserById(user.ID)
+	if stored.ResetHash != "" || stored.HashAttempts != 0 || !stored.ResetHashSpawnedAt.IsZero() {
+		t.Errorf("stored hash %q attempts %d spawned %v, want all cleared", stored.ResetHash, stored.HashAttempts, stored.ResetHashSpawnedAt)
+	}
+	if names := strings.Join(eventNames(*fixture.events), ","); names != "user.password_reset" {
+		t.Errorf("events = %s, want user.password_reset", names)
+	}
+}
+
+func TestMailAuthenticationServicePasswordExpired(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxAge    time.Duration
+		changedAt time.Time
+		createdAt time.Time
+		want      bool
+	}{
+		{name: "no maximum age", maxAge: 0, changedAt: testEpoch.AddDate(-1, 0, 0), want: false},
+		{name: "recent", maxAge: 30 * 24 * time.Hour, changedAt: testEpoch.AddDate(0, 0, -29), want: false},
+		{name: "exactly the maximum age", maxAge: 30 * 24 * time.Hour, changedAt: testEpoch.AddDate(0, 0, -30), want: false},
+		{name: "old", maxAge: 30 * 24 * time.Hour, changedAt: testEpoch.AddDate(0, 0, -31), want: true},
+		{name: "never changed, old account", maxAge: 30 * 24 * time.Hour, createdAt: testEpoch.AddDate(0, 0, -31), want: true},
+		{name: "never changed, new account", maxAge: 30 * 24 * time.Hour, createdAt: testEpoch.AddDate(0, 0, -1), want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := newAuthFixture(t)
+			fixture.appConfig.PasswordMaxAge = test.maxAge
+			user := &domain.User{PasswordChangedAt: test.changedAt}
+			user.CreatedAt = test.createdAt
+			if got := fixture.service.PasswordExpired(user); got != test.want {
+				t.Errorf("PasswordExpired = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package services
+
+import (
+	"context"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/events"
+	"hitenok/pkg/repository"
+	"hitenok/pkg/security"
+	"sync"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The fixtures shared by the service tests: a clock the test moves, a random source
+// that yields known codes, and fakes for the collaborators that are not under test.
+
+var testEpoch = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: testEpoch}
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) Advance(duration time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(duration)
+}
+
+// countingReader yields the bytes 0, 1, 2, ... For charsets of at most 256 characters
+// security.RandomStringFrom takes one byte per character, so a fresh reader makes the
+// codes "0123..." from OTPCharset and "ABCD..." from hashCharset.
+type countingReader struct {
+	next byte
+}
+
+func (reader *countingReader) Read(buffer []byte) (int, error) {
+	for i := range buffer {
+		buffer[i] = reader.next
+		reader.next += 1
+	}
+	return len(buffer), nil
+}
+
+type sentMail struct {
+	To, Subject, Body string
+}
+
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+func (mailer *fakeMailer) Send(to, subject, body string) error {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	mailer.sent = append(mailer.sent, sentMail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+func (mailer *fakeMailer) Ping(ctx context.Context) error {
+	return nil
+}
+
+// fakePasswordHistoryRepository saves the user through the user repository, as the
+// real one does in its transaction, and keeps the history in memory.
+type fakePasswordHistoryRepository struct {
+	userRepo repository.UserRepositoryI
+	history  map[uint][]domain.PasswordHistory
+}
+
+func (historyRepo *fakePasswordHistoryRepository) FindPasswordHistory(userId uint, limit int) ([]domain.PasswordHistory, *domain.MyError) {
+	history := historyRepo.history[userId]
+	if len(history) > limit {
+		history = history[:limit]
+	}
+	return history, nil
+}
+
+func (historyRepo *fakePasswordHistoryRepository) SavePasswordChange(user *domain.User, keep int) *domain.MyError {
+	if err := historyRepo.userRepo.SaveUser(user); err != nil {
+		return err
+	}
+	history := append([]domain.PasswordHistory{{UserId: user.ID, Password: user.Password}}, historyRepo.history[user.ID]...)
+	if len(history) > keep {
+		history = history[:keep]
+	}
+	historyRepo.history[user.ID] = history
+	return nil
+}
+
+func (historyRepo *fakePasswordHistoryRepository) RehashPasswordHistory(userId uint, oldHash, newHash string) *domain.MyError {
+	for i, entry := range historyRepo.history[userId] {
+		if entry.Password == oldHash {
+			historyRepo.history[userId][i].Password = newHash
+		}
+	}
+	return nil
+}
+
+// fakeDenylistService keeps what this replica knows is revoked in revoked and what is
+// stored in stored; a test that empties revoked plays a replica that has not synced.
+type fakeDenylistService struct {
+	revoked map[string]bool
+	stored  map[string]bool
+}
+
+func (denylist *fakeDenylistService) Revoke(claims *domain.Claims) *domain.MyError {
+	denylist.Claim(claims)
+	return nil
+}
+
+func (denylist *fakeDenylistService) Claim(claims *domain.Claims) (bool, *domain.MyError) {
+	claimed := !denylist.stored[claims.ID]
+	denylist.revoked[claims.ID] = true
+	denylist.stored[claims.ID] = true
+	return claimed, nil
+}
+
+func (denylist *fakeDenylistService) RevokeSession(sessionId string, expiresAt time.Time) *domain.MyError {
+	denylist.revoked[sessionId] = true
+	denylist.stored[sessionId] = true
+	return nil
+}
+
+func (denylist *fakeDenylistService) IsRevoked(jti string) bool {
+	return denylist.revoked[jti]
+}
+
+func (denylist *fakeDenylistService) Sync() *domain.MyError {
+	return nil
+}
+
+// fakeOrganizationRepository knows only the memberships, as user and organization ids;
+// the other methods are left to the embedded nil interface.
+type fakeOrganizationRepository struct {
+	repository.OrganizationRepositoryI
+	memberships map[[2]uint]bool
+}
+
+func (organizationRepo *fakeOrganizationRepository) FindMembership(organizationId, userId uint) (*domain.Membership, *domain.MyError) {
+	if !organizationRepo.memberships[[2]uint{userId, organizationId}] {
+		return &domain.Membership{}, domain.NewError(gorm.ErrRecordNotFound, "fakeOrganizationRepository.FindMembership")
+	}
+	return &domain.Membership{UserId: userId, OrganizationId: organizationId}, nil
+}
+
+// fakeSessionRepository keeps the sessions by id.
+type fakeSessionRepository struct {
+	sessions map[string]domain.Session
+}
+
+func (sessionRepo *fakeSessionRepository) SaveSession(session *domain.Session) *domain.MyError {
+	if stored, found := sessionRepo.sessions[session.Id]; found {
+		session.CreatedAt = stored.CreatedAt
+	}
+	sessionRepo.sessions[session.Id] = *session
+	return nil
+}
+
+func (sessionRepo *fakeSessionRepository) FindActiveSessions(user *domain.User, now time.Time) ([]domain.Session, *domain.MyError) {
+	sessions := []domain.Session{}
+	for _, session := range sessionRepo.sessions {
+		if session.UserId == user.ID && session.JWTVersion == user.JWTVersion && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (sessionRepo *fakeSessionRepository) DeleteSession(sessionId string) *domain.MyError {
+	delete(sessionRepo.sessions, sessionId)
+	return nil
+}
+
+// fakeApiKeyRepository keeps the keys by id; deleted keys are dropped.
+type fakeApiKeyRepository struct {
+	apiKeys map[uint]domain.ApiKey
+}
+
+func (apiKeyRepo *fakeApiKeyRepository) FindApiKeyByHash(hash string) (*domain.ApiKey, *domain.MyError) {
+	for _, apiKey := range apiKeyRepo.apiKeys {
+		if apiKey.Hash == hash {
+			return &apiKey, nil
+		}
+	}
+	return &domain.ApiKey{}, domain.NewError(gorm.ErrRecordNotFound, "fakeApiKeyRepository.FindApiKeyByHash")
+}
+
+func (apiKeyRepo *fakeApiKeyRepository) FindUserApiKey(user *domain.User, id uint) (*domain.ApiKey, *domain.MyError) {
+	apiKey, found := apiKeyRepo.apiKeys[id]
+	if !found || apiKey.UserId != user.ID {
+		return &domain.ApiKey{}, domain.NewError(gorm.ErrRecordNotFound, "fakeApiKeyRepository.FindUserApiKey")
+	}
+	return &apiKey, nil
+}
+
+func (apiKeyRepo *fakeApiKeyRepository) FindUserApiKeys(user *domain.User) ([]domain.ApiKey, *domain.MyError) {
+	apiKeys := []domain.ApiKey{}
+	for _, apiKey := range apiKeyRepo.apiKeys {
+		if apiKey.UserId == user.ID {
+			apiKeys = append(apiKeys, apiKey)
+		}
+	}
+	return apiKeys, nil
+}
+
+func (apiKeyRepo *fakeApiKeyRepository) SaveApiKey(apiKey *domain.ApiKey) *domain.MyError {
+	if apiKey.ID == 0 {
+		apiKey.ID = uint(len(apiKeyRepo.apiKeys) + 1)
+	}
+	apiKeyRepo.apiKeys[apiKey.ID] = *apiKey
+	return nil
+}
+
+func (apiKeyRepo *fakeApiKeyRepository) TouchApiKey(apiKey *domain.ApiKey, usedAt time.Time) *domain.MyError {
+	apiKey.LastUsedAt = &usedAt
+	apiKeyRepo.apiKeys[apiKey.ID] = *apiKey
+	return nil
+}
+
+func (apiKeyRepo *fakeApiKeyRepository) DeleteApiKey(apiKey *domain.ApiKey) *domain.MyError {
+	delete(apiKeyRepo.apiKeys, apiKey.ID)
+	return nil
+}
+
+// recordEvents subscribes synchronously to the named events and returns the list they
+// are appended to.
+func recordEvents(bus events.EventBusI, names ...string) *[]events.Event {
+	recorded := &[]events.Event{}
+	for _, name := range names {
+		bus.Subscribe(name, func(event events.Event) *domain.MyError {
+			*recorded = append(*recorded, event)
+			return nil
+		})
+	}
+	return recorded
+}
+
+func testKeyring(t *testing.T, entries ...string) *security.Keyring {
+	t.Helper()
+	keyring, err := security.NewKeyring(entries)
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	return keyring
+}
+
+func testConfig(t *testing.T) *config.AppConfig {
+	t.Helper()
+	return &config.AppConfig{
+		SecretKey: "legacy-secret",
+		Jwt: config.JwtConfig{
+			AccessTtl:  time.Hour,
+			RefreshTtl: 24 * time.Hour,
+		},
+		Otp: config.OtpConfig{
+			Length:         6,
+			Ttl:            5 * time.Minute,
+			ResendInterval: time.Minute,
+			Attempts:       3,
+			ResetTtl:       10 * time.Minute,
+			ResetAttempts:  2,
+		},
+		Keys: config.KeysConfig{
+			Jwt:    testKeyring(t, "jwt-1:jwt-secret"),
+			Pepper: testKeyring(t, "pepper-1:pepper-secret"),
+			Otp:    testKeyring(t, "otp-1:otp-secret"),
+			Audit:  testKeyring(t, "audit-1:audit-secret"),
+		},
+		RegistrationMode:    "open",
+		PasswordHistorySize: 2,
+	}
+}
+
+// errorText is the message of an error, or "" for none, for comparing with a table.
+func errorText(err *domain.MyError) string {
+	if err == nil {
+		return ""
+	}
+	return err.ErrorBase.Error()
+}
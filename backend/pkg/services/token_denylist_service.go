@@ -0,0 +1,138 @@
+package services
+
+import (
+	"fmt"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"sync"
+	"time"
+)
+
+const denylistClockSkew = time.Minute
+
+// TokenDenylistServiceI keeps revoked token ids, and revoked session ids that stand for
+// every token of the session. Lookups are served from memory so that CheckAuth does not
+// hit the database on every request; Sync pulls revocations made by other replicas and
+// drops entries whose tokens have expired anyway.
+type TokenDenylistServiceI interface {
+	Revoke(claims *domain.Claims) *domain.MyError
+	// Claim revokes the token like Revoke and reports whether this call did it, false
+	// meaning the token had been revoked before, here or on another replica.
+	Claim(claims *domain.Claims) (bool, *domain.MyError)
+	// RevokeSession revokes the session until expiresAt, which has to be past the
+	// expiry of its last token.
+	RevokeSession(sessionId string, expiresAt time.Time) *domain.MyError
+	IsRevoked(jti string) bool
+	Sync() *domain.MyError
+}
+
+type tokenDenylistService struct {
+	repo repository.RevokedTokenRepositoryI
+
+	mu        sync.RWMutex
+	revoked   map[string]time.Time
+	watermark time.Time
+}
+
+func NewTokenDenylistService(repo repository.RevokedTokenRepositoryI) TokenDenylistServiceI {
+	return &tokenDenylistService{
+		repo:    repo,
+		revoked: map[string]time.Time{},
+	}
+}
+
+func (denylistService *tokenDenylistService) Revoke(claims *domain.Claims) *domain.MyError {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	_, err := denylistService.revoke(claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		err.Module = "tokenDenylistService.Revoke." + err.Module
+		return err
+	}
+	return nil
+}
+
+func (denylistService *tokenDenylistService) Claim(claims *domain.Claims) (bool, *domain.MyError) {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return false, domain.NewError(fmt.Errorf("token cannot be claimed"), "tokenDenylistService.Claim")
+	}
+	claimed, err := denylistService.revoke(claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		err.Module = "tokenDenylistService.Claim." + err.Module
+		return false, err
+	}
+	return claimed, nil
+}
+
+func (denylistService *tokenDenylistService) RevokeSession(sessionId string, expiresAt time.Time) *domain.MyError {
+	if sessionId == "" {
+		return nil
+	}
+	_, err := denylistService.revoke(sessionId, expiresAt)
+	if err != nil {
+		err.Module = "tokenDenylistService.RevokeSession." + err.Module
+		return err
+	}
+	return nil
+}
+
+func (denylistService *tokenDenylistService) revoke(id string, expiresAt time.Time) (bool, *domain.MyError) {
+	revokedToken := &domain.RevokedToken{
+		Jti:       id,
+		ExpiresAt: expiresAt,
+	}
+	stored, err := denylistService.repo.SaveRevokedToken(revokedToken)
+	if err != nil {
+		return false, err
+	}
+	denylistService.mu.Lock()
+	denylistService.revoked[revokedToken.Jti] = revokedToken.ExpiresAt
+	denylistService.mu.Unlock()
+	return stored, nil
+}
+
+func (denylistService *tokenDenylistService) IsRevoked(jti string) bool {
+	if jti == "" {
+		return false
+	}
+	denylistService.mu.RLock()
+	_, ok := denylistService.revoked[jti]
+	denylistService.mu.RUnlock()
+	return ok
+}
+
+func (denylistService *tokenDenylistService) Sync() *domain.MyError {
+	now := time.Now()
+	err := denylistService.repo.DeleteExpiredRevokedTokens(now)
+	if err != nil {
+		err.Module = "tokenDenylistService.Sync." + err.Module
+		return err
+	}
+
+	// Rows carry the clock of the replica that wrote them, so look back a little further
+	// than the newest row seen to pick up writes from replicas whose clock lags.
+	denylistService.mu.RLock()
+	since := denylistService.watermark.Add(-denylistClockSkew)
+	denylistService.mu.RUnlock()
+	revokedTokens, err := denylistService.repo.FindRevokedTokensSince(since)
+	if err != nil {
+		err.Module = "tokenDenylistService.Sync." + err.Module
+		return err
+	}
+
+	denylistService.mu.Lock()
+	defer denylistService.mu.Unlock()
+	for jti, expiresAt := range denylistService.revoked {
+		if !expiresAt.After(now) {
+			delete(denylistService.revoked, jti)
+		}
+	}
+	for _, revokedToken := range revokedTokens {
+		denylistService.revoked[revokedToken.Jti] = revokedToken.ExpiresAt
+		if revokedToken.CreatedAt.After(denylistService.watermark) {
+			denylistService.watermark = revokedToken.CreatedAt
+		}
+	}
+	return nil
+}
@@ -3,12 +3,23 @@ package services
 import (
 	"hitenok/pkg/domain"
 	"hitenok/pkg/repository"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/language"
 )
 
+const maxFullnameLength = 100
+
 type UserServiceI interface {
 	GetUser(id uint) (*domain.User, *domain.MyError)
 	GetUserByEmail(email string) (*domain.User, *domain.MyError)
 	UpdateUser(user *domain.User) *domain.MyError
+	UpdateProfile(user *domain.User, update domain.ProfileUpdate) ([]domain.FieldChange, *domain.MyError)
+	Roles(user *domain.User) []string
+	SetSuperuser(user *domain.User, isSuperuser bool) *domain.MyError
+	EndSessions(user *domain.User) *domain.MyError
 }
 
 type userService struct {
@@ -47,3 +58,110 @@ func (userService *userService) UpdateUser(user *domain.User) *domain.MyError {
 	}
 	return nil
 }
+
+// Roles lists the global roles of a user as exposed to other services, e.g. through the
+// forward-auth headers.
+func (userService *userService) Roles(user *domain.User) []string {
+	roles := []string{domain.RoleUser}
+	if user.IsSuperuser {
+		roles = append(roles, domain.RoleSuperuser)
+	}
+	return roles
+}
+
+// SetSuperuser grants or takes away the superuser role. Only the admin commands call
+// it; there is no endpoint for it.
+func (userService *userService) SetSuperuser(user *domain.User, isSuperuser bool) *domain.MyError {
+	if user.IsSuperuser == isSuperuser {
+		return nil
+	}
+	err := userService.repo.UpdateUserColumns(user, map[string]interface{}{"is_superuser": user.IsSuperuser}, map[string]interface{}{"is_superuser": isSuperuser})
+	if err != nil {
+		err.Module = "userService.SetSuperuser." + err.Module
+		return err
+	}
+	user.IsSuperuser = isSuperuser
+	return nil
+}
+
+// EndSessions bumps JWTVersion, which invalidates every access and refresh token issued
+// to the user so far.
+func (userService *userService) EndSessions(user *domain.User) *domain.MyError {
+	jwtVersion := user.JWTVersion + 1
+	err := userService.repo.UpdateUserColumns(user, map[string]interface{}{"jwt_version": user.JWTVersion}, map[string]interface{}{"jwt_version": jwtVersion})
+	if err != nil {
+		err.Module = "userService.EndSessions." + err.Module
+		return err
+	}
+	user.JWTVersion = jwtVersion
+	return nil
+}
+
+// UpdateProfile applies the user editable profile fields only. Everything else on the
+// user (email, flags, credentials) has dedicated flows and is never touched here. The
+// write is conditional on the old values still being stored, so concurrent edits surface
+// as "user changed concurrently" instead of overwriting each other.
+func (userService *userService) UpdateProfile(user *domain.User, update domain.ProfileUpdate) ([]domain.FieldChange, *domain.MyError) {
+	violations := []domain.FieldViolation{}
+	fullname, locale, timezone := user.Fullname, user.Locale, user.Timezone
+	if update.Fullname != nil {
+		fullname = strings.TrimSpace(*update.Fullname)
+		if fullname == "" {
+			violations = append(violations, domain.FieldViolation{Field: "fullname", Code: "required", Message: "must not be empty"})
+		} else if utf8.RuneCountInString(fullname) > maxFullnameLength {
+			violations = append(violations, domain.FieldViolation{Field: "fullname", Code: "too_long", Message: "must be at most 100 characters"})
+		}
+	}
+	if update.Locale != nil {
+		locale = strings.TrimSpace(*update.Locale)
+		if locale != "" {
+			tag, err := language.Parse(locale)
+			if err != nil {
+				violations = append(violations, domain.FieldViolation{Field: "locale", Code: "invalid_locale", Message: "must be a BCP 47 language tag"})
+			} else {
+				locale = tag.String()
+			}
+		}
+	}
+	if update.Timezone != nil {
+		timezone = strings.TrimSpace(*update.Timezone)
+		if timezone != "" {
+			if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+				violations = append(violations, domain.FieldViolation{Field: "timezone", Code: "invalid_timezone", Message: "must be an IANA time zone name"})
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return nil, domain.NewError(domain.NewValidationError(violations...), "userService.UpdateProfile")
+	}
+
+	changes := []domain.FieldChange{}
+	previous := map[string]interface{}{}
+	columns := map[string]interface{}{}
+	for _, field := range []struct {
+		name     string
+		column   string
+		old, new string
+	}{
+		{"fullname", "fullname", user.Fullname, fullname},
+		{"locale", "locale", user.Locale, locale},
+		{"timezone", "timezone", user.Timezone, timezone},
+	} {
+		if field.old == field.new {
+			continue
+		}
+		changes = append(changes, domain.FieldChange{Field: field.name, Old: field.old, New: field.new})
+		previous[field.column] = field.old
+		columns[field.column] = field.new
+	}
+	if len(changes) == 0 {
+		return changes, nil
+	}
+	err := userService.repo.UpdateUserColumns(user, previous, columns)
+	if err != nil {
+		err.Module = "userService.UpdateProfile." + err.Module
+		return nil, err
+	}
+	user.Fullname, user.Locale, user.Timezone = fullname, locale, timezone
+	return changes, nil
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"testing"
+)
+
+func TestUserServiceSetSuperuser(t *testing.T) {
+	repo := repository.NewMemoryUserRepository(nil)
+	service := NewUserService(repo)
+	user := &domain.User{Email: "user@example.com"}
+	repo.SaveUser(user)
+
+	for _, want := range []bool{true, true, false} {
+		if err := service.SetSuperuser(user, want); err != nil {
+			t.Fatalf("SetSuperuser(%v): %v", want, err.ErrorBase)
+		}
+		stored, _ := repo.FindUserById(user.ID)
+		if stored.IsSuperuser != want || user.IsSuperuser != want {
+			t.Errorf("stored %v in memory %v, want %v", stored.IsSuperuser, user.IsSuperuser, want)
+		}
+	}
+}
+
+func TestUserServiceEndSessions(t *testing.T) {
+	repo := repository.NewMemoryUserRepository(nil)
+	service := NewUserService(repo)
+	user := &domain.User{Email: "user@example.com", JWTVersion: 3}
+	repo.SaveUser(user)
+
+	if err := service.EndSessions(user); err != nil {
+		t.Fatalf("EndSessions: %v", err.ErrorBase)
+	}
+	stored, _ := repo.FindUserById(user.ID)
+	if stored.JWTVersion != 4 || user.JWTVersion != 4 {
+		t.Errorf("stored version %d in memory %d, want 4", stored.JWTVersion, user.JWTVersion)
+	}
+	// A stale copy does not end the sessions twice.
+	stale := &domain.User{}
+	*stale = *user
+	stale.JWTVersion = 3
+	if err := service.EndSessions(stale); errorText(err) != "user changed concurrently" {
+		t.Errorf("EndSessions on a stale user error = %q, want user changed concurrently", errorText(err))
+	}
+}
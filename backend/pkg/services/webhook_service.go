@@ -0,0 +1,531 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hitenok/pkg/config"
+	"hitenok/pkg/domain"
+	"hitenok/pkg/repository"
+	"hitenok/pkg/security"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	webhookBatchSize     = 100
+	webhookBaseBackoff   = 30 * time.Second
+	webhookMaxBackoff    = 6 * time.Hour
+	webhookErrorLength   = 500
+	defaultWebhookLimit  = 50
+	maxWebhookLimit      = 500
+	webhookSecretPrefix  = "whsec_"
+	webhookUserAgent     = "hitenok-webhooks/1"
+	webhookSignatureName = "X-Webhook-Signature"
+)
+
+type WebhookServiceI interface {
+	Emit(eventType string, data map[string]interface{})
+	CreateSubscription(rawUrl string, events []string, description string) (*domain.WebhookSubscription, *domain.MyError)
+	ListSubscriptions() ([]domain.WebhookSubscription, *domain.MyError)
+	GetSubscription(id uint) (*domain.WebhookSubscription, *domain.MyError)
+	UpdateSubscription(subscription *domain.WebhookSubscription) *domain.MyError
+	DeleteSubscription(id uint) *domain.MyError
+	ListDeliveries(subscriptionId uint, beforeId uint, limit int) ([]domain.WebhookDelivery, *domain.MyError)
+	Ping(subscriptionId uint) (*domain.WebhookDelivery, *domain.MyError)
+	Replay(subscriptionId uint, deliveryId uint) (*domain.WebhookDelivery, *domain.MyError)
+	DeliverDue() (int, *domain.MyError)
+	RetryFailed(subscriptionId uint) (int, *domain.MyError)
+}
+
+type webhookService struct {
+	webhookRepo repository.WebhookRepositoryI
+	client      *http.Client
+	appConfig   *config.AppConfig
+}
+
+func NewWebhookService(webhookRepo repository.WebhookRepositoryI, appConfig *config.AppConfig) WebhookServiceI {
+	dialer := &net.Dialer{Timeout: appConfig.WebhookTimeout}
+	if !appConfig.WebhookAllowPrivate {
+		dialer.Control = webhookDialControl
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// Through a proxy the dialer would only ever see the proxy's address.
+	transport.Proxy = nil
+	return &webhookService{
+		webhookRepo: webhookRepo,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   appConfig.WebhookTimeout,
+			// A redirect is reported as a failed delivery instead of re-sending the
+			// signed body somewhere else.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		appConfig: appConfig,
+	}
+}
+
+// Emit queues the event for every active subscription that wants it; the delivery
+// worker sends it on its next run. Like auditing, a failure here must not fail the
+// operation that emitted the event, so it is only logged.
+func (webhookService *webhookService) Emit(eventType string, data map[string]interface{}) {
+	subscriptions, err := webhookService.webhookRepo.FindWebhookSubscriptions(true)
+	if err != nil {
+		log.Printf("webhookService.Emit.%s: %v (%s)", err.Module, err.ErrorBase, eventType)
+		return
+	}
+	var targets []domain.WebhookSubscription
+	for _, subscription := range subscriptions {
+		if subscription.Wants(eventType) {
+			targets = append(targets, subscription)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	event, payload, err := newWebhookEvent(eventType, data)
+	if err != nil {
+		log.Printf("webhookService.Emit.%s: %v (%s)", err.Module, err.ErrorBase, eventType)
+		return
+	}
+	deliveries := make([]domain.WebhookDelivery, 0, len(targets))
+	for _, subscription := range targets {
+		deliveries = append(deliveries, domain.WebhookDelivery{
+			SubscriptionId: subscription.ID,
+			EventId:        event.Id,
+			EventType:      event.Type,
+			Payload:        payload,
+			Status:         domain.WebhookDeliveryPending,
+			NextAttemptAt:  event.CreatedAt,
+		})
+	}
+	err = webhookService.webhookRepo.CreateWebhookDeliveries(deliveries)
+	if err != nil {
+		log.Printf("webhookService.Emit.%s: %v (%s)", err.Module, err.ErrorBase, eventType)
+	}
+}
+
+func newWebhookEvent(eventType string, data map[string]interface{}) (*domain.WebhookEvent, string, *domain.MyError) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", domain.NewError(err, "webhookService.newWebhookEvent")
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	event := &domain.WebhookEvent{
+		Id:        hex.EncodeToString(id),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+		Data:      data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", domain.NewError(err, "webhookService.newWebhookEvent")
+	}
+	return event, string(payload), nil
+}
+
+// CreateSubscription registers an endpoint with a freshly generated secret. The
+// returned subscription is the only place the secret is ever handed out.
+func (webhookService *webhookService) CreateSubscription(rawUrl string, events []string, description string) (*domain.WebhookSubscription, *domain.MyError) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return &domain.WebhookSubscription{}, domain.NewError(err, "webhookService.CreateSubscription")
+	}
+	subscription := &domain.WebhookSubscription{
+		Url:         strings.TrimSpace(rawUrl),
+		Secret:      webhookSecretPrefix + hex.EncodeToString(secret),
+		Events:      events,
+		Description: strings.TrimSpace(description),
+		IsActive:    true,
+	}
+	if err := webhookService.validateSubscription(subscription); err != nil {
+		err.Module = "webhookService.CreateSubscription." + err.Module
+		return subscription, err
+	}
+	err := webhookService.webhookRepo.SaveWebhookSubscription(subscription)
+	if err != nil {
+		err.Module = "webhookService.CreateSubscription." + err.Module
+		return subscription, err
+	}
+	return subscription, nil
+}
+
+// publicHost tells apart the hosts that are internal by their name alone: localhost and
+// literal addresses that are not public.
+func publicHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return publicAddress(addr)
+	}
+	return true
+}
+
+// webhookDialControl runs on every connection a delivery opens, after the host name has
+// been resolved, so a name that resolves to an internal address is refused as well,
+// even when it only starts to do so after the subscription was created.
+func webhookDialControl(network, address string, conn syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(addrPort.Addr()) {
+		return fmt.Errorf("webhook address %s is not public", addrPort.Addr())
+	}
+	return nil
+}
+
+// nonPublicPrefixes are the ranges netip has no predicate for: shared address space,
+// and the IPv4 block reserved for future use.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// publicAddress reports whether a webhook may be delivered to addr: not loopback,
+// private, link-local, multicast or unspecified.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (webhookService *webhookService) validateSubscription(subscription *domain.WebhookSubscription) *domain.MyError {
+	var violations []domain.FieldViolation
+	endpoint, parseErr := url.Parse(subscription.Url)
+	if parseErr != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		violations = append(violations, domain.FieldViolation{
+			Field:   "url",
+			Code:    "invalid",
+			Message: "must be an absolute http or https URL",
+		})
+	} else if !webhookService.appConfig.WebhookAllowPrivate && !publicHost(endpoint.Hostname()) {
+		// Only caught early here; the dialer refuses names resolving to such addresses.
+		violations = append(violations, domain.FieldViolation{
+			Field:   "url",
+			Code:    "not_public",
+			Message: "must not point at a loopback, private or link-local address",
+		})
+	}
+	events := []string{}
+	for _, eventType := range subscription.Events {
+		if !slices.Contains(domain.WebhookEventTypes, eventType) {
+			violations = append(violations, domain.FieldViolation{
+				Field:   "events",
+				Code:    "unknown",
+				Message: fmt.Sprintf("unknown event %q", eventType),
+			})
+			continue
+		}
+		if !slices.Contains(events, eventType) {
+			events = append(events, eventType)
+		}
+	}
+	if len(subscription.Description) > 200 {
+		violations = append(violations, domain.FieldViolation{
+			Field:   "description",
+			Code:    "too_long",
+			Message: "must be at most 200 characters",
+		})
+	}
+	if len(violations) > 0 {
+		return domain.NewError(domain.NewValidationError(violations...), "validateSubscription")
+	}
+	subscription.Events = events
+	return nil
+}
+
+func (webhookService *webhookService) ListSubscriptions() ([]domain.WebhookSubscription, *domain.MyError) {
+	subscriptions, err := webhookService.webhookRepo.FindWebhookSubscriptions(false)
+	if err != nil {
+		err.Module = "webhookService.ListSubscriptions." + err.Module
+		return subscriptions, err
+	}
+	return subscriptions, nil
+}
+
+func (webhookService *webhookService) GetSubscription(id uint) (*domain.WebhookSubscription, *domain.MyError) {
+	subscription, err := webhookService.webhookRepo.FindWebhookSubscriptionById(id)
+	if err != nil {
+		err.Module = "webhookService.GetSubscription." + err.Module
+		return subscription, err
+	}
+	return subscription, nil
+}
+
+func (webhookService *webhookService) UpdateSubscription(subscription *domain.WebhookSubscription) *domain.MyError {
+	subscription.Url = strings.TrimSpace(subscription.Url)
+	subscription.Description = strings.TrimSpace(subscription.Description)
+	if err := webhookService.validateSubscription(subscription); err != nil {
+		err.Module = "webhookService.UpdateSubscription." + err.Module
+		return err
+	}
+	err := webhookService.webhookRepo.SaveWebhookSubscription(subscription)
+	if err != nil {
+		err.Module = "webhookService.UpdateSubscription." + err.Module
+		return err
+	}
+	return nil
+}
+
+func (webhookService *webhookService) DeleteSubscription(id uint) *domain.MyError {
+	subscription, err := webhookService.webhookRepo.FindWebhookSubscriptionById(id)
+	if err != nil {
+		err.Module = "webhookService.DeleteSubscription." + err.Module
+		return err
+	}
+	err = webhookService.webhookRepo.DeleteWebhookSubscription(subscription)
+	if err != nil {
+		err.Module = "webhookService.DeleteSubscription." + err.Module
+		return err
+	}
+	return nil
+}
+
+func (webhookService *webhookService) ListDeliveries(subscriptionId uint, beforeId uint, limit int) ([]domain.WebhookDelivery, *domain.MyError) {
+	if limit <= 0 {
+		limit = defaultWebhookLimit
+	}
+	limit = min(limit, maxWebhookLimit)
+	deliveries, err := webhookService.webhookRepo.FindWebhookDeliveries(subscriptionId, beforeId, limit)
+	if err != nil {
+		err.Module = "webhookService.ListDeliveries." + err.Module
+		return deliveries, err
+	}
+	return deliveries, nil
+}
+
+// Ping sends a ping event to the subscription right away, whatever its event filter or
+// active flag, and returns the delivery with the outcome of that first attempt. A
+// failed ping is retried like any other delivery.
+func (webhookService *webhookService) Ping(subscriptionId uint) (*domain.WebhookDelivery, *domain.MyError) {
+	subscription, err := webhookService.webhookRepo.FindWebhookSubscriptionById(subscriptionId)
+	if err != nil {
+		err.Module = "webhookService.Ping." + err.Module
+		return &domain.WebhookDelivery{}, err
+	}
+	event, payload, err := newWebhookEvent(domain.WebhookPing, map[string]interface{}{
+		"subscription_id": subscription.ID,
+	})
+	if err != nil {
+		err.Module = "webhookService.Ping." + err.Module
+		return &domain.WebhookDelivery{}, err
+	}
+	deliveries := []domain.WebhookDelivery{{
+		SubscriptionId: subscription.ID,
+		EventId:        event.Id,
+		EventType:      event.Type,
+		Payload:        payload,
+		Status:         domain.WebhookDeliveryPending,
+		// Leased from the start so that the worker leaves it to this request.
+		NextAttemptAt: webhookService.leaseUntil(),
+	}}
+	err = webhookService.webhookRepo.CreateWebhookDeliveries(deliveries)
+	delivery := &deliveries[0]
+	if err != nil {
+		err.Module = "webhookService.Ping." + err.Module
+		return delivery, err
+	}
+	err = webhookService.attempt(delivery, subscription)
+	if err != nil {
+		err.Module = "webhookService.Ping." + err.Module
+		return delivery, err
+	}
+	return delivery, nil
+}
+
+// Replay queues the exact payload of an earlier delivery again, as a new delivery with
+// the same event id, so receivers that deduplicate on it stay idempotent.
+func (webhookService *webhookService) Replay(subscriptionId uint, deliveryId uint) (*domain.WebhookDelivery, *domain.MyError) {
+	original, err := webhookService.webhookRepo.FindWebhookDeliveryById(deliveryId)
+	if err != nil {
+		err.Module = "webhookService.Replay." + err.Module
+		return original, err
+	}
+	if original.SubscriptionId != subscriptionId {
+		return original, domain.NewError(gorm.ErrRecordNotFound, "webhookService.Replay")
+	}
+	_, err = webhookService.webhookRepo.FindWebhookSubscriptionById(original.SubscriptionId)
+	if err != nil {
+		err.Module = "webhookService.Replay." + err.Module
+		return original, err
+	}
+	replay := []domain.WebhookDelivery{{
+		SubscriptionId: original.SubscriptionId,
+		EventId:        original.EventId,
+		EventType:      original.EventType,
+		Payload:        original.Payload,
+		Status:         domain.WebhookDeliveryPending,
+		NextAttemptAt:  time.Now(),
+	}}
+	err = webhookService.webhookRepo.CreateWebhookDeliveries(replay)
+	if err != nil {
+		err.Module = "webhookService.Replay." + err.Module
+		return &replay[0], err
+	}
+	return &replay[0], nil
+}
+
+// DeliverDue sends the deliveries whose next attempt is due. Each one is claimed
+// first, so several instances can run the worker against the same database. It is run
+// periodically from app.New.
+func (webhookService *webhookService) DeliverDue() (int, *domain.MyError) {
+	deliveries, err := webhookService.webhookRepo.FindDueWebhookDeliveries(time.Now(), webhookBatchSize)
+	if err != nil {
+		err.Module = "webhookService.DeliverDue." + err.Module
+		return 0, err
+	}
+	subscriptions := map[uint]*domain.WebhookSubscription{}
+	sent := 0
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		claimed, err := webhookService.webhookRepo.ClaimWebhookDelivery(delivery, webhookService.leaseUntil())
+		if err != nil {
+			log.Printf("webhookService.DeliverDue.%s: %v", err.Module, err.ErrorBase)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		subscription, found := subscriptions[delivery.SubscriptionId]
+		if !found {
+			subscription, err = webhookService.webhookRepo.FindWebhookSubscriptionById(delivery.SubscriptionId)
+			if err != nil {
+				subscription = nil
+			}
+			subscriptions[delivery.SubscriptionId] = subscription
+		}
+		if subscription == nil || !subscription.IsActive {
+			// Events queued before the subscription was disabled are given up on
+			// rather than piling up until it is enabled again.
+			delivery.Status = domain.WebhookDeliveryFailed
+			delivery.LastError = "subscription disabled or deleted"
+			if err := webhookService.webhookRepo.SaveWebhookDelivery(delivery); err != nil {
+				log.Printf("webhookService.DeliverDue.%s: %v", err.Module, err.ErrorBase)
+			}
+			continue
+		}
+		if err := webhookService.attempt(delivery, subscription); err != nil {
+			log.Printf("webhookService.DeliverDue.%s: %v", err.Module, err.ErrorBase)
+			continue
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// RetryFailed puts the deliveries that ran out of attempts back in the outbox, for all
+// subscriptions when subscriptionId is 0, once the receiver has been fixed. It returns
+// how many were requeued.
+func (webhookService *webhookService) RetryFailed(subscriptionId uint) (int, *domain.MyError) {
+	if subscriptionId != 0 {
+		_, err := webhookService.webhookRepo.FindWebhookSubscriptionById(subscriptionId)
+		if err != nil {
+			err.Module = "webhookService.RetryFailed." + err.Module
+			return 0, err
+		}
+	}
+	requeued, err := webhookService.webhookRepo.RequeueFailedWebhookDeliveries(subscriptionId, time.Now())
+	if err != nil {
+		err.Module = "webhookService.RetryFailed." + err.Module
+		return 0, err
+	}
+	return requeued, nil
+}
+
+func (webhookService *webhookService) leaseUntil() time.Time {
+	return time.Now().Add(2 * webhookService.appConfig.WebhookTimeout)
+}
+
+// attempt POSTs the delivery once and records the outcome on it: delivered, rescheduled
+// with exponential backoff, or failed for good after WEBHOOK_MAX_ATTEMPTS.
+func (webhookService *webhookService) attempt(delivery *domain.WebhookDelivery, subscription *domain.WebhookSubscription) *domain.MyError {
+	now := time.Now()
+	delivery.Attempts += 1
+	delivery.LastAttemptAt = &now
+	delivery.LastStatusCode = 0
+	delivery.LastError = ""
+
+	body := []byte(delivery.Payload)
+	request, requestErr := http.NewRequest(http.MethodPost, subscription.Url, bytes.NewReader(body))
+	if requestErr == nil {
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("User-Agent", webhookUserAgent)
+		request.Header.Set("X-Webhook-Id", delivery.EventId)
+		request.Header.Set("X-Webhook-Event", delivery.EventType)
+		request.Header.Set("X-Webhook-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+		request.Header.Set(webhookSignatureName, security.SignWebhook(subscription.Secret, now.Unix(), body))
+		response, sendErr := webhookService.client.Do(request)
+		if sendErr != nil {
+			requestErr = sendErr
+		} else {
+			io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+			response.Body.Close()
+			delivery.LastStatusCode = response.StatusCode
+		}
+	}
+
+	switch {
+	case requestErr == nil && delivery.LastStatusCode >= 200 && delivery.LastStatusCode < 300:
+		delivery.Status = domain.WebhookDeliverySucceeded
+		delivery.DeliveredAt = &now
+	default:
+		if requestErr != nil {
+			delivery.LastError = requestErr.Error()
+		} else {
+			delivery.LastError = fmt.Sprintf("unexpected status %d", delivery.LastStatusCode)
+		}
+		if len(delivery.LastError) > webhookErrorLength {
+			delivery.LastError = delivery.LastError[:webhookErrorLength]
+		}
+		if delivery.Attempts >= webhookService.appConfig.WebhookMaxAttempts {
+			delivery.Status = domain.WebhookDeliveryFailed
+		} else {
+			delivery.NextAttemptAt = now.Add(webhookBackoff(delivery.Attempts))
+		}
+	}
+	err := webhookService.webhookRepo.SaveWebhookDelivery(delivery)
+	if err != nil {
+		err.Module = "webhookService.attempt." + err.Module
+		return err
+	}
+	return nil
+}
+
+// webhookBackoff doubles the wait after every failed attempt: 30s, 1m, 2m, ... capped
+// at 6h.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, webhookMaxBackoff)
+}
@@ -0,0 +1,58 @@
+package services
+
+import (
+	"hitenok/pkg/domain"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookServiceValidatesTheUrl(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{url: "https://hooks.example.com/in"},
+		{url: "http://93.184.216.34:8080/in"},
+		{url: "ftp://hooks.example.com/in", wantErr: "validation failed: url: must be an absolute http or https URL"},
+		{url: "http://localhost:8080/in", wantErr: "validation failed: url: must not point at a loopback, private or link-local address"},
+		{url: "http://127.0.0.1/in", wantErr: "validation failed: url: must not point at a loopback, private or link-local address"},
+		{url: "http://10.0.0.8/in", wantErr: "validation failed: url: must not point at a loopback, private or link-local address"},
+		{url: "http://169.254.169.254/latest/meta-data", wantErr: "validation failed: url: must not point at a loopback, private or link-local address"},
+		{url: "http://[::1]/in", wantErr: "validation failed: url: must not point at a loopback, private or link-local address"},
+		{url: "http://[::ffff:192.168.1.1]/in", wantErr: "validation failed: url: must not point at a loopback, private or link-local address"},
+		{url: "http://100.64.0.1/in", wantErr: "validation failed: url: must not point at a loopback, private or link-local address"},
+	}
+	service := NewWebhookService(nil, testConfig(t)).(*webhookService)
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			err := service.validateSubscription(&domain.WebhookSubscription{Url: test.url})
+			if errorText(err) != test.wantErr {
+				t.Errorf("validateSubscription error = %q, want %q", errorText(err), test.wantErr)
+			}
+		})
+	}
+}
+
+// TestWebhookClientRefusesPrivateAddresses dials a receiver on loopback, where a name
+// that resolves there after the subscription was checked would lead as well.
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer receiver.Close()
+	appConfig := testConfig(t)
+
+	client := NewWebhookService(nil, appConfig).(*webhookService).client
+	_, err := client.Get(receiver.URL)
+	if err == nil || !strings.Contains(err.Error(), "is not public") {
+		t.Errorf("delivery to %s error = %v, want the address refused", receiver.URL, err)
+	}
+
+	appConfig.WebhookAllowPrivate = true
+	client = NewWebhookService(nil, appConfig).(*webhookService).client
+	response, err := client.Get(receiver.URL)
+	if err != nil {
+		t.Fatalf("delivery with webhook_allow_private: %v", err)
+	}
+	response.Body.Close()
+}